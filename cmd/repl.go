@@ -2,13 +2,18 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/rob2244/SimpleDB/pkg/persist"
+	"github.com/rob2244/SimpleDB/pkg/query"
 )
 
 type statementType int
@@ -16,25 +21,93 @@ type statementType int
 const (
 	statementInsert statementType = iota
 	statementSelect
+	statementUpdate
+	statementDelete
+	statementCreateIndex
+	statementExplain
+	statementAnalyze
+	statementVacuum
 )
 
+func (s statementType) String() string {
+	switch s {
+	case statementInsert:
+		return "Insert"
+	case statementSelect:
+		return "Select"
+	case statementUpdate:
+		return "Update"
+	case statementDelete:
+		return "Delete"
+	case statementCreateIndex:
+		return "Create index"
+	case statementExplain:
+		return "Explain"
+	case statementVacuum:
+		return "Vacuum"
+	default:
+		return "Analyze"
+	}
+}
+
+// statement is a command translated to a query statement, id
+// is the id of the row an update or delete command changes
 type statement struct {
 	statementType statementType
-	rowToInsert   *persist.Row
+	query         query.Statement
+	id            uint32
 }
 
+// databaseFile is the file the database is stored in
+const databaseFile = "test.db"
+
+// preparedStatements are the statements prepared with
+// '.prepare', keyed by the name they were given
+var preparedStatements = map[string]*query.Prepared{}
+
+// statementCache holds the statements '.prepare' planned, preparing
+// the same SQL under another name reuses the plan
+var statementCache = query.NewCache(statementCacheSize)
+
+const statementCacheSize = 128
+
+// archiveDir is the directory the log is archived to, set with '-archive'
+var archiveDir string
+
+// pageSize is the page size of a new database file, set with '-pagesize'
+var pageSize uint
+
+// memoryMap reads the database file through a memory mapping, set with '-mmap'
+var memoryMap bool
+
 func main() {
-	reader := bufio.NewReader(os.Stdin)
-	t, err := persist.OpenDatabase("test.db")
-	if err != nil {
-		color.Red("Unable to open database: '%s'", err)
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := restoreCommand(os.Args[2:]); err != nil {
+			color.Red("%v", err)
+			os.Exit(1)
+		}
+
+		return
 	}
-	defer t.Close()
+
+	flag.StringVar(&archiveDir, "archive", "", "directory to archive the log to")
+	flag.UintVar(&pageSize, "pagesize", uint(persist.DefaultPageSize), "page size of a new database file")
+	flag.BoolVar(&memoryMap, "mmap", false, "read the database file through a memory mapping")
+	flag.Parse()
+
+	reader := bufio.NewReader(os.Stdin)
+	t := openDatabase()
+	defer func() { t.Close() }()
 
 	for {
 		printPrompt()
 		input := readInput(reader)
 
+		if strings.HasPrefix(input, ".restore ") {
+			t = doRestore(strings.Fields(input)[1:], t)
+			continue
+		}
+
 		if strings.HasPrefix(input, ".") {
 			if err := doMetaCommand(input, t); err != nil {
 				color.Yellow("%v'\n", err)
@@ -54,6 +127,21 @@ func main() {
 	}
 }
 
+func openDatabase() *persist.Table {
+	t, err := persist.OpenDatabaseWithOptions(databaseFile, persist.Options{
+		BusyTimeout: time.Second,
+		ArchiveDir:  archiveDir,
+		PageSize:    uint32(pageSize),
+		MemoryMap:   memoryMap,
+	})
+	if err != nil {
+		color.Red("Unable to open database: '%s'", err)
+		os.Exit(1)
+	}
+
+	return t
+}
+
 func printPrompt() {
 	fmt.Print("db > ")
 }
@@ -74,10 +162,23 @@ func doMetaCommand(input string, t *persist.Table) error {
 		os.Exit(0)
 	} else if strings.Compare(input, ".constants") == 0 {
 		color.Green("Constants:\n")
-		persist.PrintConstants()
+		t.PrintConstants()
 	} else if strings.Compare(input, ".btree") == 0 {
 		color.Green("Tree:\n")
 		t.PrintTree(0, 0)
+	} else if strings.Compare(input, ".stats") == 0 {
+		color.Green("Statistics:\n")
+		for _, column := range query.Columns {
+			if s, ok := t.Stats(column); ok {
+				fmt.Println(s)
+			}
+		}
+	} else if strings.HasPrefix(input, ".backup ") {
+		return doBackup(strings.Fields(input)[1:], t)
+	} else if strings.HasPrefix(input, ".prepare ") {
+		return doPrepare(strings.TrimPrefix(input, ".prepare "))
+	} else if strings.HasPrefix(input, ".execute ") {
+		return doExecute(strings.Fields(input)[1:], t)
 	} else {
 		return fmt.Errorf("unrecognized keyword at start of '%s'", input)
 	}
@@ -85,60 +186,475 @@ func doMetaCommand(input string, t *persist.Table) error {
 	return nil
 }
 
+// doBackup writes a copy of the database as of the last commit to the
+// file given as '<file> [since_lsn]', the database stays open and can be
+// changed meanwhile. With a log sequence number only the pages changed
+// since are written, the number to take the next one since is printed
+func doBackup(args []string, t *persist.Table) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("expected '.backup <file> [since_lsn]'")
+	}
+
+	filename := args[0]
+	backup := t.Backup
+	if len(args) == 2 {
+		since, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid log sequence number '%s'", args[1])
+		}
+
+		backup = func(w io.Writer) error { return t.IncrementalBackup(since, w) }
+	}
+
+	// Commits after the number are in the next incremental backup
+	lsn := t.LSN()
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := backup(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	color.Green("Backed up to '%s' at log sequence number %d", filename, lsn)
+	return nil
+}
+
+// doRestore closes the database, replaces it with the backup in the
+// files given as '<file> [incremental]...' and opens it again. The
+// database is opened again if it fails
+func doRestore(filenames []string, t *persist.Table) *persist.Table {
+	if len(filenames) == 0 {
+		color.Yellow("expected '.restore <file> [incremental]...'\n")
+		return t
+	}
+
+	if err := t.Close(); err != nil {
+		color.Yellow("%v\n", err)
+		return openDatabase()
+	}
+
+	err := func() error {
+		readers := make([]io.Reader, 0, len(filenames))
+		for _, filename := range filenames {
+			file, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+
+			defer file.Close()
+			readers = append(readers, file)
+		}
+
+		return persist.RestoreChain(databaseFile, readers[0], readers[1:], persist.Options{BusyTimeout: time.Second})
+	}()
+
+	if err != nil {
+		color.Yellow("%v\n", err)
+	} else {
+		color.Green("Restored from '%s'", strings.Join(filenames, "', '"))
+	}
+
+	return openDatabase()
+}
+
+// restoreCommand restores the database from a backup and the log
+// archived after it, given as 'restore [-archive dir] [-until
+// timestamp|lsn] <backup>'. The timestamp is in RFC 3339 format
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	archive := flags.String("archive", "", "directory the log was archived to")
+	until := flags.String("until", "", "last timestamp or log sequence number to replay")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("expected 'restore [-archive dir] [-until timestamp|lsn] <backup>'")
+	}
+
+	var target persist.RecoveryTarget
+	if *until != "" {
+		if lsn, err := strconv.ParseUint(*until, 10, 64); err == nil {
+			target.LSN = lsn
+		} else if target.Time, err = time.Parse(time.RFC3339Nano, *until); err != nil {
+			return fmt.Errorf("invalid timestamp or log sequence number '%s'", *until)
+		}
+	}
+
+	if *archive == "" && *until != "" {
+		return errors.New("replaying the log up to a point needs its archive")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	options := persist.Options{BusyTimeout: time.Second}
+	if *archive == "" {
+		err = persist.Restore(databaseFile, file, options)
+	} else {
+		err = persist.RestoreUntil(databaseFile, file, *archive, target, options)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	color.Green("Restored from '%s'", flags.Arg(0))
+	return nil
+}
+
+// doPrepare prepares a statement given as '<name> <sql>',
+// parameters are written as '?', '$n' or ':name'
+func doPrepare(input string) error {
+	fields := strings.SplitN(strings.TrimSpace(input), " ", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("expected '.prepare <name> <sql>'")
+	}
+
+	p, err := statementCache.Prepare(fields[1])
+	if err != nil {
+		return err
+	}
+
+	preparedStatements[fields[0]] = p
+	color.Green("Prepared '%s' with %d parameters", fields[0], p.NumParams())
+
+	return nil
+}
+
+// doExecute executes a prepared statement given as '<name> [arg]...',
+// an arg in the form ':name=value' is bound by name and every other
+// arg by position. Args that are integers are bound as integers
+func doExecute(args []string, t *persist.Table) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected '.execute <name> [arg]...'")
+	}
+
+	p, ok := preparedStatements[args[0]]
+	if !ok {
+		return fmt.Errorf("no prepared statement named '%s'", args[0])
+	}
+
+	values := make([]interface{}, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, ":") && strings.Contains(arg, "=") {
+			kv := strings.SplitN(arg[1:], "=", 2)
+			values = append(values, query.Named(kv[0], parseArg(kv[1])))
+			continue
+		}
+
+		values = append(values, parseArg(arg))
+	}
+
+	result, err := p.Execute(t, values...)
+	if err != nil {
+		return err
+	}
+
+	printRows(result)
+
+	color.Green("Executed, %d rows affected", result.RowsAffected)
+	return nil
+}
+
+func parseArg(s string) interface{} {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+
+	return s
+}
+
 func prepareStatement(input string) (*statement, error) {
 	if strings.HasPrefix(input, "insert") {
-		strs := strings.Split(input, " ")[1:]
+		row, err := parseRow(input)
+		if err != nil {
+			return nil, err
+		}
 
-		if len(strs) != 3 {
-			return nil, fmt.Errorf("syntax error in insert command '%s'", input)
+		return &statement{
+				statementType: statementInsert,
+				query: &query.InsertStatement{
+					Columns: query.Columns,
+					Values:  rowValues(row),
+				}},
+			nil
+	}
+
+	if strings.HasPrefix(input, "update") {
+		row, err := parseRow(input)
+		if err != nil {
+			return nil, err
 		}
 
-		n, err := strconv.Atoi(strs[0])
-		if err != nil || n < 0 {
-			return nil, fmt.Errorf("invalid user id: '%s'", strs[0])
+		values := rowValues(row)
+		return &statement{
+				statementType: statementUpdate,
+				id:            row.Id(),
+				query: &query.UpdateStatement{
+					Set: []query.Assignment{
+						{Column: "username", Value: values[1]},
+						{Column: "email", Value: values[2]},
+					},
+					Where: []query.Condition{{Column: "id", Op: persist.Equal, Value: values[0]}},
+				}},
+			nil
+	}
+
+	if strings.HasPrefix(input, "delete") {
+		strs := strings.Split(input, " ")[1:]
+
+		if len(strs) != 1 {
+			return nil, fmt.Errorf("syntax error in delete command '%s'", input)
 		}
 
-		row, err := persist.NewRow(uint32(n), strs[1], strs[2])
+		n, err := parseId(strs[0])
 		if err != nil {
 			return nil, err
 		}
 
 		return &statement{
-				statementType: statementInsert,
-				rowToInsert:   row},
+				statementType: statementDelete,
+				id:            n,
+				query: &query.DeleteStatement{
+					Where: []query.Condition{{Column: "id", Op: persist.Equal, Value: query.Literal{Value: int64(n)}}},
+				}},
 			nil
 	}
 
 	if strings.HasPrefix(input, "select") {
-		return &statement{statementType: statementSelect}, nil
+		// 'select' and 'select where ...' select whole rows,
+		// anything else is a select statement
+		fields := strings.Fields(input)
+		if len(fields) > 1 && !strings.EqualFold(fields[1], "where") {
+			stmt, _, err := query.Parse(input)
+			if err != nil {
+				return nil, fmt.Errorf("syntax error in select command '%s': %v", input, err)
+			}
+
+			return &statement{statementType: statementSelect, query: stmt}, nil
+		}
+
+		where, err := parseWhere(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("syntax error in select command '%s': %v", input, err)
+		}
+
+		return &statement{
+				statementType: statementSelect,
+				query:         &query.SelectStatement{From: query.TableRef{Name: query.TableName}, Where: where}},
+			nil
+	}
+
+	if strings.HasPrefix(input, "explain") {
+		stmt, _, err := query.Parse(input)
+		if err != nil {
+			return nil, fmt.Errorf("syntax error in explain command '%s': %v", input, err)
+		}
+
+		return &statement{statementType: statementExplain, query: stmt}, nil
+	}
+
+	if strings.TrimSpace(input) == "analyze" {
+		return &statement{statementType: statementAnalyze, query: &query.AnalyzeStatement{}}, nil
+	}
+
+	if strings.HasPrefix(input, "vacuum") {
+		stmt, _, err := query.Parse(input)
+		if err != nil {
+			return nil, fmt.Errorf("syntax error in vacuum command '%s': %v", input, err)
+		}
+
+		return &statement{statementType: statementVacuum, query: stmt}, nil
+	}
+
+	if strings.HasPrefix(input, "create") {
+		stmt, err := parseCreateIndex(strings.Fields(input)[1:])
+		if err != nil {
+			return nil, fmt.Errorf("syntax error in create command '%s': %v", input, err)
+		}
+
+		return &statement{statementType: statementCreateIndex, query: stmt}, nil
 	}
 
 	return nil, fmt.Errorf("unrecognized command '%s'", input)
 }
 
-func executeStatement(stmnt *statement, t *persist.Table) {
-	switch stmnt.statementType {
-	case statementInsert:
-		if err := executeInsert(stmnt, t); err != nil {
-			color.Red("Insert failed: '%v'", err)
-			return
+// rowValues returns the values of the row in column order
+func rowValues(r *persist.Row) []query.Value {
+	return []query.Value{
+		query.Literal{Value: int64(r.Id())},
+		query.Literal{Value: r.Username()},
+		query.Literal{Value: r.Email()},
+	}
+}
+
+// parseRow parses the values of an insert or update
+// command in the form '<command> <id> <username> <email>'
+func parseRow(input string) (*persist.Row, error) {
+	strs := strings.Split(input, " ")
+
+	if len(strs) != 4 {
+		return nil, fmt.Errorf("syntax error in %s command '%s'", strs[0], input)
+	}
+
+	n, err := parseId(strs[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return persist.NewRow(n, strs[2], strs[3])
+}
+
+func parseId(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user id: '%s'", s)
+	}
+
+	return uint32(n), nil
+}
+
+// parseWhere parses an optional where clause in the form
+// 'where <column> <op> <value> [and <column> <op> <value>]...'
+func parseWhere(tokens []string) ([]query.Condition, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	if !strings.EqualFold(tokens[0], "where") {
+		return nil, fmt.Errorf("expected 'where' but found '%s'", tokens[0])
+	}
+
+	var conditions []query.Condition
+	tokens = tokens[1:]
+
+	for {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("expected '<column> <op> <value>'")
 		}
 
-		color.Green("Inserting into database")
+		op, err := persist.ParseOperator(tokens[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if !isColumn(tokens[0]) {
+			return nil, fmt.Errorf("unknown column '%s'", tokens[0])
+		}
+
+		conditions = append(conditions, query.Condition{
+			Column: tokens[0],
+			Op:     op,
+			Value:  query.Literal{Value: tokens[2]},
+		})
+
+		tokens = tokens[3:]
+		if len(tokens) == 0 {
+			return conditions, nil
+		}
+
+		if !strings.EqualFold(tokens[0], "and") {
+			return nil, fmt.Errorf("expected 'and' but found '%s'", tokens[0])
+		}
+
+		tokens = tokens[1:]
+	}
+}
+
+func isColumn(name string) bool {
+	for _, c := range query.Columns {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCreateIndex parses the rest of a
+// 'create [unique] index <name> on <column>' command
+func parseCreateIndex(tokens []string) (*query.CreateIndexStatement, error) {
+	stmt := &query.CreateIndexStatement{}
+
+	if len(tokens) > 0 && strings.EqualFold(tokens[0], "unique") {
+		stmt.Unique = true
+		tokens = tokens[1:]
+	}
+
+	if len(tokens) != 4 || !strings.EqualFold(tokens[0], "index") || !strings.EqualFold(tokens[2], "on") {
+		return nil, fmt.Errorf("expected 'create [unique] index <name> on <column>'")
+	}
+
+	stmt.Name = tokens[1]
+	stmt.Column = tokens[3]
+
+	return stmt, nil
+}
+
+// executeStatement runs the statement's plan, the rows
+// of a select or an explain are printed
+func executeStatement(stmnt *statement, t *persist.Table) {
+	result, err := query.Execute(t, stmnt.query, nil)
+
+	// Updating or deleting a missing row is an error for a command
+	if err == nil && result.RowsAffected == 0 &&
+		(stmnt.statementType == statementUpdate || stmnt.statementType == statementDelete) {
+		err = fmt.Errorf("no row found with id '%d'", stmnt.id)
+	}
+
+	if err != nil {
+		color.Red("%s failed: '%v'", stmnt.statementType, err)
 		return
+	}
 
+	switch stmnt.statementType {
+	case statementInsert:
+		color.Green("Inserting into database")
+	case statementUpdate:
+		color.Green("Row updated")
+	case statementDelete:
+		color.Green("Row deleted")
 	case statementSelect:
-		executeSelect(stmnt, t)
+		printRows(result)
 		color.Green("Rows retrieved successfully")
-
-		return
+	case statementCreateIndex:
+		color.Green("Index '%s' created", stmnt.query.(*query.CreateIndexStatement).Name)
+	case statementAnalyze:
+		color.Green("Statistics collected")
+	case statementVacuum:
+		color.Green("Database vacuumed")
+	case statementExplain:
+		for _, row := range result.Rows {
+			fmt.Println(row[0])
+		}
 	}
 }
 
-func executeInsert(stmnt *statement, t *persist.Table) error {
-	return t.Insert(stmnt.rowToInsert)
-}
+func printRows(result *query.Result) {
+	for _, row := range result.Rows {
+		values := make([]string, len(row))
+		for i, v := range row {
+			values[i] = fmt.Sprint(v)
+		}
 
-func executeSelect(stmnt *statement, t *persist.Table) {
-	t.Select()
+		fmt.Printf("(%s)\n", strings.Join(values, ", "))
+	}
 }
@@ -0,0 +1,48 @@
+package kv
+
+import "github.com/rob2244/SimpleDB/pkg/persist"
+
+// Batch collects puts and deletes which are applied together by Write
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:   append([]byte{}, key...),
+		value: append([]byte{}, value...),
+	})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:    append([]byte{}, key...),
+		delete: true,
+	})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies the operations of the batch in the order they were added
+// as one commit. If one of them fails, a key or value too large for the
+// database or the file being full, none of them is applied
+func (db *DB) Write(b *Batch) error {
+	ops := make([]persist.TreeOp, len(b.ops))
+	for i, op := range b.ops {
+		ops[i] = persist.TreeOp{Key: op.key, Value: op.value, Delete: op.delete}
+	}
+
+	return db.tree.Write(ops)
+}
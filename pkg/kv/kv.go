@@ -0,0 +1,130 @@
+// Package kv is a persistent ordered map of byte string keys to byte
+// string values. It is stored in a single B-tree file without the fixed
+// row layout the table uses.
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+var ErrNotFound = errors.New("kv: key not found")
+
+// Options sets the page size of a new database, the default when 0. Keys
+// may be up to about a quarter of a page long and values of any length.
+// Durability and the group commit settings apply while the file is open,
+// see persist.Options
+type Options struct {
+	PageSize uint32
+
+	Durability       persist.Durability
+	GroupCommitDelay time.Duration
+	GroupCommitSize  int
+}
+
+var DefaultOptions = Options{}
+
+type DB struct {
+	tree *persist.Tree
+}
+
+// Open opens the database stored in the file,
+// creating it with DefaultOptions if it does not exist
+func Open(path string) (*DB, error) {
+	return OpenWithOptions(path, DefaultOptions)
+}
+
+// OpenWithOptions opens the database stored in the file, the page size
+// is only used to create a new file. An existing file keeps its own
+func OpenWithOptions(path string, options Options) (*DB, error) {
+	tree, err := persist.OpenTree(path, persist.TreeOptions{
+		PageSize:         options.PageSize,
+		Durability:       options.Durability,
+		GroupCommitDelay: options.GroupCommitDelay,
+		GroupCommitSize:  options.GroupCommitSize,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{tree: tree}, nil
+}
+
+func (db *DB) Close() error {
+	return db.tree.Close()
+}
+
+// Get returns a copy of the value stored under the key
+// or ErrNotFound if the key is not present
+func (db *DB) Get(key []byte) ([]byte, error) {
+	v, ok, err := db.tree.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return v, nil
+}
+
+func (db *DB) Has(key []byte) (bool, error) {
+	_, ok, err := db.tree.Get(key)
+	return ok, err
+}
+
+// Put stores the value under the key, replacing any existing value
+func (db *DB) Put(key, value []byte) error {
+	return db.tree.Put(key, value)
+}
+
+// Delete removes the key, deleting a key which is not present is not an error
+func (db *DB) Delete(key []byte) error {
+	_, err := db.tree.Delete(key)
+	return err
+}
+
+// Iterate calls fn for every key in the range [start, end) in order until
+// fn returns false. A nil start or end leaves that side of the range open.
+// The slices passed to fn are only valid until fn returns
+func (db *DB) Iterate(start, end []byte, fn func(key, value []byte) bool) error {
+	seek := start
+	if uint32(len(seek)) > db.tree.MaxKeySize() {
+		// Keys are never longer than the maximum so the
+		// truncated start is the closest key to seek to
+		seek = seek[:db.tree.MaxKeySize()]
+	}
+
+	return db.tree.Ascend(seek, func(key, value []byte) bool {
+		if bytes.Compare(key, start) < 0 {
+			return true
+		}
+
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return false
+		}
+
+		return fn(key, value)
+	})
+}
+
+// IteratePrefix calls fn for every key starting with the prefix in order
+// until fn returns false. The slices passed to fn are only valid until fn returns
+func (db *DB) IteratePrefix(prefix []byte, fn func(key, value []byte) bool) error {
+	if uint32(len(prefix)) > db.tree.MaxKeySize() {
+		return nil
+	}
+
+	return db.tree.Ascend(prefix, func(key, value []byte) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+
+		return fn(key, value)
+	})
+}
@@ -0,0 +1,203 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+func TestPutGetDelete(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "test.kv")
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key:%04d", i))
+		// Values from a few bytes to several pages long
+		value := bytes.Repeat([]byte{byte(i)}, i*20)
+
+		if err := db.Put(key, value); err != nil {
+			t.Fatalf("Unable to put '%s': '%s'", key, err)
+		}
+	}
+
+	if err := db.Put([]byte("key:0001"), []byte("replaced")); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := db.Delete([]byte("key:0002")); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer db.Close()
+
+	v, err := db.Get([]byte("key:0001"))
+	if err != nil || string(v) != "replaced" {
+		t.Fatalf("Expected the replaced value, got '%s' '%v'", v, err)
+	}
+
+	if _, err := db.Get([]byte("key:0002")); err != ErrNotFound {
+		t.Fatalf("Expected deleted key to be missing, got '%v'", err)
+	}
+
+	v, err = db.Get([]byte("key:0499"))
+	if err != nil || !bytes.Equal(v, bytes.Repeat([]byte{499 % 256}, 499*20)) {
+		t.Fatalf("Unexpected value for key:0499 '%v'", err)
+	}
+
+	if ok, err := db.Has([]byte("key:0300")); err != nil || !ok {
+		t.Fatalf("Expected key:0300 to be present")
+	}
+}
+
+func TestIterate(t *testing.T) {
+	db, err := Open(path.Join(t.TempDir(), "test.kv"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a", "ab", "abc", "b", "ba", "c", "a\x00"} {
+		if err := db.Put([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	var keys []string
+	collect := func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}
+
+	if err := db.IteratePrefix([]byte("a"), collect); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if fmt.Sprintf("%q", keys) != `["a" "a\x00" "ab" "abc"]` {
+		t.Fatalf("Unexpected prefix iteration %q", keys)
+	}
+
+	keys = nil
+	if err := db.Iterate([]byte("ab"), []byte("ba"), collect); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if fmt.Sprintf("%q", keys) != `["ab" "abc" "b"]` {
+		t.Fatalf("Unexpected range iteration %q", keys)
+	}
+}
+
+func TestBatchRejectedWhole(t *testing.T) {
+	db, err := OpenWithOptions(path.Join(t.TempDir(), "test.kv"), Options{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer db.Close()
+
+	var b Batch
+	b.Put([]byte("a"), []byte("1"))
+	b.Put(bytes.Repeat([]byte("b"), 4096), []byte("2"))
+
+	if err := db.Write(&b); err == nil {
+		t.Fatalf("Expected the batch to be rejected")
+	}
+
+	if ok, _ := db.Has([]byte("a")); ok {
+		t.Fatalf("Rejected batch was partially applied")
+	}
+
+	b.Reset()
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("b"), []byte("2"))
+	b.Delete([]byte("a"))
+
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ok, _ := db.Has([]byte("a")); ok {
+		t.Fatalf("Expected the delete in the batch to be applied")
+	}
+
+	if v, _ := db.Get([]byte("b")); string(v) != "2" {
+		t.Fatalf("Expected the put in the batch to be applied")
+	}
+}
+
+func TestBatchFailingPartwayIsRolledBack(t *testing.T) {
+	filename := path.Join(t.TempDir(), "test.kv")
+	db, err := OpenWithOptions(filename, Options{PageSize: persist.MinPageSize})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := db.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Enough puts to split leaves before the op which fails
+	var b Batch
+	b.Put([]byte("a"), []byte("changed"))
+	b.Delete([]byte("c"))
+	for i := 0; i < 200; i++ {
+		b.Put([]byte(fmt.Sprintf("k%03d", i)), []byte("v"))
+	}
+	b.Put(bytes.Repeat([]byte("z"), 4096), []byte("1"))
+	b.Put([]byte("zz"), []byte("1"))
+
+	if err := db.Write(&b); err == nil {
+		t.Fatalf("Expected the batch to fail")
+	}
+
+	for i := 0; i < 2; i++ {
+		if v, _ := db.Get([]byte("a")); string(v) != "1" {
+			t.Fatalf("Expected the put before the failing op to be rolled back, got %q", v)
+		}
+
+		if ok, _ := db.Has([]byte("c")); !ok {
+			t.Fatalf("Expected the delete before the failing op to be rolled back")
+		}
+
+		var keys []string
+		err := db.Iterate(nil, nil, func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if fmt.Sprintf("%q", keys) != `["a" "c"]` {
+			t.Fatalf("Expected none of the batch to be applied, got %q", keys)
+		}
+
+		// The rollback is not written to the file either
+		if err := db.Close(); err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if db, err = Open(filename); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	db.Close()
+}
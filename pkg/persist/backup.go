@@ -0,0 +1,356 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// An incremental backup holds the pages changed after a log sequence
+// number, it is applied on top of a backup at or after that number.
+// It is [magic][since][lsn][numPages] [header] ([pageNum][page])...
+// [incrementalEnd], lsn is the number of the commit it was taken at.
+// Its pages have the size the header records
+const (
+	incrementalMagicSize    uint32 = 8
+	incrementalMagicOffset  uint32 = 0
+	incrementalSinceSize    uint32 = 8
+	incrementalSinceOffset  uint32 = incrementalMagicOffset + incrementalMagicSize
+	incrementalLSNSize      uint32 = 8
+	incrementalLSNOffset    uint32 = incrementalSinceOffset + incrementalSinceSize
+	incrementalNumPagesSize uint32 = 4
+	incrementalNumPagesOff  uint32 = incrementalLSNOffset + incrementalLSNSize
+	incrementalHeaderSize   uint32 = incrementalNumPagesOff + incrementalNumPagesSize
+	incrementalPageNumSize  uint32 = 4
+	incrementalEnd          uint32 = ^uint32(0)
+)
+
+var incrementalMagic = []byte("SimpleIB")
+
+// LSN returns the log sequence number of the last commit,
+// the point a backup taken now is at
+func (t *Table) LSN() uint64 {
+	t.pager.mu.Lock()
+	defer t.pager.mu.Unlock()
+
+	return headerLSN(t.pager.committedHeader)
+}
+
+// Backup writes a copy of the database as of the last commit, a file
+// written in place which can be opened or restored. The pages are copied
+// one at a time from a snapshot so the table can be read and changed
+// meanwhile. A copy-on-write database is copied the same way
+func (t *Table) Backup(w io.Writer) error {
+	s, header, numPages := t.pager.acquireCommit()
+	defer s.release()
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for pageNum := uint32(0); pageNum < numPages; pageNum++ {
+		page, err := t.pager.readPage(s, pageNum)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(page); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IncrementalBackup writes the pages the commits after the log sequence
+// number changed, as of the last commit. Like Backup it copies them from
+// a snapshot while the table can be changed
+func (t *Table) IncrementalBackup(sinceLSN uint64, w io.Writer) error {
+	s, header, numPages := t.pager.acquireCommit()
+	defer s.release()
+
+	lsn := headerLSN(header)
+	if sinceLSN > lsn {
+		return fmt.Errorf("log sequence number '%d' is after the last commit '%d'", sinceLSN, lsn)
+	}
+
+	head := make([]byte, incrementalHeaderSize)
+	copy(head[incrementalMagicOffset:incrementalMagicOffset+incrementalMagicSize], incrementalMagic)
+	binary.LittleEndian.PutUint64(head[incrementalSinceOffset:incrementalSinceOffset+incrementalSinceSize], sinceLSN)
+	binary.LittleEndian.PutUint64(head[incrementalLSNOffset:incrementalLSNOffset+incrementalLSNSize], lsn)
+	binary.LittleEndian.PutUint32(head[incrementalNumPagesOff:incrementalNumPagesOff+incrementalNumPagesSize], numPages)
+
+	if _, err := w.Write(append(head, header...)); err != nil {
+		return err
+	}
+
+	pageNum := make([]byte, incrementalPageNumSize)
+	for n := uint32(0); n < numPages; n++ {
+		page, err := t.pager.readPage(s, n)
+		if err != nil {
+			return err
+		}
+
+		if getPageLSN(page) <= sinceLSN {
+			continue
+		}
+
+		binary.LittleEndian.PutUint32(pageNum, n)
+		if _, err := w.Write(append(pageNum, page...)); err != nil {
+			return err
+		}
+	}
+
+	binary.LittleEndian.PutUint32(pageNum, incrementalEnd)
+	_, err := w.Write(pageNum)
+	return err
+}
+
+// Restore replaces the database file with the backup read from r. The
+// file is locked like it is by OpenDatabaseWithOptions, it must not be
+// open. The backup is written next to it and renamed over it once it is
+// synced, a crash leaves either the old database or the backup
+func Restore(filename string, r io.Reader, options Options) error {
+	return RestoreChain(filename, r, nil, options)
+}
+
+// RestoreChain restores a backup like Restore with the incremental
+// backups applied on top of it in order. Each has to start at or before
+// the point the backup and the incrementals before it reached and must
+// not end before it, one ending there changes nothing
+func RestoreChain(filename string, full io.Reader, incrementals []io.Reader, options Options) error {
+	return restore(filename, options.ArchiveDir, options, func(file *os.File) error {
+		lsn, pageSize, err := copyBackup(file, full)
+		if err != nil {
+			return err
+		}
+
+		for _, incremental := range incrementals {
+			if lsn, err = applyIncremental(file, incremental, lsn, pageSize); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// restore replaces the database file with the one build writes,
+// the new file is written next to it and synced before the rename.
+// The restored header starts a timeline after the one of the backup,
+// the one of the replaced database and the ones archived to the
+// directory, so neither the log of the replaced database is replayed
+// onto it nor are its segments mixed up with those of another history
+func restore(filename, archiveDir string, options Options, build func(file *os.File) error) error {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if err := lockFile(file, options); err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".restore")
+	if err != nil {
+		return err
+	}
+
+	if err := build(temp); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := stampTimeline(temp, file, archiveDir); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := os.Rename(temp.Name(), filename); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	// The log of the old database is of an older timeline, a crash
+	// before it is removed leaves it to be emptied by the next open
+	if err := os.Remove(filename + walFileSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return syncDir(filepath.Dir(filename))
+}
+
+// stampTimeline gives the restored file a timeline after the one of the
+// backup, the one of the database it replaces, if it has a header, and
+// the ones archived to the directory
+func stampTimeline(restored, replaced *os.File, archiveDir string) error {
+	header, err := readHeader(restored)
+	if err != nil {
+		return err
+	}
+
+	timeline := headerTimeline(header)
+	if old, err := readHeader(replaced); err == nil && headerTimeline(old) > timeline {
+		timeline = headerTimeline(old)
+	}
+
+	archived, err := archivedTimeline(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	if archived > timeline {
+		timeline = archived
+	}
+
+	setHeaderTimeline(header, timeline+1)
+	_, err = restored.WriteAt(header, 0)
+	return err
+}
+
+// copyBackup copies the backup to the file and returns the log sequence
+// number it is at and its page size. The backup has to start with the
+// header of a database
+func copyBackup(file *os.File, r io.Reader) (uint64, uint32, error) {
+	header, err := readBackupHeader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := file.Write(header); err != nil {
+		return 0, 0, err
+	}
+
+	n, err := io.Copy(file, r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pageSize := uint32(len(header))
+	if n%int64(pageSize) != 0 {
+		return 0, 0, errors.New("backup is not a whole number of pages")
+	}
+
+	return headerLSN(header), pageSize, nil
+}
+
+// readBackupHeader reads the database header a backup starts with,
+// the page size at its start is the size of the rest
+func readBackupHeader(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, headerPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("backup is not a database: '%s'", err)
+	}
+
+	if !bytes.Equal(prefix[headerMagicOffset:headerMagicOffset+headerMagicSize], headerMagic) {
+		return nil, errors.New("backup is missing the database header")
+	}
+
+	version := binary.LittleEndian.Uint32(prefix[headerVersionOffset : headerVersionOffset+headerVersionSize])
+	if version != headerFormatVersion {
+		return nil, fmt.Errorf("unsupported backup version '%d'", version)
+	}
+
+	pageSize := headerPageSize(prefix)
+	if !validPageSize(pageSize) {
+		return nil, fmt.Errorf("backup has an invalid page size '%d'", pageSize)
+	}
+
+	header := make([]byte, pageSize)
+	copy(header, prefix)
+	if _, err := io.ReadFull(r, header[headerPrefixSize:]); err != nil {
+		return nil, fmt.Errorf("backup is not a database: '%s'", err)
+	}
+
+	return header, nil
+}
+
+// applyIncremental writes the pages of the incremental backup to the
+// file which is at the log sequence number and has pages of the size,
+// it returns the number the file is at after
+func applyIncremental(file *os.File, r io.Reader, lsn uint64, pageSize uint32) (uint64, error) {
+	head := make([]byte, incrementalHeaderSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, fmt.Errorf("backup is not an incremental backup: '%s'", err)
+	}
+
+	if !bytes.Equal(head[incrementalMagicOffset:incrementalMagicOffset+incrementalMagicSize], incrementalMagic) {
+		return 0, errors.New("backup is not an incremental backup")
+	}
+
+	header, err := readBackupHeader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if uint32(len(header)) != pageSize {
+		return 0, fmt.Errorf("incremental backup has pages of '%d' bytes, the backup of '%d'", len(header), pageSize)
+	}
+
+	since := binary.LittleEndian.Uint64(head[incrementalSinceOffset : incrementalSinceOffset+incrementalSinceSize])
+	to := binary.LittleEndian.Uint64(head[incrementalLSNOffset : incrementalLSNOffset+incrementalLSNSize])
+	numPages := binary.LittleEndian.Uint32(head[incrementalNumPagesOff : incrementalNumPagesOff+incrementalNumPagesSize])
+
+	// Pages changed between the backup and the incremental would be missing
+	if since > lsn {
+		return 0, fmt.Errorf("incremental backup since '%d' does not follow the backup at '%d'", since, lsn)
+	}
+
+	// An older incremental would take the file back to before the backup
+	if to < lsn {
+		return 0, fmt.Errorf("incremental backup at '%d' is older than the backup at '%d'", to, lsn)
+	}
+
+	if to == lsn {
+		return lsn, nil
+	}
+
+	page := make([]byte, incrementalPageNumSize+pageSize)
+	for {
+		if _, err := io.ReadFull(r, page[:incrementalPageNumSize]); err != nil {
+			return 0, fmt.Errorf("incremental backup is cut short: '%s'", err)
+		}
+
+		pageNum := binary.LittleEndian.Uint32(page[:incrementalPageNumSize])
+		if pageNum == incrementalEnd {
+			break
+		}
+
+		if pageNum >= numPages {
+			return 0, fmt.Errorf("incremental backup has page '%d' of '%d'", pageNum, numPages)
+		}
+
+		if _, err := io.ReadFull(r, page[incrementalPageNumSize:]); err != nil {
+			return 0, fmt.Errorf("incremental backup is cut short: '%s'", err)
+		}
+
+		if _, err := file.WriteAt(page[incrementalPageNumSize:], pageOffset(pageSize, pageNum)); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := file.WriteAt(header, 0); err != nil {
+		return 0, err
+	}
+
+	return to, file.Truncate(pageOffset(pageSize, numPages))
+}
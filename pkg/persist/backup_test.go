@@ -0,0 +1,288 @@
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+// changingWriter changes the table while the backup is written
+type changingWriter struct {
+	bytes.Buffer
+	t      *testing.T
+	tbl    *Table
+	writes int
+}
+
+func (w *changingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes == 2 {
+		insertUsers(w.t, w.tbl, 200, 500)
+		for i := 0; i < 100; i++ {
+			if err := w.tbl.Delete(uint32(i)); err != nil {
+				w.t.Fatalf("%s", err)
+			}
+		}
+	}
+
+	return w.Buffer.Write(p)
+}
+
+func TestBackupIsConsistent(t *testing.T) {
+	for _, copyOnWrite := range []bool{false, true} {
+		t.Run(fmt.Sprintf("copyOnWrite=%v", copyOnWrite), func(t *testing.T) {
+			createTestDir(t, testDirPath)
+			t.Cleanup(cleanupTestDir(t, testDirPath))
+
+			tbl, err := OpenDatabaseWithOptions(path.Join(testDirPath, "test.db"), Options{CopyOnWrite: copyOnWrite})
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			defer tbl.Close()
+
+			insertUsers(t, tbl, 0, 200)
+			if err := tbl.CreateIndex("idx_username", "username", true); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			w := &changingWriter{t: t, tbl: tbl}
+			if err := tbl.Backup(w); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			restored := path.Join(testDirPath, "restored.db")
+			if err := Restore(restored, &w.Buffer, Options{}); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			backup, err := OpenDatabase(restored)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			defer backup.Close()
+
+			if ids := checkScan(t, backup, false); len(ids) != 200 || ids[0] != 0 {
+				t.Fatalf("Expected the 200 rows committed when the backup began, got %d", len(ids))
+			}
+
+			if ids := selectIds(t, backup, Predicate{Column: "username", Op: Equal, Value: "user#7"}); len(ids) != 1 {
+				t.Fatalf("Expected the index to be in the backup, got %v", ids)
+			}
+		})
+	}
+}
+
+func TestRestoreReplacesDatabase(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 10)
+
+	var backup bytes.Buffer
+	if err := tbl.Backup(&backup); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 10, 20)
+
+	if err := Restore(filename, bytes.NewReader(backup.Bytes()), Options{}); err != ErrDatabaseLocked {
+		t.Fatalf("Expected an open database to be locked, got %v", err)
+	}
+
+	crash(tbl)
+
+	// The commits in the log of the replaced database are dropped with it
+	if stat, err := os.Stat(filename + walFileSuffix); err != nil || stat.Size() == 0 {
+		t.Fatalf("Expected the log to hold the last commits: %v %v", stat, err)
+	}
+
+	if err := Restore(filename, bytes.NewReader([]byte("not a database")), Options{}); err == nil {
+		t.Fatalf("Expected a file which is not a backup to be rejected")
+	}
+
+	if err := Restore(filename, &backup, Options{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl, err = OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	if ids := checkScan(t, tbl, false); len(ids) != 10 {
+		t.Fatalf("Expected the 10 rows of the backup, got %d", len(ids))
+	}
+}
+
+func TestRestoreIgnoresOldLog(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 10)
+
+	var backup bytes.Buffer
+	if err := tbl.Backup(&backup); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 10, 20)
+	crash(tbl)
+
+	log, err := os.ReadFile(filename + walFileSuffix)
+	if err != nil || len(log) == 0 {
+		t.Fatalf("Expected the log to hold the last commits: %v", err)
+	}
+
+	if err := Restore(filename, &backup, Options{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// A crash after the rename leaves the log of the old database
+	if err := os.WriteFile(filename+walFileSuffix, log, 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		tbl, err = OpenDatabase(filename)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if ids := checkScan(t, tbl, false); len(ids) != 10+i {
+			t.Fatalf("Expected the %d rows of the backup and the commit after it, got %d", 10+i, len(ids))
+		}
+
+		if i == 0 {
+			insertUsers(t, tbl, 30, 31)
+		}
+
+		crash(tbl)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	insertUsers(t, tbl, 0, 300)
+
+	var full bytes.Buffer
+	if err := tbl.Backup(&full); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	fullLSN := tbl.LSN()
+	since := fullLSN
+	if err := updateUser(tbl, 1, "first@example.com"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var first bytes.Buffer
+	if err := tbl.IncrementalBackup(since, &first); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Only the leaf with the row changed
+	pageSize := tbl.pager.pageSize
+	if size := int(incrementalHeaderSize+pageSize) + int(incrementalPageNumSize+pageSize) + int(incrementalPageNumSize); first.Len() != size {
+		t.Fatalf("Expected one page in the incremental backup, got %d bytes", first.Len())
+	}
+
+	since = tbl.LSN()
+	insertUsers(t, tbl, 300, 600)
+
+	var second bytes.Buffer
+	if err := tbl.IncrementalBackup(since, &second); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var cumulative bytes.Buffer
+	if err := tbl.IncrementalBackup(fullLSN, &cumulative); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	restored := path.Join(testDirPath, "restored.db")
+	err = RestoreChain(restored, bytes.NewReader(full.Bytes()), []io.Reader{bytes.NewReader(second.Bytes())}, Options{})
+	if err == nil {
+		t.Fatalf("Expected an incremental backup skipping one to be rejected")
+	}
+
+	// The first incremental would take the newer one back
+	err = RestoreChain(restored, bytes.NewReader(full.Bytes()),
+		[]io.Reader{bytes.NewReader(cumulative.Bytes()), bytes.NewReader(first.Bytes())}, Options{})
+	if err == nil {
+		t.Fatalf("Expected an incremental backup older than the one before it to be rejected")
+	}
+
+	if _, err := os.Stat(restored); err == nil && fileSize(t, restored) != 0 {
+		t.Fatalf("Expected a rejected chain to leave the database as it was")
+	}
+
+	err = RestoreChain(restored, bytes.NewReader(full.Bytes()), []io.Reader{bytes.NewReader(cumulative.Bytes())}, Options{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	cumulativeDB, err := OpenDatabase(restored)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ids := checkScan(t, cumulativeDB, false); len(ids) != 600 {
+		t.Fatalf("Expected the 600 rows of the incremental backup since the full one, got %d", len(ids))
+	}
+
+	if err := cumulativeDB.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = RestoreChain(restored, &full, []io.Reader{&first, &second}, Options{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	backup, err := OpenDatabase(restored)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer backup.Close()
+
+	if ids := checkScan(t, backup, false); len(ids) != 600 {
+		t.Fatalf("Expected the 600 rows of the last incremental backup, got %d", len(ids))
+	}
+
+	if r, err := backup.Lookup(1); err != nil || r.email != "first@example.com" {
+		t.Fatalf("Expected the update of the first incremental backup, got %v %v", r, err)
+	}
+
+	if backup.LSN() != tbl.LSN() {
+		t.Fatalf("Expected the restored database at %d, got %d", tbl.LSN(), backup.LSN())
+	}
+}
@@ -0,0 +1,253 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// BatchSize is the most rows a Batch holds
+const BatchSize = 1024
+
+// Batch holds up to BatchSize consecutive rows of the table as column
+// vectors decoded from copies of the cells of the leaves. The ids are always decoded, a text column is decoded
+// the first time it is asked for and its values refer to the copied cells.
+// A batch is only valid until the next batch is read
+type Batch struct {
+	Len int
+	Ids []uint32
+
+	data      []byte
+	cells     [][]byte
+	usernames [][]byte
+	emails    [][]byte
+}
+
+func newBatch() *Batch {
+	return &Batch{
+		Ids:   make([]uint32, 0, BatchSize),
+		data:  make([]byte, 0, BatchSize*int(rowSize)),
+		cells: make([][]byte, 0, BatchSize),
+	}
+}
+
+func (b *Batch) reset() {
+	b.Len = 0
+	b.Ids = b.Ids[:0]
+	b.data = b.data[:0]
+	b.cells = b.cells[:0]
+	b.usernames = b.usernames[:0]
+	b.emails = b.emails[:0]
+}
+
+// add copies the cell into the batch, the data never
+// grows past its capacity so earlier cells stay in place
+func (b *Batch) add(cell []byte) {
+	start := len(b.data)
+	b.data = append(b.data, cell...)
+
+	b.Ids = append(b.Ids, binary.LittleEndian.Uint32(cell[idOffset:idOffset+idSize]))
+	b.cells = append(b.cells, b.data[start:])
+	b.Len++
+}
+
+// Usernames returns the username of every row of the batch
+func (b *Batch) Usernames() [][]byte {
+	if len(b.usernames) < b.Len {
+		b.usernames = decodeText(b.usernames[:0], b.cells, usernameOffset, usernameSize)
+	}
+
+	return b.usernames
+}
+
+// Emails returns the email of every row of the batch
+func (b *Batch) Emails() [][]byte {
+	if len(b.emails) < b.Len {
+		b.emails = decodeText(b.emails[:0], b.cells, emailOffset, emailSize)
+	}
+
+	return b.emails
+}
+
+// Text returns the values of a text column
+func (b *Batch) Text(column string) [][]byte {
+	if column == "username" {
+		return b.Usernames()
+	}
+
+	return b.Emails()
+}
+
+func decodeText(dst [][]byte, cells [][]byte, offset, size uint32) [][]byte {
+	for _, cell := range cells {
+		field := cell[offset : offset+size]
+		if n := bytes.IndexByte(field, 0); n >= 0 {
+			field = field[:n]
+		}
+
+		dst = append(dst, field)
+	}
+
+	return dst
+}
+
+// Row builds the row at position i of the batch
+func (b *Batch) Row(i int) *Row {
+	return serializedRow(b.cells[i]).Deserialize()
+}
+
+// Filter keeps the positions in sel of the rows matching the predicate,
+// it returns sel shortened in place. The predicate must have been
+// validated by planning a scan with it
+func (b *Batch) Filter(p Predicate, sel []int) []int {
+	if p.Column == "id" {
+		n, _ := strconv.ParseUint(p.Value, 10, 32)
+		return filterIds(b.Ids, p.Op, uint32(n), sel)
+	}
+
+	return filterText(b.Text(p.Column), p.Op, []byte(p.Value), sel)
+}
+
+func filterIds(ids []uint32, op Operator, v uint32, sel []int) []int {
+	out := sel[:0]
+
+	switch op {
+	case Equal:
+		for _, i := range sel {
+			if ids[i] == v {
+				out = append(out, i)
+			}
+		}
+	case Less:
+		for _, i := range sel {
+			if ids[i] < v {
+				out = append(out, i)
+			}
+		}
+	case LessOrEqual:
+		for _, i := range sel {
+			if ids[i] <= v {
+				out = append(out, i)
+			}
+		}
+	case Greater:
+		for _, i := range sel {
+			if ids[i] > v {
+				out = append(out, i)
+			}
+		}
+	case GreaterOrEqual:
+		for _, i := range sel {
+			if ids[i] >= v {
+				out = append(out, i)
+			}
+		}
+	}
+
+	return out
+}
+
+func filterText(values [][]byte, op Operator, v []byte, sel []int) []int {
+	out := sel[:0]
+
+	if op == Equal {
+		for _, i := range sel {
+			if bytes.Equal(values[i], v) {
+				out = append(out, i)
+			}
+		}
+
+		return out
+	}
+
+	for _, i := range sel {
+		cmp := bytes.Compare(values[i], v)
+		if (op == Less && cmp < 0) || (op == LessOrEqual && cmp <= 0) ||
+			(op == Greater && cmp > 0) || (op == GreaterOrEqual && cmp >= 0) {
+			out = append(out, i)
+		}
+	}
+
+	return out
+}
+
+// BatchCursor reads the rows of a range of ids a batch at a time
+type BatchCursor struct {
+	table  *Table
+	cursor *Cursor
+	upper  uint32
+	batch  *Batch
+}
+
+// OpenBatches positions a batch cursor before the first row the plan
+// reads, the plan has to read the leaves of the table in order
+func (t *Table) OpenBatches(plan *Plan) (*BatchCursor, error) {
+	if !plan.Sequential() {
+		return nil, fmt.Errorf("a %s cannot be read in batches", plan.Method)
+	}
+
+	c := &BatchCursor{table: t, batch: newBatch()}
+
+	lower, upper, ok := idBounds(plan.Bounds)
+	if !ok {
+		return c, nil
+	}
+
+	s, release := t.reading()
+	cursor, err := t.tree.seek(s, release, rowKey(lower))
+	if err != nil {
+		return nil, err
+	}
+
+	c.cursor, c.upper = cursor, upper
+	return c, nil
+}
+
+// Next reads the next batch, nil once there are no more rows
+func (c *BatchCursor) Next() (*Batch, error) {
+	b := c.batch
+	b.reset()
+
+	for c.cursor != nil && !c.cursor.endOfTable && b.Len < BatchSize {
+		page, err := c.table.pager.readPage(c.cursor.snapshot, c.cursor.pageNum)
+		if err != nil {
+			return nil, err
+		}
+
+		numCells := getLeafNodeNumCells(page)
+		for c.cursor.cellNum < numCells && b.Len < BatchSize {
+			cell := c.table.tree.getLeafNodeValue(page, c.cursor.cellNum)
+			if binary.LittleEndian.Uint32(cell[idOffset:idOffset+idSize]) > c.upper {
+				c.Close()
+				break
+			}
+
+			b.add(cell)
+			c.cursor.cellNum++
+		}
+
+		if c.cursor == nil {
+			break
+		}
+
+		if err := c.cursor.skipExhaustedLeaves(); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.Len == 0 {
+		return nil, nil
+	}
+
+	return b, nil
+}
+
+// Close releases the snapshot of the cursor, which is
+// released anyway once the last batch has been read
+func (c *BatchCursor) Close() {
+	if c.cursor != nil {
+		c.cursor.Close()
+		c.cursor = nil
+	}
+}
@@ -0,0 +1,92 @@
+package persist
+
+import (
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestBatchCursor(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 3000)
+
+	plan, err := tbl.Plan([]Predicate{
+		{Column: "id", Op: GreaterOrEqual, Value: "500"},
+		{Column: "id", Op: Less, Value: "2600"},
+		{Column: "username", Op: Greater, Value: "user#2"},
+	})
+
+	if err != nil || plan.Method != RangeScan {
+		t.Fatalf("Expected a range scan: %v %v", plan, err)
+	}
+
+	c, err := tbl.OpenBatches(plan)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var read, matched []uint32
+	for {
+		b, err := c.Next()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if b == nil {
+			break
+		}
+
+		if b.Len > BatchSize || len(b.Ids) != b.Len || len(b.Usernames()) != b.Len {
+			t.Fatalf("Batch of %d rows holds %d ids and %d usernames", b.Len, len(b.Ids), len(b.Usernames()))
+		}
+
+		sel := make([]int, b.Len)
+		for i := range sel {
+			sel[i] = i
+
+			if string(b.Emails()[i]) != fmt.Sprintf("person#%d@example.com", b.Ids[i]) || b.Row(i).id != b.Ids[i] {
+				t.Fatalf("Unexpected row %d of the batch: %s", i, b.Row(i))
+			}
+		}
+
+		read = append(read, b.Ids...)
+		for _, i := range b.Filter(plan.Filter[0], sel) {
+			matched = append(matched, b.Ids[i])
+		}
+	}
+
+	if len(read) != 2100 || read[0] != 500 || read[len(read)-1] != 2599 {
+		t.Fatalf("Read %d rows from %d to %d", len(read), read[0], read[len(read)-1])
+	}
+
+	expected := 0
+	for id := 500; id < 2600; id++ {
+		if fmt.Sprintf("user#%d", id) > "user#2" {
+			expected++
+		}
+	}
+
+	if len(matched) != expected {
+		t.Fatalf("Filter kept %d rows, expected %d", len(matched), expected)
+	}
+
+	if err := tbl.CreateIndex("idx_email", "email", true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	plan, err = tbl.Plan([]Predicate{{Column: "email", Op: Equal, Value: "person#1@example.com"}})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := tbl.OpenBatches(plan); err == nil {
+		t.Fatalf("Expected an index scan not to be read in batches")
+	}
+}
@@ -24,9 +24,12 @@ func (a ArrayWriter) Write(p []byte) (n int, err error) {
 const (
 	internalNode NodeType = iota
 	leafNode
+	overflowNode
+	freeNode
 )
 
-// Common node header layout
+// Common node header layout. The log sequence number is the
+// one of the commit which changed the node last
 const (
 	nodeTypeSize         uint32 = 1
 	nodeTypeOffset       uint32 = 0
@@ -34,7 +37,9 @@ const (
 	isRootOffset         uint32 = nodeTypeSize
 	parentPointerSize    uint32 = 4
 	parentPointerOffset  uint32 = isRootOffset + isRootSize
-	commonNodeHeaderSize uint32 = nodeTypeSize + isRootSize + parentPointerSize
+	pageLSNSize          uint32 = 8
+	pageLSNOffset        uint32 = parentPointerOffset + parentPointerSize
+	commonNodeHeaderSize uint32 = nodeTypeSize + isRootSize + parentPointerSize + pageLSNSize
 )
 
 // Leaf Node Header Layout
@@ -46,17 +51,6 @@ const (
 	leafNodeHeaderSize     uint32 = commonNodeHeaderSize + leafNodeNumCellsSize + leafNodeNextLeafSize
 )
 
-// Leaf Node Body Layout
-const (
-	leafNodeKeySize     uint32 = 4
-	leafNodeKeyOffset   uint32 = 0
-	leafNodeValueSize   uint32 = rowSize
-	leafNodeValueOffset uint32 = leafNodeKeyOffset + leafNodeKeySize
-	leafNodeCellSize    uint32 = leafNodeKeySize + leafNodeValueSize
-	leafNodeCellSpace   uint32 = pageSize - leafNodeHeaderSize
-	leafNodeMaxCells    uint32 = leafNodeCellSpace / leafNodeCellSize
-)
-
 // Internal node header layout
 const (
 	internalNodeNumKeysSize      uint32 = 4
@@ -66,19 +60,58 @@ const (
 	internalNodeHeaderSize       uint32 = commonNodeHeaderSize + internalNodeNumKeysSize + internalNodeRightChildSize
 )
 
-// Internal Node Body Layout
+// Internal Node Body Layout. The key size depends on the tree,
+// a cell is the child pointer followed by the key
 const (
-	internalNodeKeySize   uint32 = 4
-	internalNodeChildSize uint32 = 4
-	internalNodeCellSize  uint32 = internalNodeChildSize + internalNodeKeySize
-	// TODO making count small for testing
-	internalNodeMaxCells uint32 = 3
+	internalNodeChildSize   uint32 = 4
+	internalNodeChildOffset uint32 = 0
+	internalNodeKeyOffset   uint32 = internalNodeChildOffset + internalNodeChildSize
 )
 
-const (
-	leafNodeRightSplitCount uint32 = (leafNodeMaxCells + 1) / 2
-	leafNodeLeftSplitCount  uint32 = (leafNodeMaxCells + 1) - leafNodeRightSplitCount
-)
+var errDuplicateKey = errors.New("duplicate key")
+
+// btree is a single B+ tree stored in the pager. Keys are encoded with the
+// tree's key encoding and compared with bytes.Compare, values are fixed
+// width byte strings. The table and each of its secondary indexes are
+// separate trees in the same file, they only differ in their root page,
+// key encoding and value size. A variable tree stores cells of any
+// length instead, see the variable node layout, its keys are compared
+// as they are and key and valueSize are not used.
+//
+// A descent crabs: it latches a child shared before it lets go of the
+// parent, so it holds at most two latches and the versions on its path
+// are not collected or replaced while it moves between them, see
+// pageLatch. The versions a snapshot reads never change and the one
+// writer allowed at a time changes its own copies of the pages, so the
+// page returned is read without a latch once the descent is done
+type btree struct {
+	pager       *pager
+	rootPageNum uint32
+	key         KeyEncoding
+	valueSize   uint32
+	variable    bool
+}
+
+// Leaf Node Body Layout, a cell is the key followed by the value
+func (t *btree) leafNodeCellSize() uint32 {
+	return t.key.Size() + t.valueSize
+}
+
+func (t *btree) leafNodeCellSpace() uint32 {
+	return t.pager.pageSize - leafNodeHeaderSize
+}
+
+func (t *btree) leafNodeMaxCells() uint32 {
+	return t.leafNodeCellSpace() / t.leafNodeCellSize()
+}
+
+func (t *btree) internalNodeCellSize() uint32 {
+	return internalNodeChildSize + t.key.Size()
+}
+
+func (t *btree) internalNodeMaxCells() uint32 {
+	return (t.pager.pageSize - internalNodeHeaderSize) / t.internalNodeCellSize()
+}
 
 func getNodeParent(page []byte) uint32 {
 	return binary.LittleEndian.Uint32(
@@ -91,6 +124,14 @@ func setNodeParent(page []byte, parent uint32) {
 		parent)
 }
 
+func getPageLSN(page []byte) uint64 {
+	return binary.LittleEndian.Uint64(page[pageLSNOffset : pageLSNOffset+pageLSNSize])
+}
+
+func setPageLSN(page []byte, lsn uint64) {
+	binary.LittleEndian.PutUint64(page[pageLSNOffset:pageLSNOffset+pageLSNSize], lsn)
+}
+
 func getLeafNodeNumCells(page []byte) uint32 {
 	return binary.LittleEndian.Uint32(page[leafNodeNumCellsOffset : leafNodeNumCellsOffset+leafNodeNumCellsSize])
 }
@@ -104,25 +145,69 @@ func incrementLeafNodeNumCells(page []byte) {
 	setLeafNodeNumCells(page, num+1)
 }
 
-func getleafNodeCell(page []byte, cellNum uint32) []byte {
+func (t *btree) getLeafNodeCell(page []byte, cellNum uint32) []byte {
+	if t.variable {
+		return getVarLeafCell(page, cellNum)
+	}
+
 	// TODO add bounds checking
-	offset := leafNodeHeaderSize + (cellNum * leafNodeCellSize)
-	return page[offset : offset+leafNodeCellSize]
+	offset := leafNodeHeaderSize + (cellNum * t.leafNodeCellSize())
+	return page[offset : offset+t.leafNodeCellSize()]
+}
+
+func (t *btree) getLeafNodeKey(page []byte, cellNum uint32) []byte {
+	return t.leafCellKey(t.getLeafNodeCell(page, cellNum))
+}
+
+func (t *btree) getLeafNodeValue(page []byte, cellNum uint32) []byte {
+	cell := t.getLeafNodeCell(page, cellNum)
+	if t.variable {
+		return cell[varLeafKeyOffset+varLeafKeyLen(cell):]
+	}
+
+	return cell[t.key.Size():]
+}
+
+func (t *btree) leafCellKey(cell []byte) []byte {
+	if t.variable {
+		return cell[varLeafKeyOffset : varLeafKeyOffset+varLeafKeyLen(cell)]
+	}
+
+	return cell[:t.key.Size()]
 }
 
-func getLeafNodeKey(page []byte, cellNum uint32) uint32 {
-	cell := getleafNodeCell(page, cellNum)
-	return binary.LittleEndian.Uint32(cell[leafNodeKeyOffset : leafNodeKeyOffset+leafNodeKeySize])
+// leafNodeCells returns copies of the cells of the leaf in key order
+func (t *btree) leafNodeCells(page []byte) [][]byte {
+	cells := make([][]byte, getLeafNodeNumCells(page))
+	for i := range cells {
+		cells[i] = append([]byte(nil), t.getLeafNodeCell(page, uint32(i))...)
+	}
+
+	return cells
 }
 
-func setLeafNodeKey(page []byte, cellNum, key uint32) {
-	cell := getleafNodeCell(page, cellNum)
-	binary.LittleEndian.PutUint32(cell[leafNodeKeyOffset:leafNodeKeyOffset+leafNodeKeySize], key)
+// setLeafNodeCells replaces the cells of the leaf,
+// they must not be slices of the page
+func (t *btree) setLeafNodeCells(page []byte, cells [][]byte) {
+	setLeafNodeNumCells(page, uint32(len(cells)))
+
+	if t.variable {
+		t.setVarCells(page, leafNodeHeaderSize, cells)
+		return
+	}
+
+	for i, cell := range cells {
+		copy(t.getLeafNodeCell(page, uint32(i)), cell)
+	}
 }
 
-func getLeafNodeValue(page []byte, cellNum uint32) []byte {
-	cell := getleafNodeCell(page, cellNum)
-	return cell[leafNodeValueOffset : leafNodeValueOffset+leafNodeValueSize]
+// leafNodeFits returns true if the cells fit in one leaf
+func (t *btree) leafNodeFits(cells [][]byte) bool {
+	if t.variable {
+		return t.varCellsFit(leafNodeHeaderSize, cells)
+	}
+
+	return uint32(len(cells)) <= t.leafNodeMaxCells()
 }
 
 func getLeafNodeNextLeaf(page []byte) uint32 {
@@ -145,41 +230,291 @@ func initializeLeafNode(page []byte) {
 	binary.LittleEndian.PutUint32(page[leafNodeNumCellsOffset:leafNodeNumCellsOffset+leafNodeNumCellsSize], 0)
 }
 
+// find returns a cursor pointing to the position of the given key
+// as the writer sees the tree. If the key is not present, return
+// the position where it should be inserted
+func (t *btree) find(key []byte) (*Cursor, error) {
+	pageNum, page, err := t.descend(nil, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cursor{tree: t, pageNum: pageNum, cellNum: t.leafNodeFind(page, key)}, nil
+}
+
+// descend returns the leaf which should hold the key as of the
+// snapshot, a nil key descends to the first leaf
+func (t *btree) descend(s *snapshot, key []byte) (uint32, []byte, error) {
+	pageNum := t.rootPageNum
+
+	var parent *pageLatch
+	defer func() { parent.unlockShared() }()
+
+	for {
+		page, latch, err := t.pager.latchPage(s, pageNum)
+
+		// The child is latched before the parent is let go
+		parent.unlockShared()
+		parent = latch
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch getNodeType(page) {
+		case leafNode:
+			return pageNum, page, nil
+
+		case internalNode:
+			childIndex := uint32(0)
+			if key != nil {
+				childIndex = t.internalNodeFindChild(page, key)
+			}
+
+			pageNum, err = t.getInternalNodeChild(page, childIndex)
+			if err != nil {
+				return 0, nil, err
+			}
+
+		default:
+			panic("Node type not recognized, the page may have been corrupted.")
+		}
+	}
+}
+
+// leafNodeFind returns the index of the first cell with
+// a key greater than or equal to the given key
+func (t *btree) leafNodeFind(page []byte, key []byte) uint32 {
+	low := 0
+	high := int(getLeafNodeNumCells(page))
+
+	for low != high {
+		mid := low + ((high - low) / 2)
+
+		if bytes.Compare(t.getLeafNodeKey(page, uint32(mid)), key) >= 0 {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+
+	return uint32(low)
+}
+
+// internalNodeFindChild returns the index of the child which
+// should contain the given key
+func (t *btree) internalNodeFindChild(page []byte, key []byte) uint32 {
+	low := 0
+	// There is one more child than key
+	high := int(getInternalNodeNumKeys(page))
+
+	for low != high {
+		mid := low + ((high - low) / 2)
+		keyToRight := t.getInternalNodeKey(page, uint32(mid))
+
+		if bytes.Compare(keyToRight, key) >= 0 {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+
+	return uint32(low)
+}
+
+// start returns a cursor pointing at the first cell of the tree as of
+// the snapshot, release is called when the cursor is done with it
+func (t *btree) start(s *snapshot, release func()) (*Cursor, error) {
+	return t.seek(s, release, nil)
+}
+
+// seek returns a cursor pointing at the first cell with a key
+// greater than or equal to the given key, ready to be used for a scan
+func (t *btree) seek(s *snapshot, release func(), key []byte) (*Cursor, error) {
+	c := &Cursor{tree: t, snapshot: s, release: release}
+
+	pageNum, page, err := t.descend(s, key)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.pageNum = pageNum
+	if key != nil {
+		c.cellNum = t.leafNodeFind(page, key)
+	}
+
+	if err := c.skipExhaustedLeaves(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// get returns the value stored under the given key as of
+// the snapshot or nil if the key is not present
+func (t *btree) get(s *snapshot, key []byte) ([]byte, error) {
+	_, page, err := t.descend(s, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cellNum := t.leafNodeFind(page, key)
+	if cellNum >= getLeafNodeNumCells(page) || !bytes.Equal(t.getLeafNodeKey(page, cellNum), key) {
+		return nil, nil
+	}
+
+	return t.getLeafNodeValue(page, cellNum), nil
+}
+
+func (t *btree) insert(key, value []byte) error {
+	c, err := t.find(key)
+	if err != nil {
+		return err
+	}
+
+	page, err := t.pager.GetPage(c.pageNum)
+	if err != nil {
+		return err
+	}
+
+	if c.cellNum < getLeafNodeNumCells(page) && bytes.Equal(t.getLeafNodeKey(page, c.cellNum), key) {
+		return errDuplicateKey
+	}
+
+	return t.leafNodeInsert(c, key, value)
+}
+
+// update replaces the value stored under the given key,
+// it returns false if the key was not present
+func (t *btree) update(key, value []byte) (bool, error) {
+	c, err := t.find(key)
+	if err != nil {
+		return false, err
+	}
+
+	page, err := t.pager.GetPage(c.pageNum)
+	if err != nil {
+		return false, err
+	}
+
+	if c.cellNum >= getLeafNodeNumCells(page) || !bytes.Equal(t.getLeafNodeKey(page, c.cellNum), key) {
+		return false, nil
+	}
+
+	page, err = t.pager.getPageForWrite(c.pageNum)
+	if err != nil {
+		return false, err
+	}
+
+	if old := t.getLeafNodeValue(page, c.cellNum); len(old) == len(value) || !t.variable {
+		copy(old, value)
+		return true, nil
+	}
+
+	// The cell of a variable tree changes size, the leaf is
+	// written again and split if it no longer fits
+	cells := t.leafNodeCells(page)
+	cells[c.cellNum] = t.newLeafCell(key, value)
+
+	return true, t.leafNodeReplace(c.pageNum, page, cells)
+}
+
+// delete removes the given key from the tree, it
+// returns false if the key was not present
+func (t *btree) delete(key []byte) (bool, error) {
+	c, err := t.find(key)
+	if err != nil {
+		return false, err
+	}
+
+	page, err := t.pager.GetPage(c.pageNum)
+	if err != nil {
+		return false, err
+	}
+
+	if c.cellNum >= getLeafNodeNumCells(page) || !bytes.Equal(t.getLeafNodeKey(page, c.cellNum), key) {
+		return false, nil
+	}
+
+	return true, t.leafNodeDelete(c)
+}
+
 // This modifies the page
-func leafNodeInsert(cursor *Cursor, key uint32, value serializedRow) error {
-	node, err := cursor.table.pager.GetPage(cursor.pageNum)
+func (t *btree) leafNodeInsert(cursor *Cursor, key, value []byte) error {
+	node, err := t.pager.getPageForWrite(cursor.pageNum)
 	if err != nil {
 		return err
 	}
 
 	numCells := getLeafNodeNumCells(node)
-	if numCells >= leafNodeMaxCells {
-		return leafNodeSplitAndInsert(cursor, key, value)
+	if t.variable || numCells >= t.leafNodeMaxCells() {
+		cells := t.leafNodeCells(node)
+		cells = append(cells, nil)
+		copy(cells[cursor.cellNum+1:], cells[cursor.cellNum:])
+		cells[cursor.cellNum] = t.newLeafCell(key, value)
+
+		return t.leafNodeReplace(cursor.pageNum, node, cells)
 	}
 
 	if cursor.cellNum < numCells {
 		for i := numCells; i > cursor.cellNum; i-- {
-			copy(getleafNodeCell(node, i), getleafNodeCell(node, i-1))
+			copy(t.getLeafNodeCell(node, i), t.getLeafNodeCell(node, i-1))
 		}
 	}
 
 	incrementLeafNodeNumCells(node)
-	setLeafNodeKey(node, cursor.cellNum, key)
-	copy(getLeafNodeValue(node, cursor.cellNum), value)
+	copy(t.getLeafNodeKey(node, cursor.cellNum), key)
+	copy(t.getLeafNodeValue(node, cursor.cellNum), value)
 
 	return nil
 }
 
-func leafNodeSplitAndInsert(c *Cursor, key uint32, value serializedRow) error {
-	oldNode, err := c.table.pager.GetPage(c.pageNum)
+// leafNodeDelete removes the cell the cursor points at. Nodes are
+// never merged, a leaf may be left empty and the keys in the parent
+// remain valid upper bounds for the leaf
+func (t *btree) leafNodeDelete(cursor *Cursor) error {
+	node, err := t.pager.getPageForWrite(cursor.pageNum)
 	if err != nil {
 		return err
 	}
 
-	oldMax := getNodeMaxKey(oldNode)
+	if t.variable {
+		cells := t.leafNodeCells(node)
+		t.setLeafNodeCells(node, append(cells[:cursor.cellNum], cells[cursor.cellNum+1:]...))
+		return nil
+	}
+
+	numCells := getLeafNodeNumCells(node)
+	for i := cursor.cellNum; i+1 < numCells; i++ {
+		copy(t.getLeafNodeCell(node, i), t.getLeafNodeCell(node, i+1))
+	}
 
-	newPageNum := c.table.pager.GetUnusedPageNum()
-	newNode, err := c.table.pager.GetPage(newPageNum)
+	setLeafNodeNumCells(node, numCells-1)
+	return nil
+}
+
+// leafNodeReplace writes the cells to the leaf,
+// splitting it if they do not fit
+func (t *btree) leafNodeReplace(pageNum uint32, node []byte, cells [][]byte) error {
+	if t.leafNodeFits(cells) {
+		t.setLeafNodeCells(node, cells)
+		return nil
+	}
+
+	return t.leafNodeSplit(pageNum, node, cells)
+}
+
+// leafNodeSplit writes the lower half of the cells back
+// to the leaf and the upper half to a new leaf after it
+func (t *btree) leafNodeSplit(pageNum uint32, oldNode []byte, cells [][]byte) error {
+	newPageNum, err := t.pager.allocatePage()
+	if err != nil {
+		return err
+	}
+
+	newNode, err := t.pager.getPageForWrite(newPageNum)
 	if err != nil {
 		return err
 	}
@@ -190,116 +525,287 @@ func leafNodeSplitAndInsert(c *Cursor, key uint32, value serializedRow) error {
 	setLeafNodeNextLeaf(newNode, getLeafNodeNextLeaf(oldNode))
 	setLeafNodeNextLeaf(oldNode, newPageNum)
 
-	var destinationNode []byte
-	for i := int(leafNodeMaxCells); i >= 0; i-- {
-		if uint32(i) >= leafNodeLeftSplitCount {
-			destinationNode = newNode
-		} else {
-			destinationNode = oldNode
-		}
+	leftSplitCount := t.splitPoint(cells, 0)
+	t.setLeafNodeCells(oldNode, cells[:leftSplitCount])
+	t.setLeafNodeCells(newNode, cells[leftSplitCount:])
 
-		indexWithinNode := uint32(i) % leafNodeLeftSplitCount
+	oldMax := append([]byte(nil), t.leafCellKey(cells[leftSplitCount-1])...)
 
-		if uint32(i) == c.cellNum {
-			copy(getLeafNodeValue(destinationNode, indexWithinNode), value)
-			setLeafNodeKey(destinationNode, indexWithinNode, key)
-		} else if uint32(i) > c.cellNum {
-			dest := getleafNodeCell(destinationNode, indexWithinNode)
-			copy(dest, getleafNodeCell(oldNode, uint32(i-1)))
-		} else {
-			dest := getleafNodeCell(destinationNode, indexWithinNode)
-			copy(dest, getleafNodeCell(oldNode, uint32(i)))
+	if isNodeRoot(oldNode) {
+		return t.createNewRoot(newPageNum, oldMax)
+	}
+
+	return t.internalNodeInsert(getNodeParent(oldNode), pageNum, oldMax, newPageNum)
+}
+
+// splitPoint returns the number of cells which go to the left node of a
+// split. The cells of a variable tree are split by their size, each of
+// the halves holds about as many bytes. The cells of an internal node
+// are its keys, which take extra bytes in front of them
+func (t *btree) splitPoint(cells [][]byte, extra uint32) int {
+	if !t.variable {
+		return len(cells) / 2
+	}
+
+	total := uint32(0)
+	for _, cell := range cells {
+		total += extra + uint32(len(cell)) + varSlotSize
+	}
+
+	left := uint32(0)
+	for i, cell := range cells {
+		if 2*left >= total {
+			return i
 		}
+
+		left += extra + uint32(len(cell)) + varSlotSize
 	}
 
-	setLeafNodeNumCells(oldNode, leafNodeRightSplitCount)
-	setLeafNodeNumCells(newNode, leafNodeLeftSplitCount)
+	return len(cells) - 1
+}
 
-	if isNodeRoot(oldNode) {
-		return createNewRoot(c.table, newPageNum)
+// newLeafCell returns a cell holding the key and the value
+func (t *btree) newLeafCell(key, value []byte) []byte {
+	if t.variable {
+		return newVarLeafCell(key, value)
 	}
 
-	parentPageNum := getNodeParent(oldNode)
-	newMax := getNodeMaxKey(oldNode)
+	cell := make([]byte, t.leafNodeCellSize())
+	copy(cell, key)
+	copy(cell[len(key):], value)
+
+	return cell
+}
+
+// internalNodeInsert adds rightChildPageNum to the parent directly after
+// leftChildPageNum, which was just split. The separator is the
+// largest key that is stored under the left child
+func (t *btree) internalNodeInsert(parentPageNum, leftChildPageNum uint32, separator []byte, rightChildPageNum uint32) error {
+	parent, err := t.pager.getPageForWrite(parentPageNum)
+	if err != nil {
+		return err
+	}
 
-	parent, err := c.table.pager.GetPage(parentPageNum)
+	rightChild, err := t.pager.getPageForWrite(rightChildPageNum)
 	if err != nil {
 		return err
 	}
-	updateInternalNodeKey(parent, oldMax, newMax)
-	internalNodeInsert(c.table, parentPageNum, newPageNum)
+
+	numKeys := getInternalNodeNumKeys(parent)
+	index, err := t.internalNodeChildIndex(parent, leftChildPageNum)
+	if err != nil {
+		return err
+	}
+
+	if t.variable || numKeys >= t.internalNodeMaxCells() {
+		keys, children, err := t.internalNodeEntries(parent)
+		if err != nil {
+			return err
+		}
+
+		// The separator goes in front of the key of the split node,
+		// which is still the upper bound of the new node after it
+		keys = append(keys, nil)
+		copy(keys[index+1:], keys[index:])
+		keys[index] = separator
+
+		children = append(children, 0)
+		copy(children[index+2:], children[index+1:])
+		children[index+1] = rightChildPageNum
+
+		if !t.internalNodeFits(keys) {
+			return t.internalNodeSplit(parentPageNum, parent, keys, children)
+		}
+
+		setNodeParent(rightChild, parentPageNum)
+		t.setInternalNodeCells(parent, keys, children)
+
+		return nil
+	}
+
+	setNodeParent(rightChild, parentPageNum)
+
+	if index == numKeys {
+		// The split node was the right child, it moves into the last
+		// cell and the new node becomes the right child
+		setInternalNodeNumKeys(parent, numKeys+1)
+		t.setInternalNodeChild(parent, numKeys, leftChildPageNum)
+		t.setInternalNodeKey(parent, numKeys, separator)
+		setInternalNodeRightChild(parent, rightChildPageNum)
+
+		return nil
+	}
+
+	for i := numKeys; i > index; i-- {
+		copy(t.getInternalNodeCell(parent, i), t.getInternalNodeCell(parent, i-1))
+	}
+
+	// The cell after the split node keeps the old key,
+	// which is still the upper bound of the new node
+	setInternalNodeNumKeys(parent, numKeys+1)
+	t.setInternalNodeKey(parent, index, separator)
+	t.setInternalNodeChild(parent, index+1, rightChildPageNum)
 
 	return nil
 }
 
-// TODO, not thrilled about passing the table as a parameter here
-// find a better way to do this
-func internalNodeInsert(table *Table, parentPageNum, childPageNum uint32) error {
-	parent, err := table.pager.GetPage(parentPageNum)
+// internalNodeEntries returns copies of the keys of the
+// internal node and its children, the right child last
+func (t *btree) internalNodeEntries(page []byte) ([][]byte, []uint32, error) {
+	numKeys := getInternalNodeNumKeys(page)
+	keys := make([][]byte, 0, numKeys+1)
+	children := make([]uint32, 0, numKeys+2)
+
+	for i := uint32(0); i <= numKeys; i++ {
+		child, err := t.getInternalNodeChild(page, i)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		children = append(children, child)
+		if i < numKeys {
+			keys = append(keys, append([]byte(nil), t.getInternalNodeKey(page, i)...))
+		}
+	}
+
+	return keys, children, nil
+}
+
+// internalNodeFits returns true if the keys fit in one internal node
+func (t *btree) internalNodeFits(keys [][]byte) bool {
+	if !t.variable {
+		return uint32(len(keys)) <= t.internalNodeMaxCells()
+	}
+
+	size := internalNodeHeaderSize
+	for _, key := range keys {
+		size += varInternalKeyOffset + uint32(len(key)) + varSlotSize
+	}
+
+	return size <= t.pager.pageSize
+}
+
+// internalNodeSplit writes the lower half of the keys and children back
+// to the node and the upper half to a new node. The middle key moves up
+// to the parent, it is the upper bound of the right most child of the
+// left node
+func (t *btree) internalNodeSplit(pageNum uint32, node []byte, keys [][]byte, children []uint32) error {
+	mid := t.splitPoint(keys, varInternalKeyOffset)
+	promoted := keys[mid]
+
+	newPageNum, err := t.pager.allocatePage()
 	if err != nil {
 		return err
 	}
 
-	child, err := table.pager.GetPage(childPageNum)
+	newNode, err := t.pager.getPageForWrite(newPageNum)
 	if err != nil {
 		return err
 	}
 
-	childMaxKey := getNodeMaxKey(child)
-	index := internalNodeFindChild(parent, childMaxKey)
-
-	origNumKeys := getInternalNodeNumKeys(parent)
-	setInternalNodeNumKeys(parent, origNumKeys+1)
+	initializeInternalNode(newNode)
+	setNodeParent(newNode, getNodeParent(node))
 
-	if origNumKeys >= internalNodeMaxCells {
-		return errors.New("need to implement splitting internal node")
+	if err := t.writeInternalNode(pageNum, node, keys[:mid], children[:mid+1]); err != nil {
+		return err
 	}
 
-	rightChildPageNum := getInternalNodeRightChild(parent)
-	rightChild, err := table.pager.GetPage(rightChildPageNum)
-	if err != nil {
+	if err := t.writeInternalNode(newPageNum, newNode, keys[mid+1:], children[mid+1:]); err != nil {
 		return err
 	}
 
-	if childMaxKey > getNodeMaxKey(rightChild) {
-		setInternalNodeChild(parent, origNumKeys, rightChildPageNum)
-		setInternalNodeRightChild(parent, childPageNum)
+	if isNodeRoot(node) {
+		return t.createNewRoot(newPageNum, promoted)
+	}
 
-		return nil
+	return t.internalNodeInsert(getNodeParent(node), pageNum, promoted, newPageNum)
+}
+
+// writeInternalNode replaces the cells of the node and points
+// the parent pointer of every child at it
+func (t *btree) writeInternalNode(pageNum uint32, page []byte, keys [][]byte, children []uint32) error {
+	t.setInternalNodeCells(page, keys, children)
+	return t.setChildrenParent(pageNum, page)
+}
+
+// setInternalNodeCells replaces the keys and children of the
+// internal node, the keys must not be slices of the page
+func (t *btree) setInternalNodeCells(page []byte, keys [][]byte, children []uint32) {
+	setInternalNodeNumKeys(page, uint32(len(keys)))
+	setInternalNodeRightChild(page, children[len(children)-1])
+
+	if t.variable {
+		cells := make([][]byte, len(keys))
+		for i, key := range keys {
+			cells[i] = newVarInternalCell(children[i], key)
+		}
+
+		t.setVarCells(page, internalNodeHeaderSize, cells)
+		return
 	}
 
-	for i := origNumKeys; i > index; i-- {
-		dest := getInternalNodeCell(parent, i)
-		source := getInternalNodeCell(parent, i-1)
-		copy(dest, source)
+	for i, key := range keys {
+		t.setInternalNodeChild(page, uint32(i), children[i])
+		t.setInternalNodeKey(page, uint32(i), key)
 	}
+}
+
+func (t *btree) setChildrenParent(pageNum uint32, page []byte) error {
+	for i := uint32(0); i <= getInternalNodeNumKeys(page); i++ {
+		childNum, err := t.getInternalNodeChild(page, i)
+		if err != nil {
+			return err
+		}
 
-	setInternalNodeChild(parent, index, childPageNum)
-	setInternalNodeKey(parent, index, childMaxKey)
+		child, err := t.pager.getPageForWrite(childNum)
+		if err != nil {
+			return err
+		}
+
+		setNodeParent(child, pageNum)
+	}
 
 	return nil
 }
 
-func updateInternalNodeKey(page []byte, oldKey, newKey uint32) {
-	oldChildIndex := internalNodeFindChild(page, oldKey)
-	setInternalNodeKey(page, oldChildIndex, newKey)
+// internalNodeChildIndex returns the index of the
+// given child page within the internal node
+func (t *btree) internalNodeChildIndex(page []byte, childPageNum uint32) (uint32, error) {
+	numKeys := getInternalNodeNumKeys(page)
+
+	for i := uint32(0); i <= numKeys; i++ {
+		child, err := t.getInternalNodeChild(page, i)
+		if err != nil {
+			return 0, err
+		}
+
+		if child == childPageNum {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("page %d is not a child of the node, the page may have been corrupted", childPageNum)
 }
 
-func internalNodFindChild(page []byte)
+// createNewRoot moves the contents of the root to a new page which becomes
+// the left child, the root page itself never moves
+func (t *btree) createNewRoot(rightChildPageNum uint32, separator []byte) error {
+	root, err := t.pager.getPageForWrite(t.rootPageNum)
+	if err != nil {
+		return err
+	}
 
-func createNewRoot(t *Table, rightChildPageNum uint32) error {
-	root, err := t.pager.GetPage(t.rootPageNum)
+	rightChild, err := t.pager.getPageForWrite(rightChildPageNum)
 	if err != nil {
 		return err
 	}
 
-	rightChild, err := t.pager.GetPage(rightChildPageNum)
+	leftChildPageNum, err := t.pager.allocatePage()
 	if err != nil {
 		return err
 	}
 
-	leftChildPageNum := t.pager.GetUnusedPageNum()
-	leftChild, err := t.pager.GetPage(leftChildPageNum)
+	leftChild, err := t.pager.getPageForWrite(leftChildPageNum)
 	if err != nil {
 		return err
 	}
@@ -307,15 +813,15 @@ func createNewRoot(t *Table, rightChildPageNum uint32) error {
 	copy(leftChild, root)
 	setNodeRoot(leftChild, false)
 
+	if getNodeType(leftChild) == internalNode {
+		if err := t.setChildrenParent(leftChildPageNum, leftChild); err != nil {
+			return err
+		}
+	}
+
 	initializeInternalNode(root)
 	setNodeRoot(root, true)
-
-	setInternalNodeNumKeys(root, 1)
-	setInternalNodeChild(root, 0, leftChildPageNum)
-
-	leftChildMaxKey := getNodeMaxKey(leftChild)
-	setInternalNodeKey(root, 0, leftChildMaxKey)
-	setInternalNodeRightChild(root, rightChildPageNum)
+	t.setInternalNodeCells(root, [][]byte{separator}, []uint32{leftChildPageNum, rightChildPageNum})
 
 	setNodeParent(leftChild, t.rootPageNum)
 	setNodeParent(rightChild, t.rootPageNum)
@@ -362,7 +868,7 @@ func setInternalNodeRightChild(page []byte, pageNum uint32) {
 		pageNum)
 }
 
-func setInternalNodeChild(page []byte, childNum, newChildNum uint32) error {
+func (t *btree) setInternalNodeChild(page []byte, childNum, newChildNum uint32) error {
 	numKeys := getInternalNodeNumKeys(page)
 	if childNum > numKeys {
 		return fmt.Errorf("Tried to access child num %d > num_keys %d\n", childNum, numKeys)
@@ -373,38 +879,32 @@ func setInternalNodeChild(page []byte, childNum, newChildNum uint32) error {
 		return nil
 	}
 
-	cell := getInternalNodeCell(page, childNum)
+	cell := t.getInternalNodeCell(page, childNum)
 
-	binary.LittleEndian.PutUint32(cell[:internalNodeChildSize], newChildNum)
+	binary.LittleEndian.PutUint32(cell[internalNodeChildOffset:internalNodeChildOffset+internalNodeChildSize], newChildNum)
 	return nil
 }
 
-func setInternalNodeKey(page []byte, keyNum, key uint32) {
-	cell := getInternalNodeCell(page, keyNum)
-	binary.LittleEndian.PutUint32(cell[internalNodeChildSize:internalNodeChildSize+internalNodeKeySize], key)
+func (t *btree) setInternalNodeKey(page []byte, keyNum uint32, key []byte) {
+	copy(t.getInternalNodeKey(page, keyNum), key)
 }
 
-func getInternalNodeCell(page []byte, cellNum uint32) []byte {
-	offset := internalNodeHeaderSize + cellNum*internalNodeCellSize
-	return page[offset : offset+internalNodeCellSize]
-}
+func (t *btree) getInternalNodeCell(page []byte, cellNum uint32) []byte {
+	if t.variable {
+		return getVarInternalCell(page, cellNum)
+	}
 
-func getInternalNodeKey(page []byte, keyNum uint32) uint32 {
-	cell := getInternalNodeCell(page, keyNum)
-	return binary.LittleEndian.Uint32(cell[internalNodeChildSize : internalNodeChildSize+internalNodeKeySize])
+	offset := internalNodeHeaderSize + cellNum*t.internalNodeCellSize()
+	return page[offset : offset+t.internalNodeCellSize()]
 }
 
-func getNodeMaxKey(page []byte) uint32 {
-	switch getNodeType(page) {
-	case internalNode:
-		return getInternalNodeKey(page, getInternalNodeNumKeys(page)-1)
-
-	case leafNode:
-		return getLeafNodeKey(page, getLeafNodeNumCells(page)-1)
-
-	default:
-		panic("Node type not recognized, the page may have been corrupted.")
+func (t *btree) getInternalNodeKey(page []byte, keyNum uint32) []byte {
+	cell := t.getInternalNodeCell(page, keyNum)
+	if t.variable {
+		return cell[varInternalKeyOffset : varInternalKeyOffset+varInternalKeyLen(cell)]
 	}
+
+	return cell[internalNodeKeyOffset : internalNodeKeyOffset+t.key.Size()]
 }
 
 func isNodeRoot(page []byte) bool {
@@ -432,7 +932,7 @@ func initializeInternalNode(page []byte) {
 	setInternalNodeNumKeys(page, 0)
 }
 
-func getInternalNodeChild(page []byte, childNum uint32) (uint32, error) {
+func (t *btree) getInternalNodeChild(page []byte, childNum uint32) (uint32, error) {
 	numKeys := getInternalNodeNumKeys(page)
 	if childNum > numKeys {
 		return 0, fmt.Errorf("Tried to access child num %d > num_keys %d\n", childNum, numKeys)
@@ -442,8 +942,8 @@ func getInternalNodeChild(page []byte, childNum uint32) (uint32, error) {
 		return getInternalNodeRightChild(page), nil
 	}
 
-	cell := getInternalNodeCell(page, childNum)
-	return binary.LittleEndian.Uint32(cell[:internalNodeChildSize]), nil
+	cell := t.getInternalNodeCell(page, childNum)
+	return binary.LittleEndian.Uint32(cell[internalNodeChildOffset : internalNodeChildOffset+internalNodeChildSize]), nil
 }
 
 // getInternalNodeRightChild gets the rightmost child of the internal node
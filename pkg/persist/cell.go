@@ -0,0 +1,97 @@
+package persist
+
+import "encoding/binary"
+
+// Variable node layout. The node header is followed by a slot for every
+// cell holding the offset of the cell in the page, in key order, and the
+// cells are packed at the end of the page. A leaf cell is the length of
+// the key and of the value followed by both, an internal cell is the
+// child pointer followed by the length of the key and the key
+const (
+	varSlotSize             uint32 = 2
+	varLeafKeyLenSize       uint32 = 2
+	varLeafKeyLenOffset     uint32 = 0
+	varLeafValueLenSize     uint32 = 2
+	varLeafValueLenOffset   uint32 = varLeafKeyLenOffset + varLeafKeyLenSize
+	varLeafKeyOffset        uint32 = varLeafValueLenOffset + varLeafValueLenSize
+	varInternalKeyLenSize   uint32 = 2
+	varInternalKeyLenOffset uint32 = internalNodeChildOffset + internalNodeChildSize
+	varInternalKeyOffset    uint32 = varInternalKeyLenOffset + varInternalKeyLenSize
+)
+
+// maxVarCellSize is the size of the largest cell of a variable tree.
+// At least four cells fit in a node, so a node split by the size of its
+// cells leaves cells on both sides and both halves fit in a page
+func (t *btree) maxVarCellSize() uint32 {
+	return (t.pager.pageSize-leafNodeHeaderSize)/4 - varSlotSize
+}
+
+func varCellOffset(page []byte, headerSize, cellNum uint32) uint32 {
+	slot := headerSize + cellNum*varSlotSize
+	return uint32(binary.LittleEndian.Uint16(page[slot : slot+varSlotSize]))
+}
+
+func getVarLeafCell(page []byte, cellNum uint32) []byte {
+	cell := page[varCellOffset(page, leafNodeHeaderSize, cellNum):]
+	return cell[:varLeafKeyOffset+varLeafKeyLen(cell)+varLeafValueLen(cell)]
+}
+
+func getVarInternalCell(page []byte, cellNum uint32) []byte {
+	cell := page[varCellOffset(page, internalNodeHeaderSize, cellNum):]
+	return cell[:varInternalKeyOffset+varInternalKeyLen(cell)]
+}
+
+func varLeafKeyLen(cell []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint16(cell[varLeafKeyLenOffset : varLeafKeyLenOffset+varLeafKeyLenSize]))
+}
+
+func varLeafValueLen(cell []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint16(cell[varLeafValueLenOffset : varLeafValueLenOffset+varLeafValueLenSize]))
+}
+
+func varInternalKeyLen(cell []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint16(cell[varInternalKeyLenOffset : varInternalKeyLenOffset+varInternalKeyLenSize]))
+}
+
+func newVarLeafCell(key, value []byte) []byte {
+	cell := make([]byte, varLeafKeyOffset+uint32(len(key)+len(value)))
+	binary.LittleEndian.PutUint16(cell[varLeafKeyLenOffset:varLeafKeyLenOffset+varLeafKeyLenSize], uint16(len(key)))
+	binary.LittleEndian.PutUint16(cell[varLeafValueLenOffset:varLeafValueLenOffset+varLeafValueLenSize], uint16(len(value)))
+	copy(cell[varLeafKeyOffset:], key)
+	copy(cell[varLeafKeyOffset+uint32(len(key)):], value)
+
+	return cell
+}
+
+func newVarInternalCell(child uint32, key []byte) []byte {
+	cell := make([]byte, varInternalKeyOffset+uint32(len(key)))
+	binary.LittleEndian.PutUint32(cell[internalNodeChildOffset:internalNodeChildOffset+internalNodeChildSize], child)
+	binary.LittleEndian.PutUint16(cell[varInternalKeyLenOffset:varInternalKeyLenOffset+varInternalKeyLenSize], uint16(len(key)))
+	copy(cell[varInternalKeyOffset:], key)
+
+	return cell
+}
+
+// setVarCells packs the cells at the end of the page and writes their
+// slots after the node header, the number of cells is set by the caller
+func (t *btree) setVarCells(page []byte, headerSize uint32, cells [][]byte) {
+	end := t.pager.pageSize
+	for i, cell := range cells {
+		end -= uint32(len(cell))
+		copy(page[end:], cell)
+
+		slot := headerSize + uint32(i)*varSlotSize
+		binary.LittleEndian.PutUint16(page[slot:slot+varSlotSize], uint16(end))
+	}
+}
+
+// varCellsFit returns true if the cells and their slots
+// fit in a node with a header of the given size
+func (t *btree) varCellsFit(headerSize uint32, cells [][]byte) bool {
+	size := headerSize
+	for _, cell := range cells {
+		size += uint32(len(cell)) + varSlotSize
+	}
+
+	return size <= t.pager.pageSize
+}
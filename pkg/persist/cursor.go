@@ -1,165 +1,150 @@
 package persist
 
+import "encoding/binary"
+
+// Cursor reads the cells of a tree in order as of a snapshot, the pages
+// of which never change. A cursor reading as the writer, with a nil
+// snapshot, must not be used after the writer changes the tree. The
+// snapshot is released once the cursor reaches the end or is closed.
+// A cursor with a snapshot reads ahead once it scans, see readAhead
 type Cursor struct {
-	table      *Table
+	tree       *btree
+	snapshot   *snapshot
+	release    func()
 	pageNum    uint32
 	cellNum    uint32
 	endOfTable bool
+
+	// leaves counts the leaves moved to along the chain
+	leaves    uint32
+	readAhead *readAhead
 }
 
-func (c Cursor) Value() (serializedRow, error) {
-	page, err := c.table.pager.GetPage(c.pageNum)
+func (c Cursor) Key() ([]byte, error) {
+	page, err := c.tree.pager.readPage(c.snapshot, c.pageNum)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return serializedRow(getLeafNodeValue(page, c.cellNum)), nil
+	return c.tree.getLeafNodeKey(page, c.cellNum), nil
 }
 
-func (c *Cursor) Advance() error {
-	page, err := c.table.pager.GetPage(c.pageNum)
+func (c Cursor) Value() ([]byte, error) {
+	page, err := c.tree.pager.readPage(c.snapshot, c.pageNum)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	c.cellNum += 1
+	return c.tree.getLeafNodeValue(page, c.cellNum), nil
+}
 
-	if c.cellNum >= getLeafNodeNumCells(page) {
-		nextPageNum := getLeafNodeNextLeaf(page)
-		if nextPageNum == 0 {
-			c.endOfTable = true
-		} else {
-			c.pageNum = nextPageNum
-			c.cellNum = 0
-		}
-	}
+func (c *Cursor) Advance() error {
+	c.cellNum += 1
 
-	return nil
+	return c.skipExhaustedLeaves()
 }
 
-func TableStart(t *Table) (*Cursor, error) {
-	cursor, err := TableFind(t, 0)
-	if err != nil {
-		return nil, err
+// Close releases the snapshot of the cursor and stops
+// its read-ahead, it may be called more than once
+func (c *Cursor) Close() {
+	if c.readAhead != nil {
+		c.readAhead.close()
+		c.readAhead = nil
 	}
 
-	page, err := t.pager.GetPage(cursor.pageNum)
-	if err != nil {
-		return nil, err
+	if c.release != nil {
+		c.release()
+		c.release = nil
 	}
-
-	numCells := getLeafNodeNumCells(page)
-	cursor.endOfTable = (numCells == 0)
-
-	return cursor, nil
 }
 
-// TableFind returns a cursor pointing to the position of
-// the given key. If the key is not present, return the position
-// where it should be inserted
-func TableFind(t *Table, key uint32) (*Cursor, error) {
-	n, err := t.pager.GetPage(t.rootPageNum)
+// nextLeaf moves the cursor to the first cell of the next leaf
+func (c *Cursor) nextLeaf() error {
+	page, err := c.tree.pager.readPage(c.snapshot, c.pageNum)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if getNodeType(n) == leafNode {
-		return leafNodeFind(t, t.rootPageNum, key)
-	} else {
-		return internalNodeFind(t, t.rootPageNum, key)
-	}
+	c.cellNum = getLeafNodeNumCells(page)
+	return c.skipExhaustedLeaves()
 }
 
-func internalNodeFind(t *Table, pageNum, key uint32) (*Cursor, error) {
-	page, err := t.pager.GetPage(pageNum)
-	if err != nil {
-		return nil, err
-	}
+// skipExhaustedLeaves moves the cursor along the leaf chain until it
+// points at a cell. Leaves can be left empty by deletes so there may be
+// more than one leaf to skip, it crabs from one to the next like a
+// descent does
+func (c *Cursor) skipExhaustedLeaves() error {
+	var prev *pageLatch
+	defer func() { prev.unlockShared() }()
 
-	childIndex := internalNodeFindChild(page, key)
-	childNum, err := getInternalNodeChild(page, childIndex)
-	if err != nil {
-		return nil, err
-	}
+	for {
+		page, latch, err := c.tree.pager.latchPage(c.snapshot, c.pageNum)
 
-	child, err := t.pager.GetPage(childNum)
-	if err != nil {
-		return nil, err
-	}
+		prev.unlockShared()
+		prev = latch
 
-	switch getNodeType(child) {
-	case leafNode:
-		return leafNodeFind(t, childNum, key)
+		if err != nil {
+			return err
+		}
 
-	case internalNode:
-		return internalNodeFind(t, childNum, key)
+		if c.cellNum < getLeafNodeNumCells(page) {
+			return nil
+		}
 
-	default:
-		panic("Node type not recognized, the page may have been corrupted.")
+		nextPageNum := getLeafNodeNextLeaf(page)
+		if nextPageNum == 0 {
+			// releasing the snapshot collects versions under
+			// exclusive latches so the leaf has to be let go first
+			prev.unlockShared()
+			prev = nil
+
+			c.endOfTable = true
+			c.Close()
+			return nil
+		}
 
+		c.pageNum = nextPageNum
+		c.cellNum = 0
+		c.scanned()
 	}
 }
 
-// TODO, this function is also used in btree.go
-// I don't like that it's used in both places/how it's structured
-// fix this
-func internalNodeFindChild(page []byte, key uint32) uint32 {
-	numKeys := getInternalNodeNumKeys(page)
-
-	low := 0
-	// There is one more child than key
-	high := int(numKeys)
-
-	for low != high {
-		mid := low + ((high - low) / 2)
-		keyToRight := getInternalNodeKey(page, uint32(mid))
+// scanned starts reading ahead of the cursor once it has moved along
+// the chain often enough and tells the read-ahead the leaf it is at
+func (c *Cursor) scanned() {
+	c.leaves++
+	if c.snapshot == nil || c.tree.pager.memoryMapped || c.leaves < readAheadTrigger {
+		return
+	}
 
-		if keyToRight >= key {
-			high = mid
-		} else {
-			low = mid + 1
-		}
+	if c.readAhead == nil {
+		c.readAhead = startReadAhead(c.tree.pager, c.snapshot.seq)
 	}
 
-	return uint32(low)
+	c.readAhead.at(c.pageNum)
 }
 
-func leafNodeFind(t *Table, pageNum, key uint32) (*Cursor, error) {
-	n, err := t.pager.GetPage(pageNum)
-	if err != nil {
-		return nil, err
-	}
+// TableStart returns a cursor at the first row of the table,
+// it should be closed if it is not read to the end
+func TableStart(t *Table) (*Cursor, error) {
+	s, release := t.reading()
+	return t.tree.start(s, release)
+}
 
-	numCells := getLeafNodeNumCells(n)
-
-	low := 0
-	high := int(numCells)
-
-	for low < high {
-		mid := low + ((high - low) / 2)
-		keyAtIdx := getLeafNodeKey(n, uint32(mid))
-
-		if key == keyAtIdx {
-			return &Cursor{
-				table:      t,
-				pageNum:    pageNum,
-				cellNum:    uint32(mid),
-				endOfTable: true,
-			}, nil
-		} else if key < keyAtIdx {
-			high = mid - 1
-		} else {
-			low = mid + 1
-		}
-	}
+// TableFind returns a cursor pointing to the given key. If the key is
+// not present it points at the next key. It should be closed if it is
+// not read to the end
+func TableFind(t *Table, key uint32) (*Cursor, error) {
+	s, release := t.reading()
+	return t.tree.seek(s, release, rowKey(key))
+}
 
-	return &Cursor{
-		table:      t,
-		pageNum:    pageNum,
-		cellNum:    uint32(low),
-		endOfTable: true,
-	}, nil
+// rowKey encodes the primary key of a row with Uint32Key
+func rowKey(id uint32) []byte {
+	key := make([]byte, Uint32Key.Size())
+	binary.BigEndian.PutUint32(key, id)
 
+	return key
 }
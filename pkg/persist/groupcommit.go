@@ -0,0 +1,220 @@
+package persist
+
+import (
+	"sync"
+	"time"
+)
+
+// groupCommit syncs the log once for many commits. With full durability
+// a commit queues its record and waits, the flusher writes every record
+// queued meanwhile and syncs the log once before it wakes their commits.
+// The flusher waits up to maxDelay for more records after the first one
+// unless maxBatch records are queued, so fewer syncs serve more commits
+// at the price of the latency of each.
+//
+// A commit's changes are visible once it queued its record, before its
+// commit returns. A commit reading them has a higher sequence number so
+// it is never synced without the commits it read. Once a write or sync
+// fails the table takes no more commits nor checkpoints, see failed, so
+// the changes of a commit which failed are never written to the file
+type groupCommit struct {
+	log      *writeAheadLog
+	maxDelay time.Duration
+	maxBatch int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// queue holds the records not written yet, lsn the number of the
+	// last record queued and synced the number of the last one synced
+	queue  []queuedRecord
+	lsn    uint64
+	synced uint64
+	syncs  int
+
+	// err fails every commit after a write or sync of the log failed,
+	// it is not known which of their records reached the file
+	err    error
+	closed bool
+	wake   chan struct{}
+	done   chan struct{}
+}
+
+type queuedRecord struct {
+	lsn  uint64
+	data []byte
+}
+
+// newGroupCommit starts the flusher of the log, the log
+// has every commit up to the sequence number synced
+func newGroupCommit(log *writeAheadLog, lsn uint64, maxDelay time.Duration, maxBatch int) *groupCommit {
+	g := &groupCommit{
+		log:      log,
+		maxDelay: maxDelay,
+		maxBatch: maxBatch,
+		lsn:      lsn,
+		synced:   lsn,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	g.cond = sync.NewCond(&g.mu)
+	go g.flusher()
+
+	return g
+}
+
+// enqueue queues the record of the commit with the sequence number
+func (g *groupCommit) enqueue(lsn uint64, record []byte) {
+	g.mu.Lock()
+	g.queue = append(g.queue, queuedRecord{lsn: lsn, data: record})
+	g.lsn = lsn
+	g.mu.Unlock()
+
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits until the log has the commit with the sequence number synced
+func (g *groupCommit) wait(lsn uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.synced < lsn && g.err == nil {
+		g.cond.Wait()
+	}
+
+	if g.synced >= lsn {
+		return nil
+	}
+
+	return g.err
+}
+
+// failed returns the error of the write or sync of the log which failed,
+// nil if none did
+func (g *groupCommit) failed() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.err
+}
+
+// flush waits until every queued record is synced
+func (g *groupCommit) flush() error {
+	g.mu.Lock()
+	lsn := g.lsn
+	g.mu.Unlock()
+
+	return g.wait(lsn)
+}
+
+// close stops the flusher once the records queued are synced
+func (g *groupCommit) close() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+
+	<-g.done
+}
+
+func (g *groupCommit) flusher() {
+	defer close(g.done)
+
+	for range g.wake {
+		g.gather()
+
+		for {
+			g.mu.Lock()
+			batch := g.queue
+			if g.maxBatch > 0 && len(batch) > g.maxBatch {
+				batch = batch[:g.maxBatch]
+			}
+
+			g.queue = g.queue[len(batch):]
+			closed := g.closed && len(g.queue) == 0
+			g.mu.Unlock()
+
+			if len(batch) > 0 {
+				g.write(batch)
+			}
+
+			if closed {
+				return
+			}
+
+			if len(batch) == 0 || g.pending() == 0 {
+				break
+			}
+		}
+	}
+}
+
+// gather waits for more records until maxDelay has passed
+// since the first one or maxBatch records are queued
+func (g *groupCommit) gather() {
+	if g.maxDelay <= 0 {
+		return
+	}
+
+	deadline := time.NewTimer(g.maxDelay)
+	defer deadline.Stop()
+
+	for g.maxBatch <= 0 || g.pending() < g.maxBatch {
+		select {
+		case <-deadline.C:
+			return
+		case <-g.wake:
+		}
+	}
+}
+
+func (g *groupCommit) pending() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.queue)
+}
+
+// write appends the records, syncs the log
+// and wakes the commits waiting for them
+func (g *groupCommit) write(batch []queuedRecord) {
+	size := 0
+	for _, record := range batch {
+		size += len(record.data)
+	}
+
+	records := make([]byte, 0, size)
+	for _, record := range batch {
+		records = append(records, record.data...)
+	}
+
+	g.mu.Lock()
+	failed := g.err != nil
+	g.mu.Unlock()
+
+	// Records after one which may be missing would be replayed without it
+	if failed {
+		return
+	}
+
+	err := g.log.append(records, true)
+
+	g.mu.Lock()
+	if err != nil {
+		g.err = err
+	} else {
+		g.synced = batch[len(batch)-1].lsn
+		g.syncs++
+	}
+
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
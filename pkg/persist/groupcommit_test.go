@@ -0,0 +1,240 @@
+package persist
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func openGroupCommit(tb testing.TB, delay time.Duration) (*Table, string) {
+	createTestDir(tb, testDirPath)
+	tb.Cleanup(cleanupTestDir(tb, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabaseWithOptions(filename, Options{
+		Durability:       DurabilityFull,
+		GroupCommitDelay: delay,
+		GroupCommitSize:  64,
+	})
+
+	if err != nil {
+		tb.Fatalf("%s", err)
+	}
+
+	return tbl, filename
+}
+
+func openGroupCommitTree(tb testing.TB, delay time.Duration) *Tree {
+	createTestDir(tb, testDirPath)
+	tb.Cleanup(cleanupTestDir(tb, testDirPath))
+
+	tree, err := OpenTree(path.Join(testDirPath, "test.tree"), TreeOptions{
+		Durability:       DurabilityFull,
+		GroupCommitDelay: delay,
+		GroupCommitSize:  64,
+	})
+
+	if err != nil {
+		tb.Fatalf("%s", err)
+	}
+
+	return tree
+}
+
+func TestGroupCommit(t *testing.T) {
+	tbl, filename := openGroupCommit(t, 5*time.Millisecond)
+
+	const writers, rows = 8, 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := w * rows; i < (w+1)*rows; i++ {
+				row, err := NewRow(uint32(i), fmt.Sprintf("user#%d", i), "person@example.com")
+				if err == nil {
+					err = tbl.Insert(row)
+				}
+
+				if err != nil {
+					t.Errorf("%s", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	group := tbl.pager.log.group
+	group.mu.Lock()
+	syncs := group.syncs
+	group.mu.Unlock()
+
+	if syncs >= writers*rows {
+		t.Fatalf("Expected commits to share syncs, %d commits synced %d times", writers*rows, syncs)
+	}
+
+	// Every commit which returned is in the log
+	crash(tbl)
+
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	if ids := checkScan(t, tbl, false); len(ids) != writers*rows {
+		t.Fatalf("Expected %d rows after the crash, got %d", writers*rows, len(ids))
+	}
+}
+
+func TestFailedSyncStopsCommits(t *testing.T) {
+	tbl, filename := openGroupCommit(t, 0)
+	insertUsers(t, tbl, 0, 10)
+
+	// Writes to a log opened read only fail like a sync would
+	log := tbl.pager.log
+	writable := log.file
+	readOnly, err := os.Open(filename + walFileSuffix)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	log.file = readOnly
+	row, _ := NewRow(10, "user#10", "person@example.com")
+	if err := tbl.Insert(row); err == nil {
+		t.Fatalf("Expected the commit to fail when the log cannot be written")
+	}
+
+	log.file = writable
+	readOnly.Close()
+
+	row, _ = NewRow(11, "user#11", "person@example.com")
+	if err := tbl.Insert(row); err == nil {
+		t.Fatalf("Expected no commit to be taken after a failed sync")
+	}
+
+	if r, err := tbl.Lookup(11); err != nil || r != nil {
+		t.Fatalf("Expected the refused commit not to be visible: %v %v", r, err)
+	}
+
+	if err := tbl.Close(); err == nil {
+		t.Fatalf("Expected the checkpoint to be refused after a failed sync")
+	}
+
+	tbl, err = OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	if ids := checkScan(t, tbl, false); len(ids) != 10 {
+		t.Fatalf("Expected only the 10 rows synced, got %d", len(ids))
+	}
+}
+
+func TestGroupCommitTree(t *testing.T) {
+	tree := openGroupCommitTree(t, 5*time.Millisecond)
+	defer tree.Close()
+
+	const writers, keys = 8, 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := w * keys; i < (w+1)*keys; i++ {
+				if err := tree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+					t.Errorf("%s", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	group := tree.pager.log.group
+	group.mu.Lock()
+	syncs := group.syncs
+	group.mu.Unlock()
+
+	if syncs >= writers*keys {
+		t.Fatalf("Expected puts to share syncs, %d puts synced %d times", writers*keys, syncs)
+	}
+}
+
+// BenchmarkGroupCommit measures single row inserts into a table and
+// single puts into a tree, each its own commit synced with full
+// durability, as the number of writers grows
+func BenchmarkGroupCommit(b *testing.B) {
+	for _, writers := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("table/writers=%d", writers), func(b *testing.B) {
+			tbl, _ := openGroupCommit(b, 0)
+			defer tbl.Close()
+
+			benchmarkWriters(b, writers, func(i int64) error {
+				row, err := NewRow(uint32(i), fmt.Sprintf("user#%d", i), "person@example.com")
+				if err != nil {
+					return err
+				}
+
+				return tbl.Insert(row)
+			})
+		})
+
+		b.Run(fmt.Sprintf("tree/writers=%d", writers), func(b *testing.B) {
+			tree := openGroupCommitTree(b, 0)
+			defer tree.Close()
+
+			benchmarkWriters(b, writers, func(i int64) error {
+				return tree.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+			})
+		})
+	}
+}
+
+// benchmarkWriters calls write b.N times from the number of writers
+// and reports the number of writes a second
+func benchmarkWriters(b *testing.B, writers int, write func(i int64) error) {
+	var next int64 = -1
+	var wg sync.WaitGroup
+
+	b.ResetTimer()
+	start := time.Now()
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(b.N) {
+					return
+				}
+
+				if err := write(i); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "commits/s")
+}
@@ -0,0 +1,358 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Index catalog layout, the catalog is stored in the database header
+// after the format version. Each entry describes one secondary index
+const (
+	catalogNumIndexesSize   uint32 = 4
+	catalogNumIndexesOffset uint32 = headerCatalogOffset
+	catalogEntriesOffset    uint32 = catalogNumIndexesOffset + catalogNumIndexesSize
+	indexNameSize           uint32 = 32
+	indexNameOffset         uint32 = 0
+	indexColumnSize         uint32 = 16
+	indexColumnOffset       uint32 = indexNameOffset + indexNameSize
+	indexUniqueSize         uint32 = 1
+	indexUniqueOffset       uint32 = indexColumnOffset + indexColumnSize
+	indexRootSize           uint32 = 4
+	indexRootOffset         uint32 = indexUniqueOffset + indexUniqueSize
+	catalogEntrySize        uint32 = indexNameSize + indexColumnSize + indexUniqueSize + indexRootSize
+)
+
+// catalogMaxIndexes is the number of indexes the catalog fits
+// in a header of the page size before the extension fields
+func catalogMaxIndexes(pageSize uint32) uint32 {
+	return (pageSize - headerCatalogOffset - catalogNumIndexesSize - headerExtensionSize) / catalogEntrySize
+}
+
+// indexedColumns are the columns which can be indexed and
+// their width. The id column is already the primary key
+var indexedColumns = map[string]uint32{
+	"username": usernameSize,
+	"email":    emailSize,
+}
+
+// Index is a secondary index over one of the text columns. It is a
+// separate tree keyed by the column value followed by the id of the
+// row, so equal column values are still unique keys and are ordered
+// by id. The entries have no value, the row is looked up by id
+type Index struct {
+	name   string
+	column string
+	unique bool
+	tree   *btree
+}
+
+func newIndexTree(pager *pager, column string, rootPageNum uint32) *btree {
+	return &btree{
+		pager:       pager,
+		rootPageNum: rootPageNum,
+		key:         CompositeKey(BytesKey(indexedColumns[column]), Uint32Key),
+		valueSize:   0,
+	}
+}
+
+func (idx *Index) Name() string {
+	return idx.name
+}
+
+func (idx *Index) Column() string {
+	return idx.column
+}
+
+func (idx *Index) Unique() bool {
+	return idx.unique
+}
+
+func (idx *Index) key(value string, id uint32) ([]byte, error) {
+	return encodeKey(idx.tree.key, []interface{}{value, id})
+}
+
+// boundKey encodes the key used to start or stop a range scan, values
+// longer than the column are truncated which keeps the range a superset
+// of the matching values
+func (idx *Index) boundKey(value string, id uint32) ([]byte, error) {
+	if size := indexedColumns[idx.column]; uint32(len(value)) > size {
+		value = value[:size]
+	}
+
+	return idx.key(value, id)
+}
+
+func (idx *Index) decodeKey(key []byte) (string, uint32, error) {
+	v, err := idx.tree.key.Decode(key)
+	if err != nil {
+		return "", 0, err
+	}
+
+	values := v.([]interface{})
+	return string(values[0].([]byte)), values[1].(uint32), nil
+}
+
+func (idx *Index) insert(r *Row) error {
+	key, err := idx.key(columnValue(r, idx.column), r.id)
+	if err != nil {
+		return err
+	}
+
+	return idx.tree.insert(key, nil)
+}
+
+func (idx *Index) delete(r *Row) error {
+	key, err := idx.key(columnValue(r, idx.column), r.id)
+	if err != nil {
+		return err
+	}
+
+	_, err = idx.tree.delete(key)
+	return err
+}
+
+// checkUnique returns an error if a unique index already holds
+// the row's column value for a row with a different id
+func (idx *Index) checkUnique(r *Row) error {
+	if !idx.unique {
+		return nil
+	}
+
+	value := columnValue(r, idx.column)
+	key, err := idx.key(value, 0)
+	if err != nil {
+		return err
+	}
+
+	c, err := idx.tree.seek(nil, nil, key)
+	if err != nil {
+		return err
+	}
+
+	if c.endOfTable {
+		return nil
+	}
+
+	found, err := c.Key()
+	if err != nil {
+		return err
+	}
+
+	foundValue, foundId, err := idx.decodeKey(found)
+	if err != nil {
+		return err
+	}
+
+	if foundValue == value && foundId != r.id {
+		return fmt.Errorf("duplicate value '%s' for unique index '%s'", value, idx.name)
+	}
+
+	return nil
+}
+
+// open positions a cursor at the start of the range of the index
+// selected by the predicates on the indexed column. Every row is
+// checked against all predicates as the range is only a bound
+func (idx *Index) open(t *Table, predicates []Predicate) (*RowCursor, error) {
+	lower, upper := columnBounds(idx.column, predicates)
+
+	var lowerKey, upperKey []byte
+	var err error
+
+	if lower != nil {
+		lowerKey, err = idx.boundKey(*lower, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if upper != nil {
+		upperKey, err = idx.boundKey(*upper, math.MaxUint32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s, release := t.reading()
+	c, err := idx.tree.seek(s, release, lowerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RowCursor{table: t, cursor: c, bounds: predicates, index: idx, upperKey: upperKey}, nil
+}
+
+// read looks up the row of the index entry under the cursor,
+// nil when the entry is past the upper key
+func (idx *Index) read(t *Table, c *Cursor, upperKey []byte) (*Row, error) {
+	key, err := c.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	if upperKey != nil && bytes.Compare(key, upperKey) > 0 {
+		return nil, nil
+	}
+
+	_, id, err := idx.decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := t.getAt(c.snapshot, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if r == nil {
+		return nil, fmt.Errorf("index '%s' refers to missing row '%d'", idx.name, id)
+	}
+
+	return r, nil
+}
+
+func (c catalog) indexOn(column string) (*Index, bool) {
+	for _, idx := range c.indexes {
+		if idx.column == column {
+			return idx, true
+		}
+	}
+
+	return nil, false
+}
+
+func (t *Table) Indexes() []*Index {
+	return t.visibleCatalog().indexes
+}
+
+// CreateIndex builds a new index over the column from the
+// existing rows and records it in the catalog
+func (t *Table) CreateIndex(name, column string, unique bool) error {
+	return t.apply(nil, func(w *Table) error {
+		return w.createIndex(name, column, unique)
+	})
+}
+
+func (t *Table) createIndex(name, column string, unique bool) error {
+	if _, ok := indexedColumns[column]; !ok {
+		return fmt.Errorf("column '%s' cannot be indexed", column)
+	}
+
+	if len(name) == 0 || uint32(len(name)) > indexNameSize || !isAscii(name) {
+		return fmt.Errorf("invalid index name '%s'. index names must use ascii characters only and have a maximum of %d characters",
+			name,
+			indexNameSize)
+	}
+
+	for _, idx := range t.indexes {
+		if idx.name == name {
+			return fmt.Errorf("index '%s' already exists", name)
+		}
+	}
+
+	if max := catalogMaxIndexes(t.pager.pageSize); uint32(len(t.indexes)) >= max {
+		return fmt.Errorf("too many indexes, the maximum is %d", max)
+	}
+
+	var rows []*Row
+	seen := map[string]bool{}
+
+	err := t.Scan(nil, func(r *Row) error {
+		value := columnValue(r, column)
+		if unique && seen[value] {
+			return fmt.Errorf("cannot create unique index '%s', duplicate value '%s'", name, value)
+		}
+
+		seen[value] = true
+		rows = append(rows, r)
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	rootPageNum := t.pager.GetUnusedPageNum()
+	root, err := t.pager.getPageForWrite(rootPageNum)
+	if err != nil {
+		return err
+	}
+
+	initializeLeafNode(root)
+	setNodeRoot(root, true)
+
+	idx := &Index{
+		name:   name,
+		column: column,
+		unique: unique,
+		tree:   newIndexTree(t.pager, column, rootPageNum),
+	}
+
+	for _, r := range rows {
+		if err := idx.insert(r); err != nil {
+			return err
+		}
+	}
+
+	t.indexes = append(append([]*Index{}, t.indexes...), idx)
+	writeCatalog(t.pager, t.indexes)
+
+	return nil
+}
+
+func readCatalog(p *pager) ([]*Index, error) {
+	numIndexes := binary.LittleEndian.Uint32(
+		p.header[catalogNumIndexesOffset : catalogNumIndexesOffset+catalogNumIndexesSize])
+
+	if numIndexes > catalogMaxIndexes(p.pageSize) {
+		return nil, fmt.Errorf("index catalog holds %d indexes, the header may have been corrupted", numIndexes)
+	}
+
+	indexes := make([]*Index, 0, numIndexes)
+	for i := uint32(0); i < numIndexes; i++ {
+		offset := catalogEntriesOffset + i*catalogEntrySize
+		entry := p.header[offset : offset+catalogEntrySize]
+
+		column := string(bytes.TrimRight(entry[indexColumnOffset:indexColumnOffset+indexColumnSize], "\x00"))
+		if _, ok := indexedColumns[column]; !ok {
+			return nil, fmt.Errorf("index catalog refers to unknown column '%s'", column)
+		}
+
+		rootPageNum := binary.LittleEndian.Uint32(entry[indexRootOffset : indexRootOffset+indexRootSize])
+
+		indexes = append(indexes, &Index{
+			name:   string(bytes.TrimRight(entry[indexNameOffset:indexNameOffset+indexNameSize], "\x00")),
+			column: column,
+			unique: entry[indexUniqueOffset] == 1,
+			tree:   newIndexTree(p, column, rootPageNum),
+		})
+	}
+
+	return indexes, nil
+}
+
+func writeCatalog(p *pager, indexes []*Index) {
+	binary.LittleEndian.PutUint32(
+		p.header[catalogNumIndexesOffset:catalogNumIndexesOffset+catalogNumIndexesSize],
+		uint32(len(indexes)))
+
+	for i, idx := range indexes {
+		offset := catalogEntriesOffset + uint32(i)*catalogEntrySize
+		entry := p.header[offset : offset+catalogEntrySize]
+
+		for j := range entry {
+			entry[j] = 0
+		}
+
+		copy(entry[indexNameOffset:indexNameOffset+indexNameSize], idx.name)
+		copy(entry[indexColumnOffset:indexColumnOffset+indexColumnSize], idx.column)
+		if idx.unique {
+			entry[indexUniqueOffset] = 1
+		}
+
+		binary.LittleEndian.PutUint32(entry[indexRootOffset:indexRootOffset+indexRootSize], idx.tree.rootPageNum)
+	}
+}
@@ -0,0 +1,175 @@
+package persist
+
+import (
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestIndexLookup(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 250)
+
+	if err := tbl.CreateIndex("idx_email", "email", true); err != nil {
+		t.Fatalf("Unable to create index: '%s'", err)
+	}
+
+	insertUsers(t, tbl, 250, 500)
+
+	rows := selectIds(t, tbl, Predicate{Column: "email", Op: Equal, Value: "person#321@example.com"})
+	if fmt.Sprint(rows) != "[321]" {
+		t.Fatalf("Unexpected rows for equality lookup: %v", rows)
+	}
+
+	rows = selectIds(t, tbl,
+		Predicate{Column: "email", Op: GreaterOrEqual, Value: "person#40"},
+		Predicate{Column: "email", Op: Less, Value: "person#41"})
+	if len(rows) != 11 {
+		t.Fatalf("Expected 11 rows for range lookup, got %v", rows)
+	}
+}
+
+func TestUniqueIndexRejectsDuplicates(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 10)
+
+	if err := tbl.CreateIndex("idx_email", "email", true); err != nil {
+		t.Fatalf("Unable to create index: '%s'", err)
+	}
+
+	row, err := NewRow(100, "someone", "person#3@example.com")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tbl.Insert(row); err == nil {
+		t.Fatalf("Expected duplicate email to be rejected")
+	}
+
+	if r, _ := tbl.get(100); r != nil {
+		t.Fatalf("Rejected row was inserted: %v", r)
+	}
+
+	row, err = NewRow(3, "user#3", "person#3@example.com")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tbl.Update(row); err != nil {
+		t.Fatalf("Updating a row to its own value failed: '%s'", err)
+	}
+
+	row, err = NewRow(0, "user#0", "person#0@example.com")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tbl.CreateIndex("idx_username", "username", true); err != nil {
+		t.Fatalf("Unable to create index: '%s'", err)
+	}
+
+	if err := tbl.Insert(row); err == nil {
+		t.Fatalf("Expected duplicate id to be rejected")
+	}
+}
+
+func TestIndexMaintainedOnUpdateAndDelete(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	dbPath := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tbl.CreateIndex("idx_username", "username", false); err != nil {
+		t.Fatalf("Unable to create index: '%s'", err)
+	}
+
+	insertUsers(t, tbl, 0, 100)
+
+	row, err := NewRow(7, "renamed", "person#7@example.com")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tbl.Update(row); err != nil {
+		t.Fatalf("Unable to update row: '%s'", err)
+	}
+
+	if err := tbl.Delete(8); err != nil {
+		t.Fatalf("Unable to delete row: '%s'", err)
+	}
+
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl, err = OpenDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(tbl.Indexes()) != 1 {
+		t.Fatalf("Expected the index to be reloaded from the catalog")
+	}
+
+	if rows := selectIds(t, tbl, Predicate{Column: "username", Op: Equal, Value: "user#7"}); len(rows) != 0 {
+		t.Fatalf("Old value still indexed: %v", rows)
+	}
+
+	if rows := selectIds(t, tbl, Predicate{Column: "username", Op: Equal, Value: "renamed"}); fmt.Sprint(rows) != "[7]" {
+		t.Fatalf("New value not indexed: %v", rows)
+	}
+
+	if rows := selectIds(t, tbl, Predicate{Column: "username", Op: Equal, Value: "user#8"}); len(rows) != 0 {
+		t.Fatalf("Deleted row still indexed: %v", rows)
+	}
+
+	if rows := selectIds(t, tbl); len(rows) != 99 {
+		t.Fatalf("Expected 99 rows after delete, got %d", len(rows))
+	}
+}
+
+func insertUsers(t *testing.T, tbl *Table, from, to int) {
+	for i := from; i < to; i++ {
+		row, err := NewRow(uint32(i), fmt.Sprintf("user#%d", i), fmt.Sprintf("person#%d@example.com", i))
+		if err != nil {
+			t.Fatalf("Unable to create row: '%s'", err)
+		}
+
+		if err := tbl.Insert(row); err != nil {
+			t.Fatalf("Unable to insert row: '%s'", err)
+		}
+	}
+}
+
+func selectIds(t *testing.T, tbl *Table, predicates ...Predicate) []uint32 {
+	var ids []uint32
+
+	err := tbl.Scan(predicates, func(r *Row) error {
+		ids = append(ids, r.id)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Unable to select rows: '%s'", err)
+	}
+
+	return ids
+}
@@ -0,0 +1,215 @@
+package persist
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// KeyEncoding converts the keys of a tree to fixed width byte strings.
+// The tree only ever compares encoded keys with bytes.Compare so an
+// encoding has to sort the bytes in the same order as the values
+type KeyEncoding interface {
+	// Size is the width of every encoded key in bytes
+	Size() uint32
+
+	// Encode writes the value to dst, which is Size bytes long
+	Encode(dst []byte, value interface{}) error
+
+	Decode(src []byte) (interface{}, error)
+}
+
+var errKeyTooLong = errors.New("key is too long for the key encoding")
+
+// Uint32Key encodes uint32 values as big endian bytes
+var Uint32Key KeyEncoding = uint32Key{}
+
+// Int64Key encodes int64 values as big endian bytes with the sign bit
+// flipped, so negative values sort before positive values
+var Int64Key KeyEncoding = int64Key{}
+
+type uint32Key struct{}
+
+func (uint32Key) Size() uint32 {
+	return 4
+}
+
+func (uint32Key) Encode(dst []byte, value interface{}) error {
+	n, ok := value.(uint32)
+	if !ok {
+		return fmt.Errorf("expected a uint32 key but got %T", value)
+	}
+
+	binary.BigEndian.PutUint32(dst, n)
+	return nil
+}
+
+func (uint32Key) Decode(src []byte) (interface{}, error) {
+	return binary.BigEndian.Uint32(src), nil
+}
+
+type int64Key struct{}
+
+func (int64Key) Size() uint32 {
+	return 8
+}
+
+func (int64Key) Encode(dst []byte, value interface{}) error {
+	n, ok := value.(int64)
+	if !ok {
+		return fmt.Errorf("expected an int64 key but got %T", value)
+	}
+
+	binary.BigEndian.PutUint64(dst, uint64(n)^(1<<63))
+	return nil
+}
+
+func (int64Key) Decode(src []byte) (interface{}, error) {
+	return int64(binary.BigEndian.Uint64(src) ^ (1 << 63)), nil
+}
+
+// BytesKey encodes byte strings of at most maxLen bytes, both []byte
+// and string values are accepted and values are decoded as []byte.
+//
+// Zero bytes are escaped as 0x00 0xFF and the value is terminated by
+// 0x00 0x01, the rest of the key is padded with zeros. The terminator
+// sorts before any byte of a longer value so a prefix sorts first, which
+// also keeps the order when the key is followed by another key in a
+// composite key
+func BytesKey(maxLen uint32) KeyEncoding {
+	return bytesKey{maxLen: maxLen}
+}
+
+type bytesKey struct {
+	maxLen uint32
+}
+
+func (k bytesKey) Size() uint32 {
+	// Every byte may need to be escaped
+	return 2*k.maxLen + 2
+}
+
+func (k bytesKey) Encode(dst []byte, value interface{}) error {
+	var b []byte
+
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("expected a []byte or string key but got %T", value)
+	}
+
+	if uint32(len(b)) > k.maxLen {
+		return errKeyTooLong
+	}
+
+	i := 0
+	for _, c := range b {
+		if c == 0x00 {
+			dst[i] = 0x00
+			dst[i+1] = 0xFF
+			i += 2
+		} else {
+			dst[i] = c
+			i++
+		}
+	}
+
+	dst[i] = 0x00
+	dst[i+1] = 0x01
+
+	for i += 2; i < len(dst); i++ {
+		dst[i] = 0
+	}
+
+	return nil
+}
+
+func (k bytesKey) Decode(src []byte) (interface{}, error) {
+	b := []byte{}
+
+	for i := 0; i+1 < len(src); i++ {
+		if src[i] != 0x00 {
+			b = append(b, src[i])
+			continue
+		}
+
+		switch src[i+1] {
+		case 0x01:
+			return b, nil
+		case 0xFF:
+			b = append(b, 0x00)
+			i++
+		default:
+			return nil, errors.New("invalid escape sequence in byte string key")
+		}
+	}
+
+	return nil, errors.New("byte string key is not terminated")
+}
+
+// CompositeKey encodes a []interface{} with one value for each of the
+// parts. Keys are ordered by the first part, then the second and so on
+func CompositeKey(parts ...KeyEncoding) KeyEncoding {
+	return compositeKey{parts: parts}
+}
+
+type compositeKey struct {
+	parts []KeyEncoding
+}
+
+func (k compositeKey) Size() uint32 {
+	size := uint32(0)
+	for _, part := range k.parts {
+		size += part.Size()
+	}
+
+	return size
+}
+
+func (k compositeKey) Encode(dst []byte, value interface{}) error {
+	values, ok := value.([]interface{})
+	if !ok || len(values) != len(k.parts) {
+		return fmt.Errorf("expected %d key values but got %v", len(k.parts), value)
+	}
+
+	offset := uint32(0)
+	for i, part := range k.parts {
+		if err := part.Encode(dst[offset:offset+part.Size()], values[i]); err != nil {
+			return err
+		}
+
+		offset += part.Size()
+	}
+
+	return nil
+}
+
+func (k compositeKey) Decode(src []byte) (interface{}, error) {
+	values := make([]interface{}, len(k.parts))
+
+	offset := uint32(0)
+	for i, part := range k.parts {
+		v, err := part.Decode(src[offset : offset+part.Size()])
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = v
+		offset += part.Size()
+	}
+
+	return values, nil
+}
+
+// encodeKey returns a new key holding the encoded value
+func encodeKey(encoding KeyEncoding, value interface{}) ([]byte, error) {
+	key := make([]byte, encoding.Size())
+	if err := encoding.Encode(key, value); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
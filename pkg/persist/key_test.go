@@ -0,0 +1,89 @@
+package persist
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestKeyEncodingsPreserveOrder(t *testing.T) {
+	cases := []struct {
+		name     string
+		encoding KeyEncoding
+		values   []interface{}
+	}{
+		{
+			name:     "uint32",
+			encoding: Uint32Key,
+			values:   []interface{}{uint32(0), uint32(1), uint32(255), uint32(256), uint32(math.MaxUint32)},
+		},
+		{
+			name:     "int64",
+			encoding: Int64Key,
+			values:   []interface{}{int64(math.MinInt64), int64(-256), int64(-1), int64(0), int64(1), int64(math.MaxInt64)},
+		},
+		{
+			name:     "bytes",
+			encoding: BytesKey(4),
+			values: []interface{}{
+				[]byte{},
+				[]byte{0x00},
+				[]byte{0x00, 0x00},
+				[]byte{0x00, 0x01},
+				[]byte("a"),
+				[]byte("a\x00"),
+				[]byte("a\x00b"),
+				[]byte("ab"),
+				[]byte{0xFF, 0xFF, 0xFF, 0xFF},
+			},
+		},
+		{
+			name:     "composite",
+			encoding: CompositeKey(BytesKey(3), Int64Key),
+			values: []interface{}{
+				[]interface{}{[]byte("a"), int64(5)},
+				[]interface{}{[]byte("a\x00"), int64(-5)},
+				[]interface{}{[]byte("ab"), int64(-5)},
+				[]interface{}{[]byte("ab"), int64(0)},
+				[]interface{}{[]byte("b"), int64(-10)},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		var previous []byte
+
+		for _, v := range tc.values {
+			key, err := encodeKey(tc.encoding, v)
+			if err != nil {
+				t.Fatalf("%s: unable to encode %v: '%s'", tc.name, v, err)
+			}
+
+			if previous != nil && bytes.Compare(previous, key) >= 0 {
+				t.Fatalf("%s: %v does not sort after the previous value", tc.name, v)
+			}
+
+			decoded, err := tc.encoding.Decode(key)
+			if err != nil {
+				t.Fatalf("%s: unable to decode %v: '%s'", tc.name, v, err)
+			}
+
+			if !reflect.DeepEqual(decoded, v) {
+				t.Fatalf("%s: decoded %v but encoded %v", tc.name, decoded, v)
+			}
+
+			previous = key
+		}
+	}
+}
+
+func TestBytesKeyRejectsLongValues(t *testing.T) {
+	if _, err := encodeKey(BytesKey(3), "abcd"); err == nil {
+		t.Fatalf("Expected a value longer than the key to be rejected")
+	}
+
+	if _, err := encodeKey(Uint32Key, "abcd"); err == nil {
+		t.Fatalf("Expected a value of the wrong type to be rejected")
+	}
+}
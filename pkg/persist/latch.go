@@ -0,0 +1,73 @@
+package persist
+
+import "sync"
+
+// pageLatch guards the versions of a page. Readers latch it shared while
+// they find the version of their snapshot and the writer exclusively
+// while it adds a version, a page is read from the file and old versions
+// are collected under it exclusively too.
+//
+// Readers go first: a reader only waits while the latch is held
+// exclusively, never for a waiting writer. Nobody waits for a latch
+// while holding another one exclusively, so descents which latch the
+// pages of different snapshots in different orders cannot deadlock, see
+// btree. The pager's mu may be taken with a latch held but is never held
+// while waiting for one
+type pageLatch struct {
+	mu        sync.Mutex
+	free      *sync.Cond
+	readers   int
+	exclusive bool
+
+	// newest is the newest committed version of the page,
+	// nil until the page is read from the file
+	newest *pageVersion
+}
+
+func newPageLatch() *pageLatch {
+	l := &pageLatch{}
+	l.free = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *pageLatch) lockShared() {
+	l.mu.Lock()
+	for l.exclusive {
+		l.free.Wait()
+	}
+
+	l.readers++
+	l.mu.Unlock()
+}
+
+// unlockShared releases a shared latch, a nil latch is not held
+func (l *pageLatch) unlockShared() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	l.readers--
+	if l.readers == 0 {
+		l.free.Broadcast()
+	}
+
+	l.mu.Unlock()
+}
+
+func (l *pageLatch) lock() {
+	l.mu.Lock()
+	for l.exclusive || l.readers > 0 {
+		l.free.Wait()
+	}
+
+	l.exclusive = true
+	l.mu.Unlock()
+}
+
+func (l *pageLatch) unlock() {
+	l.mu.Lock()
+	l.exclusive = false
+	l.free.Broadcast()
+	l.mu.Unlock()
+}
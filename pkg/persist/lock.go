@@ -0,0 +1,33 @@
+package persist
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var ErrDatabaseLocked = errors.New("database is locked by another process")
+
+// lockRetryInterval is how long to wait before trying to lock a busy file again
+const lockRetryInterval = 10 * time.Millisecond
+
+// lockFile locks the file for as long as it is open so two processes
+// never change it at once. A read only file is locked shared, any number
+// of processes may read it as long as none writes it. A busy file is
+// tried again until the busy timeout has passed
+func lockFile(file *os.File, options Options) error {
+	deadline := time.Now().Add(options.BusyTimeout)
+
+	for {
+		ok, err := tryLock(file, !options.ReadOnly)
+		if err != nil || ok {
+			return err
+		}
+
+		if !time.Now().Before(deadline) {
+			return ErrDatabaseLocked
+		}
+
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -0,0 +1,60 @@
+package persist
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDatabaseLocked(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 10)
+
+	if _, err := OpenDatabase(filename); err != ErrDatabaseLocked {
+		t.Fatalf("Expected a second writer to be locked out, got %v", err)
+	}
+
+	if _, err := OpenDatabaseWithOptions(filename, Options{ReadOnly: true}); err != ErrDatabaseLocked {
+		t.Fatalf("Expected a reader to be locked out by the writer, got %v", err)
+	}
+
+	// A busy open waits for the writer to close the file
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tbl.Close()
+	}()
+
+	reader, err := OpenDatabaseWithOptions(filename, Options{ReadOnly: true, BusyTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer reader.Close()
+
+	other, err := OpenDatabaseWithOptions(filename, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Expected readers to share the file, got %v", err)
+	}
+
+	defer other.Close()
+
+	if ids := checkScan(t, other, false); len(ids) != 10 {
+		t.Fatalf("Expected 10 rows, got %d", len(ids))
+	}
+
+	if err := reader.Insert(&Row{id: 10}); err != ErrReadOnly {
+		t.Fatalf("Expected a read only database to reject changes, got %v", err)
+	}
+
+	if _, err := OpenDatabaseWithOptions(filename, Options{BusyTimeout: 20 * time.Millisecond}); err != ErrDatabaseLocked {
+		t.Fatalf("Expected a writer to be locked out by the readers, got %v", err)
+	}
+}
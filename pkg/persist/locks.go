@@ -0,0 +1,155 @@
+package persist
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrDeadlock = errors.New("deadlock detected, the transaction was rolled back and may be retried")
+var ErrWriteConflict = errors.New("row was changed by a concurrent transaction, the transaction was rolled back and may be retried")
+
+// IsRetryable reports whether the error rolled back a transaction which
+// may succeed if it is run again
+func IsRetryable(err error) bool {
+	return err == ErrDeadlock || err == ErrWriteConflict
+}
+
+type lockMode int
+
+const (
+	sharedLock lockMode = iota
+	exclusiveLock
+)
+
+// lockKey names a row of a table
+type lockKey struct {
+	table string
+	id    uint32
+}
+
+// userLock returns the key of the row of the users table with the id
+func userLock(id uint32) lockKey {
+	return lockKey{table: "users", id: id}
+}
+
+// lockRequest is the lock a transaction waits for
+type lockRequest struct {
+	key  lockKey
+	mode lockMode
+}
+
+// lockManager holds the row locks of the transactions. Any number of
+// transactions may hold a shared lock on a row, an exclusive lock is only
+// held by one. Locks are held until the transaction ends.
+//
+// A transaction which has to wait for a lock waits for the transactions
+// holding it, together the waits form the wait-for graph. A wait which
+// would close a cycle in the graph is a deadlock, it is refused and the
+// transaction which asked for it is rolled back so the others can go on
+type lockManager struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	held    map[lockKey]map[*Tx]lockMode
+	owned   map[*Tx][]lockKey
+	waiting map[*Tx]lockRequest
+}
+
+func newLockManager() *lockManager {
+	lm := &lockManager{
+		held:    map[lockKey]map[*Tx]lockMode{},
+		owned:   map[*Tx][]lockKey{},
+		waiting: map[*Tx]lockRequest{},
+	}
+
+	lm.cond = sync.NewCond(&lm.mu)
+	return lm
+}
+
+// lock waits until the transaction holds the lock in at least the given
+// mode, a shared lock is upgraded. It returns true if the transaction did
+// not hold the lock in the mode before
+func (lm *lockManager) lock(tx *Tx, key lockKey, mode lockMode) (bool, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for {
+		current, holds := lm.held[key][tx]
+		if holds && current >= mode {
+			return false, nil
+		}
+
+		if lm.compatible(tx, key, mode) {
+			if lm.held[key] == nil {
+				lm.held[key] = map[*Tx]lockMode{}
+			}
+
+			if !holds {
+				lm.owned[tx] = append(lm.owned[tx], key)
+			}
+
+			lm.held[key][tx] = mode
+			return true, nil
+		}
+
+		lm.waiting[tx] = lockRequest{key: key, mode: mode}
+		if lm.waitsFor(tx, tx, map[*Tx]bool{}) {
+			delete(lm.waiting, tx)
+			return false, ErrDeadlock
+		}
+
+		lm.cond.Wait()
+		delete(lm.waiting, tx)
+	}
+}
+
+// compatible reports whether the transaction can hold the
+// lock in the mode alongside the transactions holding it
+func (lm *lockManager) compatible(tx *Tx, key lockKey, mode lockMode) bool {
+	for holder, held := range lm.held[key] {
+		if holder != tx && (mode == exclusiveLock || held == exclusiveLock) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// waitsFor reports whether from waits, directly or through other
+// waiting transactions, for a transaction holding a lock target waits for
+func (lm *lockManager) waitsFor(from, target *Tx, visited map[*Tx]bool) bool {
+	request, ok := lm.waiting[from]
+	if !ok || visited[from] {
+		return false
+	}
+
+	visited[from] = true
+
+	for holder, held := range lm.held[request.key] {
+		if holder == from || (request.mode == sharedLock && held == sharedLock) {
+			continue
+		}
+
+		if holder == target || lm.waitsFor(holder, target, visited) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// releaseAll releases every lock of the transaction
+// and wakes the transactions waiting for them
+func (lm *lockManager) releaseAll(tx *Tx) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for _, key := range lm.owned[tx] {
+		delete(lm.held[key], tx)
+		if len(lm.held[key]) == 0 {
+			delete(lm.held, key)
+		}
+	}
+
+	delete(lm.owned, tx)
+	lm.cond.Broadcast()
+}
@@ -0,0 +1,192 @@
+package persist
+
+import (
+	"fmt"
+	"path"
+	"testing"
+	"time"
+)
+
+func openTestDatabase(t *testing.T) *Table {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	t.Cleanup(func() { tbl.Close() })
+	return tbl
+}
+
+func begin(t *testing.T, tbl *Table) *Tx {
+	tx, err := tbl.Begin()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return tx
+}
+
+func updateUser(tbl *Table, id uint32, email string) error {
+	row, err := NewRow(id, fmt.Sprintf("user#%d", id), email)
+	if err != nil {
+		return err
+	}
+
+	return tbl.Update(row)
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+	tbl := openTestDatabase(t)
+	insertUsers(t, tbl, 0, 20)
+
+	first, second := begin(t, tbl), begin(t, tbl)
+
+	// Enough rows to split leaves in both transactions
+	insertUsers(t, first.Table(), 100, 300)
+	insertUsers(t, second.Table(), 300, 500)
+
+	if err := updateUser(second.Table(), 1, "second@example.com"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ids := checkScan(t, first.Table(), false); len(ids) != 220 {
+		t.Fatalf("Expected the first transaction to see 220 rows, got %d", len(ids))
+	}
+
+	if err := first.Commit(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// The second transaction began before the first committed
+	if err := second.Commit(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ids := checkScan(t, tbl, false); len(ids) != 420 {
+		t.Fatalf("Expected the rows of both transactions, got %d", len(ids))
+	}
+
+	if r, err := tbl.Lookup(1); err != nil || r.email != "second@example.com" {
+		t.Fatalf("Expected the update of the second transaction, got %v %v", r, err)
+	}
+}
+
+func TestDeadlockDetected(t *testing.T) {
+	tbl := openTestDatabase(t)
+	insertUsers(t, tbl, 0, 20)
+
+	first, second := begin(t, tbl), begin(t, tbl)
+
+	if err := updateUser(first.Table(), 1, "first@example.com"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := updateUser(second.Table(), 2, "second@example.com"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- updateUser(first.Table(), 2, "first@example.com")
+	}()
+
+	// Wait until the first transaction waits for the second
+	for {
+		tbl.locks.mu.Lock()
+		_, waiting := tbl.locks.waiting[first]
+		tbl.locks.mu.Unlock()
+
+		if waiting {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	err := updateUser(second.Table(), 1, "second@example.com")
+	if err != ErrDeadlock || !IsRetryable(err) {
+		t.Fatalf("Expected a deadlock, got %v", err)
+	}
+
+	if err := second.Rollback(); err != ErrTxDone {
+		t.Fatalf("Expected the deadlocked transaction to be rolled back, got %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := first.Commit(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if r, err := tbl.Lookup(2); err != nil || r.email != "first@example.com" {
+		t.Fatalf("Expected the update of the first transaction, got %v %v", r, err)
+	}
+}
+
+func TestWriteConflict(t *testing.T) {
+	tbl := openTestDatabase(t)
+	insertUsers(t, tbl, 0, 20)
+
+	tx := begin(t, tbl)
+
+	if err := updateUser(tbl, 1, "committed@example.com"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Rows nobody changed are still fine
+	if err := updateUser(tx.Table(), 2, "tx@example.com"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err := updateUser(tx.Table(), 1, "tx@example.com")
+	if err != ErrWriteConflict || !IsRetryable(err) {
+		t.Fatalf("Expected a write conflict, got %v", err)
+	}
+
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("Expected the transaction to be rolled back, got %v", err)
+	}
+
+	if r, err := tbl.Lookup(2); err != nil || r.email == "tx@example.com" {
+		t.Fatalf("Expected the changes of the transaction to be dropped, got %v %v", r, err)
+	}
+}
+
+func TestLookupLocksShared(t *testing.T) {
+	tbl := openTestDatabase(t)
+	insertUsers(t, tbl, 0, 20)
+
+	reader, writer := begin(t, tbl), begin(t, tbl)
+
+	if _, err := reader.Table().Lookup(1); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- updateUser(writer.Table(), 1, "writer@example.com")
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the writer to wait for the shared lock, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := reader.Commit(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := writer.Commit(); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
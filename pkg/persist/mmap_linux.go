@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package persist
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps the first size bytes of the file read only, the
+// mapping follows the writes to the file. It may reach past the
+// end of the file, the pages past it must not be read
+func mmap(file *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(mapping []byte) error {
+	return syscall.Munmap(mapping)
+}
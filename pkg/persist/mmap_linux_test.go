@@ -0,0 +1,172 @@
+//go:build linux
+// +build linux
+
+package persist
+
+import (
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestMemoryMap(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	options := Options{MemoryMap: true, PageSize: MinPageSize}
+
+	tbl, err := OpenDatabaseWithOptions(filename, options)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 3000)
+
+	// The file grows past the first mapping
+	if err := tbl.pager.checkpoint(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(tbl.pager.mappings) < 2 {
+		t.Fatalf("Expected the file to be mapped again after growing to %d bytes", tbl.pager.fileLength)
+	}
+
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl, err = OpenDatabaseWithOptions(filename, options)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ids := checkScan(t, tbl, false); len(ids) != 3000 {
+		t.Fatalf("Expected 3000 rows after reopening, got %d", len(ids))
+	}
+
+	if !tbl.pager.pages[0].newest.mapped {
+		t.Fatalf("Expected the pages to be read from the mapping")
+	}
+
+	// The snapshot reads the pages the update changes from the mapping
+	snapshot := tbl.Snapshot()
+	for i := 0; i < 3000; i += 100 {
+		row, err := NewRow(uint32(i), fmt.Sprintf("user#%d", i), "changed@example.com")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if err := tbl.Update(row); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if err := tbl.pager.checkpoint(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if tbl.pager.log.size == 0 {
+		t.Fatalf("Expected the checkpoint to wait for the snapshot")
+	}
+
+	changed := Predicate{Column: "email", Op: Equal, Value: "changed@example.com"}
+	if ids := selectIds(t, snapshot, changed); len(ids) != 0 {
+		t.Fatalf("Expected the snapshot to read the rows as they were, got %v", ids)
+	}
+
+	snapshot.Release()
+	if err := tbl.pager.checkpoint(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if tbl.pager.log.size != 0 {
+		t.Fatalf("Expected the checkpoint to write the file once the snapshot is released")
+	}
+
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl, err = OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	if ids := selectIds(t, tbl, changed); len(ids) != 30 {
+		t.Fatalf("Expected 30 changed rows after reopening, got %d", len(ids))
+	}
+}
+
+func TestMemoryMapCopyOnWrite(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	if _, err := OpenDatabaseWithOptions(path.Join(testDirPath, "test.db"), Options{CopyOnWrite: true, MemoryMap: true}); err == nil {
+		t.Fatalf("Expected a copy-on-write file not to be memory mapped")
+	}
+}
+
+// BenchmarkRead opens the file and scans every row, the pages
+// are copied from the file or read from the mapping
+func BenchmarkRead(b *testing.B) {
+	createTestDir(b, testDirPath)
+	b.Cleanup(cleanupTestDir(b, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		b.Fatalf("%s", err)
+	}
+
+	for i := 0; i < 20000; i++ {
+		row, err := NewRow(uint32(i), fmt.Sprintf("user#%d", i), fmt.Sprintf("person#%d@example.com", i))
+		if err == nil {
+			err = tbl.Insert(row)
+		}
+
+		if err != nil {
+			b.Fatalf("%s", err)
+		}
+	}
+
+	if err := tbl.Close(); err != nil {
+		b.Fatalf("%s", err)
+	}
+
+	for _, memoryMap := range []bool{false, true} {
+		mode := "buffered"
+		if memoryMap {
+			mode = "mmap"
+		}
+
+		b.Run(mode, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				tbl, err := OpenDatabaseWithOptions(filename, Options{MemoryMap: memoryMap, ReadOnly: true})
+				if err != nil {
+					b.Fatalf("%s", err)
+				}
+
+				rows := 0
+				err = tbl.Scan(nil, func(r *Row) error {
+					rows++
+					return nil
+				})
+
+				if err == nil && rows != 20000 {
+					err = fmt.Errorf("scanned %d rows", rows)
+				}
+
+				if err != nil {
+					b.Fatalf("%s", err)
+				}
+
+				tbl.Close()
+			}
+		})
+	}
+}
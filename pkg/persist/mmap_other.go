@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package persist
+
+import (
+	"errors"
+	"os"
+)
+
+var errMemoryMapUnsupported = errors.New("memory mapped files are only supported on linux")
+
+// mmap fails, files are only memory mapped on linux
+func mmap(file *os.File, size int64) ([]byte, error) {
+	return nil, errMemoryMapUnsupported
+}
+
+func munmap(mapping []byte) error {
+	return errMemoryMapUnsupported
+}
@@ -0,0 +1,164 @@
+package persist
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Overflow page layout. A value too large for a leaf is stored in a
+// chain of overflow pages, each holds the next page of the chain and as
+// much of the value as fits. A freed page keeps the same layout, it is
+// on the free list and next is the free page after it
+const (
+	overflowNextSize   uint32 = 4
+	overflowNextOffset uint32 = commonNodeHeaderSize
+	overflowHeaderSize uint32 = overflowNextOffset + overflowNextSize
+)
+
+// The free list is the first free page, 0 when there is none as page 0
+// is the root. It is a header extension field after the timeline
+const headerFreeListSize uint32 = 4
+
+func headerFreeListOffset(pageSize uint32) uint32 {
+	return headerTimelineOffset(pageSize) + headerTimelineSize
+}
+
+func getFreeList(p *pager) uint32 {
+	offset := headerFreeListOffset(p.pageSize)
+	return binary.LittleEndian.Uint32(p.header[offset : offset+headerFreeListSize])
+}
+
+func setFreeList(p *pager, pageNum uint32) {
+	offset := headerFreeListOffset(p.pageSize)
+	binary.LittleEndian.PutUint32(p.header[offset:offset+headerFreeListSize], pageNum)
+}
+
+func getOverflowNext(page []byte) uint32 {
+	return binary.LittleEndian.Uint32(page[overflowNextOffset : overflowNextOffset+overflowNextSize])
+}
+
+func setOverflowNext(page []byte, next uint32) {
+	binary.LittleEndian.PutUint32(page[overflowNextOffset:overflowNextOffset+overflowNextSize], next)
+}
+
+// allocatePage returns the number of a page the writer may use for a new
+// node, the first free page or else the page after the last one
+func (p *pager) allocatePage() (uint32, error) {
+	pageNum := getFreeList(p)
+	if pageNum == 0 {
+		return p.GetUnusedPageNum(), nil
+	}
+
+	page, err := p.getPageForWrite(pageNum)
+	if err != nil {
+		return 0, err
+	}
+
+	if getNodeType(page) != freeNode {
+		return 0, fmt.Errorf("page '%d' on the free list is not free, the page may have been corrupted", pageNum)
+	}
+
+	setFreeList(p, getOverflowNext(page))
+	return pageNum, nil
+}
+
+// freePage puts the page on the free list
+func (p *pager) freePage(pageNum uint32) error {
+	page, err := p.getPageForWrite(pageNum)
+	if err != nil {
+		return err
+	}
+
+	setNodeType(page, freeNode)
+	setOverflowNext(page, getFreeList(p))
+	setFreeList(p, pageNum)
+
+	return nil
+}
+
+// writeOverflow stores the value in a chain of
+// overflow pages and returns the first one
+func (p *pager) writeOverflow(value []byte) (uint32, error) {
+	capacity := p.pageSize - overflowHeaderSize
+
+	// The chain is written from its end so every page
+	// knows the next one when it is written
+	next := uint32(0)
+	for end := len(value); end > 0; {
+		start := (end - 1) / int(capacity) * int(capacity)
+
+		pageNum, err := p.allocatePage()
+		if err != nil {
+			return 0, err
+		}
+
+		page, err := p.getPageForWrite(pageNum)
+		if err != nil {
+			return 0, err
+		}
+
+		setNodeType(page, overflowNode)
+		setNodeRoot(page, false)
+		setOverflowNext(page, next)
+		copy(page[overflowHeaderSize:], value[start:end])
+
+		next, end = pageNum, start
+	}
+
+	return next, nil
+}
+
+// readOverflow returns a copy of the value of the given length stored in
+// the chain starting at the page as of the snapshot, see readPage
+func (p *pager) readOverflow(s *snapshot, pageNum, length uint32) ([]byte, error) {
+	value := make([]byte, 0, length)
+	for uint32(len(value)) < length {
+		if pageNum == 0 {
+			return nil, fmt.Errorf("overflow chain ends after %d of %d bytes, the page may have been corrupted", len(value), length)
+		}
+
+		page, err := p.readPage(s, pageNum)
+		if err != nil {
+			return nil, err
+		}
+
+		if getNodeType(page) != overflowNode {
+			return nil, fmt.Errorf("page '%d' is not an overflow page, the page may have been corrupted", pageNum)
+		}
+
+		n := length - uint32(len(value))
+		if n > p.pageSize-overflowHeaderSize {
+			n = p.pageSize - overflowHeaderSize
+		}
+
+		value = append(value, page[overflowHeaderSize:overflowHeaderSize+n]...)
+		pageNum = getOverflowNext(page)
+	}
+
+	return value, nil
+}
+
+// freeOverflow puts every page of the chain starting at the page on the
+// free list. The snapshots which still read the value read the versions
+// of the pages from before they were freed
+func (p *pager) freeOverflow(pageNum uint32) error {
+	for pageNum != 0 {
+		page, err := p.GetPage(pageNum)
+		if err != nil {
+			return err
+		}
+
+		if getNodeType(page) != overflowNode {
+			return fmt.Errorf("page '%d' is not an overflow page, the page may have been corrupted", pageNum)
+		}
+
+		next := getOverflowNext(page)
+		if err := p.freePage(pageNum); err != nil {
+			return err
+		}
+
+		pageNum = next
+	}
+
+	return nil
+}
@@ -0,0 +1,469 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+)
+
+// A copy-on-write file never overwrites a page the last commit reads.
+// Pages are kept in slots of the file, the page map records the slot of
+// every page. A commit writes the changed pages to free slots, then the
+// map pages pointing at them and a new map root, and last the meta which
+// points at the root. There are two metas which are written in turn, the
+// valid one with the highest transaction id is the state of the file, so
+// a crash at any point leaves the last commit intact without a log.
+//
+// Slot 0 and 1 hold the metas, the map root holds the slot of every map
+// page and a map page the slot of entries pages. A slot is a page, the
+// meta records the page size so the second meta can be found
+const (
+	metaMagicSize        uint32 = 8
+	metaMagicOffset      uint32 = 0
+	metaVersionSize      uint32 = 4
+	metaVersionOffset    uint32 = metaMagicOffset + metaMagicSize
+	metaPageSizeSize     uint32 = 4
+	metaPageSizeOffset   uint32 = metaVersionOffset + metaVersionSize
+	metaTxnIdSize        uint32 = 8
+	metaTxnIdOffset      uint32 = metaPageSizeOffset + metaPageSizeSize
+	metaNumPagesSize     uint32 = 4
+	metaNumPagesOffset   uint32 = metaTxnIdOffset + metaTxnIdSize
+	metaHeaderSlotSize   uint32 = 4
+	metaHeaderSlotOffset uint32 = metaNumPagesOffset + metaNumPagesSize
+	metaRootSlotSize     uint32 = 4
+	metaRootSlotOffset   uint32 = metaHeaderSlotOffset + metaHeaderSlotSize
+	metaChecksumSize     uint32 = 4
+	metaChecksumOffset   uint32 = metaRootSlotOffset + metaRootSlotSize
+	metaSize             uint32 = metaChecksumOffset + metaChecksumSize
+	metaFormatVersion    uint32 = 2
+	metaSlots            uint32 = 2
+	pageMapEntrySize     uint32 = 4
+)
+
+var metaMagic = []byte("SimpleCW")
+
+// pageMap is the placement of the pages of a copy-on-write file as of
+// the last commit. It is only used by the writer
+type pageMap struct {
+	pageSize   uint32
+	txnId      uint64
+	slots      []uint32
+	headerSlot uint32
+	mapSlots   []uint32
+	rootSlot   uint32
+
+	// numSlots is the length of the file in slots, free holds
+	// the slots below it which the last commit does not read
+	numSlots uint32
+	free     []uint32
+}
+
+func (m *pageMap) slotOffset(slot uint32) int64 {
+	return int64(slot) * int64(m.pageSize)
+}
+
+// entries is the number of slots a map page or the map root holds
+func (m *pageMap) entries() uint32 {
+	return m.pageSize / pageMapEntrySize
+}
+
+// maxPages is the number of pages the map root and its map pages place
+func (m *pageMap) maxPages() uint32 {
+	return m.entries() * m.entries()
+}
+
+// metaOffsets are where the metas may be. The second meta is one page
+// into the file, the size of which is only known from a meta
+func metaOffsets() []int64 {
+	offsets := []int64{0}
+	for size := MinPageSize; size <= MaxPageSize; size *= 2 {
+		offsets = append(offsets, int64(size))
+	}
+
+	return offsets
+}
+
+// isCopyOnWrite reports whether the file has a meta. Until its second
+// commit only the second meta of a new file has been written
+func isCopyOnWrite(file *os.File) (bool, error) {
+	magic := make([]byte, metaMagicSize)
+	for i, offset := range metaOffsets() {
+		if _, err := file.ReadAt(magic, offset); err != nil {
+			if i == 0 {
+				return false, err
+			}
+
+			break
+		}
+
+		if bytes.Equal(magic, metaMagic) {
+			return true, nil
+		}
+
+		// A file written in place starts with the header
+		if i == 0 && !bytes.Equal(magic, make([]byte, metaMagicSize)) {
+			return false, nil
+		}
+	}
+
+	return false, nil
+}
+
+func newPageMap(pageSize uint32) *pageMap {
+	return &pageMap{pageSize: pageSize, numSlots: metaSlots}
+}
+
+// readPageMap reads the page map of the newest valid meta and
+// the header it points at. Slots no commit reads are free
+func readPageMap(file *os.File, fileLength int64) (*pageMap, []byte, error) {
+	var meta []byte
+
+	for _, offset := range metaOffsets() {
+		m := make([]byte, metaSize)
+		if _, err := file.ReadAt(m, offset); err != nil {
+			continue
+		}
+
+		if !validMeta(m) || (offset != 0 && offset != int64(metaPageSize(m))) {
+			continue
+		}
+
+		if meta == nil || metaTxnId(m) > metaTxnId(meta) {
+			meta = m
+		}
+	}
+
+	if meta == nil {
+		return nil, nil, errors.New("DB file has no valid meta. Corrupt file")
+	}
+
+	version := binary.LittleEndian.Uint32(meta[metaVersionOffset : metaVersionOffset+metaVersionSize])
+	if version != metaFormatVersion {
+		return nil, nil, errors.New("unsupported copy-on-write DB file version")
+	}
+
+	pageSize := metaPageSize(meta)
+	if !validPageSize(pageSize) || fileLength%int64(pageSize) != 0 {
+		return nil, nil, errors.New("DB file is not a whole number of pages. Corrupt file")
+	}
+
+	numPages := binary.LittleEndian.Uint32(meta[metaNumPagesOffset : metaNumPagesOffset+metaNumPagesSize])
+	m := &pageMap{
+		pageSize:   pageSize,
+		txnId:      metaTxnId(meta),
+		slots:      make([]uint32, numPages),
+		headerSlot: binary.LittleEndian.Uint32(meta[metaHeaderSlotOffset : metaHeaderSlotOffset+metaHeaderSlotSize]),
+		rootSlot:   binary.LittleEndian.Uint32(meta[metaRootSlotOffset : metaRootSlotOffset+metaRootSlotSize]),
+		numSlots:   uint32(fileLength / int64(pageSize)),
+	}
+
+	used := map[uint32]bool{m.headerSlot: true, m.rootSlot: true}
+
+	root := make([]byte, pageSize)
+	if _, err := file.ReadAt(root, m.slotOffset(m.rootSlot)); err != nil {
+		return nil, nil, err
+	}
+
+	entries := m.entries()
+	page := make([]byte, pageSize)
+	for i := uint32(0); i*entries < numPages; i++ {
+		slot := mapEntry(root, i)
+		if _, err := file.ReadAt(page, m.slotOffset(slot)); err != nil {
+			return nil, nil, err
+		}
+
+		m.mapSlots = append(m.mapSlots, slot)
+		used[slot] = true
+
+		for j := uint32(0); j < entries && i*entries+j < numPages; j++ {
+			m.slots[i*entries+j] = mapEntry(page, j)
+			used[mapEntry(page, j)] = true
+		}
+	}
+
+	for slot := metaSlots; slot < m.numSlots; slot++ {
+		if !used[slot] {
+			m.free = append(m.free, slot)
+		}
+	}
+
+	header := make([]byte, pageSize)
+	if _, err := file.ReadAt(header, m.slotOffset(m.headerSlot)); err != nil {
+		return nil, nil, err
+	}
+
+	return m, header, nil
+}
+
+func validMeta(meta []byte) bool {
+	if !bytes.Equal(meta[metaMagicOffset:metaMagicOffset+metaMagicSize], metaMagic) {
+		return false
+	}
+
+	checksum := binary.LittleEndian.Uint32(meta[metaChecksumOffset : metaChecksumOffset+metaChecksumSize])
+	return crc32.ChecksumIEEE(meta[:metaChecksumOffset]) == checksum
+}
+
+func metaPageSize(meta []byte) uint32 {
+	return binary.LittleEndian.Uint32(meta[metaPageSizeOffset : metaPageSizeOffset+metaPageSizeSize])
+}
+
+func metaTxnId(meta []byte) uint64 {
+	return binary.LittleEndian.Uint64(meta[metaTxnIdOffset : metaTxnIdOffset+metaTxnIdSize])
+}
+
+func mapEntry(page []byte, i uint32) uint32 {
+	return binary.LittleEndian.Uint32(page[i*pageMapEntrySize : (i+1)*pageMapEntrySize])
+}
+
+func setMapEntry(page []byte, i, slot uint32) {
+	binary.LittleEndian.PutUint32(page[i*pageMapEntrySize:(i+1)*pageMapEntrySize], slot)
+}
+
+// pageOffset returns where the newest committed version
+// of the page is in the file, false if it has none
+func (m *pageMap) pageOffset(pageNum uint32) (int64, bool) {
+	if pageNum >= uint32(len(m.slots)) {
+		return 0, false
+	}
+
+	return m.slotOffset(m.slots[pageNum]), true
+}
+
+// allocate returns the lowest slot no commit reads so the pages gather at
+// the start of the file, the file grows when none is free
+func (m *pageMap) allocate() uint32 {
+	if n := len(m.free); n > 0 {
+		lowest := 0
+		for i, slot := range m.free {
+			if slot < m.free[lowest] {
+				lowest = i
+			}
+		}
+
+		slot := m.free[lowest]
+		m.free[lowest] = m.free[n-1]
+		m.free = m.free[:n-1]
+		return slot
+	}
+
+	m.numSlots++
+	return m.numSlots - 1
+}
+
+// neededSlots is the number of slots the pages of the last commit,
+// its map, header and metas take up
+func (m *pageMap) neededSlots() uint32 {
+	return metaSlots + uint32(len(m.slots)) + uint32(len(m.mapSlots)) + 2
+}
+
+// truncate cuts the free slots at the end off the file
+func (m *pageMap) truncate(file *os.File) error {
+	free := make(map[uint32]bool, len(m.free))
+	for _, slot := range m.free {
+		free[slot] = true
+	}
+
+	numSlots := m.numSlots
+	for numSlots > metaSlots && free[numSlots-1] {
+		numSlots--
+	}
+
+	if numSlots == m.numSlots {
+		return nil
+	}
+
+	if err := file.Truncate(m.slotOffset(numSlots)); err != nil {
+		return err
+	}
+
+	kept := m.free[:0]
+	for _, slot := range m.free {
+		if slot < numSlots {
+			kept = append(kept, slot)
+		}
+	}
+
+	m.free, m.numSlots = kept, numSlots
+	return nil
+}
+
+// placement is where a commit wrote its pages
+type placement struct {
+	pageSlots  map[uint32]uint32
+	headerSlot uint32
+	mapSlots   map[uint32]uint32
+	rootSlot   uint32
+	numPages   uint32
+}
+
+// commit writes the writer's pages to the file, nothing the last commit
+// reads is overwritten. The map points at the new slots once the placement
+// is applied, the slots the last commit read are free after that. Without
+// syncing a crash of the machine may find the slots of the last commit
+// reused before its meta is in the file
+func (m *pageMap) commit(file *os.File, dirty map[uint32][]byte, header []byte, numPages uint32, sync bool) (*placement, error) {
+	var allocated []uint32
+
+	write := func(data []byte) (uint32, error) {
+		slot := m.allocate()
+		allocated = append(allocated, slot)
+
+		_, err := file.WriteAt(data, m.slotOffset(slot))
+		return slot, err
+	}
+
+	pl, err := func() (*placement, error) {
+		pageSlots := map[uint32]uint32{}
+		for pageNum, data := range dirty {
+			slot, err := write(data)
+			if err != nil {
+				return nil, err
+			}
+
+			pageSlots[pageNum] = slot
+		}
+
+		headerSlot, err := write(header)
+		if err != nil {
+			return nil, err
+		}
+
+		entries := m.entries()
+		touched := map[uint32]bool{}
+		for pageNum := range pageSlots {
+			touched[pageNum/entries] = true
+		}
+
+		mapSlots := map[uint32]uint32{}
+		page := make([]byte, m.pageSize)
+		for i := range touched {
+			for j := uint32(0); j < entries; j++ {
+				pageNum := i*entries + j
+
+				slot, ok := pageSlots[pageNum]
+				if !ok && pageNum < uint32(len(m.slots)) {
+					slot = m.slots[pageNum]
+				}
+
+				setMapEntry(page, j, slot)
+			}
+
+			if mapSlots[i], err = write(page); err != nil {
+				return nil, err
+			}
+		}
+
+		for i := uint32(0); i < uint32(len(m.mapSlots)); i++ {
+			if _, ok := mapSlots[i]; !ok {
+				mapSlots[i] = m.mapSlots[i]
+			}
+		}
+
+		root := make([]byte, m.pageSize)
+		for i, slot := range mapSlots {
+			setMapEntry(root, i, slot)
+		}
+
+		rootSlot, err := write(root)
+		if err != nil {
+			return nil, err
+		}
+
+		// Every page the meta points at has to be in the file before it
+		if sync {
+			if err := file.Sync(); err != nil {
+				return nil, err
+			}
+		}
+
+		meta := make([]byte, m.pageSize)
+		copy(meta[metaMagicOffset:metaMagicOffset+metaMagicSize], metaMagic)
+		binary.LittleEndian.PutUint32(meta[metaVersionOffset:metaVersionOffset+metaVersionSize], metaFormatVersion)
+		binary.LittleEndian.PutUint32(meta[metaPageSizeOffset:metaPageSizeOffset+metaPageSizeSize], m.pageSize)
+		binary.LittleEndian.PutUint64(meta[metaTxnIdOffset:metaTxnIdOffset+metaTxnIdSize], m.txnId+1)
+		binary.LittleEndian.PutUint32(meta[metaNumPagesOffset:metaNumPagesOffset+metaNumPagesSize], numPages)
+		binary.LittleEndian.PutUint32(meta[metaHeaderSlotOffset:metaHeaderSlotOffset+metaHeaderSlotSize], headerSlot)
+		binary.LittleEndian.PutUint32(meta[metaRootSlotOffset:metaRootSlotOffset+metaRootSlotSize], rootSlot)
+		binary.LittleEndian.PutUint32(meta[metaChecksumOffset:metaChecksumOffset+metaChecksumSize],
+			crc32.ChecksumIEEE(meta[:metaChecksumOffset]))
+
+		// The meta of the last commit is left for a crash while this one is written
+		if _, err := file.WriteAt(meta, m.slotOffset(uint32((m.txnId+1)%uint64(metaSlots)))); err != nil {
+			return nil, err
+		}
+
+		if sync {
+			if err := file.Sync(); err != nil {
+				return nil, err
+			}
+		}
+
+		return &placement{pageSlots, headerSlot, mapSlots, rootSlot, numPages}, nil
+	}()
+
+	if err != nil {
+		m.free = append(m.free, allocated...)
+	}
+
+	return pl, err
+}
+
+// apply points the map at the slots of a commit
+// and frees the slots the commit replaced
+func (m *pageMap) apply(pl *placement) {
+	pageSlots, mapSlots, numPages := pl.pageSlots, pl.mapSlots, pl.numPages
+	m.txnId++
+
+	if numPages > uint32(len(m.slots)) {
+		m.slots = append(m.slots, make([]uint32, numPages-uint32(len(m.slots)))...)
+	}
+
+	for pageNum, slot := range pageSlots {
+		if m.slots[pageNum] != 0 {
+			m.free = append(m.free, m.slots[pageNum])
+		}
+
+		m.slots[pageNum] = slot
+	}
+
+	for uint32(len(m.mapSlots)) < uint32(len(mapSlots)) {
+		m.mapSlots = append(m.mapSlots, 0)
+	}
+
+	for i, slot := range mapSlots {
+		if m.mapSlots[i] != 0 && m.mapSlots[i] != slot {
+			m.free = append(m.free, m.mapSlots[i])
+		}
+
+		m.mapSlots[i] = slot
+	}
+
+	// The pages past the last one were dropped
+	if numPages < uint32(len(m.slots)) {
+		for _, slot := range m.slots[numPages:] {
+			if slot != 0 {
+				m.free = append(m.free, slot)
+			}
+		}
+
+		m.slots = m.slots[:numPages]
+	}
+
+	if numMaps := (numPages + m.entries() - 1) / m.entries(); numMaps < uint32(len(m.mapSlots)) {
+		m.free = append(m.free, m.mapSlots[numMaps:]...)
+		m.mapSlots = m.mapSlots[:numMaps]
+	}
+
+	if m.headerSlot != 0 {
+		m.free = append(m.free, m.headerSlot)
+	}
+
+	if m.rootSlot != 0 {
+		m.free = append(m.free, m.rootSlot)
+	}
+
+	m.headerSlot, m.rootSlot = pl.headerSlot, pl.rootSlot
+}
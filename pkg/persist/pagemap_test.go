@@ -0,0 +1,147 @@
+package persist
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func openCopyOnWrite(t *testing.T, filename string) *Table {
+	tbl, err := OpenDatabaseWithOptions(filename, Options{CopyOnWrite: true})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if tbl.pager.pageMap == nil {
+		t.Fatalf("Expected a copy-on-write file")
+	}
+
+	return tbl
+}
+
+// crash closes the file and its log without writing anything
+func crash(tbl *Table) {
+	if tbl.pager.log != nil {
+		tbl.pager.log.Close()
+	}
+
+	tbl.pager.fileDescriptor.Close()
+	for _, mapping := range tbl.pager.mappings {
+		munmap(mapping)
+	}
+}
+
+func TestCopyOnWriteReopen(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl := openCopyOnWrite(t, filename)
+
+	insertUsers(t, tbl, 0, 300)
+	if err := tbl.CreateIndex("idx_username", "username", true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// The mode of an existing file is kept whatever the options say
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	if tbl.pager.pageMap == nil {
+		t.Fatalf("Expected the file to stay copy-on-write")
+	}
+
+	if ids := checkScan(t, tbl, false); len(ids) != 300 {
+		t.Fatalf("Expected 300 rows after reopening, got %d", len(ids))
+	}
+
+	if len(tbl.Indexes()) != 1 {
+		t.Fatalf("Expected the index to be reopened")
+	}
+}
+
+func TestCopyOnWriteCrash(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl := openCopyOnWrite(t, filename)
+
+	insertUsers(t, tbl, 0, 100)
+
+	// A transaction which never commits is lost, it splits
+	// leaves and grows the root without touching the file
+	tx, err := tbl.Begin()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tx.Table(), 100, 400)
+	crash(tbl)
+
+	tbl = openCopyOnWrite(t, filename)
+	if ids := checkScan(t, tbl, false); len(ids) != 100 {
+		t.Fatalf("Expected the 100 committed rows, got %d", len(ids))
+	}
+
+	insertUsers(t, tbl, 100, 101)
+	crash(tbl)
+
+	// A torn meta falls back to the commit before it
+	meta := tbl.pager.pageMap.txnId % uint64(metaSlots)
+	file, err := os.OpenFile(filename, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := file.WriteAt([]byte("torn"), tbl.pager.pageMap.slotOffset(uint32(meta))+int64(metaTxnIdOffset)); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	file.Close()
+
+	tbl = openCopyOnWrite(t, filename)
+	defer tbl.Close()
+
+	if ids := checkScan(t, tbl, false); len(ids) != 100 {
+		t.Fatalf("Expected the commit before the torn meta, got %d rows", len(ids))
+	}
+}
+
+func TestCopyOnWriteReusesSlots(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl := openCopyOnWrite(t, filename)
+	defer tbl.Close()
+
+	insertUsers(t, tbl, 0, 100)
+	size := tbl.pager.pageMap.numSlots
+
+	for i := 0; i < 200; i++ {
+		row, err := NewRow(uint32(i%100), fmt.Sprintf("user#%d", i%100), "changed@example.com")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if err := tbl.Update(row); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	// Each update replaces a leaf, a map page, the map root and the
+	// header, the slots of the last commit are reused by the next
+	if n := tbl.pager.pageMap.numSlots; n > size+8 {
+		t.Fatalf("Expected the file to stay at about %d slots, it grew to %d", size, n)
+	}
+}
@@ -1,88 +1,1418 @@
 package persist
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
+// The first page of the file is the database header, node pages
+// are stored after it. Page numbers do not include the header page.
+// The header records the size of the pages, which every node layout
+// is computed from, and the key and value size of the tree rooted at
+// page 0 so a file is never opened with a different cell layout, and
+// the log sequence number of the commit it is part of. The page size
+// comes right after the version so it is read before the rest.
+//
+// The last headerExtensionSize bytes of the header are kept for fields
+// added after version 7. A file written before a field was added holds
+// zeros there, so a new field defaults to 0 and the version stays the
+// same. The catalog of a file of version 7 never reached them
+const (
+	headerMagicSize       uint32 = 8
+	headerMagicOffset     uint32 = 0
+	headerVersionSize     uint32 = 4
+	headerVersionOffset   uint32 = headerMagicOffset + headerMagicSize
+	headerPageSizeSize    uint32 = 4
+	headerPageSizeOffset  uint32 = headerVersionOffset + headerVersionSize
+	headerPrefixSize      uint32 = headerPageSizeOffset + headerPageSizeSize
+	headerKeySizeSize     uint32 = 4
+	headerKeySizeOffset   uint32 = headerPageSizeOffset + headerPageSizeSize
+	headerValueSizeSize   uint32 = 4
+	headerValueSizeOffset uint32 = headerKeySizeOffset + headerKeySizeSize
+	headerStatsRootSize   uint32 = 4
+	headerStatsRootOffset uint32 = headerValueSizeOffset + headerValueSizeSize
+	headerLSNSize         uint32 = 8
+	headerLSNOffset       uint32 = headerStatsRootOffset + headerStatsRootSize
+	headerCatalogOffset   uint32 = headerLSNOffset + headerLSNSize
+	headerExtensionSize   uint32 = 16
+	headerTimelineSize    uint32 = 8
+	headerFormatVersion   uint32 = 7
+)
+
+// headerTimelineOffset is where the timeline is in a header of the page
+// size, the first of the extension fields. A restore starts a new one
+func headerTimelineOffset(pageSize uint32) uint32 {
+	return pageSize - headerExtensionSize
+}
+
+var headerMagic = []byte("SimpleDB")
+
+// mmapMinPages is the number of pages the first mapping of a
+// memory mapped file holds, it may reach past the end of the file
+const mmapMinPages uint32 = 1024
+
+// The pager keeps every committed version of a page a reader may still
+// need. Committed versions are never changed: the writer changes copies of
+// the pages, which become the newest versions when it commits and are
+// dropped when it rolls back. A reader reads the pages of a snapshot, the
+// versions which were newest at the commit the snapshot was taken at, so
+// readers never wait for the writer nor the writer for readers.
+//
+// mu guards the page table, the snapshots and the commit sequence. The
+// versions of a page are guarded by its latch, see pageLatch, so mu is
+// only held for a moment and never while a page is read from the file:
+// readers of other pages do not wait for it. A reader latches a page
+// shared while it finds the version of its snapshot, the writer latches
+// it exclusively while it adds a version. The write set is only used by
+// the writer, only one of which runs at a time
 type pager struct {
+	mu             sync.RWMutex
 	fileDescriptor *os.File
-	fileLength     uint32
-	numPages       uint32
-	pages          [][]byte
+	fileLength     int64
+	pages          []*pageLatch
+	commitSeq      uint64
+	snapshots      map[uint64]int
+
+	// versioned holds the pages with older versions kept for snapshots,
+	// it changes with both mu and the latch of the page held
+	versioned map[uint32]bool
+
+	// pageMap places the pages of a copy-on-write file,
+	// it is nil when pages are written in place
+	pageMap  *pageMap
+	readOnly bool
+
+	// log holds the commits to a file written in place until a
+	// checkpoint writes the pages in unflushed to the file
+	log        *writeAheadLog
+	unflushed  map[uint32]bool
+	durability Durability
+	dir        string
+
+	committedPages  uint32
+	committedHeader []byte
+
+	// pageSize is the size of every page and of the header, maxPages
+	// the number of pages the file can hold with it
+	pageSize uint32
+	maxPages uint32
+
+	// mappings is the file memory mapped when the options ask for it,
+	// the versions read from the file are slices of the last mapping.
+	// A larger mapping is added once the file grows past it, see remap
+	mappings     [][]byte
+	memoryMapped bool
+
+	// The writer changes the pages of the write set it was given,
+	// by default one on top of the newest commit
+	*writeSet
+}
+
+// writeSet is the writer's copies of the pages it changed, the number of
+// pages and the header. The other pages are read as of the base snapshot,
+// a nil base reads the newest committed pages
+type writeSet struct {
+	base       *snapshot
+	dirty      map[uint32][]byte
+	numPages   uint32
+	header     []byte
+	basePages  uint32
+	baseHeader []byte
+
+	// saves are the savepoints of a transaction, oldest first
+	saves []*savedWrites
+}
+
+// pageVersion is the contents of a page as of a commit,
+// prev is the version the commit replaced
+type pageVersion struct {
+	data   []byte
+	commit uint64
+	prev   *pageVersion
+
+	// mapped is set when data is a slice of the memory mapped
+	// file, it changes when the file is written there
+	mapped bool
+}
+
+// snapshot is the state of the pages as of a commit. Its versions are
+// kept until it is released. The snapshot of a transaction also reads
+// the pages the transaction changed
+type snapshot struct {
+	pager    *pager
+	seq      uint64
+	writes   *writeSet
+	released bool
+}
+
+func (p *pager) acquireSnapshot() *snapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.snapshots[p.commitSeq]++
+	return &snapshot{pager: p, seq: p.commitSeq}
+}
+
+// acquireCommit returns a snapshot of the newest commit
+// with its header and number of pages
+func (p *pager) acquireCommit() (*snapshot, []byte, uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.snapshots[p.commitSeq]++
+	return &snapshot{pager: p, seq: p.commitSeq}, append([]byte{}, p.committedHeader...), p.committedPages
+}
+
+// newWriteSet returns a write set on top of a snapshot of the newest
+// commit, the snapshot reads the pages of the write set
+func (p *pager) newWriteSet() *writeSet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.snapshots[p.commitSeq]++
+	ws := p.latestWriteSet()
+	ws.base = &snapshot{pager: p, seq: p.commitSeq, writes: ws}
+
+	return ws
+}
+
+// latestWriteSet returns a write set on top of the newest commit. mu must
+// be held or the writer be the only one which commits
+func (p *pager) latestWriteSet() *writeSet {
+	return &writeSet{
+		dirty:      map[uint32][]byte{},
+		numPages:   p.committedPages,
+		header:     append([]byte{}, p.committedHeader...),
+		basePages:  p.committedPages,
+		baseHeader: append([]byte{}, p.committedHeader...),
+	}
+}
+
+// install makes the writer change the pages of the write set,
+// it returns the write set it replaces
+func (p *pager) install(ws *writeSet) *writeSet {
+	prev := p.writeSet
+	p.writeSet = ws
+	return prev
+}
+
+// savedWrites is the state of a write set to return to. Pages are
+// copied the first time they change after it, pages holds what they
+// were before, nil for a page the write set did not have
+type savedWrites struct {
+	pages    map[uint32][]byte
+	numPages uint32
+	header   []byte
+}
+
+// save marks the state of the write set to return to, no page is copied
+func (ws *writeSet) save() {
+	ws.saves = append(ws.saves, &savedWrites{
+		pages:    map[uint32][]byte{},
+		numPages: ws.numPages,
+		header:   append([]byte{}, ws.header...),
+	})
+}
+
+// preserve records the page as it is before it changes,
+// once after the newest save
+func (ws *writeSet) preserve(pageNum uint32) {
+	if len(ws.saves) == 0 {
+		return
+	}
+
+	s := ws.saves[len(ws.saves)-1]
+	if _, ok := s.pages[pageNum]; ok {
+		return
+	}
+
+	if page, ok := ws.dirty[pageNum]; ok {
+		s.pages[pageNum] = append([]byte{}, page...)
+	} else {
+		s.pages[pageNum] = nil
+	}
+}
+
+// restore returns the write set to the i-th save and drops the ones
+// after it. The save is kept so it can be returned to again
+func (ws *writeSet) restore(i int) {
+	for j := len(ws.saves) - 1; j >= i; j-- {
+		for pageNum, page := range ws.saves[j].pages {
+			if page == nil {
+				delete(ws.dirty, pageNum)
+			} else {
+				ws.dirty[pageNum] = page
+			}
+		}
+	}
+
+	s := ws.saves[i]
+	s.pages = map[uint32][]byte{}
+	ws.numPages = s.numPages
+	copy(ws.header, s.header)
+	ws.saves = ws.saves[:i+1]
+}
+
+// release drops the i-th save and the ones after it, the pages they
+// recorded are kept by the save before if they changed since it
+func (ws *writeSet) release(i int) {
+	if i > 0 {
+		prev := ws.saves[i-1]
+		for _, s := range ws.saves[i:] {
+			for pageNum, page := range s.pages {
+				if _, ok := prev.pages[pageNum]; !ok {
+					prev.pages[pageNum] = page
+				}
+			}
+		}
+	}
+
+	ws.saves = ws.saves[:i]
+}
+
+// committedSeq returns the sequence number of the newest commit
+func (p *pager) committedSeq() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.commitSeq
+}
+
+// share returns another reference to the snapshot,
+// each is released on its own
+func (s *snapshot) share() *snapshot {
+	p := s.pager
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.snapshots[s.seq]++
+	return &snapshot{pager: p, seq: s.seq}
+}
+
+// release lets the pager collect the versions only the snapshot could
+// read, releasing a snapshot more than once has no effect
+func (s *snapshot) release() {
+	p := s.pager
+
+	p.mu.Lock()
+	if s.released {
+		p.mu.Unlock()
+		return
+	}
+
+	s.released = true
+	p.snapshots[s.seq]--
+	if p.snapshots[s.seq] == 0 {
+		delete(p.snapshots, s.seq)
+	}
+	p.mu.Unlock()
+
+	p.collect()
+}
+
+// collect drops every version older than the newest version visible to
+// the oldest snapshot, no snapshot can read them. A snapshot taken
+// meanwhile is of a later commit, the versions it reads are kept. The
+// pages are latched one at a time, mu must not be held
+func (p *pager) collect() {
+	p.mu.RLock()
+	horizon := p.commitSeq
+	for seq := range p.snapshots {
+		if seq < horizon {
+			horizon = seq
+		}
+	}
+
+	latches := p.latchesOf(p.versioned)
+	p.mu.RUnlock()
+
+	for pageNum, l := range latches {
+		l.lock()
+
+		v := l.newest
+		for v.commit > horizon && v.prev != nil {
+			v = v.prev
+		}
+
+		v.prev = nil
+		if l.newest.prev == nil {
+			p.mu.Lock()
+			delete(p.versioned, pageNum)
+			p.mu.Unlock()
+		}
+
+		l.unlock()
+	}
+}
+
+// latchesOf returns the latches of the pages, mu must be held
+func (p *pager) latchesOf(pageNums map[uint32]bool) map[uint32]*pageLatch {
+	latches := make(map[uint32]*pageLatch, len(pageNums))
+	for pageNum := range pageNums {
+		latches[pageNum] = p.pages[pageNum]
+	}
+
+	return latches
+}
+
+// numVersions counts the committed versions held in memory
+func (p *pager) numVersions() int {
+	p.mu.RLock()
+	latches := append([]*pageLatch{}, p.pages...)
+	p.mu.RUnlock()
+
+	n := 0
+	for _, l := range latches {
+		if l == nil {
+			continue
+		}
+
+		l.lockShared()
+		for v := l.newest; v != nil; v = v.prev {
+			n++
+		}
+		l.unlockShared()
+	}
+
+	return n
+}
+
+// commit makes the writer's pages the newest versions and waits for
+// them to be synced. They are written first, the commit is dropped if
+// that fails
+func (p *pager) commit() error {
+	lsn, err := p.commitUnsynced()
+	if err != nil {
+		return err
+	}
+
+	return p.sync(lsn)
+}
+
+// commitUnsynced commits like commit without waiting for the sync, it
+// returns the log sequence number to wait for with sync. A writer waits
+// once it let go of the writer lock so other commits can join the sync
+func (p *pager) commitUnsynced() (uint64, error) {
+	if err := p.write(); err != nil {
+		return 0, err
+	}
+
+	p.publish()
+	p.autoCheckpoint()
+
+	return headerLSN(p.committedHeader), nil
+}
+
+// sync waits until the commit with the sequence number survives a crash
+// as far as the durability promises. Only a group commit has to wait. The
+// changes of the commit stay visible to readers if syncing it fails, but
+// they are cut from the log and no commit nor checkpoint follows, so they
+// never reach the file
+func (p *pager) sync(lsn uint64) error {
+	if p.log == nil || p.log.group == nil {
+		return nil
+	}
+
+	return p.log.group.wait(lsn)
+}
+
+// write writes the writer's pages to a copy-on-write file or appends
+// them to the log, they are dropped if that fails. The commit gets the
+// log sequence number after the one of the commit it is on top of, the
+// header and every page it changed record it
+func (p *pager) write() error {
+	if len(p.dirty) == 0 && bytes.Equal(p.header, p.baseHeader) {
+		return nil
+	}
+
+	lsn := headerLSN(p.baseHeader) + 1
+	setHeaderLSN(p.header, lsn)
+	for _, page := range p.dirty {
+		setPageLSN(page, lsn)
+	}
+
+	if p.log != nil {
+		// A commit after one whose sync failed could be replayed without it
+		if p.log.group != nil {
+			if err := p.log.group.failed(); err != nil {
+				p.rollback()
+				return err
+			}
+		}
+
+		record := logRecordOf(p.header, p.numPages, p.dirty)
+
+		// A commit in a group waits for the sync once the writer lock is released
+		if p.log.group != nil {
+			p.log.group.enqueue(headerLSN(p.header), record)
+		} else if err := p.log.append(record, false); err != nil {
+			p.rollback()
+			return err
+		}
+
+		p.log.pages += uint32(len(p.dirty))
+		return nil
+	}
+
+	pl, err := p.pageMap.commit(p.fileDescriptor, p.dirty, p.header, p.numPages, p.durability != DurabilityOff)
+	if err != nil {
+		p.rollback()
+		return err
+	}
+
+	// Readers look up the pages they have not read yet in the map
+	p.mu.Lock()
+	p.pageMap.apply(pl)
+	p.mu.Unlock()
+
+	return nil
+}
+
+// publish makes the writer's pages the newest versions, the write set
+// continues on top of them. The versions are added with the latch of
+// each page held in turn. No snapshot reads them until the commit
+// sequence is advanced, which is when the commit becomes visible
+func (p *pager) publish() {
+	p.mu.Lock()
+	seq := p.commitSeq
+	if len(p.dirty) > 0 || !bytes.Equal(p.header, p.committedHeader) {
+		seq++
+	}
+
+	latches := make(map[uint32]*pageLatch, len(p.dirty))
+	for pageNum := range p.dirty {
+		latches[pageNum] = p.latchLocked(pageNum)
+	}
+	p.mu.Unlock()
+
+	for pageNum, l := range latches {
+		l.lock()
+
+		l.newest = &pageVersion{data: p.dirty[pageNum], commit: seq, prev: l.newest}
+		if l.newest.prev != nil {
+			p.mu.Lock()
+			p.versioned[pageNum] = true
+			p.mu.Unlock()
+		}
+
+		l.unlock()
+	}
+
+	p.mu.Lock()
+	p.commitSeq = seq
+	if p.log != nil {
+		for pageNum := range p.dirty {
+			p.unflushed[pageNum] = true
+		}
+	}
+
+	p.committedPages = p.numPages
+	copy(p.committedHeader, p.header)
+	p.mu.Unlock()
+
+	p.dirty = map[uint32][]byte{}
+	p.base = nil
+	p.basePages = p.numPages
+	copy(p.baseHeader, p.header)
+
+	p.collect()
 }
 
+// rollback drops the writer's pages, pages allocated
+// since the base of the write set are forgotten
+func (p *pager) rollback() {
+	p.dirty = map[uint32][]byte{}
+	p.numPages = p.basePages
+	copy(p.header, p.baseHeader)
+}
+
+// Close closes the file and its log. The pages of a memory
+// mapped file must not be read once it is closed
 func (p *pager) Close() error {
-	return p.fileDescriptor.Close()
+	if p.log != nil {
+		if p.log.group != nil {
+			p.log.group.close()
+		}
+
+		p.log.Close()
+	}
+
+	err := p.fileDescriptor.Close()
+	for _, mapping := range p.mappings {
+		munmap(mapping)
+	}
+
+	p.mappings = nil
+	return err
+}
+
+// autoCheckpoint checkpoints once the log has grown past walCheckpointPages.
+// The commits stay in the log if that fails, the next commit tries again
+func (p *pager) autoCheckpoint() {
+	if p.log != nil && p.log.pages >= walCheckpointPages {
+		p.checkpoint()
+	}
+}
+
+// checkpoint writes the newest committed version of the pages committed
+// since the last checkpoint and the committed header to the file, then
+// empties the log. A copy-on-write file is written by every commit and a
+// read only one never, there is nothing to write. A memory mapped file is
+// not written while a snapshot may read a page it would change from the
+// mapping, the log is kept for a later checkpoint. Nothing is written once
+// a sync of the log failed, see groupCommit. Only the writer checkpoints
+func (p *pager) checkpoint() error {
+	if p.log == nil || p.readOnly {
+		return nil
+	}
+
+	if p.log.group != nil {
+		if err := p.log.group.flush(); err != nil {
+			return err
+		}
+	}
+
+	if p.log.size == 0 {
+		return nil
+	}
+
+	if p.readingMapped() {
+		return nil
+	}
+
+	sync := p.durability != DurabilityOff
+
+	// A crash while the file is written is repaired from the log,
+	// it has to hold every page before the file is changed
+	if sync {
+		if err := p.log.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := p.log.archive(sync); err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	latches := p.latchesOf(p.unflushed)
+	header := append([]byte{}, p.committedHeader...)
+	numPages := p.committedPages
+	p.mu.RUnlock()
+
+	pages := make(map[uint32][]byte, len(latches))
+	for pageNum, l := range latches {
+		l.lockShared()
+		pages[pageNum] = l.newest.data
+		l.unlockShared()
+	}
+
+	for pageNum, data := range pages {
+		if _, err := p.fileDescriptor.WriteAt(data, pageOffset(p.pageSize, pageNum)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := p.fileDescriptor.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	if sync {
+		if err := p.fileDescriptor.Sync(); err != nil {
+			return err
+		}
+
+		if err := syncDir(p.dir); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	length := pageOffset(p.pageSize, numPages)
+	if p.mappings != nil && length > int64(len(p.mappings[len(p.mappings)-1])) {
+		if err := p.remap(length); err != nil {
+			p.mu.Unlock()
+			return err
+		}
+	}
+
+	p.unflushed = map[uint32]bool{}
+	if length > p.fileLength {
+		p.fileLength = length
+	}
+	p.mu.Unlock()
+
+	// Records left by a crash before the log is emptied
+	// are skipped, the header has their sequence numbers
+	return p.log.reset()
+}
+
+// replayLog makes the commits in the log the file does not hold yet
+// the newest versions, a file which is not read only is checkpointed.
+// A log of another timeline than the file is emptied instead
+func (p *pager) replayLog() error {
+	fileLSN := headerLSN(p.committedHeader)
+	timeline := headerTimeline(p.committedHeader)
+
+	stale := false
+	err := p.log.replay(p.readOnly, func(r *logRecord) {
+		// A log left by the database a backup was restored over is on
+		// an older timeline, none of its records belong to the file
+		if headerTimeline(r.header) != timeline {
+			stale = true
+			return
+		}
+
+		if r.lsn <= fileLSN {
+			return
+		}
+
+		for pageNum, data := range r.pages {
+			p.latchLocked(pageNum).newest = &pageVersion{data: data}
+			p.unflushed[pageNum] = true
+		}
+
+		p.committedPages = r.numPages
+		p.committedHeader = r.header
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if stale {
+		if p.readOnly {
+			return nil
+		}
+
+		return p.log.reset()
+	}
+
+	return p.checkpoint()
 }
 
-func (p *pager) FlushPage(pageNum uint32) error {
+// latch returns the latch of the page, adding it to the page table
+func (p *pager) latch(pageNum uint32) *pageLatch {
+	p.mu.RLock()
+	if pageNum < uint32(len(p.pages)) && p.pages[pageNum] != nil {
+		l := p.pages[pageNum]
+		p.mu.RUnlock()
+		return l
+	}
+	p.mu.RUnlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.latchLocked(pageNum)
+}
+
+// latchLocked is latch with mu held exclusively, or
+// without it while the pager is being opened
+func (p *pager) latchLocked(pageNum uint32) *pageLatch {
+	if pageNum >= uint32(len(p.pages)) {
+		p.pages = append(p.pages, make([]*pageLatch, pageNum+1-uint32(len(p.pages)))...)
+	}
+
 	if p.pages[pageNum] == nil {
-		return fmt.Errorf("no page found to flush at index %d", pageNum)
+		p.pages[pageNum] = newPageLatch()
 	}
 
-	_, err := p.fileDescriptor.WriteAt(p.pages[pageNum], int64(pageNum)*int64(pageSize))
-	return err
+	return p.pages[pageNum]
 }
 
+// latchShared returns the latch of the page held shared. A page not in
+// memory is read from the file first with only its own latch held
+func (p *pager) latchShared(pageNum uint32) (*pageLatch, error) {
+	l := p.latch(pageNum)
+	l.lockShared()
+	if l.newest != nil {
+		return l, nil
+	}
+	l.unlockShared()
+
+	l.lock()
+	err := p.load(l, pageNum)
+	l.unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	l.lockShared()
+	return l, nil
+}
+
+// load reads the page from the file unless another reader did, its latch
+// must be held exclusively. A page not in memory has not changed since
+// the file was opened. A commit changing it reads it first, so a commit
+// never writes a page to the file while it is loaded
+func (p *pager) load(l *pageLatch, pageNum uint32) error {
+	if l.newest != nil {
+		return nil
+	}
+
+	p.mu.RLock()
+	offset, inFile := p.fileOffset(pageNum)
+	var mapping []byte
+	if p.mappings != nil {
+		mapping = p.mappings[len(p.mappings)-1]
+	}
+	p.mu.RUnlock()
+
+	// The last mapping reaches past the end of the file, see remap
+	if inFile && mapping != nil {
+		end := offset + int64(p.pageSize)
+		l.newest = &pageVersion{data: mapping[offset:end:end], mapped: true}
+		return nil
+	}
+
+	data := make([]byte, p.pageSize)
+	if inFile {
+		_, err := p.fileDescriptor.ReadAt(data, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	l.newest = &pageVersion{data: data}
+	return nil
+}
+
+// fileOffset returns where the newest committed version of the page
+// is in the file, false if it is not in the file. mu must be held
+func (p *pager) fileOffset(pageNum uint32) (int64, bool) {
+	if p.pageMap != nil {
+		return p.pageMap.pageOffset(pageNum)
+	}
+
+	offset := pageOffset(p.pageSize, pageNum)
+	return offset, offset < p.fileLength
+}
+
+// prefetch returns the committed page as of the snapshot, reading it
+// from the file if it is not in memory yet. It returns false if the
+// page cannot be read ahead
+func (p *pager) prefetch(seq uint64, pageNum uint32) ([]byte, bool) {
+	p.mu.RLock()
+	ahead := pageNum < p.committedPages && p.mappings == nil
+	p.mu.RUnlock()
+
+	if !ahead {
+		return nil, false
+	}
+
+	page, err := p.readVersion(seq, pageNum)
+	return page, err == nil
+}
+
+// remap adds a mapping of the file at least as long as the length, twice
+// as long as the last one if that is more. The file is mapped again every
+// time it grows past the last mapping, the mappings before stay until the
+// file is closed as readers may still read versions from them. mu must be
+// held unless the pager is being opened
+func (p *pager) remap(length int64) error {
+	size := int64(p.pageSize) * int64(mmapMinPages)
+	if n := len(p.mappings); n > 0 {
+		size = 2 * int64(len(p.mappings[n-1]))
+	}
+
+	if length > size {
+		size = length
+	}
+
+	mapping, err := mmap(p.fileDescriptor, size)
+	if err != nil {
+		return err
+	}
+
+	p.mappings = append(p.mappings, mapping)
+	return nil
+}
+
+// readingMapped reports whether a snapshot may still read a version of
+// a page committed since the last checkpoint from the mapping, which
+// the checkpoint would change. mu must not be held
+func (p *pager) readingMapped() bool {
+	p.mu.RLock()
+	latches := p.latchesOf(p.unflushed)
+	p.mu.RUnlock()
+
+	for _, l := range latches {
+		l.lockShared()
+		mapped := false
+		for v := l.newest.prev; v != nil && !mapped; v = v.prev {
+			mapped = v.mapped
+		}
+		l.unlockShared()
+
+		if mapped {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetPage returns the page as the writer sees it, with its uncommitted
+// changes. The page must not be changed, see getPageForWrite
 func (p *pager) GetPage(pageNum uint32) ([]byte, error) {
-	if pageNum > tableMaxPages {
+	page, l, err := p.latchPage(nil, pageNum)
+	l.unlockShared()
+	return page, err
+}
+
+// readBase returns the page as of the base of the write set
+func (p *pager) readBase(pageNum uint32) ([]byte, error) {
+	page, l, err := p.latchBase(pageNum)
+	l.unlockShared()
+	return page, err
+}
+
+// latchBase returns the page as of the base of the write set with its
+// latch held shared, a nil base reads the newest committed version
+func (p *pager) latchBase(pageNum uint32) ([]byte, *pageLatch, error) {
+	seq := uint64(math.MaxUint64)
+	if p.base != nil {
+		seq = p.base.seq
+	}
+
+	return p.latchVersion(seq, pageNum)
+}
+
+// getPageForWrite returns the writer's copy of the page, which it may
+// change. A page past the last one is allocated
+func (p *pager) getPageForWrite(pageNum uint32) ([]byte, error) {
+	if pageNum >= p.maxPages {
 		return nil, fmt.Errorf("page number: '%d' out of bounds, Max page is: '%d'",
 			pageNum,
-			tableMaxPages)
+			p.maxPages)
 	}
 
-	if p.pages[pageNum] == nil {
-		p.pages[pageNum] = make([]byte, pageSize)
+	p.preserve(pageNum)
+	if page, ok := p.dirty[pageNum]; ok {
+		return page, nil
+	}
 
-		numPages := p.fileLength / pageSize
+	page := make([]byte, p.pageSize)
 
-		if p.fileLength%pageSize != 0 {
-			numPages++
+	if pageNum < p.basePages {
+		data, err := p.readBase(pageNum)
+		if err != nil {
+			return nil, err
 		}
 
-		if pageNum <= numPages {
-			_, err := p.fileDescriptor.ReadAt(p.pages[pageNum], int64(pageNum*pageSize))
-			if err != nil && err != io.EOF {
-				return nil, err
+		copy(page, data)
+	}
+
+	p.dirty[pageNum] = page
+	if pageNum >= p.numPages {
+		p.numPages = pageNum + 1
+	}
+
+	return page, nil
+}
+
+// readPage returns the page as of the snapshot, a nil
+// snapshot reads the page as the writer sees it
+func (p *pager) readPage(s *snapshot, pageNum uint32) ([]byte, error) {
+	page, l, err := p.latchPage(s, pageNum)
+	l.unlockShared()
+	return page, err
+}
+
+// latchPage returns the page like readPage with its latch held shared,
+// the caller releases it with unlockShared. The pages the writer changed
+// are its own, nothing else reads them and they are not latched
+func (p *pager) latchPage(s *snapshot, pageNum uint32) ([]byte, *pageLatch, error) {
+	if s != nil {
+		if s.writes != nil {
+			if page, ok := s.writes.dirty[pageNum]; ok {
+				return page, nil, nil
 			}
 		}
+
+		return p.latchVersion(s.seq, pageNum)
 	}
 
-	if pageNum >= p.numPages {
-		p.numPages++
+	if pageNum >= p.maxPages {
+		return nil, nil, fmt.Errorf("page number: '%d' out of bounds, Max page is: '%d'",
+			pageNum,
+			p.maxPages)
+	}
+
+	if page, ok := p.dirty[pageNum]; ok {
+		return page, nil, nil
+	}
+
+	if pageNum >= p.basePages {
+		page, err := p.getPageForWrite(pageNum)
+		return page, nil, err
 	}
 
-	return p.pages[pageNum], nil
+	return p.latchBase(pageNum)
 }
 
-func (p pager) GetUnusedPageNum() uint32 {
+// readVersion returns the newest version of the page as of the commit
+func (p *pager) readVersion(seq uint64, pageNum uint32) ([]byte, error) {
+	page, l, err := p.latchVersion(seq, pageNum)
+	l.unlockShared()
+	return page, err
+}
+
+// latchVersion returns the newest version of the page as of the
+// commit with the latch of the page held shared
+func (p *pager) latchVersion(seq uint64, pageNum uint32) ([]byte, *pageLatch, error) {
+	l, err := p.latchShared(pageNum)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	v := l.newest
+	for v != nil && v.commit > seq {
+		v = v.prev
+	}
+
+	if v == nil {
+		l.unlockShared()
+		return nil, nil, fmt.Errorf("page %d is not part of the snapshot", pageNum)
+	}
+
+	return v.data, l, nil
+}
+
+// initializeRootTree creates the root of the tree at page 0 in a new
+// file, or checks the layout of the existing tree matches the given one
+func (p *pager) initializeRootTree(t *btree) error {
+	// A variable tree records sizes of 0
+	keySize, valueSize := uint32(0), uint32(0)
+	if !t.variable {
+		keySize, valueSize = t.key.Size(), t.valueSize
+	}
+
+	if p.numPages == 0 {
+		root, err := p.getPageForWrite(0)
+		if err != nil {
+			return err
+		}
+
+		initializeLeafNode(root)
+		setNodeRoot(root, true)
+
+		binary.LittleEndian.PutUint32(p.header[headerKeySizeOffset:headerKeySizeOffset+headerKeySizeSize], keySize)
+		binary.LittleEndian.PutUint32(p.header[headerValueSizeOffset:headerValueSizeOffset+headerValueSizeSize], valueSize)
+
+		return p.commit()
+	}
+
+	fileKeySize := binary.LittleEndian.Uint32(p.header[headerKeySizeOffset : headerKeySizeOffset+headerKeySizeSize])
+	fileValueSize := binary.LittleEndian.Uint32(p.header[headerValueSizeOffset : headerValueSizeOffset+headerValueSizeSize])
+
+	if fileKeySize != keySize || fileValueSize != valueSize {
+		return fmt.Errorf("DB file stores keys of %d bytes and values of %d bytes, expected %d and %d",
+			fileKeySize,
+			fileValueSize,
+			keySize,
+			valueSize)
+	}
+
+	return nil
+}
+
+// truncate drops the writer's pages from the page number on. Snapshots
+// older than the commit still read the pages, they are read before the
+// file is cut
+func (p *pager) truncate(numPages uint32) error {
+	for pageNum := numPages; pageNum < p.basePages; pageNum++ {
+		if _, err := p.readBase(pageNum); err != nil {
+			return err
+		}
+	}
+
+	for pageNum := range p.dirty {
+		if pageNum >= numPages {
+			p.preserve(pageNum)
+			delete(p.dirty, pageNum)
+		}
+	}
+
+	p.numPages = numPages
+	return nil
+}
+
+// shrink cuts the file to the pages of the last commit. A file written in
+// place is checkpointed first, a copy-on-write file loses the free slots
+// at its end. Only the writer shrinks the file
+func (p *pager) shrink() error {
+	if p.readOnly {
+		return nil
+	}
+
+	if p.pageMap != nil {
+		if err := p.relocate(); err != nil {
+			return err
+		}
+
+		return p.pageMap.truncate(p.fileDescriptor)
+	}
+
+	if err := p.checkpoint(); err != nil {
+		return err
+	}
+
+	// The checkpoint was put off for the readers of the mapping
+	if p.log.size != 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	length := pageOffset(p.pageSize, p.committedPages)
+	if length < p.fileLength && p.mappings != nil && !p.forgetPast(p.committedPages) {
+		length = p.fileLength
+	}
+	p.mu.Unlock()
+
+	if length >= p.fileLength {
+		return nil
+	}
+
+	if err := p.fileDescriptor.Truncate(length); err != nil {
+		return err
+	}
+
+	if p.durability != DurabilityOff {
+		if err := p.fileDescriptor.Sync(); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.fileLength = length
+	p.mu.Unlock()
+
+	return nil
+}
+
+// forgetPast drops the versions of the pages past the last one of a memory
+// mapped file before it is cut, reading them from the mapping would fail.
+// It does nothing if a snapshot older than the last commit may read them.
+// mu must be held
+func (p *pager) forgetPast(numPages uint32) bool {
+	for seq := range p.snapshots {
+		if seq < p.commitSeq {
+			return false
+		}
+	}
+
+	for pageNum := numPages; pageNum < uint32(len(p.pages)); pageNum++ {
+		delete(p.versioned, pageNum)
+	}
+
+	if numPages < uint32(len(p.pages)) {
+		p.pages = p.pages[:numPages]
+	}
+
+	return true
+}
+
+// relocate commits a copy of every page of a copy-on-write file in a slot
+// past the ones the file needs, the copies take the lowest free slots
+func (p *pager) relocate() error {
+	prev := p.install(p.latestWriteSet())
+	defer p.install(prev)
+
+	limit := p.pageMap.neededSlots()
+	for pageNum, slot := range p.pageMap.slots {
+		if slot < limit {
+			continue
+		}
+
+		if _, err := p.getPageForWrite(uint32(pageNum)); err != nil {
+			p.rollback()
+			return err
+		}
+	}
+
+	return p.commit()
+}
+
+func (p *pager) GetUnusedPageNum() uint32 {
 	return p.numPages
 }
 
-func NewPager(filename string) (*pager, error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+// pageOffset is where the page is in a file written in place,
+// the header before it takes up one page
+func pageOffset(pageSize, pageNum uint32) int64 {
+	return int64(pageNum+1) * int64(pageSize)
+}
+
+// newPageSize is the page size of a new file. A file written in place
+// which was never checkpointed may have commits in its log, they keep
+// the page size they were written with
+func newPageSize(filename string, options Options) (uint32, error) {
+	var size uint32
+	if !options.CopyOnWrite {
+		var err error
+		if size, err = loggedPageSize(filename); err != nil {
+			return 0, err
+		}
+	}
+
+	if size == 0 {
+		size = options.PageSize
+	}
+
+	if size == 0 {
+		size = DefaultPageSize
+	}
+
+	if !validPageSize(size) {
+		return 0, fmt.Errorf("invalid page size '%d', it must be a power of two from %d to %d", size, MinPageSize, MaxPageSize)
+	}
+
+	return size, nil
+}
+
+func newHeader(pageSize uint32) []byte {
+	header := make([]byte, pageSize)
+	copy(header[headerMagicOffset:headerMagicOffset+headerMagicSize], headerMagic)
+	binary.LittleEndian.PutUint32(header[headerVersionOffset:headerVersionOffset+headerVersionSize], headerFormatVersion)
+	binary.LittleEndian.PutUint32(header[headerPageSizeOffset:headerPageSizeOffset+headerPageSizeSize], pageSize)
+
+	return header
+}
+
+// readHeader reads the header at the start of a file written in place,
+// the page size it starts with is the size of the rest
+func readHeader(r io.ReaderAt) ([]byte, error) {
+	prefix := make([]byte, headerPrefixSize)
+	if _, err := r.ReadAt(prefix, 0); err != nil {
+		return nil, err
+	}
+
+	size, err := checkHeader(prefix)
 	if err != nil {
 		return nil, err
 	}
 
+	header := make([]byte, size)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// checkHeader checks the start of the header and returns the page size
+func checkHeader(header []byte) (uint32, error) {
+	if !bytes.Equal(header[headerMagicOffset:headerMagicOffset+headerMagicSize], headerMagic) {
+		return 0, errors.New("DB file is missing the database header. Corrupt file")
+	}
+
+	version := binary.LittleEndian.Uint32(header[headerVersionOffset : headerVersionOffset+headerVersionSize])
+	if version != headerFormatVersion {
+		return 0, fmt.Errorf("unsupported DB file version '%d'", version)
+	}
+
+	size := headerPageSize(header)
+	if !validPageSize(size) {
+		return 0, fmt.Errorf("DB file has an invalid page size '%d'. Corrupt file", size)
+	}
+
+	return size, nil
+}
+
+func headerPageSize(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[headerPageSizeOffset : headerPageSizeOffset+headerPageSizeSize])
+}
+
+// NewPager opens and locks the file, a new file is created copy-on-write
+// if the options ask for it. An existing file keeps its mode, the log of
+// one written in place is replayed. A file of an older version is
+// upgraded first, see upgrade
+func NewPager(filename string, options Options) (*pager, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if options.ReadOnly {
+		flag = os.O_RDONLY
+	}
+
+	file, err := os.OpenFile(filename, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file, options); err != nil {
+		file.Close()
+		return nil, err
+	}
+
 	stat, err := file.Stat()
 	if err != nil {
 		file.Close()
 		return nil, err
 	}
 
-	fl := uint32(stat.Size())
-	if fl%pageSize != 0 {
+	fl := stat.Size()
+	if fl == 0 && options.ReadOnly {
+		file.Close()
+		return nil, errors.New("DB file is empty, it cannot be created read only")
+	}
+
+	var header []byte
+	numPages := uint32(0)
+	var pm *pageMap
+
+	if fl != 0 {
+		legacy, err := openLegacy(file, fl)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		if legacy != nil {
+			err := upgrade(filename, legacy, options)
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			return NewPager(filename, options)
+		}
+	}
+
+	copyOnWrite := options.CopyOnWrite && fl == 0
+	if fl != 0 {
+		if copyOnWrite, err = isCopyOnWrite(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	switch {
+	case fl == 0:
+		size, err := newPageSize(filename, options)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		header = newHeader(size)
+		if copyOnWrite {
+			pm = newPageMap(size)
+		}
+	case copyOnWrite:
+		if pm, header, err = readPageMap(file, fl); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		numPages = uint32(len(pm.slots))
+	default:
+		if header, err = readHeader(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	size, err := checkHeader(header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if fl%int64(size) != 0 {
+		file.Close()
 		return nil, errors.New("DB file is not a whole number of pages. Corrupt file")
 	}
 
-	return &pager{
-		fileDescriptor: file,
-		fileLength:     fl,
-		pages:          make([][]byte, tableMaxPages),
-		numPages:       fl / pageSize,
-	}, nil
+	if pm == nil && fl != 0 {
+		numPages = uint32(fl/int64(size)) - 1
+	}
+
+	maxPages := tableMaxPages
+	if pm != nil && pm.maxPages() < maxPages {
+		maxPages = pm.maxPages()
+	}
+
+	p := &pager{
+		fileDescriptor:  file,
+		fileLength:      fl,
+		pageMap:         pm,
+		readOnly:        options.ReadOnly,
+		snapshots:       map[uint64]int{},
+		versioned:       map[uint32]bool{},
+		committedPages:  numPages,
+		committedHeader: header,
+		pageSize:        size,
+		maxPages:        maxPages,
+		unflushed:       map[uint32]bool{},
+		durability:      options.Durability,
+		dir:             filepath.Dir(filename),
+	}
+
+	if pm == nil {
+		if p.log, err = openLog(filename, options.ReadOnly, size); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if options.MemoryMap {
+		if pm != nil {
+			p.Close()
+			return nil, errors.New("only a file written in place is memory mapped")
+		}
+
+		if err := p.remap(fl); err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		p.memoryMapped = true
+	}
+
+	if options.ArchiveDir != "" {
+		if p.log == nil || p.readOnly {
+			p.Close()
+			return nil, errors.New("only a file written in place archives its log")
+		}
+
+		if err := os.MkdirAll(options.ArchiveDir, 0700); err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		p.log.archiveDir = options.ArchiveDir
+	}
+
+	if p.log != nil {
+		if err := p.replayLog(); err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		if p.durability == DurabilityFull && !p.readOnly {
+			p.log.group = newGroupCommit(p.log, headerLSN(p.committedHeader),
+				options.GroupCommitDelay, options.GroupCommitSize)
+		}
+	}
+
+	// A new file and its log are only there after a crash once the directory is synced
+	if fl == 0 && p.durability != DurabilityOff {
+		if err := syncDir(p.dir); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	p.writeSet = p.latestWriteSet()
+	return p, nil
 }
@@ -0,0 +1,442 @@
+package persist
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// AccessMethod is the way a plan reads rows from the table
+type AccessMethod int
+
+const (
+	FullScan AccessMethod = iota
+	PrimaryKeySeek
+	RangeScan
+	IndexScan
+)
+
+func (m AccessMethod) String() string {
+	switch m {
+	case FullScan:
+		return "Full Scan"
+	case PrimaryKeySeek:
+		return "Primary Key Seek"
+	case RangeScan:
+		return "Range Scan"
+	case IndexScan:
+		return "Index Scan"
+	default:
+		return "?"
+	}
+}
+
+// Costs of reading a row. Rows found through an index are looked up in
+// the table tree one at a time, which costs more than reading the leaves
+// of the table in order. Seeking to the start of a range costs a lookup
+const (
+	seqRowCost    = 1.0
+	lookupRowCost = 4.0
+)
+
+// Selectivities assumed for columns without statistics
+const (
+	defaultEqualSelectivity = 0.01
+	defaultRangeSelectivity = 1.0 / 3
+)
+
+// Plan describes how the rows matching a set of predicates are read.
+// The access method reads only rows matching Bounds, the Filter
+// predicates have to be checked against every row it reads.
+//
+// Once the table has been analyzed plans are chosen by cost and carry
+// the estimated number of rows matching all the predicates
+type Plan struct {
+	Method        AccessMethod
+	Index         *Index
+	Bounds        []Predicate
+	Filter        []Predicate
+	Estimated     bool
+	EstimatedRows uint32
+	Cost          float64
+}
+
+func (p *Plan) String() string {
+	return p.Describe("users")
+}
+
+// Describe describes the plan reading the table under the given name
+func (p *Plan) Describe(name string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s on %s", p.Method, name)
+
+	if p.Index != nil {
+		fmt.Fprintf(&b, " using %s", p.Index.name)
+	}
+
+	if len(p.Bounds) > 0 {
+		fmt.Fprintf(&b, " (%s)", joinPredicates(p.Bounds))
+	}
+
+	if p.Estimated {
+		fmt.Fprintf(&b, " (estimated rows=%d)", p.EstimatedRows)
+	}
+
+	return b.String()
+}
+
+// Matches reports whether a row read by the plan matches its filter
+func (p *Plan) Matches(r *Row) bool {
+	return matchesAll(r, p.Filter)
+}
+
+// Sequential reports whether the plan reads a range of ids, which
+// reads the leaves of the table in order
+func (p *Plan) Sequential() bool {
+	return p.Method == FullScan || p.Method == PrimaryKeySeek || p.Method == RangeScan
+}
+
+func joinPredicates(predicates []Predicate) string {
+	strs := make([]string, len(predicates))
+	for i, p := range predicates {
+		strs[i] = p.String()
+	}
+
+	return strings.Join(strs, " and ")
+}
+
+// Plan chooses how to read the rows matching all of the predicates.
+// With statistics the cheapest access method is chosen, see costPlan.
+// Without them, in order of preference, it seeks an id, scans an index
+// for an equal value, scans a range of ids, scans an index for a range
+// of values, and only then falls back to scanning the whole table
+func (t *Table) Plan(predicates []Predicate) (*Plan, error) {
+	c := t.visibleCatalog()
+
+	for _, p := range predicates {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if stats, ok := c.stats["id"]; ok {
+		return c.costPlan(predicates, float64(stats.RowCount)), nil
+	}
+
+	hasId, hasIdEqual := false, false
+	var equalIndex, rangeIndex *Index
+
+	for _, p := range predicates {
+		if p.Column == "id" {
+			hasId = true
+			hasIdEqual = hasIdEqual || p.Op == Equal
+			continue
+		}
+
+		idx, ok := c.indexOn(p.Column)
+		if !ok {
+			continue
+		}
+
+		if p.Op == Equal && equalIndex == nil {
+			equalIndex = idx
+		}
+
+		if rangeIndex == nil {
+			rangeIndex = idx
+		}
+	}
+
+	switch {
+	case hasIdEqual:
+		return newPlan(PrimaryKeySeek, nil, "id", predicates), nil
+	case equalIndex != nil:
+		return newPlan(IndexScan, equalIndex, equalIndex.column, predicates), nil
+	case hasId:
+		return newPlan(RangeScan, nil, "id", predicates), nil
+	case rangeIndex != nil:
+		return newPlan(IndexScan, rangeIndex, rangeIndex.column, predicates), nil
+	default:
+		return &Plan{Method: FullScan, Filter: predicates}, nil
+	}
+}
+
+// costPlan estimates the cost of every access method the predicates
+// allow and returns the cheapest, rowCount is the size of the table
+func (c catalog) costPlan(predicates []Predicate, rowCount float64) *Plan {
+	var candidates []*Plan
+
+	byColumn := map[string][]Predicate{}
+	for _, p := range predicates {
+		byColumn[p.Column] = append(byColumn[p.Column], p)
+	}
+
+	if ids, ok := byColumn["id"]; ok {
+		method := RangeScan
+		for _, p := range ids {
+			if p.Op == Equal {
+				method = PrimaryKeySeek
+			}
+		}
+
+		candidates = append(candidates, newPlan(method, nil, "id", predicates))
+	}
+
+	for _, idx := range c.indexes {
+		if _, ok := byColumn[idx.column]; ok {
+			candidates = append(candidates, newPlan(IndexScan, idx, idx.column, predicates))
+		}
+	}
+
+	candidates = append(candidates, &Plan{Method: FullScan, Filter: predicates})
+
+	var chosen *Plan
+	for _, plan := range candidates {
+		read := rowCount
+		if len(plan.Bounds) > 0 {
+			read *= c.selectivity(plan.Bounds[0].Column, plan.Bounds)
+		}
+
+		switch plan.Method {
+		case FullScan:
+			plan.Cost = read * seqRowCost
+		case IndexScan:
+			plan.Cost = lookupRowCost + read*lookupRowCost
+		default:
+			plan.Cost = lookupRowCost + read*seqRowCost
+		}
+
+		if chosen == nil || plan.Cost < chosen.Cost {
+			chosen = plan
+		}
+	}
+
+	estimate := rowCount
+	for column, preds := range byColumn {
+		estimate *= c.selectivity(column, preds)
+	}
+
+	chosen.Estimated = true
+	chosen.EstimatedRows = uint32(math.Round(estimate))
+
+	return chosen
+}
+
+// selectivity estimates the fraction of rows matching all
+// of the predicates, which must all be on the column
+func (c catalog) selectivity(column string, predicates []Predicate) float64 {
+	if s, ok := c.stats[column]; ok {
+		return s.selectivity(predicates)
+	}
+
+	for _, p := range predicates {
+		if p.Op == Equal {
+			return defaultEqualSelectivity
+		}
+	}
+
+	return defaultRangeSelectivity
+}
+
+// newPlan splits the predicates into the bounds on the column
+// the access method reads by and the filter on the other columns
+func newPlan(method AccessMethod, idx *Index, column string, predicates []Predicate) *Plan {
+	plan := &Plan{Method: method, Index: idx}
+
+	for _, p := range predicates {
+		if p.Column == column {
+			plan.Bounds = append(plan.Bounds, p)
+		} else {
+			plan.Filter = append(plan.Filter, p)
+		}
+	}
+
+	return plan
+}
+
+// Scan calls fn for every row matching all of the predicates in order
+// of the scanned tree, it stops at the first error returned by fn
+func (t *Table) Scan(predicates []Predicate, fn func(r *Row) error) error {
+	plan, err := t.Plan(predicates)
+	if err != nil {
+		return err
+	}
+
+	return t.ScanPlan(plan, func(r *Row) error {
+		if !plan.Matches(r) {
+			return nil
+		}
+
+		return fn(r)
+	})
+}
+
+// ScanPlan calls fn for every row the plan's access method reads,
+// these match the plan's bounds but not necessarily its filter
+func (t *Table) ScanPlan(plan *Plan, fn func(r *Row) error) error {
+	c, err := t.OpenPlan(plan)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	for {
+		r, err := c.Next()
+		if err != nil || r == nil {
+			return err
+		}
+
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+}
+
+// RowCursor reads the rows of a plan's access method one at a time.
+// The table may be changed while it is in use, the cursor reads the
+// rows as of the snapshot it was opened in
+type RowCursor struct {
+	table  *Table
+	cursor *Cursor
+	bounds []Predicate
+
+	// index is set for index scans which stop after upperKey,
+	// id scans stop after upperId
+	index    *Index
+	upperKey []byte
+	upperId  uint32
+}
+
+// OpenPlan positions a cursor before the first row the plan reads
+func (t *Table) OpenPlan(plan *Plan) (*RowCursor, error) {
+	switch plan.Method {
+	case PrimaryKeySeek, RangeScan:
+		return t.openIds(plan.Bounds)
+	case IndexScan:
+		return plan.Index.open(t, plan.Bounds)
+	default:
+		return t.openIds(nil)
+	}
+}
+
+// openIds reads the rows in the range of ids allowed by the predicates
+func (t *Table) openIds(predicates []Predicate) (*RowCursor, error) {
+	lower, upper, ok := idBounds(predicates)
+	if !ok {
+		return &RowCursor{table: t}, nil
+	}
+
+	s, release := t.reading()
+	c, err := t.tree.seek(s, release, rowKey(lower))
+	if err != nil {
+		return nil, err
+	}
+
+	return &RowCursor{table: t, cursor: c, bounds: predicates, upperId: upper}, nil
+}
+
+// Next returns the next row matching the bounds, nil once there are none
+func (c *RowCursor) Next() (*Row, error) {
+	for c.cursor != nil && !c.cursor.endOfTable {
+		r, err := c.read()
+		if err != nil || r == nil {
+			c.Close()
+			return nil, err
+		}
+
+		if err := c.cursor.Advance(); err != nil {
+			return nil, err
+		}
+
+		if matchesAll(r, c.bounds) {
+			return r, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Close releases the snapshot of the cursor, which is
+// released anyway once the last row has been read
+func (c *RowCursor) Close() {
+	if c.cursor != nil {
+		c.cursor.Close()
+		c.cursor = nil
+	}
+}
+
+// read returns the row under the cursor, nil when it is past the bound
+func (c *RowCursor) read() (*Row, error) {
+	if c.index != nil {
+		return c.index.read(c.table, c.cursor, c.upperKey)
+	}
+
+	v, err := c.cursor.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	r := serializedRow(v).Deserialize()
+	if r.id > c.upperId {
+		return nil, nil
+	}
+
+	return r, nil
+}
+
+// idBounds returns the inclusive range of ids which can satisfy
+// the predicates on the id column, ok is false if there is none
+func idBounds(predicates []Predicate) (lower, upper uint32, ok bool) {
+	lower, upper = 0, math.MaxUint32
+
+	for _, p := range predicates {
+		if p.Column != "id" {
+			continue
+		}
+
+		// The value has been validated when the plan was made
+		n, _ := strconv.ParseUint(p.Value, 10, 32)
+		v := uint32(n)
+
+		switch p.Op {
+		case Equal:
+			if v > lower {
+				lower = v
+			}
+
+			if v < upper {
+				upper = v
+			}
+
+		case Greater, GreaterOrEqual:
+			if p.Op == Greater {
+				if v == math.MaxUint32 {
+					return 0, 0, false
+				}
+
+				v++
+			}
+
+			if v > lower {
+				lower = v
+			}
+
+		case Less, LessOrEqual:
+			if p.Op == Less {
+				if v == 0 {
+					return 0, 0, false
+				}
+
+				v--
+			}
+
+			if v < upper {
+				upper = v
+			}
+		}
+	}
+
+	return lower, upper, lower <= upper
+}
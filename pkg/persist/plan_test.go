@@ -0,0 +1,89 @@
+package persist
+
+import (
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestPlanChoosesAccessMethod(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 100)
+
+	if err := tbl.CreateIndex("idx_email", "email", true); err != nil {
+		t.Fatalf("Unable to create index: '%s'", err)
+	}
+
+	tests := []struct {
+		predicates []Predicate
+		plan       string
+		rows       int
+	}{
+		{nil, "Full Scan on users", 100},
+		{
+			[]Predicate{{Column: "username", Op: Equal, Value: "user#5"}},
+			"Full Scan on users", 1,
+		},
+		{
+			[]Predicate{{Column: "email", Op: Greater, Value: "person#9"}, {Column: "id", Op: Equal, Value: "95"}},
+			"Primary Key Seek on users (id = 95)", 1,
+		},
+		{
+			[]Predicate{{Column: "id", Op: Greater, Value: "10"}, {Column: "email", Op: Equal, Value: "person#50@example.com"}},
+			"Index Scan on users using idx_email (email = person#50@example.com)", 1,
+		},
+		{
+			[]Predicate{{Column: "id", Op: Greater, Value: "10"}, {Column: "id", Op: LessOrEqual, Value: "20"}},
+			"Range Scan on users (id > 10 and id <= 20)", 10,
+		},
+		{
+			[]Predicate{{Column: "id", Op: Less, Value: "0"}},
+			"Range Scan on users (id < 0)", 0,
+		},
+		{
+			[]Predicate{{Column: "email", Op: Less, Value: "person#2"}, {Column: "username", Op: Greater, Value: "user#1"}},
+			"Index Scan on users using idx_email (email < person#2)", 10,
+		},
+	}
+
+	for _, test := range tests {
+		plan, err := tbl.Plan(test.predicates)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if plan.String() != test.plan {
+			t.Fatalf("Expected plan '%s' for %v, got '%s'", test.plan, test.predicates, plan)
+		}
+
+		if rows := selectIds(t, tbl, test.predicates...); len(rows) != test.rows {
+			t.Fatalf("Expected %d rows for %v, got %v", test.rows, test.predicates, rows)
+		}
+	}
+}
+
+func TestIdBounds(t *testing.T) {
+	tests := []struct {
+		predicates []Predicate
+		bounds     string
+	}{
+		{nil, "0 4294967295 true"},
+		{[]Predicate{{Column: "id", Op: Greater, Value: "4294967295"}}, "0 0 false"},
+		{[]Predicate{{Column: "id", Op: GreaterOrEqual, Value: "5"}, {Column: "id", Op: Less, Value: "5"}}, "5 4 false"},
+		{[]Predicate{{Column: "id", Op: Equal, Value: "7"}, {Column: "id", Op: Less, Value: "100"}}, "7 7 true"},
+	}
+
+	for _, test := range tests {
+		lower, upper, ok := idBounds(test.predicates)
+		if bounds := fmt.Sprint(lower, upper, ok); bounds != test.bounds {
+			t.Fatalf("Expected bounds '%s' for %v, got '%s'", test.bounds, test.predicates, bounds)
+		}
+	}
+}
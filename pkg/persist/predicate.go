@@ -0,0 +1,153 @@
+package persist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Operator int
+
+const (
+	Equal Operator = iota
+	Less
+	LessOrEqual
+	Greater
+	GreaterOrEqual
+)
+
+var operators = map[string]Operator{
+	"=":  Equal,
+	"<":  Less,
+	"<=": LessOrEqual,
+	">":  Greater,
+	">=": GreaterOrEqual,
+}
+
+func ParseOperator(s string) (Operator, error) {
+	op, ok := operators[s]
+	if !ok {
+		return 0, fmt.Errorf("unrecognized operator '%s'", s)
+	}
+
+	return op, nil
+}
+
+func (o Operator) String() string {
+	for s, op := range operators {
+		if op == o {
+			return s
+		}
+	}
+
+	return "?"
+}
+
+// Predicate compares a column of the row against a constant. The id
+// column is compared as a number, the other columns as strings
+type Predicate struct {
+	Column string
+	Op     Operator
+	Value  string
+}
+
+func (p Predicate) String() string {
+	return fmt.Sprintf("%s %s %s", p.Column, p.Op, p.Value)
+}
+
+func (p Predicate) validate() error {
+	if p.Column == "id" {
+		if _, err := strconv.ParseUint(p.Value, 10, 32); err != nil {
+			return fmt.Errorf("invalid user id: '%s'", p.Value)
+		}
+
+		return nil
+	}
+
+	if _, ok := indexedColumns[p.Column]; !ok {
+		return fmt.Errorf("unknown column '%s'", p.Column)
+	}
+
+	return nil
+}
+
+// Matches reports whether the row satisfies the predicate, the
+// predicate must have been validated by planning a scan with it
+func (p Predicate) Matches(r *Row) bool {
+	var cmp int
+
+	if p.Column == "id" {
+		// The value has been validated before the scan started
+		id, _ := strconv.ParseUint(p.Value, 10, 32)
+
+		switch {
+		case r.id < uint32(id):
+			cmp = -1
+		case r.id > uint32(id):
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(columnValue(r, p.Column), p.Value)
+	}
+
+	switch p.Op {
+	case Equal:
+		return cmp == 0
+	case Less:
+		return cmp < 0
+	case LessOrEqual:
+		return cmp <= 0
+	case Greater:
+		return cmp > 0
+	case GreaterOrEqual:
+		return cmp >= 0
+	default:
+		return false
+	}
+}
+
+func matchesAll(r *Row, predicates []Predicate) bool {
+	for _, p := range predicates {
+		if !p.Matches(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// columnBounds returns the smallest range of values of the column
+// which can satisfy the predicates, nil means the side is unbounded
+func columnBounds(column string, predicates []Predicate) (lower, upper *string) {
+	for i := range predicates {
+		p := predicates[i]
+		if p.Column != column {
+			continue
+		}
+
+		if p.Op == Equal || p.Op == Greater || p.Op == GreaterOrEqual {
+			if lower == nil || p.Value > *lower {
+				lower = &predicates[i].Value
+			}
+		}
+
+		if p.Op == Equal || p.Op == Less || p.Op == LessOrEqual {
+			if upper == nil || p.Value < *upper {
+				upper = &predicates[i].Value
+			}
+		}
+	}
+
+	return lower, upper
+}
+
+func columnValue(r *Row, column string) string {
+	switch column {
+	case "username":
+		return r.username
+	case "email":
+		return r.email
+	default:
+		return strconv.FormatUint(uint64(r.id), 10)
+	}
+}
@@ -0,0 +1,85 @@
+package persist
+
+// A scan reads the leaves of a tree one after the other along their
+// chain. Once a cursor has moved to the next leaf readAheadTrigger times
+// in a row a read-ahead loads the readAheadLeaves leaves after the one it
+// is at into memory in the background, so the scan finds them there
+// instead of waiting for each to be read from the file
+const (
+	readAheadTrigger uint32 = 2
+	readAheadLeaves  uint32 = 8
+)
+
+// readAhead follows the leaves a scan moves to, it reads the
+// pages as of the snapshot of the scan until it is stopped
+type readAhead struct {
+	pager *pager
+	seq   uint64
+	next  chan uint32
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func startReadAhead(p *pager, seq uint64) *readAhead {
+	r := &readAhead{
+		pager: p,
+		seq:   seq,
+		next:  make(chan uint32, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	go r.run()
+	return r
+}
+
+// at tells the read-ahead the scan moved to the leaf, it replaces
+// a leaf the read-ahead has not got to yet. Only the cursor calls it
+func (r *readAhead) at(pageNum uint32) {
+	select {
+	case <-r.next:
+	default:
+	}
+
+	r.next <- pageNum
+}
+
+// close stops the read-ahead once the page it is reading is loaded
+func (r *readAhead) close() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *readAhead) run() {
+	defer close(r.done)
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case pageNum := <-r.next:
+			r.load(pageNum)
+		}
+	}
+}
+
+// load reads the leaves after the leaf which are not in memory yet,
+// it gives up at a page which cannot be read ahead
+func (r *readAhead) load(pageNum uint32) {
+	for i := uint32(0); i <= readAheadLeaves; i++ {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		page, ok := r.pager.prefetch(r.seq, pageNum)
+		if !ok {
+			return
+		}
+
+		if pageNum = getLeafNodeNextLeaf(page); pageNum == 0 {
+			return
+		}
+	}
+}
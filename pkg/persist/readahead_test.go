@@ -0,0 +1,115 @@
+package persist
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+// loadedAhead counts the leaves after the one the cursor is
+// at which are in memory, up to the first one which is not
+func loadedAhead(tbl *Table, c *Cursor) uint32 {
+	n, pageNum := uint32(0), c.pageNum
+	for n < readAheadLeaves {
+		pageNum = getLeafNodeNextLeaf(loadedPage(tbl.pager, pageNum))
+		if pageNum == 0 || loadedPage(tbl.pager, pageNum) == nil {
+			break
+		}
+
+		n++
+	}
+
+	return n
+}
+
+// loadedPage returns the newest version of a page if it is in memory
+func loadedPage(p *pager, pageNum uint32) []byte {
+	p.mu.RLock()
+	var l *pageLatch
+	if pageNum < uint32(len(p.pages)) {
+		l = p.pages[pageNum]
+	}
+	p.mu.RUnlock()
+
+	if l == nil {
+		return nil
+	}
+
+	l.lockShared()
+	defer l.unlockShared()
+
+	if l.newest == nil {
+		return nil
+	}
+
+	return l.newest.data
+}
+
+func TestReadAhead(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 2000)
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Nothing is in memory after reopening
+	tbl, err = OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	c, err := TableStart(tbl)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer c.Close()
+
+	rows := 0
+	for c.leaves < readAheadTrigger {
+		if err := c.Advance(); err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		rows++
+	}
+
+	if c.readAhead == nil {
+		t.Fatalf("Expected the scan to read ahead after %d leaves", c.leaves)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for loadedAhead(tbl, c) < readAheadLeaves {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d leaves to be read ahead, got %d", readAheadLeaves, loadedAhead(tbl, c))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	for !c.endOfTable {
+		if err := c.Advance(); err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		rows++
+	}
+
+	if rows != 2000 {
+		t.Fatalf("Expected the scan to read 2000 rows, got %d", rows)
+	}
+
+	if c.readAhead != nil {
+		t.Fatalf("Expected the read-ahead to stop at the end of the table")
+	}
+}
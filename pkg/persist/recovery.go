@@ -0,0 +1,224 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every restore starts a new timeline, the history of the database from
+// then on. A point in time restore leaves the commits after the target
+// behind, the restored database reuses their sequence numbers on its own
+// timeline. Segments are named after the timeline and the sequence number
+// of their first commit so the histories are kept apart in one archive
+const (
+	segmentTimelineDigits = 8
+	segmentLSNDigits      = 16
+)
+
+// segmentName is the name of the segment of the timeline which
+// starts with the commit, segments of a timeline sort by it
+func segmentName(timeline, lsn uint64) string {
+	return fmt.Sprintf("%0*x%0*x%s", segmentTimelineDigits, timeline, segmentLSNDigits, lsn, walSegmentSuffix)
+}
+
+// parseSegmentName returns the timeline and the first commit of the
+// segment. A segment archived before there were timelines is named
+// after its first commit only and is of timeline 0
+func parseSegmentName(name string) (uint64, uint64, bool) {
+	if !strings.HasSuffix(name, walSegmentSuffix) {
+		return 0, 0, false
+	}
+
+	name = strings.TrimSuffix(name, walSegmentSuffix)
+
+	var timeline uint64
+	switch len(name) {
+	case segmentTimelineDigits + segmentLSNDigits:
+		var err error
+		if timeline, err = strconv.ParseUint(name[:segmentTimelineDigits], 16, 64); err != nil {
+			return 0, 0, false
+		}
+
+		name = name[segmentTimelineDigits:]
+	case segmentLSNDigits:
+	default:
+		return 0, 0, false
+	}
+
+	lsn, err := strconv.ParseUint(name, 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return timeline, lsn, true
+}
+
+// archivedTimeline returns the highest timeline of the segments
+// in the directory, 0 if it has none or does not exist
+func archivedTimeline(archiveDir string) (uint64, error) {
+	if archiveDir == "" {
+		return 0, nil
+	}
+
+	entries, err := os.ReadDir(archiveDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	var highest uint64
+	for _, entry := range entries {
+		if timeline, _, ok := parseSegmentName(entry.Name()); ok && !entry.IsDir() && timeline > highest {
+			highest = timeline
+		}
+	}
+
+	return highest, nil
+}
+
+// RecoveryTarget is the point RestoreUntil replays the archived log up to,
+// the last commit at or before the sequence number and the time. A zero
+// field is no limit, with both zero every archived commit is replayed
+type RecoveryTarget struct {
+	LSN  uint64
+	Time time.Time
+}
+
+func (target RecoveryTarget) includes(r *logRecord) bool {
+	if target.LSN != 0 && r.lsn > target.LSN {
+		return false
+	}
+
+	return target.Time.IsZero() || !r.time.After(target.Time)
+}
+
+// RestoreUntil restores the backup like Restore and replays the commits
+// of the log segments archived to the directory after it up to the
+// target. Only the segments of the timeline of the backup are replayed.
+// The commits since the last checkpoint are only in the log of the
+// database, they are archived by the checkpoint when it is closed
+func RestoreUntil(filename string, base io.Reader, archiveDir string, target RecoveryTarget, options Options) error {
+	return restore(filename, archiveDir, options, func(file *os.File) error {
+		lsn, pageSize, err := copyBackup(file, base)
+		if err != nil {
+			return err
+		}
+
+		header, err := readHeader(file)
+		if err != nil {
+			return err
+		}
+
+		lsn, err = replayArchive(file, archiveDir, headerTimeline(header), lsn, pageSize, target)
+		if err != nil {
+			return err
+		}
+
+		if target.LSN != 0 && lsn != target.LSN {
+			return fmt.Errorf("archived log ends at '%d' before '%d'", lsn, target.LSN)
+		}
+
+		return nil
+	})
+}
+
+// replayArchive writes the commits of the segments of the timeline in the
+// directory after the log sequence number up to the target to the file
+// with pages of the size, it returns the number of the last commit written
+func replayArchive(file *os.File, archiveDir string, timeline, lsn uint64, pageSize uint32, target RecoveryTarget) (uint64, error) {
+	entries, err := os.ReadDir(archiveDir)
+	if err != nil {
+		return 0, err
+	}
+
+	type segment struct {
+		name string
+		lsn  uint64
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		t, first, ok := parseSegmentName(entry.Name())
+		if entry.IsDir() || !ok || t != timeline {
+			continue
+		}
+
+		segments = append(segments, segment{name: entry.Name(), lsn: first})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].lsn < segments[j].lsn
+	})
+
+	for _, s := range segments {
+		segment, err := os.Open(filepath.Join(archiveDir, s.name))
+		if err != nil {
+			return 0, err
+		}
+
+		done, err := replaySegment(file, segment, timeline, &lsn, pageSize, target)
+		segment.Close()
+
+		if err != nil || done {
+			return lsn, err
+		}
+	}
+
+	return lsn, nil
+}
+
+// replaySegment writes the commits of the segment of the timeline after the
+// log sequence number to the file and advances it. It is done once it
+// reached a commit after the target
+func replaySegment(file *os.File, segment *os.File, timeline uint64, lsn *uint64, pageSize uint32, target RecoveryTarget) (bool, error) {
+	var offset int64
+	for {
+		r, size, err := readLogRecord(segment, offset, pageSize)
+		if err != nil {
+			return false, err
+		}
+
+		if r == nil {
+			return false, nil
+		}
+
+		offset += size
+		if r.lsn <= *lsn || headerTimeline(r.header) != timeline {
+			continue
+		}
+
+		if !target.includes(r) {
+			return true, nil
+		}
+
+		if r.lsn != *lsn+1 {
+			return false, fmt.Errorf("archived log is missing the commits after '%d'", *lsn)
+		}
+
+		for pageNum, data := range r.pages {
+			if _, err := file.WriteAt(data, pageOffset(pageSize, pageNum)); err != nil {
+				return false, err
+			}
+		}
+
+		if _, err := file.WriteAt(r.header, 0); err != nil {
+			return false, err
+		}
+
+		if err := file.Truncate(pageOffset(pageSize, r.numPages)); err != nil {
+			return false, err
+		}
+
+		*lsn = r.lsn
+	}
+}
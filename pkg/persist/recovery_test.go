@@ -0,0 +1,153 @@
+package persist
+
+import (
+	"bytes"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRestoreUntil(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	archive := path.Join(testDirPath, "archive")
+	tbl, err := OpenDatabaseWithOptions(path.Join(testDirPath, "test.db"), Options{ArchiveDir: archive})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 100)
+
+	var base bytes.Buffer
+	if err := tbl.Backup(&base); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Enough pages to checkpoint in between
+	insertUsers(t, tbl, 100, int(walCheckpointPages)+200)
+	lsn, before := tbl.LSN(), time.Now()
+
+	for i := 0; i < 50; i++ {
+		if err := tbl.Delete(uint32(i)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	// Closing archives the commits since the last checkpoint
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	restored := path.Join(testDirPath, "restored.db")
+	for _, tt := range []struct {
+		name   string
+		target RecoveryTarget
+		rows   int
+	}{
+		{"lsn", RecoveryTarget{LSN: lsn}, int(walCheckpointPages) + 200},
+		{"time", RecoveryTarget{Time: before}, int(walCheckpointPages) + 200},
+		{"latest", RecoveryTarget{}, int(walCheckpointPages) + 150},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := RestoreUntil(restored, bytes.NewReader(base.Bytes()), archive, tt.target, Options{}); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			tbl, err := OpenDatabase(restored)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			defer tbl.Close()
+
+			if ids := checkScan(t, tbl, false); len(ids) != tt.rows {
+				t.Fatalf("Expected %d rows, got %d", tt.rows, len(ids))
+			}
+		})
+	}
+
+	if err := RestoreUntil(restored, bytes.NewReader(base.Bytes()), archive, RecoveryTarget{LSN: lsn + 1000}, Options{}); err == nil {
+		t.Fatalf("Expected a target after the archived log to be rejected")
+	}
+}
+
+func TestRestoreUntilFollowsTimeline(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	archive := path.Join(testDirPath, "archive")
+	tbl, err := OpenDatabaseWithOptions(path.Join(testDirPath, "test.db"), Options{ArchiveDir: archive})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 100)
+
+	var base bytes.Buffer
+	if err := tbl.Backup(&base); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 100, 200)
+	lsn := tbl.LSN()
+
+	// The history the first restore leaves behind
+	for i := 0; i < 50; i++ {
+		if err := tbl.Delete(uint32(i)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	restored := path.Join(testDirPath, "restored.db")
+	if err := RestoreUntil(restored, bytes.NewReader(base.Bytes()), archive, RecoveryTarget{LSN: lsn}, Options{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// The restored database commits on its own timeline after the target
+	tbl, err = OpenDatabaseWithOptions(restored, Options{ArchiveDir: archive})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var branch bytes.Buffer
+	if err := tbl.Backup(&branch); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 200, 210)
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		base []byte
+		rows int
+	}{
+		{"restored", branch.Bytes(), 210},
+		{"original", base.Bytes(), 150},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			again := path.Join(testDirPath, "again.db")
+			if err := RestoreUntil(again, bytes.NewReader(tt.base), archive, RecoveryTarget{}, Options{}); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			tbl, err := OpenDatabase(again)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			defer tbl.Close()
+
+			if ids := checkScan(t, tbl, false); len(ids) != tt.rows {
+				t.Fatalf("Expected %d rows, got %d", tt.rows, len(ids))
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package persist
+
+import "fmt"
+
+// savepoint is the state of a transaction to roll back to, its catalog
+// and the number of its changes. The pages are saved by the write set
+// of the transaction, the i-th savepoint is its i-th save
+type savepoint struct {
+	name    string
+	catalog catalog
+	changes int
+}
+
+// Savepoint marks the state of the transaction so the changes made after
+// it can be rolled back without the ones before. Savepoints nest, one
+// with the name of an earlier one hides it until it is released
+func (tx *Tx) Savepoint(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.writes.save()
+	tx.savepoints = append(tx.savepoints, savepoint{
+		name:    name,
+		catalog: tx.catalog,
+		changes: len(tx.changes),
+	})
+
+	return nil
+}
+
+// Release forgets the newest savepoint with the name and the ones after
+// it, the changes made since are kept as part of the transaction
+func (tx *Tx) Release(name string) error {
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+
+	tx.writes.release(i)
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+// RollbackTo drops the changes made since the newest savepoint with the
+// name and forgets the savepoints after it. The savepoint itself is kept
+// so it can be rolled back to again, the rows locked since stay locked
+func (tx *Tx) RollbackTo(name string) error {
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+
+	sp := tx.savepoints[i]
+	tx.writes.restore(i)
+	tx.catalog = sp.catalog
+	tx.changes = tx.changes[:sp.changes]
+	tx.savepoints = tx.savepoints[:i+1]
+
+	return nil
+}
+
+func (tx *Tx) findSavepoint(name string) (int, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no savepoint named '%s'", name)
+}
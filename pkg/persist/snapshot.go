@@ -0,0 +1,128 @@
+package persist
+
+import "errors"
+
+var ErrReadOnly = errors.New("a snapshot of the table or a read only database cannot be changed")
+
+// catalog is the indexes and statistics of the table as of a commit,
+// they are replaced rather than changed in place
+type catalog struct {
+	indexes []*Index
+	stats   map[string]*ColumnStats
+}
+
+// Snapshot returns a handle which reads the table as of the last commit
+// until it is released, every read through it sees the same rows however
+// the table changes meanwhile. The versions of the pages it reads are
+// kept for it so Release must be called once it is done. The handle of
+// a transaction is returned as it is, a transaction reads its own changes
+func (t *Table) Snapshot() *Table {
+	if t.writing || t.tx != nil {
+		return t
+	}
+
+	if t.snapshot != nil {
+		return &Table{tableState: t.tableState, snapshot: t.snapshot.share(), snapshotCatalog: t.snapshotCatalog}
+	}
+
+	t.catalogLock.RLock()
+	defer t.catalogLock.RUnlock()
+
+	return &Table{tableState: t.tableState, snapshot: t.pager.acquireSnapshot(), snapshotCatalog: t.committed}
+}
+
+// Release lets the versions of the pages only a handle returned by
+// Snapshot reads be collected, it has no effect on other handles
+func (t *Table) Release() {
+	if t.snapshot != nil && t.tx == nil {
+		t.snapshot.release()
+	}
+}
+
+// reading returns the snapshot a read through the handle sees and the
+// function to call once the read is done. A nil snapshot reads the
+// table as the writer sees it
+func (t *Table) reading() (*snapshot, func()) {
+	switch {
+	case t.writing:
+		return nil, func() {}
+	case t.snapshot != nil:
+		return t.snapshot, func() {}
+	default:
+		s := t.pager.acquireSnapshot()
+		return s, s.release
+	}
+}
+
+// visibleCatalog returns the indexes and statistics reads through the handle see
+func (t *Table) visibleCatalog() catalog {
+	switch {
+	case t.writing:
+		return catalog{indexes: t.indexes, stats: t.stats}
+	case t.tx != nil:
+		return t.tx.catalog
+	case t.snapshot != nil:
+		return t.snapshotCatalog
+	default:
+		t.catalogLock.RLock()
+		defer t.catalogLock.RUnlock()
+
+		return t.committed
+	}
+}
+
+// Change runs fn with the handle of a transaction. Through the handle of
+// a transaction fn is part of it, otherwise fn runs in a transaction of
+// its own which is committed once fn returns or rolled back if it fails
+func (t *Table) Change(fn func(w *Table) error) error {
+	switch {
+	case t.tx != nil && t.tx.done:
+		return ErrTxDone
+	case t.writing || t.tx != nil:
+		return fn(t)
+	case t.snapshot != nil || t.pager.readOnly:
+		return ErrReadOnly
+	}
+
+	tx, err := t.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx.Table()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// apply makes a change to the rows with the ids, see Tx.run.
+// A writing handle makes the change to the pages it changes
+func (t *Table) apply(ids []uint32, fn func(w *Table) error) error {
+	if t.writing {
+		return fn(t)
+	}
+
+	return t.Change(func(w *Table) error {
+		return w.tx.run(ids, fn)
+	})
+}
+
+// commit makes the writer's pages and catalog the ones snapshots read,
+// they are dropped if they cannot be written to the file
+func (t *tableState) commit() error {
+	if err := t.pager.write(); err != nil {
+		t.indexes, t.stats = t.committed.indexes, t.committed.stats
+		return err
+	}
+
+	t.catalogLock.Lock()
+	defer t.catalogLock.Unlock()
+
+	t.pager.publish()
+	t.committed = catalog{indexes: t.indexes, stats: t.stats}
+	t.pager.autoCheckpoint()
+
+	return nil
+}
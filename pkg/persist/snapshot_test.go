@@ -0,0 +1,173 @@
+package persist
+
+import (
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotIsolation(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	insertUsers(t, tbl, 0, 100)
+
+	snap := tbl.Snapshot()
+
+	// Enough rows to split leaves and grow the tree under the snapshot
+	insertUsers(t, tbl, 100, 400)
+	for i := 0; i < 100; i += 2 {
+		if err := tbl.Delete(uint32(i)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if err := tbl.CreateIndex("idx_username", "username", true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ids := checkScan(t, snap, false); len(ids) != 100 || ids[0] != 0 {
+		t.Fatalf("Expected the snapshot to read the first 100 rows, got %d", len(ids))
+	}
+
+	if ids := checkScan(t, snap, true); len(ids) != 100 {
+		t.Fatalf("Expected the snapshot to read 100 rows in batches, got %d", len(ids))
+	}
+
+	if r, err := snap.Lookup(0); err != nil || r == nil {
+		t.Fatalf("Expected row 0 to be in the snapshot, got %v %v", r, err)
+	}
+
+	if len(snap.Indexes()) != 0 {
+		t.Fatalf("Expected the index created after the snapshot to be hidden")
+	}
+
+	if err := snap.Insert(&Row{id: 1000}); err != ErrReadOnly {
+		t.Fatalf("Expected a snapshot to reject changes, got %v", err)
+	}
+
+	if ids := checkScan(t, tbl, false); len(ids) != 350 {
+		t.Fatalf("Expected 350 rows, got %d", len(ids))
+	}
+
+	snap.Release()
+}
+
+func TestSnapshotVersionsCollected(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	insertUsers(t, tbl, 0, 200)
+	pages := tbl.pager.numVersions()
+
+	snap := tbl.Snapshot()
+	for i := 0; i < 200; i++ {
+		if err := tbl.Delete(uint32(i)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if tbl.pager.numVersions() <= pages {
+		t.Fatalf("Expected the versions read by the snapshot to be kept")
+	}
+
+	if ids := checkScan(t, snap, false); len(ids) != 200 {
+		t.Fatalf("Expected the snapshot to read 200 rows, got %d", len(ids))
+	}
+
+	snap.Release()
+
+	if n := tbl.pager.numVersions(); n != pages {
+		t.Fatalf("Expected %d versions once the snapshot was released, got %d", pages, n)
+	}
+
+	// A cursor abandoned before the end of the table holds its snapshot until closed
+	insertUsers(t, tbl, 0, 10)
+	pages = tbl.pager.numVersions()
+
+	c, err := TableStart(tbl)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	row, err := NewRow(0, "user#0", "changed@example.com")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tbl.Update(row); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if tbl.pager.numVersions() == pages {
+		t.Fatalf("Expected the versions read by the cursor to be kept")
+	}
+
+	c.Close()
+
+	if n := tbl.pager.numVersions(); n != pages {
+		t.Fatalf("Expected %d versions once the cursor was closed, got %d", pages, n)
+	}
+}
+
+func TestReadersCrabAlongsideWriter(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	insertUsers(t, tbl, 0, 500)
+
+	// Readers descend and scan their own snapshots while the writer splits
+	// and frees the pages under them
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				snap := tbl.Snapshot()
+				if ids := checkScan(t, snap, false); len(ids) < 500 {
+					t.Errorf("Expected a snapshot to read at least 500 rows, got %d", len(ids))
+				}
+
+				snap.Release()
+			}
+		}()
+	}
+
+	insertUsers(t, tbl, 500, 1500)
+	for i := 500; i < 1500; i += 3 {
+		if err := tbl.Delete(uint32(i)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	wg.Wait()
+
+	// A descent lets go of every latch it took
+	for pageNum, l := range tbl.pager.pages {
+		if l != nil && (l.readers != 0 || l.exclusive) {
+			t.Fatalf("Expected page %d to be unlatched, got %d readers", pageNum, l.readers)
+		}
+	}
+}
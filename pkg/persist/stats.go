@@ -0,0 +1,521 @@
+package persist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Statistics catalog layout. The statistics are kept in a tree of their
+// own keyed by column name and entry number, its root is recorded in the
+// database header. Entry 0 of a column holds the row count, the distinct
+// value estimate and the minimum, entry 1 the maximum and the entries
+// after it the buckets of the histogram with their upper bound
+const (
+	statsCountSize      uint32 = 4
+	statsCountOffset    uint32 = 0
+	statsDistinctSize   uint32 = 4
+	statsDistinctOffset uint32 = statsCountOffset + statsCountSize
+	statsValueLenSize   uint32 = 4
+	statsValueLenOffset uint32 = statsDistinctOffset + statsDistinctSize
+	statsValueSize      uint32 = emailSize
+	statsValueOffset    uint32 = statsValueLenOffset + statsValueLenSize
+	statsEntrySize      uint32 = statsValueOffset + statsValueSize
+)
+
+const (
+	// statsSampleLeaves is the number of leaves Analyze reads,
+	// tables with more leaves are sampled evenly along the chain
+	statsSampleLeaves uint32 = 64
+	statsBuckets      int    = 16
+)
+
+// statsColumns are the columns Analyze collects statistics for
+var statsColumns = []string{"id", "username", "email"}
+
+// ColumnStats describe the values of a column when Analyze last ran.
+// The counts are estimates when the table was sampled
+type ColumnStats struct {
+	Column    string
+	RowCount  uint32
+	Distinct  uint32
+	Min       string
+	Max       string
+	Histogram []Bucket
+}
+
+// Bucket of an equi-depth histogram, it counts the
+// values greater than the previous bucket's bound
+type Bucket struct {
+	UpperBound string
+	Count      uint32
+}
+
+func (s *ColumnStats) String() string {
+	return fmt.Sprintf("%s: rows=%d distinct=%d min=%s max=%s buckets=%d",
+		s.Column, s.RowCount, s.Distinct, s.Min, s.Max, len(s.Histogram))
+}
+
+// Stats returns the statistics of the column, ok is false
+// if Analyze has not been run since the table was created
+func (t *Table) Stats(column string) (*ColumnStats, bool) {
+	s, ok := t.visibleCatalog().stats[column]
+	return s, ok
+}
+
+// Analyze samples the leaves of the table and replaces the
+// statistics of every column, the planner uses them to
+// estimate how many rows each access method reads
+func (t *Table) Analyze() error {
+	return t.apply(nil, func(w *Table) error {
+		return w.analyze()
+	})
+}
+
+func (t *Table) analyze() error {
+	rows, rowCount, err := t.sampleLeaves()
+	if err != nil {
+		return err
+	}
+
+	stats := map[string]*ColumnStats{}
+	for _, column := range statsColumns {
+		values := make([]string, len(rows))
+		for i, r := range rows {
+			values[i] = columnValue(r, column)
+		}
+
+		stats[column] = buildColumnStats(column, values, rowCount)
+	}
+
+	if err := t.writeStats(stats); err != nil {
+		return err
+	}
+
+	t.stats = stats
+	return nil
+}
+
+// sampleLeaves reads the rows of every leaf if there are at most
+// statsSampleLeaves leaves, otherwise of evenly spaced leaves. It
+// returns the rows read and the estimated number of rows in the table
+func (t *Table) sampleLeaves() ([]*Row, uint32, error) {
+	numLeaves, err := t.tree.countLeaves()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	step := (numLeaves + statsSampleLeaves - 1) / statsSampleLeaves
+
+	c, err := t.tree.start(nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rows []*Row
+	sampledLeaves := uint32(0)
+
+	for leaf := uint32(0); !c.endOfTable; leaf++ {
+		if leaf%step == 0 {
+			page, err := t.pager.GetPage(c.pageNum)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			for i := uint32(0); i < getLeafNodeNumCells(page); i++ {
+				rows = append(rows, serializedRow(t.tree.getLeafNodeValue(page, i)).Deserialize())
+			}
+
+			sampledLeaves++
+		}
+
+		if err := c.nextLeaf(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if step == 1 || sampledLeaves == 0 {
+		return rows, uint32(len(rows)), nil
+	}
+
+	// Empty leaves left by deletes are counted in numLeaves but skipped
+	// by the cursor, so large tables with many of them are overestimated
+	return rows, uint32(uint64(len(rows)) * uint64(numLeaves) / uint64(sampledLeaves)), nil
+}
+
+// countLeaves counts the leaves from the internal nodes
+// above them, without reading the leaves themselves
+func (t *btree) countLeaves() (uint32, error) {
+	height := 0
+
+	pageNum := t.rootPageNum
+	for {
+		page, err := t.pager.GetPage(pageNum)
+		if err != nil {
+			return 0, err
+		}
+
+		if getNodeType(page) == leafNode {
+			break
+		}
+
+		height++
+		pageNum, err = t.getInternalNodeChild(page, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return t.countLeavesBelow(t.rootPageNum, height)
+}
+
+func (t *btree) countLeavesBelow(pageNum uint32, height int) (uint32, error) {
+	if height == 0 {
+		return 1, nil
+	}
+
+	page, err := t.pager.GetPage(pageNum)
+	if err != nil {
+		return 0, err
+	}
+
+	numChildren := getInternalNodeNumKeys(page) + 1
+	if height == 1 {
+		return numChildren, nil
+	}
+
+	total := uint32(0)
+	for i := uint32(0); i < numChildren; i++ {
+		child, err := t.getInternalNodeChild(page, i)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := t.countLeavesBelow(child, height-1)
+		if err != nil {
+			return 0, err
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
+
+// buildColumnStats summarizes the sampled values of the column,
+// counts are scaled from the sample up to rowCount
+func buildColumnStats(column string, values []string, rowCount uint32) *ColumnStats {
+	s := &ColumnStats{Column: column, RowCount: rowCount}
+	if len(values) == 0 {
+		return s
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return compareValues(column, values[i], values[j]) < 0
+	})
+
+	s.Min = values[0]
+	s.Max = values[len(values)-1]
+	s.Distinct = estimateDistinct(column, values, rowCount)
+
+	scale := float64(rowCount) / float64(len(values))
+	numBuckets := statsBuckets
+	if len(values) < numBuckets {
+		numBuckets = len(values)
+	}
+
+	start := 0
+	for i := 1; i <= numBuckets; i++ {
+		end := i * len(values) / numBuckets
+		s.Histogram = append(s.Histogram, Bucket{
+			UpperBound: values[end-1],
+			Count:      uint32(math.Round(float64(end-start) * scale)),
+		})
+
+		start = end
+	}
+
+	return s
+}
+
+// estimateDistinct estimates the distinct values in the table from the
+// sorted sample with the Duj1 estimator of Haas and Stokes. The id
+// column is the primary key so every value is distinct
+func estimateDistinct(column string, values []string, rowCount uint32) uint32 {
+	if column == "id" {
+		return rowCount
+	}
+
+	distinct, once := 0, 0
+	for i := 0; i < len(values); {
+		j := i + 1
+		for j < len(values) && values[j] == values[i] {
+			j++
+		}
+
+		distinct++
+		if j-i == 1 {
+			once++
+		}
+
+		i = j
+	}
+
+	n, total := float64(len(values)), float64(rowCount)
+	if n >= total {
+		return uint32(distinct)
+	}
+
+	estimate := n * float64(distinct) / (n - float64(once) + float64(once)*n/total)
+	return uint32(math.Min(math.Round(estimate), total))
+}
+
+// compareValues compares two values of the column,
+// the id column is compared as a number
+func compareValues(column, a, b string) int {
+	if column != "id" {
+		return strings.Compare(a, b)
+	}
+
+	x, _ := strconv.ParseUint(a, 10, 32)
+	y, _ := strconv.ParseUint(b, 10, 32)
+
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// selectivity estimates the fraction of rows matching all of
+// the predicates, which must all be on the stats' column
+func (s *ColumnStats) selectivity(predicates []Predicate) float64 {
+	if s.RowCount == 0 {
+		return 0
+	}
+
+	lower, upper := 0.0, 1.0
+
+	for _, p := range predicates {
+		switch p.Op {
+		case Equal:
+			if compareValues(s.Column, p.Value, s.Min) < 0 || compareValues(s.Column, p.Value, s.Max) > 0 {
+				return 0
+			}
+
+			return 1 / math.Max(float64(s.Distinct), 1)
+
+		case Less, LessOrEqual:
+			upper = math.Min(upper, s.fractionBelow(p.Value))
+
+		case Greater, GreaterOrEqual:
+			lower = math.Max(lower, s.fractionBelow(p.Value))
+		}
+	}
+
+	return math.Max(upper-lower, 0)
+}
+
+// fractionBelow estimates the fraction of values less than the value,
+// half of the bucket the value falls in is counted as below it
+func (s *ColumnStats) fractionBelow(value string) float64 {
+	total, below := 0.0, -1.0
+
+	for _, b := range s.Histogram {
+		if below < 0 && compareValues(s.Column, value, b.UpperBound) <= 0 {
+			below = total + float64(b.Count)/2
+		}
+
+		total += float64(b.Count)
+	}
+
+	switch {
+	case total == 0 || compareValues(s.Column, value, s.Min) <= 0:
+		return 0
+	case below < 0:
+		return 1
+	default:
+		return below / total
+	}
+}
+
+func newStatsTree(pager *pager, rootPageNum uint32) *btree {
+	return &btree{
+		pager:       pager,
+		rootPageNum: rootPageNum,
+		key:         CompositeKey(BytesKey(indexColumnSize), Uint32Key),
+		valueSize:   statsEntrySize,
+	}
+}
+
+func getStatsRoot(p *pager) uint32 {
+	return binary.LittleEndian.Uint32(p.header[headerStatsRootOffset : headerStatsRootOffset+headerStatsRootSize])
+}
+
+func setStatsRoot(p *pager, rootPageNum uint32) {
+	binary.LittleEndian.PutUint32(p.header[headerStatsRootOffset:headerStatsRootOffset+headerStatsRootSize], rootPageNum)
+}
+
+// readStats loads the statistics catalog, a root of 0 means Analyze
+// has never been run as page 0 is always the root of the table
+func readStats(p *pager) (map[string]*ColumnStats, error) {
+	stats := map[string]*ColumnStats{}
+
+	rootPageNum := getStatsRoot(p)
+	if rootPageNum == 0 {
+		return stats, nil
+	}
+
+	tree := newStatsTree(p, rootPageNum)
+
+	c, err := tree.start(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for !c.endOfTable {
+		key, err := c.Key()
+		if err != nil {
+			return nil, err
+		}
+
+		decoded, err := tree.key.Decode(key)
+		if err != nil {
+			return nil, err
+		}
+
+		parts := decoded.([]interface{})
+		column, entryNum := string(parts[0].([]byte)), parts[1].(uint32)
+
+		value, err := c.Value()
+		if err != nil {
+			return nil, err
+		}
+
+		s, ok := stats[column]
+		if !ok {
+			s = &ColumnStats{Column: column}
+			stats[column] = s
+		}
+
+		e := decodeStatsEntry(value)
+
+		switch entryNum {
+		case 0:
+			s.RowCount, s.Distinct, s.Min = e.count, e.distinct, e.value
+		case 1:
+			s.Max = e.value
+		default:
+			s.Histogram = append(s.Histogram, Bucket{UpperBound: e.value, Count: e.count})
+		}
+
+		if err := c.Advance(); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// writeStats replaces the contents of the statistics catalog,
+// its tree is created the first time Analyze runs
+func (t *Table) writeStats(stats map[string]*ColumnStats) error {
+	rootPageNum := getStatsRoot(t.pager)
+
+	if rootPageNum == 0 {
+		rootPageNum = t.pager.GetUnusedPageNum()
+		root, err := t.pager.getPageForWrite(rootPageNum)
+		if err != nil {
+			return err
+		}
+
+		initializeLeafNode(root)
+		setNodeRoot(root, true)
+		setStatsRoot(t.pager, rootPageNum)
+	}
+
+	tree := newStatsTree(t.pager, rootPageNum)
+
+	var keys [][]byte
+	c, err := tree.start(nil, nil)
+	if err != nil {
+		return err
+	}
+
+	for !c.endOfTable {
+		key, err := c.Key()
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, append([]byte{}, key...))
+
+		if err := c.Advance(); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range keys {
+		if _, err := tree.delete(key); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range stats {
+		entries := []statsEntry{
+			{count: s.RowCount, distinct: s.Distinct, value: s.Min},
+			{value: s.Max},
+		}
+
+		for _, b := range s.Histogram {
+			entries = append(entries, statsEntry{count: b.Count, value: b.UpperBound})
+		}
+
+		for i, e := range entries {
+			key, err := encodeKey(tree.key, []interface{}{s.Column, uint32(i)})
+			if err != nil {
+				return err
+			}
+
+			if err := tree.insert(key, e.encode()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// statsEntry is a row of the statistics catalog
+type statsEntry struct {
+	count    uint32
+	distinct uint32
+	value    string
+}
+
+func (e statsEntry) encode() []byte {
+	entry := make([]byte, statsEntrySize)
+
+	binary.LittleEndian.PutUint32(entry[statsCountOffset:statsCountOffset+statsCountSize], e.count)
+	binary.LittleEndian.PutUint32(entry[statsDistinctOffset:statsDistinctOffset+statsDistinctSize], e.distinct)
+	binary.LittleEndian.PutUint32(entry[statsValueLenOffset:statsValueLenOffset+statsValueLenSize], uint32(len(e.value)))
+	copy(entry[statsValueOffset:statsValueOffset+statsValueSize], e.value)
+
+	return entry
+}
+
+func decodeStatsEntry(entry []byte) statsEntry {
+	valueLen := binary.LittleEndian.Uint32(entry[statsValueLenOffset : statsValueLenOffset+statsValueLenSize])
+
+	return statsEntry{
+		count:    binary.LittleEndian.Uint32(entry[statsCountOffset : statsCountOffset+statsCountSize]),
+		distinct: binary.LittleEndian.Uint32(entry[statsDistinctOffset : statsDistinctOffset+statsDistinctSize]),
+		value:    string(entry[statsValueOffset : statsValueOffset+valueLen]),
+	}
+}
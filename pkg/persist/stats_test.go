@@ -0,0 +1,119 @@
+package persist
+
+import (
+	"path"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	dbPath := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 300)
+
+	if err := tbl.CreateIndex("idx_username", "username", false); err != nil {
+		t.Fatalf("Unable to create index: '%s'", err)
+	}
+
+	if _, ok := tbl.Stats("id"); ok {
+		t.Fatalf("Expected no statistics before analyze")
+	}
+
+	if err := tbl.Analyze(); err != nil {
+		t.Fatalf("Unable to analyze: '%s'", err)
+	}
+
+	// Analyzing again replaces the statistics
+	insertUsers(t, tbl, 300, 400)
+
+	if err := tbl.Analyze(); err != nil {
+		t.Fatalf("Unable to analyze: '%s'", err)
+	}
+
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl, err = OpenDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	s, ok := tbl.Stats("id")
+	if !ok || s.RowCount != 400 || s.Distinct != 400 || s.Min != "0" || s.Max != "399" || len(s.Histogram) != statsBuckets {
+		t.Fatalf("Unexpected statistics for id: %v", s)
+	}
+
+	s, ok = tbl.Stats("username")
+	if !ok || s.Distinct != 400 || s.Min != "user#0" || s.Max != "user#99" {
+		t.Fatalf("Unexpected statistics for username: %v", s)
+	}
+
+	// Few ids are above 390 so the range is cheaper than the index
+	plan, err := tbl.Plan([]Predicate{
+		{Column: "id", Op: Greater, Value: "390"},
+		{Column: "username", Op: GreaterOrEqual, Value: "user#"},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if plan.Method != RangeScan || plan.EstimatedRows < 5 || plan.EstimatedRows > 15 {
+		t.Fatalf("Unexpected plan: %s", plan)
+	}
+
+	plan, err = tbl.Plan([]Predicate{
+		{Column: "id", Op: Greater, Value: "10"},
+		{Column: "username", Op: Equal, Value: "user#5"},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if plan.Method != IndexScan || plan.EstimatedRows != 1 {
+		t.Fatalf("Unexpected plan: %s", plan)
+	}
+}
+
+func TestAnalyzeSamplesLargeTables(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 5000)
+
+	if err := tbl.Analyze(); err != nil {
+		t.Fatalf("Unable to analyze: '%s'", err)
+	}
+
+	s, _ := tbl.Stats("email")
+	if s.RowCount < 4500 || s.RowCount > 5500 {
+		t.Fatalf("Row count estimate %d is too far from 5000", s.RowCount)
+	}
+
+	if s.Distinct < 4000 || s.Distinct > s.RowCount {
+		t.Fatalf("Distinct estimate %d is too far from 5000", s.Distinct)
+	}
+}
+
+func TestEstimateDistinct(t *testing.T) {
+	values := []string{"a", "a", "a", "b", "b", "c", "d"}
+
+	if d := estimateDistinct("username", values, uint32(len(values))); d != 4 {
+		t.Fatalf("Expected 4 distinct values in a full sample, got %d", d)
+	}
+
+	if d := estimateDistinct("username", values, 70); d < 4 || d > 70 {
+		t.Fatalf("Unexpected distinct estimate %d", d)
+	}
+}
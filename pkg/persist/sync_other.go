@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package persist
+
+// syncDir does nothing, directories are only synced on unix
+func syncDir(dir string) error {
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sync"
+	"time"
 	"unicode"
 
 	"github.com/fatih/color"
@@ -23,16 +25,29 @@ const (
 	rowSize        uint32 = 291
 )
 
-// Constants for the in memory table definition
+// RowSize is the size of a serialized row
+const RowSize = rowSize
+
+// The page size is chosen when a file is created and recorded in its
+// header, a power of two from MinPageSize to MaxPageSize
 const (
-	pageSize      uint32 = 4096
-	tableMaxPages uint32 = 100
-	rowsPerPage   uint32 = pageSize / rowSize
-	tableMaxRows  uint32 = rowsPerPage * tableMaxPages
+	DefaultPageSize uint32 = 4096
+	MinPageSize     uint32 = 1024
+	MaxPageSize     uint32 = 64 * 1024
+	tableMaxPages   uint32 = 1 << 20
 )
 
+func validPageSize(size uint32) bool {
+	return size >= MinPageSize && size <= MaxPageSize && size&(size-1) == 0
+}
+
 type serializedRow []byte
 
+// DeserializeRow decodes a row serialized with Row.Serialize
+func DeserializeRow(b []byte) *Row {
+	return serializedRow(b).Deserialize()
+}
+
 func (b serializedRow) Deserialize() *Row {
 	id := binary.LittleEndian.Uint32(b[idOffset : idOffset+idSize])
 	username := string(bytes.TrimRight(b[usernameOffset:usernameOffset+usernameSize], "\x00"))
@@ -47,6 +62,18 @@ type Row struct {
 	email    string
 }
 
+func (r Row) Id() uint32 {
+	return r.id
+}
+
+func (r Row) Username() string {
+	return r.username
+}
+
+func (r Row) Email() string {
+	return r.email
+}
+
 func (r Row) String() string {
 	return fmt.Sprintf("(%d, %s, %s)", r.id, r.username, r.email)
 }
@@ -94,32 +121,125 @@ func NewRow(id uint32, username string, email string) (*Row, error) {
 	}, nil
 }
 
+// Table may be used by many goroutines at once. Reads see a snapshot of
+// the table as of the last commit, a scan sees the rows as they were when
+// it began however long it runs and however the table changes meanwhile.
+// One change is made at a time, under the writer lock, and readers never
+// wait for it. Every change is made in a transaction, a change made
+// through the table is committed as soon as it is made, changes made
+// through the handle of a transaction when it commits. A Table is a
+// handle on the table, the handles returned by Snapshot and Tx.Table
+// read differently
 type Table struct {
-	rootPageNum uint32
-	pager       *pager
+	*tableState
+
+	// writing handles read the table as the writer sees it, with the
+	// uncommitted changes of the transaction whose pages it changes,
+	// and hold the writer lock. tx is set on the handle of a transaction
+	writing bool
+	tx      *Tx
+
+	// snapshot is set on the handles returned by Snapshot, with the
+	// catalog as of the snapshot, and on the handle of a transaction
+	snapshot        *snapshot
+	snapshotCatalog catalog
+}
+
+// tableState is shared by every handle on the table
+type tableState struct {
+	pager *pager
+	tree  *btree
+
+	// writer is held while a change of a transaction is made to its pages
+	// and while a transaction commits. active holds the transactions which
+	// have not ended, locks the rows they locked
+	writer sync.Mutex
+	txLock sync.Mutex
+	active map[*Tx]bool
+	locks  *lockManager
+
+	// indexes and stats are the catalog of the writer, committed is the
+	// catalog as of the last commit. catalogLock guards committed
+	indexes     []*Index
+	stats       map[string]*ColumnStats
+	catalogLock sync.RWMutex
+	committed   catalog
 }
 
 func (t *Table) Select() error {
-	c, err := TableStart(t)
-	if err != nil {
-		return err
+	return t.SelectWhere()
+}
+
+// SelectWhere prints every row matching all of the predicates,
+// the rows are read as chosen by Plan
+func (t *Table) SelectWhere(predicates ...Predicate) error {
+	return t.Scan(predicates, func(r *Row) error {
+		fmt.Println(r)
+		return nil
+	})
+}
+
+// get returns the row with the given id or nil if it does not exist
+func (t *Table) get(id uint32) (*Row, error) {
+	s, release := t.reading()
+	defer release()
+
+	return t.getAt(s, id)
+}
+
+func (t *Table) getAt(s *snapshot, id uint32) (*Row, error) {
+	v, err := t.tree.get(s, rowKey(id))
+	if err != nil || v == nil {
+		return nil, err
 	}
 
-	for !c.endOfTable {
-		v, err := c.Value()
-		if err != nil {
-			return err
+	return serializedRow(v).Deserialize(), nil
+}
+
+// Lookup returns the row with the given id or nil if it does not
+// exist, it positions a cursor on the id with TableFind. Through the
+// handle of a transaction the row is locked shared until it ends
+func (t *Table) Lookup(id uint32) (*Row, error) {
+	if t.tx != nil {
+		if err := t.tx.lock(id, sharedLock); err != nil {
+			return nil, err
 		}
+	}
 
-		fmt.Println(v.Deserialize())
-		c.Advance()
+	c, err := TableFind(t, id)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	defer c.Close()
+
+	if c.endOfTable {
+		return nil, nil
+	}
+
+	key, err := c.Key()
+	if err != nil || !bytes.Equal(key, rowKey(id)) {
+		return nil, err
+	}
+
+	v, err := c.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return serializedRow(v).Deserialize(), nil
 }
 
-func (t Table) PrintTree(pageNum uint32, indentationLevel int) error {
-	page, err := t.pager.GetPage(pageNum)
+// PrintTree prints the nodes below the page as of a snapshot
+func (t *Table) PrintTree(pageNum uint32, indentationLevel int) error {
+	s, release := t.reading()
+	defer release()
+
+	return t.printTree(s, pageNum, indentationLevel)
+}
+
+func (t *Table) printTree(s *snapshot, pageNum uint32, indentationLevel int) error {
+	page, err := t.pager.readPage(s, pageNum)
 
 	if err != nil {
 		return err
@@ -133,7 +253,12 @@ func (t Table) PrintTree(pageNum uint32, indentationLevel int) error {
 
 		for i := 0; i < int(numKeys); i++ {
 			indent(indentationLevel + 1)
-			fmt.Printf("- %d\n", getLeafNodeKey(page, uint32(i)))
+			key, err := t.tree.key.Decode(t.tree.getLeafNodeKey(page, uint32(i)))
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("- %v\n", key)
 		}
 		return nil
 
@@ -143,19 +268,24 @@ func (t Table) PrintTree(pageNum uint32, indentationLevel int) error {
 
 		fmt.Printf("- internal (size %d)\n", numKeys)
 		for i := 0; i < int(numKeys); i++ {
-			child, err := getInternalNodeChild(page, uint32(i))
+			child, err := t.tree.getInternalNodeChild(page, uint32(i))
 			if err != nil {
 				return err
 			}
 
-			t.PrintTree(child, indentationLevel+1)
+			t.printTree(s, child, indentationLevel+1)
 
 			indent(indentationLevel + 1)
-			fmt.Printf("- key %d\n", getInternalNodeKey(page, uint32(i)))
+			key, err := t.tree.key.Decode(t.tree.getInternalNodeKey(page, uint32(i)))
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("- key %v\n", key)
 		}
 
 		child := getInternalNodeRightChild(page)
-		t.PrintTree(child, indentationLevel+1)
+		t.printTree(s, child, indentationLevel+1)
 
 		return nil
 
@@ -170,22 +300,64 @@ func indent(level int) {
 	}
 }
 
+// Insert adds the row, the row is locked until the transaction ends
 func (t *Table) Insert(r *Row) error {
-	n, err := t.pager.GetPage(t.rootPageNum)
+	return t.apply([]uint32{r.id}, func(w *Table) error {
+		return w.insert(r)
+	})
+}
+
+func (t *Table) insert(r *Row) error {
+	for _, idx := range t.indexes {
+		if err := idx.checkUnique(r); err != nil {
+			return err
+		}
+	}
+
+	serialized, err := r.Serialize()
+	if err != nil {
+		return err
+	}
+
+	err = t.tree.insert(rowKey(r.id), serialized)
+	if err == errDuplicateKey {
+		return fmt.Errorf("duplicate key found '%d'", r.id)
+	}
+
 	if err != nil {
 		return err
 	}
 
-	keyToInsert := r.id
-	c, err := TableFind(t, keyToInsert)
+	for _, idx := range t.indexes {
+		if err := idx.insert(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Update replaces the row with the same id, the
+// indexes are updated for every changed column
+func (t *Table) Update(r *Row) error {
+	return t.apply([]uint32{r.id}, func(w *Table) error {
+		return w.update(r)
+	})
+}
+
+func (t *Table) update(r *Row) error {
+	old, err := t.get(r.id)
 	if err != nil {
 		return err
 	}
 
-	if c.cellNum < getLeafNodeNumCells(n) {
-		keyAtIdx := getLeafNodeKey(n, c.cellNum)
-		if keyAtIdx == keyToInsert {
-			return fmt.Errorf("duplicate key found '%d'", keyToInsert)
+	if old == nil {
+		return fmt.Errorf("no row found with id '%d'", r.id)
+	}
+
+	for _, idx := range t.indexes {
+		if err := idx.checkUnique(r); err != nil {
+			return err
 		}
 	}
 
@@ -194,55 +366,188 @@ func (t *Table) Insert(r *Row) error {
 		return err
 	}
 
-	err = leafNodeInsert(c, r.id, serialized)
+	for _, idx := range t.indexes {
+		if columnValue(old, idx.column) == columnValue(r, idx.column) {
+			continue
+		}
+
+		if err := idx.delete(old); err != nil {
+			return err
+		}
+
+		if err := idx.insert(r); err != nil {
+			return err
+		}
+	}
+
+	_, err = t.tree.update(rowKey(r.id), serialized)
+	return err
+}
+
+func (t *Table) Delete(id uint32) error {
+	return t.apply([]uint32{id}, func(w *Table) error {
+		return w.delete(id)
+	})
+}
+
+func (t *Table) delete(id uint32) error {
+	old, err := t.get(id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if old == nil {
+		return fmt.Errorf("no row found with id '%d'", id)
+	}
+
+	for _, idx := range t.indexes {
+		if err := idx.delete(old); err != nil {
+			return err
+		}
+	}
+
+	_, err = t.tree.delete(rowKey(id))
+	return err
 }
 
+// Close writes the committed table to the file, the active transactions
+// are rolled back first. The file is closed even if it cannot be written,
+// the error is returned then. No snapshot may be in use
 func (t *Table) Close() error {
-	for i := 0; i < int(t.pager.numPages); i++ {
-		if t.pager.pages[i] != nil {
-			if err := t.pager.FlushPage(uint32(i)); err != nil {
-				return err
-			}
-		}
+	t.txLock.Lock()
+	var active []*Tx
+	for tx := range t.active {
+		active = append(active, tx)
 	}
+	t.txLock.Unlock()
+
+	for _, tx := range active {
+		tx.Rollback()
+	}
+
+	t.writer.Lock()
+	defer t.writer.Unlock()
+
+	err := t.pager.checkpoint()
+	if closeErr := t.pager.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
 
-	return t.pager.Close()
+// Options sets how a database file is opened
+type Options struct {
+	// CopyOnWrite creates a new file which is never changed in place,
+	// see pageMap. It has no effect on an existing file, the mode of a
+	// file is fixed when it is created
+	CopyOnWrite bool
+
+	// ReadOnly opens an existing file which is not changed, other
+	// processes may read it too but none may write it meanwhile
+	ReadOnly bool
+
+	// BusyTimeout is how long to wait for another process to close
+	// the file, ErrDatabaseLocked is returned once it has passed
+	BusyTimeout time.Duration
+
+	// Durability sets when the file and its log are synced, see
+	// Durability. A copy-on-write file syncs every commit unless it is off
+	Durability Durability
+
+	// GroupCommitDelay is how long a sync of the log waits for more
+	// commits to sync with the first, GroupCommitSize the number of
+	// commits it stops waiting at, no limit when 0. Only commits with
+	// full durability sync the log, see groupCommit
+	GroupCommitDelay time.Duration
+	GroupCommitSize  int
+
+	// ArchiveDir keeps every commit by copying the log to a segment in
+	// the directory before a checkpoint empties it. A backup and the
+	// segments archived after it restore any commit, see RestoreUntil
+	ArchiveDir string
+
+	// MemoryMap reads the pages of a file written in place from a read
+	// only memory mapping of the file instead of copying each one it
+	// reads, only on linux
+	MemoryMap bool
+
+	// PageSize is the size of the pages of a new file, DefaultPageSize
+	// when 0. An existing file keeps the page size it was created with
+	PageSize uint32
 }
 
+// OpenDatabase opens the database stored in the file,
+// creating it with the default options if it does not exist
 func OpenDatabase(filename string) (*Table, error) {
-	pager, err := NewPager(filename)
+	return OpenDatabaseWithOptions(filename, Options{})
+}
+
+func OpenDatabaseWithOptions(filename string, options Options) (*Table, error) {
+	pager, err := NewPager(filename, options)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if pager.numPages == 0 {
-		root, err := pager.GetPage(0)
+	t := &Table{tableState: &tableState{
+		pager:  pager,
+		tree:   newTableTree(pager, 0),
+		active: map[*Tx]bool{},
+		locks:  newLockManager(),
+	}}
 
-		if err != nil {
-			return nil, err
-		}
+	if err := pager.initializeRootTree(t.tree); err != nil {
+		pager.Close()
+		return nil, err
+	}
 
-		initializeLeafNode(root)
-		setNodeRoot(root, true)
+	if err := t.loadCatalog(); err != nil {
+		pager.Close()
+		return nil, err
 	}
 
-	return &Table{
-		rootPageNum: 0,
+	return t, nil
+}
+
+// loadCatalog reads the indexes and statistics from the file,
+// they are the catalog as of the last commit
+func (t *Table) loadCatalog() error {
+	indexes, err := readCatalog(t.pager)
+	if err != nil {
+		return err
+	}
+
+	stats, err := readStats(t.pager)
+	if err != nil {
+		return err
+	}
+
+	t.indexes = indexes
+	t.stats = stats
+	t.committed = catalog{indexes: indexes, stats: stats}
+
+	return nil
+}
+
+func newTableTree(pager *pager, rootPageNum uint32) *btree {
+	return &btree{
 		pager:       pager,
-	}, nil
+		rootPageNum: rootPageNum,
+		key:         Uint32Key,
+		valueSize:   rowSize,
+	}
 }
 
-func PrintConstants() {
+// PrintConstants prints the layout of the nodes of the table
+func (t *Table) PrintConstants() {
+	tree := t.tree
+
+	color.Green("PAGE_SIZE: %d\n", t.pager.pageSize)
 	color.Green("ROW_SIZE: %d\n", rowSize)
 	color.Green("COMMON_NODE_HEADER_SIZE: %d\n", commonNodeHeaderSize)
 	color.Green("LEAF_NODE_HEADER_SIZE: %d\n", leafNodeHeaderSize)
-	color.Green("LEAF_NODE_CELL_SIZE: %d\n", leafNodeCellSize)
-	color.Green("LEAF_NODE_SPACE_FOR_CELLS: %d\n", leafNodeCellSpace)
-	color.Green("LEAF_NODE_MAX_CELLS: %d\n", leafNodeMaxCells)
+	color.Green("LEAF_NODE_CELL_SIZE: %d\n", tree.leafNodeCellSize())
+	color.Green("LEAF_NODE_SPACE_FOR_CELLS: %d\n", tree.leafNodeCellSpace())
+	color.Green("LEAF_NODE_MAX_CELLS: %d\n", tree.leafNodeMaxCells())
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -121,27 +122,30 @@ func TestBTreeNodeSplit(t *testing.T) {
 	os.Stdout = stdOut
 	so := string(out)
 
-	expected := `
-- internal (size 1)
+	expected := `- internal (size 1)
   - leaf (size 7)
-	- 0
-	- 1
-	- 2
-	- 3
-	- 4
-	- 5
-	- 6
+    - 0
+    - 1
+    - 2
+    - 3
+    - 4
+    - 5
+    - 6
   - key 6
   - leaf (size 8)
     - 7
-	- 8
-	- 9
-	- 10
-	- 11
-	- 12
-	- 13
-	- 14
-	`
+    - 8
+    - 9
+    - 10
+    - 11
+    - 12
+    - 13
+    - 14
+`
+
+	for i := 0; i < 15; i++ {
+		expected += fmt.Sprintf("(%d, user#%d, person#%d@example.com)\n", i, i, i)
+	}
 
 	fmt.Print(so)
 
@@ -179,16 +183,222 @@ func TestErrorMessageOnStringBoundary(t *testing.T) {
 	}
 }
 
-func createTestDir(t *testing.T, dirPath string) {
+func createTestDir(t testing.TB, dirPath string) {
 	if err := os.Mkdir(dirPath, os.FileMode(0777)); err != nil {
 		t.Fatalf("Unable to create testing directory '%s'. Aborting...", err)
 	}
 }
 
-func cleanupTestDir(t *testing.T, dirPath string) func() {
+func cleanupTestDir(t testing.TB, dirPath string) func() {
 	return func() {
 		if err := os.RemoveAll(testDirPath); err != nil {
 			t.Logf("Unable to delete test directory: '%s'", dirPath)
 		}
 	}
 }
+
+// checkScan reads every row with the plan for the predicates, the ids
+// have to ascend and each row has to be the one stored under its id
+func checkScan(t *testing.T, tbl *Table, batched bool) []uint32 {
+	plan, err := tbl.Plan(nil)
+	if err != nil {
+		t.Errorf("%s", err)
+		return nil
+	}
+
+	var ids []uint32
+	check := func(r *Row) {
+		if len(ids) > 0 && r.id <= ids[len(ids)-1] {
+			t.Errorf("Row %d read after row %d", r.id, ids[len(ids)-1])
+		}
+
+		if r.username != fmt.Sprintf("user#%d", r.id) {
+			t.Errorf("Row %d read as %s", r.id, r)
+		}
+
+		ids = append(ids, r.id)
+	}
+
+	if !batched {
+		err = tbl.ScanPlan(plan, func(r *Row) error {
+			check(r)
+			return nil
+		})
+	} else {
+		var c *BatchCursor
+		c, err = tbl.OpenBatches(plan)
+		for err == nil {
+			var b *Batch
+			b, err = c.Next()
+			if b == nil {
+				break
+			}
+
+			for i := 0; i < b.Len; i++ {
+				check(b.Row(i))
+			}
+		}
+	}
+
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+
+	return ids
+}
+
+func TestConcurrentReadersAndWriter(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	// Every scan reads a snapshot, so it sees all of the even ids, which
+	// are never deleted, however the writer inserts, updates and deletes
+	// the odd ones and splits the pages it reads meanwhile
+	for i := 0; i < 2000; i += 2 {
+		insertUsers(t, tbl, i, i+1)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+
+	for reader := 0; reader < 4; reader++ {
+		readers.Add(1)
+		go func(reader int) {
+			defer readers.Done()
+
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				ids := checkScan(t, tbl, (reader+n)%2 == 0)
+
+				even := 0
+				for _, id := range ids {
+					if id%2 == 0 {
+						even++
+					}
+				}
+
+				if even != 1000 {
+					t.Errorf("Expected all 1000 even rows to be read, got %d", even)
+					return
+				}
+
+				id := uint32(2 * ((reader*131 + n*17) % 1000))
+				if r, err := tbl.Lookup(id); err != nil || r == nil {
+					t.Errorf("Unable to look up row %d: %v", id, err)
+					return
+				}
+			}
+		}(reader)
+	}
+
+	// Odd ids are inserted from both ends to split leaves all over the tree
+	for i := 0; i < 500; i++ {
+		insertUsers(t, tbl, 2*i+1, 2*i+2)
+		insertUsers(t, tbl, 1999-2*i, 2000-2*i)
+
+		if i == 250 {
+			if err := tbl.CreateIndex("idx_username", "username", true); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			if err := tbl.Analyze(); err != nil {
+				t.Fatalf("%s", err)
+			}
+		}
+	}
+
+	for i := 1; i < 2000; i += 4 {
+		if err := tbl.Delete(uint32(i)); err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		row, err := NewRow(uint32(i+1), fmt.Sprintf("user#%d", i+1), "changed@example.com")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if err := tbl.Update(row); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	close(done)
+	readers.Wait()
+
+	if ids := checkScan(t, tbl, false); len(ids) != 1500 {
+		t.Fatalf("Expected 1500 rows, got %d", len(ids))
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	for _, pageSize := range []uint32{MinPageSize, MaxPageSize} {
+		for _, copyOnWrite := range []bool{false, true} {
+			t.Run(fmt.Sprintf("pageSize=%d/copyOnWrite=%v", pageSize, copyOnWrite), func(t *testing.T) {
+				createTestDir(t, testDirPath)
+				t.Cleanup(cleanupTestDir(t, testDirPath))
+
+				filename := path.Join(testDirPath, "test.db")
+				tbl, err := OpenDatabaseWithOptions(filename, Options{CopyOnWrite: copyOnWrite, PageSize: pageSize})
+				if err != nil {
+					t.Fatalf("%s", err)
+				}
+
+				insertUsers(t, tbl, 0, 500)
+				if err := tbl.CreateIndex("idx_email", "email", true); err != nil {
+					t.Fatalf("%s", err)
+				}
+
+				if err := tbl.Close(); err != nil {
+					t.Fatalf("%s", err)
+				}
+
+				// An existing file keeps its page size whatever the options say
+				tbl, err = OpenDatabaseWithOptions(filename, Options{PageSize: DefaultPageSize})
+				if err != nil {
+					t.Fatalf("%s", err)
+				}
+
+				defer tbl.Close()
+
+				if tbl.pager.pageSize != pageSize {
+					t.Fatalf("Expected pages of %d bytes after reopening, got %d", pageSize, tbl.pager.pageSize)
+				}
+
+				if n := fileSize(t, filename); n%int64(pageSize) != 0 {
+					t.Fatalf("Expected the file to be a whole number of pages, it is %d bytes", n)
+				}
+
+				if ids := checkScan(t, tbl, false); len(ids) != 500 {
+					t.Fatalf("Expected 500 rows after reopening, got %d", len(ids))
+				}
+
+				if ids := selectIds(t, tbl, Predicate{Column: "email", Op: Equal, Value: "person#250@example.com"}); len(ids) != 1 || ids[0] != 250 {
+					t.Fatalf("Expected the index to find the row, got %v", ids)
+				}
+			})
+		}
+	}
+}
+
+func TestInvalidPageSize(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	for _, pageSize := range []uint32{512, 3000, 128 * 1024} {
+		if _, err := OpenDatabaseWithOptions(path.Join(testDirPath, "test.db"), Options{PageSize: pageSize}); err == nil {
+			t.Fatalf("Expected a page size of %d to be rejected", pageSize)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package persist
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Fixed tree value layout, the value is stored with its length
+// in front of it and padded to the maximum value size
+const (
+	treeValueLengthSize   uint32 = 4
+	treeValueLengthOffset uint32 = 0
+	treeValueOffset       uint32 = treeValueLengthOffset + treeValueLengthSize
+)
+
+// Variable tree value layout. The value starts with its kind, an inline
+// value follows it. A value too large for the leaf is stored in overflow
+// pages, its length and the first page follow the kind instead
+const (
+	treeValueKindSize        uint32 = 1
+	treeValueKindOffset      uint32 = 0
+	treeInlineValueOffset    uint32 = treeValueKindOffset + treeValueKindSize
+	treeOverflowLengthSize   uint32 = 4
+	treeOverflowLengthOffset uint32 = treeValueKindOffset + treeValueKindSize
+	treeOverflowPageSize     uint32 = 4
+	treeOverflowPageOffset   uint32 = treeOverflowLengthOffset + treeOverflowLengthSize
+	treeOverflowValueSize    uint32 = treeOverflowPageOffset + treeOverflowPageSize
+)
+
+const (
+	treeInlineValue byte = iota
+	treeOverflowValue
+)
+
+var ErrKeyTooLarge = errors.New("key is larger than the maximum key size")
+var ErrValueTooLarge = errors.New("value is larger than the maximum value size")
+
+// TreeOptions sets the page size of a new tree, it is recorded in the
+// file and the stored one is used when it is reopened. Durability and
+// the group commit settings apply to the file while it is open, see
+// Options
+type TreeOptions struct {
+	PageSize uint32
+
+	Durability       Durability
+	GroupCommitDelay time.Duration
+	GroupCommitSize  int
+}
+
+// Tree is an ordered map of byte string keys to byte string values in
+// a file of its own. It is the same tree the table is stored in without
+// the fixed row layout, its cells are as long as the key and value they
+// hold. A key may be up to about a quarter of a page long, a value of any
+// length which does not fit in the leaf is stored in overflow pages and
+// the pages of the values it replaces are reused. A file created before
+// cells were variable keeps the fixed cells and the limits it was created
+// with. Like the table it can be read by many goroutines while one writes,
+// reads see the tree as of the last commit and writes are made one at a
+// time under the writer lock
+type Tree struct {
+	pager  *pager
+	tree   *btree
+	writer sync.Mutex
+}
+
+// OpenTree opens the tree stored in the file, creating it with the
+// given options if the file does not exist yet
+func OpenTree(filename string, options TreeOptions) (*Tree, error) {
+	pager, err := NewPager(filename, Options{
+		PageSize:         options.PageSize,
+		Durability:       options.Durability,
+		GroupCommitDelay: options.GroupCommitDelay,
+		GroupCommitSize:  options.GroupCommitSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &btree{
+		pager:       pager,
+		rootPageNum: 0,
+		variable:    true,
+	}
+
+	if pager.numPages != 0 {
+		keySize := binary.LittleEndian.Uint32(pager.header[headerKeySizeOffset : headerKeySizeOffset+headerKeySizeSize])
+		valueSize := binary.LittleEndian.Uint32(pager.header[headerValueSizeOffset : headerValueSizeOffset+headerValueSizeSize])
+
+		switch {
+		case keySize == 0 && valueSize == 0:
+			// The tree has variable cells
+		case keySize < 2 || valueSize < treeValueLengthSize:
+			pager.Close()
+			return nil, errors.New("DB file does not contain a tree")
+		default:
+			// The tree has the fixed cells of the limits it was created with
+			tree.variable = false
+			tree.key = BytesKey((keySize - 2) / 2)
+			tree.valueSize = valueSize
+		}
+	}
+
+	if err := pager.initializeRootTree(tree); err != nil {
+		pager.Close()
+		return nil, err
+	}
+
+	return &Tree{pager: pager, tree: tree}, nil
+}
+
+// MaxKeySize is the length of the longest key the tree stores
+func (t *Tree) MaxKeySize() uint32 {
+	if t.tree.variable {
+		// The cell of the longest key still fits a value in overflow pages
+		return t.tree.maxVarCellSize() - varLeafKeyOffset - treeOverflowValueSize
+	}
+
+	return (t.tree.key.Size() - 2) / 2
+}
+
+// MaxValueSize is the length of the longest value the tree stores
+func (t *Tree) MaxValueSize() uint32 {
+	if t.tree.variable {
+		return math.MaxUint32
+	}
+
+	return t.tree.valueSize - treeValueLengthSize
+}
+
+// CheckSize returns an error if the key or value are too large for the tree
+func (t *Tree) CheckSize(key, value []byte) error {
+	if uint64(len(key)) > uint64(t.MaxKeySize()) {
+		return ErrKeyTooLarge
+	}
+
+	if uint64(len(value)) > uint64(t.MaxValueSize()) {
+		return ErrValueTooLarge
+	}
+
+	return nil
+}
+
+// Get returns a copy of the value stored under the key,
+// the value is nil if the key is not present
+func (t *Tree) Get(key []byte) ([]byte, bool, error) {
+	encoded, err := t.encodeKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	snapshot := t.pager.acquireSnapshot()
+	defer snapshot.release()
+
+	v, err := t.tree.get(snapshot, encoded)
+	if err != nil || v == nil {
+		return nil, false, err
+	}
+
+	value, err := t.value(snapshot, v)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return append([]byte{}, value...), true, nil
+}
+
+// Put stores the value under the key, replacing any existing value
+func (t *Tree) Put(key, value []byte) error {
+	return t.change(func() error {
+		return t.put(key, value)
+	})
+}
+
+// Delete removes the key, it returns false if the key was not present
+func (t *Tree) Delete(key []byte) (bool, error) {
+	var deleted bool
+	err := t.change(func() error {
+		var err error
+		deleted, err = t.delete(key)
+		return err
+	})
+
+	return deleted, err
+}
+
+// TreeOp is a put of the value under the key, or a delete
+// of the key if Delete is set
+type TreeOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// Write applies the operations in order as one commit. If one of
+// them fails the ones before it are rolled back, none is applied
+func (t *Tree) Write(ops []TreeOp) error {
+	return t.change(func() error {
+		for _, op := range ops {
+			var err error
+			if op.Delete {
+				_, err = t.delete(op.Key)
+			} else {
+				err = t.put(op.Key, op.Value)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// put and delete change the tree without committing,
+// the writer lock must be held
+func (t *Tree) put(key, value []byte) error {
+	if err := t.CheckSize(key, value); err != nil {
+		return err
+	}
+
+	encoded, err := t.encodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	// The pages of the value replaced are freed first so the new value can reuse them
+	old, err := t.tree.get(nil, encoded)
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		if err := t.freeValue(old); err != nil {
+			return err
+		}
+	}
+
+	v, err := t.encodeValue(key, value)
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		_, err = t.tree.update(encoded, v)
+	} else {
+		err = t.tree.insert(encoded, v)
+	}
+
+	return err
+}
+
+func (t *Tree) delete(key []byte) (bool, error) {
+	encoded, err := t.encodeKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	old, err := t.tree.get(nil, encoded)
+	if err != nil || old == nil {
+		return false, err
+	}
+
+	if err := t.freeValue(old); err != nil {
+		return false, err
+	}
+
+	return t.tree.delete(encoded)
+}
+
+// change makes the change fn makes to the tree holding the writer lock
+// and commits it, or drops it if fn fails. Like Tx.Commit it waits for
+// the sync without the writer lock so other commits can join the sync
+func (t *Tree) change(fn func() error) error {
+	t.writer.Lock()
+
+	var lsn uint64
+	err := fn()
+	if err != nil {
+		t.pager.rollback()
+	} else {
+		lsn, err = t.pager.commitUnsynced()
+	}
+
+	t.writer.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return t.pager.sync(lsn)
+}
+
+// Ascend calls fn for each key greater than or equal to start in order
+// until fn returns false. A nil start begins at the first key. The slices
+// passed to fn are only valid until fn returns
+func (t *Tree) Ascend(start []byte, fn func(key, value []byte) bool) error {
+	var c *Cursor
+	var err error
+
+	snapshot := t.pager.acquireSnapshot()
+	if start == nil {
+		c, err = t.tree.start(snapshot, snapshot.release)
+	} else {
+		// The keys of a variable tree are compared as they are,
+		// a start longer than any key is still a place to seek to
+		encoded := start
+		if !t.tree.variable {
+			encoded, err = t.encodeKey(start)
+			if err != nil {
+				snapshot.release()
+				return err
+			}
+		}
+
+		c, err = t.tree.seek(snapshot, snapshot.release, encoded)
+	}
+
+	if err != nil {
+		snapshot.release()
+		return err
+	}
+	defer c.Close()
+
+	for !c.endOfTable {
+		key, err := c.Key()
+		if err != nil {
+			return err
+		}
+
+		if !t.tree.variable {
+			decoded, err := t.tree.key.Decode(key)
+			if err != nil {
+				return err
+			}
+
+			key = decoded.([]byte)
+		}
+
+		v, err := c.Value()
+		if err != nil {
+			return err
+		}
+
+		value, err := t.value(snapshot, v)
+		if err != nil {
+			return err
+		}
+
+		if !fn(key, value) {
+			return nil
+		}
+
+		if err := c.Advance(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close writes the tree to the file and closes it, the file is
+// closed even if it cannot be written and the error returned then
+func (t *Tree) Close() error {
+	err := t.pager.checkpoint()
+	if closeErr := t.pager.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// encodeKey encodes a key, keys longer than the maximum are reported
+// with ErrKeyTooLarge rather than the encoding error. The keys of a
+// variable tree are stored as they are
+func (t *Tree) encodeKey(key []byte) ([]byte, error) {
+	if uint32(len(key)) > t.MaxKeySize() {
+		return nil, ErrKeyTooLarge
+	}
+
+	if t.tree.variable {
+		return key, nil
+	}
+
+	return encodeKey(t.tree.key, key)
+}
+
+// encodeValue returns the value to store in the cell of the key. The
+// value of a variable tree is kept in the leaf if the cell fits with it,
+// otherwise it is written to overflow pages
+func (t *Tree) encodeValue(key, value []byte) ([]byte, error) {
+	if !t.tree.variable {
+		v := make([]byte, t.tree.valueSize)
+		binary.LittleEndian.PutUint32(v[treeValueLengthOffset:treeValueLengthOffset+treeValueLengthSize], uint32(len(value)))
+		copy(v[treeValueOffset:], value)
+
+		return v, nil
+	}
+
+	if varLeafKeyOffset+uint32(len(key))+treeInlineValueOffset+uint32(len(value)) <= t.tree.maxVarCellSize() {
+		v := make([]byte, treeInlineValueOffset+uint32(len(value)))
+		v[treeValueKindOffset] = treeInlineValue
+		copy(v[treeInlineValueOffset:], value)
+
+		return v, nil
+	}
+
+	pageNum, err := t.pager.writeOverflow(value)
+	if err != nil {
+		return nil, err
+	}
+
+	v := make([]byte, treeOverflowValueSize)
+	v[treeValueKindOffset] = treeOverflowValue
+	binary.LittleEndian.PutUint32(v[treeOverflowLengthOffset:treeOverflowLengthOffset+treeOverflowLengthSize], uint32(len(value)))
+	binary.LittleEndian.PutUint32(v[treeOverflowPageOffset:treeOverflowPageOffset+treeOverflowPageSize], pageNum)
+
+	return v, nil
+}
+
+// value returns the value stored in the cell value v as of the snapshot.
+// A value in the leaf is a slice of v, one in overflow pages a copy
+func (t *Tree) value(s *snapshot, v []byte) ([]byte, error) {
+	if !t.tree.variable {
+		length := binary.LittleEndian.Uint32(v[treeValueLengthOffset : treeValueLengthOffset+treeValueLengthSize])
+		return v[treeValueOffset : treeValueOffset+length], nil
+	}
+
+	if v[treeValueKindOffset] == treeInlineValue {
+		return v[treeInlineValueOffset:], nil
+	}
+
+	length, pageNum := treeOverflowRef(v)
+	return t.pager.readOverflow(s, pageNum, length)
+}
+
+// freeValue frees the overflow pages of the cell value v
+func (t *Tree) freeValue(v []byte) error {
+	if !t.tree.variable || v[treeValueKindOffset] != treeOverflowValue {
+		return nil
+	}
+
+	_, pageNum := treeOverflowRef(v)
+	return t.pager.freeOverflow(pageNum)
+}
+
+func treeOverflowRef(v []byte) (uint32, uint32) {
+	return binary.LittleEndian.Uint32(v[treeOverflowLengthOffset : treeOverflowLengthOffset+treeOverflowLengthSize]),
+		binary.LittleEndian.Uint32(v[treeOverflowPageOffset : treeOverflowPageOffset+treeOverflowPageSize])
+}
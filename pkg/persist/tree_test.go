@@ -0,0 +1,168 @@
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestTreeWriteIsOneCommit(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tree, err := OpenTree(path.Join(testDirPath, "test.tree"), TreeOptions{PageSize: MinPageSize})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tree.Close()
+
+	if err := tree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	ops := []TreeOp{
+		{Key: []byte("a"), Value: []byte("changed")},
+		{Key: []byte("a"), Delete: true},
+	}
+	for i := 0; i < 500; i++ {
+		ops = append(ops, TreeOp{Key: []byte(fmt.Sprintf("k%03d", i)), Value: []byte("v")})
+	}
+
+	// The file fills up after the first splits, the ops
+	// before the one which fails are applied by then
+	maxPages := tree.pager.maxPages
+	tree.pager.maxPages = 4
+
+	if err := tree.Write(ops); err == nil {
+		t.Fatalf("Expected the write to fail once the file is full")
+	}
+
+	tree.pager.maxPages = maxPages
+
+	if v, ok, _ := tree.Get([]byte("a")); !ok || string(v) != "1" {
+		t.Fatalf("Expected the ops before the failing one to be rolled back, got %q", v)
+	}
+
+	var keys int
+	err = tree.Ascend(nil, func(key, value []byte) bool {
+		keys++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if keys != 1 {
+		t.Fatalf("Expected none of the ops to be applied, got %d keys", keys)
+	}
+
+	if err := tree.Write(ops); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, ok, _ := tree.Get([]byte("a")); ok {
+		t.Fatalf("Expected the delete in the write to be applied")
+	}
+
+	if v, ok, _ := tree.Get([]byte("k499")); !ok || string(v) != "v" {
+		t.Fatalf("Expected the last put in the write to be applied")
+	}
+}
+
+func TestTreeVariableCells(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.tree")
+	tree, err := OpenTree(filename, TreeOptions{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Small cells are packed, not padded to the largest key and value
+	for i := 0; i < 200; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("k%03d", i)), []byte("v")); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if tree.pager.numPages != 1 {
+		t.Fatalf("Expected 200 small cells to fit in the root, got %d pages", tree.pager.numPages)
+	}
+
+	long := bytes.Repeat([]byte("x"), int(tree.MaxKeySize()))
+	if err := tree.Put(long, bytes.Repeat([]byte("y"), 10000)); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tree.Put(append(long, 'x'), nil); err != ErrKeyTooLarge {
+		t.Fatalf("Expected a key longer than the maximum to be rejected, got %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("large%02d", i))
+		if err := tree.Put(key, bytes.Repeat(key, 1000)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	pages := tree.pager.numPages
+
+	// A snapshot keeps reading the values replaced
+	// while their overflow pages are reused
+	snap := tree.pager.acquireSnapshot()
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("large%02d", i))
+		if err := tree.Put(key, bytes.Repeat([]byte("new"), 2500)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if tree.pager.numPages > pages+1 {
+		t.Fatalf("Expected the overflow pages of replaced values to be reused, %d pages grew to %d", pages, tree.pager.numPages)
+	}
+
+	v, err := tree.tree.get(snap, []byte("large07"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if old, err := tree.value(snap, v); err != nil || !bytes.Equal(old, bytes.Repeat([]byte("large07"), 1000)) {
+		t.Fatalf("Expected the snapshot to read the replaced value, got %v", err)
+	}
+
+	snap.release()
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if tree, err = OpenTree(filename, TreeOptions{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tree.Close()
+
+	if v, ok, err := tree.Get(long); err != nil || !ok || !bytes.Equal(v, bytes.Repeat([]byte("y"), 10000)) {
+		t.Fatalf("Expected the value of the longest key, got %d bytes %v", len(v), err)
+	}
+
+	var keys []string
+	err = tree.Ascend([]byte("large"), func(key, value []byte) bool {
+		if !bytes.Equal(value, bytes.Repeat([]byte("new"), 2500)) {
+			t.Fatalf("Unexpected value of '%s'", key)
+		}
+
+		keys = append(keys, string(key))
+		return len(keys) < 50
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(keys) != 50 || keys[0] != "large00" || keys[49] != "large49" {
+		t.Fatalf("Expected the 50 large values in order, got %q", keys)
+	}
+}
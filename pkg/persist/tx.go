@@ -0,0 +1,233 @@
+package persist
+
+import (
+	"bytes"
+	"errors"
+)
+
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+var ErrTxActive = errors.New("a transaction is already active")
+
+// Tx groups changes to the table so they are committed or rolled back
+// together. Any number of transactions may be active at once, each reads
+// the table as of when it began together with its own changes. Changes
+// are made through the handle returned by Table, other readers do not see
+// them until the transaction commits.
+//
+// The rows a transaction changes are locked exclusively and the rows it
+// looks up shared until it ends, a transaction waits for the locks others
+// hold. A transaction whose wait would deadlock, or which changes a row
+// another transaction committed a change to after it began, is rolled
+// back with an error for which IsRetryable is true.
+//
+// A transaction changes copies of the pages of its own. If another
+// transaction committed since it began its changes are made again on top
+// of the newest commit when it commits, they only change rows it holds
+// locked so they have the same effect.
+//
+// A transaction must be used by one goroutine at a time. Committing writes
+// the pages it changed to a copy-on-write file, or appends them to the
+// write-ahead log of a file written in place where a checkpoint writes
+// them to the file later, see writeAheadLog. The changes are dropped if
+// they cannot be written. Once Commit returns they survive the process
+// crashing, and the machine crashing as far as the Durability promises
+type Tx struct {
+	table    *Table
+	writes   *writeSet
+	snapshot *snapshot
+	catalog  catalog
+	changes  []func(w *Table) error
+	done     bool
+
+	savepoints []savepoint
+}
+
+// Begin starts a transaction which reads the table as of the last commit
+func (t *Table) Begin() (*Tx, error) {
+	if t.writing || t.tx != nil {
+		return nil, ErrTxActive
+	}
+
+	if t.snapshot != nil || t.pager.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	t.catalogLock.RLock()
+	ws := t.pager.newWriteSet()
+	tx := &Tx{writes: ws, snapshot: ws.base, catalog: t.committed}
+	t.catalogLock.RUnlock()
+
+	tx.table = &Table{tableState: t.tableState, tx: tx, snapshot: tx.snapshot}
+
+	t.txLock.Lock()
+	t.active[tx] = true
+	t.txLock.Unlock()
+
+	return tx, nil
+}
+
+// Table returns the handle changes of the transaction are made through
+func (tx *Tx) Table() *Table {
+	return tx.table
+}
+
+// Tx returns the transaction the handle belongs
+// to, nil if it is not the handle of one
+func (t *Table) Tx() *Tx {
+	return t.tx
+}
+
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	t := tx.table.tableState
+
+	t.writer.Lock()
+	err := tx.commit()
+	lsn := headerLSN(t.pager.committedHeader)
+	t.writer.Unlock()
+
+	tx.end()
+	if err != nil {
+		return err
+	}
+
+	// Other commits can join the sync of this one without the writer lock
+	return t.pager.sync(lsn)
+}
+
+// commit makes the changes of the transaction the newest
+// commit, the writer lock must be held
+func (tx *Tx) commit() error {
+	if len(tx.changes) == 0 {
+		return nil
+	}
+
+	t := tx.table.tableState
+	writes, c := tx.writes, tx.catalog
+
+	if t.pager.committedSeq() != tx.snapshot.seq {
+		// Another transaction committed since this one began
+		writes, c = t.pager.latestWriteSet(), t.committed
+
+		for _, fn := range tx.changes {
+			if err := t.runAs(writes, &c, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return t.runAs(writes, &c, func(w *Table) error {
+		return w.commit()
+	})
+}
+
+// Rollback drops every change made by the transaction, indexes
+// created and statistics collected during it included
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.end()
+	return nil
+}
+
+// end releases the locks and the snapshot of the transaction
+func (tx *Tx) end() {
+	tx.done = true
+
+	t := tx.table.tableState
+	t.locks.releaseAll(tx)
+	tx.snapshot.release()
+
+	t.txLock.Lock()
+	delete(t.active, tx)
+	t.txLock.Unlock()
+}
+
+// run makes a change of the transaction. The rows with the ids are
+// locked exclusively first, then fn changes the pages of the transaction
+// holding the writer lock. fn is kept to be made again at commit
+func (tx *Tx) run(ids []uint32, fn func(w *Table) error) error {
+	for _, id := range ids {
+		if err := tx.lock(id, exclusiveLock); err != nil {
+			return err
+		}
+	}
+
+	t := tx.table.tableState
+
+	t.writer.Lock()
+	defer t.writer.Unlock()
+
+	if err := t.runAs(tx.writes, &tx.catalog, fn); err != nil {
+		return err
+	}
+
+	tx.changes = append(tx.changes, fn)
+	return nil
+}
+
+// lock locks the row for the transaction. A transaction which would
+// deadlock, or which locks a row exclusively which another transaction
+// changed since it began, is rolled back
+func (tx *Tx) lock(id uint32, mode lockMode) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	acquired, err := tx.table.locks.lock(tx, userLock(id), mode)
+	if err == nil && acquired && mode == exclusiveLock {
+		var changed bool
+		if changed, err = tx.changedSince(id); changed {
+			err = ErrWriteConflict
+		}
+	}
+
+	if err != nil {
+		tx.end()
+	}
+
+	return err
+}
+
+// changedSince reports whether a transaction committed a
+// change to the row after the transaction began
+func (tx *Tx) changedSince(id uint32) (bool, error) {
+	p := tx.table.pager
+	if p.committedSeq() == tx.snapshot.seq {
+		return false, nil
+	}
+
+	latest := p.acquireSnapshot()
+	defer latest.release()
+
+	before, err := tx.table.tree.get(&snapshot{pager: p, seq: tx.snapshot.seq}, rowKey(id))
+	if err != nil {
+		return false, err
+	}
+
+	after, err := tx.table.tree.get(latest, rowKey(id))
+	if err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(before, after), nil
+}
+
+// runAs runs fn as the writer changing the pages of the write set
+// with the catalog, the writer lock must be held
+func (t *tableState) runAs(writes *writeSet, c *catalog, fn func(w *Table) error) error {
+	prev := t.pager.install(writes)
+	t.indexes, t.stats = c.indexes, c.stats
+
+	err := fn(&Table{tableState: t, writing: true})
+
+	c.indexes, c.stats = t.indexes, t.stats
+	t.pager.install(prev)
+
+	return err
+}
@@ -0,0 +1,255 @@
+package persist
+
+import (
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestTxRollback(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 20)
+
+	tx, err := tbl.Begin()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := tx.Table().Begin(); err != ErrTxActive {
+		t.Fatalf("Expected a nested transaction to be rejected")
+	}
+
+	// Enough rows to split leaves and allocate new pages
+	insertUsers(t, tx.Table(), 20, 200)
+
+	if err := tx.Table().Delete(3); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tx.Table().CreateIndex("idx_email", "email", false); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if rows := selectIds(t, tx.Table()); len(rows) != 199 {
+		t.Fatalf("Expected the transaction to read its own changes, got %d rows", len(rows))
+	}
+
+	if rows := selectIds(t, tbl); len(rows) != 20 || len(tbl.Indexes()) != 0 {
+		t.Fatalf("Expected the changes of the transaction to be hidden until it commits, got %d rows", len(rows))
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("Expected a finished transaction to be rejected")
+	}
+
+	if len(tbl.Indexes()) != 0 {
+		t.Fatalf("Index created in the transaction was not dropped")
+	}
+
+	if rows := selectIds(t, tbl); len(rows) != 20 || rows[3] != 3 {
+		t.Fatalf("Expected the original 20 rows, got %v", rows)
+	}
+
+	tx, err = tbl.Begin()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tx.Table(), 20, 200)
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if rows := selectIds(t, tbl); len(rows) != 200 {
+		t.Fatalf("Expected 200 rows after commit, got %d", len(rows))
+	}
+}
+
+func TestRollbackWithReaders(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabase(path.Join(testDirPath, "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	insertUsers(t, tbl, 0, 300)
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+
+	for reader := 0; reader < 4; reader++ {
+		readers.Add(1)
+		go func(reader int) {
+			defer readers.Done()
+
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// No transaction commits so every snapshot holds the first 300 rows
+				if ids := checkScan(t, tbl, (reader+n)%2 == 0); len(ids) != 300 {
+					t.Errorf("Expected 300 rows, got %d", len(ids))
+					return
+				}
+			}
+		}(reader)
+	}
+
+	for i := 0; i < 20; i++ {
+		tx, err := tbl.Begin()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		insertUsers(t, tx.Table(), 300, 600)
+
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	close(done)
+	readers.Wait()
+
+	if ids := checkScan(t, tbl, false); len(ids) != 300 {
+		t.Fatalf("Expected 300 rows after the rollbacks, got %d", len(ids))
+	}
+}
+
+func TestTxSavepoints(t *testing.T) {
+	tbl := openTestDatabase(t)
+	insertUsers(t, tbl, 0, 20)
+
+	tx := begin(t, tbl)
+	insertUsers(t, tx.Table(), 20, 40)
+
+	if err := tx.Savepoint("batch"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Enough rows to split leaves and allocate new pages
+	insertUsers(t, tx.Table(), 40, 300)
+	if err := tx.Table().CreateIndex("idx_username", "username", true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tx.Savepoint("nested"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tx.Table().Delete(1); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tx.RollbackTo("batch"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tx.Release("nested"); err == nil {
+		t.Fatalf("Expected the savepoint after the one rolled back to be forgotten")
+	}
+
+	if ids := checkScan(t, tx.Table(), false); len(ids) != 40 {
+		t.Fatalf("Expected the 40 rows before the savepoint, got %d", len(ids))
+	}
+
+	if len(tx.Table().Indexes()) != 0 {
+		t.Fatalf("Expected the index created after the savepoint to be dropped")
+	}
+
+	// The savepoint is kept after rolling back to it
+	insertUsers(t, tx.Table(), 40, 50)
+	if err := tx.RollbackTo("batch"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ids := checkScan(t, tx.Table(), false); len(ids) != 40 {
+		t.Fatalf("Expected to roll back to the savepoint again, got %d rows", len(ids))
+	}
+
+	if err := tx.Release("batch"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Rows locked after the savepoint stay locked, others can be changed
+	insertUsers(t, tbl, 300, 310)
+
+	// The changes kept are made again on top of the commit since
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ids := checkScan(t, tbl, false); len(ids) != 50 {
+		t.Fatalf("Expected 50 rows after the commit, got %d", len(ids))
+	}
+}
+
+func TestSavepointCopiesChangedPages(t *testing.T) {
+	tbl := openTestDatabase(t)
+
+	tx := begin(t, tbl)
+	insertUsers(t, tx.Table(), 0, 300)
+
+	if err := tx.Savepoint("one"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	saved := tx.writes.saves[0]
+	if len(saved.pages) != 0 {
+		t.Fatalf("Expected a savepoint to copy no pages, copied %d", len(saved.pages))
+	}
+
+	// Only the pages an update changes are copied
+	changed, err := NewRow(1, "changed", "changed@example.com")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tx.Table().Update(changed); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(saved.pages) == 0 || len(saved.pages) >= len(tx.writes.dirty) {
+		t.Fatalf("Expected a few of the %d pages to be copied, copied %d", len(tx.writes.dirty), len(saved.pages))
+	}
+
+	if err := tx.RollbackTo("one"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	r, err := tx.Table().Lookup(1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if r.Username() == "changed" {
+		t.Fatalf("Expected the update to be rolled back")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ids := checkScan(t, tbl, false); len(ids) != 300 {
+		t.Fatalf("Expected 300 rows after the commit, got %d", len(ids))
+	}
+}
@@ -0,0 +1,462 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Files written by an older format version are upgraded when they are
+// opened. The cells of their trees are read with the layout of their
+// version and packed into a new file of the current version, which is
+// renamed over the old one like a restored backup. The file keeps its
+// mode and its log sequence number, the indexes are built again from
+// the rows as their key encoding changed with version 2.
+//
+// Every file before version 7 has pages of legacyPageSize. Version 0 is
+// a file without a header, written before the header page was added
+const legacyPageSize uint32 = 4096
+
+// legacyLayout is where an older version keeps the fields of the
+// header an upgrade reads, 0 if the version has no such field
+type legacyLayout struct {
+	keySizeOffset   uint32
+	statsRootOffset uint32
+	lsnOffset       uint32
+	catalogOffset   uint32
+	nodeHeaderSize  uint32
+}
+
+var legacyLayouts = []legacyLayout{
+	0: {nodeHeaderSize: 6},
+	1: {catalogOffset: 12, nodeHeaderSize: 6},
+	2: {catalogOffset: 12, nodeHeaderSize: 6},
+	3: {keySizeOffset: 12, catalogOffset: 20, nodeHeaderSize: 6},
+	4: {keySizeOffset: 12, statsRootOffset: 20, catalogOffset: 24, nodeHeaderSize: 6},
+	5: {keySizeOffset: 12, statsRootOffset: 20, lsnOffset: 24, catalogOffset: 32, nodeHeaderSize: 6},
+	6: {keySizeOffset: 12, statsRootOffset: 20, lsnOffset: 24, catalogOffset: 32, nodeHeaderSize: 14},
+}
+
+// Meta layout of a copy-on-write file before the meta recorded the page size
+const (
+	legacyMetaVersion          uint32 = 1
+	legacyMetaTxnIdOffset      uint32 = 12
+	legacyMetaNumPagesOffset   uint32 = 20
+	legacyMetaHeaderSlotOffset uint32 = 24
+	legacyMetaRootSlotOffset   uint32 = 28
+	legacyMetaChecksumOffset   uint32 = 32
+	legacyMetaSize             uint32 = 36
+)
+
+// legacyMaxDepth is deeper than any tree of an older file grew
+const legacyMaxDepth = 64
+
+var errLegacyCorrupt = errors.New("DB file of an older version is corrupt, it cannot be upgraded")
+
+// legacyFile is an open file of an older version
+type legacyFile struct {
+	file     *os.File
+	version  uint32
+	layout   legacyLayout
+	header   []byte
+	numPages uint32
+
+	// slots is the slot of every page of a copy-on-write file, nil for
+	// a file written in place
+	slots []uint32
+}
+
+// openLegacy returns the file if it is of an older version, nil if it is
+// of the current one. A file of an unknown version is left for NewPager
+// to reject
+func openLegacy(file *os.File, fileLength int64) (*legacyFile, error) {
+	start := make([]byte, headerPrefixSize)
+	if _, err := file.ReadAt(start, 0); err != nil {
+		return nil, nil
+	}
+
+	version := binary.LittleEndian.Uint32(start[headerVersionOffset : headerVersionOffset+headerVersionSize])
+
+	f := &legacyFile{file: file}
+	switch {
+	case bytes.Equal(start[metaMagicOffset:metaMagicOffset+metaMagicSize], metaMagic):
+		if version != legacyMetaVersion {
+			return nil, nil
+		}
+
+		if err := f.readPageMap(); err != nil {
+			return nil, err
+		}
+	case bytes.Equal(start[headerMagicOffset:headerMagicOffset+headerMagicSize], headerMagic):
+		if version >= uint32(len(legacyLayouts)) || fileLength%int64(legacyPageSize) != 0 {
+			return nil, nil
+		}
+
+		f.header = make([]byte, legacyPageSize)
+		if _, err := file.ReadAt(f.header, 0); err != nil {
+			return nil, err
+		}
+
+		f.numPages = uint32(fileLength/int64(legacyPageSize)) - 1
+	default:
+		// A file without a header starts with the root of the table
+		if fileLength%int64(legacyPageSize) != 0 || start[isRootOffset] != 1 {
+			return nil, nil
+		}
+
+		f.numPages = uint32(fileLength / int64(legacyPageSize))
+	}
+
+	if f.header != nil {
+		f.version = binary.LittleEndian.Uint32(f.header[headerVersionOffset : headerVersionOffset+headerVersionSize])
+		if f.version == 0 || f.version >= uint32(len(legacyLayouts)) {
+			return nil, fmt.Errorf("unsupported DB file version '%d'", f.version)
+		}
+	}
+
+	f.layout = legacyLayouts[f.version]
+	return f, nil
+}
+
+// readPageMap reads the slots of the pages and the header of a
+// copy-on-write file from the valid meta with the highest txn id
+func (f *legacyFile) readPageMap() error {
+	var meta []byte
+	for slot := uint32(0); slot < metaSlots; slot++ {
+		m := make([]byte, legacyMetaSize)
+		if _, err := f.file.ReadAt(m, int64(slot)*int64(legacyPageSize)); err != nil {
+			continue
+		}
+
+		checksum := binary.LittleEndian.Uint32(m[legacyMetaChecksumOffset:])
+		if !bytes.Equal(m[metaMagicOffset:metaMagicOffset+metaMagicSize], metaMagic) ||
+			crc32.ChecksumIEEE(m[:legacyMetaChecksumOffset]) != checksum {
+			continue
+		}
+
+		if meta == nil || legacyMetaUint64(m, legacyMetaTxnIdOffset) > legacyMetaUint64(meta, legacyMetaTxnIdOffset) {
+			meta = m
+		}
+	}
+
+	if meta == nil {
+		return errors.New("DB file has no valid meta. Corrupt file")
+	}
+
+	f.numPages = binary.LittleEndian.Uint32(meta[legacyMetaNumPagesOffset:])
+	f.slots = make([]uint32, f.numPages)
+
+	root, err := f.readSlot(binary.LittleEndian.Uint32(meta[legacyMetaRootSlotOffset:]))
+	if err != nil {
+		return err
+	}
+
+	entries := legacyPageSize / pageMapEntrySize
+	for i := uint32(0); i*entries < f.numPages; i++ {
+		page, err := f.readSlot(mapEntry(root, i))
+		if err != nil {
+			return err
+		}
+
+		for j := uint32(0); j < entries && i*entries+j < f.numPages; j++ {
+			f.slots[i*entries+j] = mapEntry(page, j)
+		}
+	}
+
+	f.header, err = f.readSlot(binary.LittleEndian.Uint32(meta[legacyMetaHeaderSlotOffset:]))
+	return err
+}
+
+func legacyMetaUint64(meta []byte, offset uint32) uint64 {
+	return binary.LittleEndian.Uint64(meta[offset:])
+}
+
+func (f *legacyFile) readSlot(slot uint32) ([]byte, error) {
+	page := make([]byte, legacyPageSize)
+	if _, err := f.file.ReadAt(page, int64(slot)*int64(legacyPageSize)); err != nil {
+		return nil, errLegacyCorrupt
+	}
+
+	return page, nil
+}
+
+func (f *legacyFile) page(pageNum uint32) ([]byte, error) {
+	if pageNum >= f.numPages {
+		return nil, errLegacyCorrupt
+	}
+
+	switch {
+	case f.slots != nil:
+		return f.readSlot(f.slots[pageNum])
+	case f.header != nil:
+		return f.readSlot(pageNum + 1)
+	default:
+		return f.readSlot(pageNum)
+	}
+}
+
+func (f *legacyFile) headerField(offset uint32) uint32 {
+	if offset == 0 {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(f.header[offset:])
+}
+
+// cells appends the cells of the tree under the page in key order,
+// each is the key of keySize bytes followed by the value
+func (f *legacyFile) cells(cells [][]byte, pageNum, keySize, valueSize uint32, depth int) ([][]byte, error) {
+	if depth > legacyMaxDepth {
+		return nil, errLegacyCorrupt
+	}
+
+	page, err := f.page(pageNum)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both kinds of nodes have the number of cells and a page number
+	// after the common header, the next leaf or the right child
+	headerSize := f.layout.nodeHeaderSize
+	numCells := binary.LittleEndian.Uint32(page[headerSize:])
+	body := headerSize + 8
+
+	switch NodeType(page[nodeTypeOffset]) {
+	case leafNode:
+		cellSize := keySize + valueSize
+		if numCells > (legacyPageSize-body)/cellSize {
+			return nil, errLegacyCorrupt
+		}
+
+		for i := uint32(0); i < numCells; i++ {
+			offset := body + i*cellSize
+			cells = append(cells, append([]byte{}, page[offset:offset+cellSize]...))
+		}
+	case internalNode:
+		cellSize := internalNodeChildSize + keySize
+		if numCells > (legacyPageSize-body)/cellSize {
+			return nil, errLegacyCorrupt
+		}
+
+		children := make([]uint32, 0, numCells+1)
+		for i := uint32(0); i < numCells; i++ {
+			children = append(children, binary.LittleEndian.Uint32(page[body+i*cellSize:]))
+		}
+
+		children = append(children, binary.LittleEndian.Uint32(page[headerSize+4:]))
+		for _, child := range children {
+			if cells, err = f.cells(cells, child, keySize, valueSize, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errLegacyCorrupt
+	}
+
+	return cells, nil
+}
+
+// legacyIndex is an entry of the catalog of an older file
+type legacyIndex struct {
+	name   string
+	column string
+	unique bool
+}
+
+func (f *legacyFile) catalog() ([]legacyIndex, error) {
+	offset := f.layout.catalogOffset
+	if offset == 0 {
+		return nil, nil
+	}
+
+	numIndexes := binary.LittleEndian.Uint32(f.header[offset:])
+	if numIndexes > (legacyPageSize-offset-catalogNumIndexesSize)/catalogEntrySize {
+		return nil, errLegacyCorrupt
+	}
+
+	var indexes []legacyIndex
+	for i := uint32(0); i < numIndexes; i++ {
+		start := offset + catalogNumIndexesSize + i*catalogEntrySize
+		entry := f.header[start : start+catalogEntrySize]
+
+		column := string(bytes.TrimRight(entry[indexColumnOffset:indexColumnOffset+indexColumnSize], "\x00"))
+		if _, ok := indexedColumns[column]; !ok {
+			return nil, fmt.Errorf("index catalog refers to unknown column '%s'", column)
+		}
+
+		indexes = append(indexes, legacyIndex{
+			name:   string(bytes.TrimRight(entry[indexNameOffset:indexNameOffset+indexNameSize], "\x00")),
+			column: column,
+			unique: entry[indexUniqueOffset] == 1,
+		})
+	}
+
+	return indexes, nil
+}
+
+// upgrade writes the file of an older version again in the current one.
+// The log of a file written in place has to be empty, its records are in
+// the format of the old version
+func upgrade(filename string, f *legacyFile, options Options) error {
+	if options.ReadOnly {
+		return fmt.Errorf("DB file version '%d' has to be upgraded, it cannot be opened read only", f.version)
+	}
+
+	if stat, err := os.Stat(filename + walFileSuffix); err == nil && stat.Size() > 0 {
+		return fmt.Errorf("DB file version '%d' has commits in its log, it cannot be upgraded", f.version)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".upgrade")
+	if err != nil {
+		return err
+	}
+
+	temp.Close()
+	name := temp.Name()
+	defer os.Remove(name + walFileSuffix)
+
+	if err := f.copyTo(name, options); err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	if err := os.Rename(name, filename); err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	return syncDir(filepath.Dir(filename))
+}
+
+// copyTo packs the trees of the old file into the new file with the
+// table first, then the indexes and last the statistics
+func (f *legacyFile) copyTo(filename string, options Options) error {
+	p, err := NewPager(filename, Options{
+		CopyOnWrite: f.slots != nil,
+		Durability:  options.Durability,
+		PageSize:    legacyPageSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := f.pack(p); err != nil {
+		p.Close()
+		return err
+	}
+
+	if err := p.checkpoint(); err != nil {
+		p.Close()
+		return err
+	}
+
+	return p.Close()
+}
+
+func (f *legacyFile) pack(p *pager) error {
+	// Before version 3 the file only held the table and its sizes were not recorded
+	keySize, valueSize := Uint32Key.Size(), rowSize
+	if f.layout.keySizeOffset != 0 {
+		keySize = f.headerField(f.layout.keySizeOffset)
+		valueSize = f.headerField(f.layout.keySizeOffset + headerKeySizeSize)
+	}
+
+	root := newTableTree(p, 0)
+	if keySize != root.key.Size() || valueSize != root.valueSize {
+		if keySize < 2 {
+			return errLegacyCorrupt
+		}
+
+		root = &btree{pager: p, key: BytesKey((keySize - 2) / 2), valueSize: valueSize}
+	}
+
+	cells, err := f.cells(nil, 0, keySize, valueSize, 0)
+	if err != nil {
+		return err
+	}
+
+	// Keys of the table were little endian before version 2
+	if f.version < 2 {
+		for _, cell := range cells {
+			copy(cell, cell[keySize+idOffset:keySize+idOffset+idSize])
+			binary.BigEndian.PutUint32(cell, binary.LittleEndian.Uint32(cell))
+		}
+
+		sort.Slice(cells, func(i, j int) bool {
+			return bytes.Compare(cells[i], cells[j]) < 0
+		})
+	}
+
+	packed := root.pack([][]byte{make([]byte, p.pageSize)}, 0, cells)
+
+	entries, err := f.catalog()
+	if err != nil {
+		return err
+	}
+
+	var indexes []*Index
+	for _, entry := range entries {
+		idx := &Index{name: entry.name, column: entry.column, unique: entry.unique}
+		idx.tree = newIndexTree(p, entry.column, uint32(len(packed)))
+
+		var keys [][]byte
+		for _, cell := range cells {
+			r := DeserializeRow(cell[keySize:])
+			key, err := idx.key(columnValue(r, idx.column), r.id)
+			if err != nil {
+				return err
+			}
+
+			keys = append(keys, key)
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i], keys[j]) < 0
+		})
+
+		packed = append(packed, make([]byte, p.pageSize))
+		packed = idx.tree.pack(packed, idx.tree.rootPageNum, keys)
+		indexes = append(indexes, idx)
+	}
+
+	var stats *btree
+	if statsRoot := f.headerField(f.layout.statsRootOffset); statsRoot != 0 {
+		stats = newStatsTree(p, uint32(len(packed)))
+
+		statsCells, err := f.cells(nil, statsRoot, stats.key.Size(), stats.valueSize, 0)
+		if err != nil {
+			return err
+		}
+
+		packed = append(packed, make([]byte, p.pageSize))
+		packed = stats.pack(packed, stats.rootPageNum, statsCells)
+	}
+
+	for pageNum, data := range packed {
+		page, err := p.getPageForWrite(uint32(pageNum))
+		if err != nil {
+			return err
+		}
+
+		copy(page, data)
+	}
+
+	binary.LittleEndian.PutUint32(p.header[headerKeySizeOffset:headerKeySizeOffset+headerKeySizeSize], keySize)
+	binary.LittleEndian.PutUint32(p.header[headerValueSizeOffset:headerValueSizeOffset+headerValueSizeSize], valueSize)
+	writeCatalog(p, indexes)
+	if stats != nil {
+		setStatsRoot(p, stats.rootPageNum)
+	}
+
+	// The next commit goes on from the last one of the old file
+	if f.layout.lsnOffset != 0 {
+		setHeaderLSN(p.baseHeader, binary.LittleEndian.Uint64(f.header[f.layout.lsnOffset:]))
+	}
+
+	return p.commit()
+}
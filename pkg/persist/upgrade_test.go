@@ -0,0 +1,202 @@
+package persist
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+// extractFixture writes the gzipped file of an older version from
+// testdata to the test directory and returns its name
+func extractFixture(t *testing.T, name string) string {
+	in, err := os.Open(path.Join("testdata", name+".gz"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer in.Close()
+
+	r, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	filename := path.Join(testDirPath, name)
+	out, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer out.Close()
+
+	if _, err := io.Copy(out, r); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return filename
+}
+
+func TestUpgrade(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tests := []struct {
+		name        string
+		numRows     uint32
+		indexes     []string
+		stats       bool
+		copyOnWrite bool
+	}{
+		{name: "v0.db", numRows: 30},
+		{name: "v1.db", numRows: 30, indexes: []string{"by_username"}},
+		{name: "v4-cow.db", numRows: 100, indexes: []string{"by_email"}, stats: true, copyOnWrite: true},
+		{name: "v6.db", numRows: 100, indexes: []string{"by_username", "by_email"}, stats: true},
+	}
+
+	for _, test := range tests {
+		filename := extractFixture(t, test.name)
+
+		// The second open finds the file upgraded
+		for i := 0; i < 2; i++ {
+			tbl, err := OpenDatabase(filename)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			for id := uint32(1); id <= test.numRows; id++ {
+				r, err := tbl.Lookup(id)
+				if err != nil {
+					t.Fatalf("%s: %s", test.name, err)
+				}
+
+				if r == nil || r.Username() != fmt.Sprintf("user%d", id) || r.Email() != fmt.Sprintf("user%d@example.com", id) {
+					t.Fatalf("%s: expected row %d to be upgraded but got %v", test.name, id, r)
+				}
+			}
+
+			var scanned uint32
+			err = tbl.Scan(nil, func(r *Row) error {
+				if scanned++; r.id != scanned {
+					return fmt.Errorf("row %d scanned as row %d", r.id, scanned)
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			if scanned != test.numRows {
+				t.Fatalf("%s: expected %d rows but scanned %d", test.name, test.numRows, scanned)
+			}
+
+			indexes := tbl.Indexes()
+			if len(indexes) != len(test.indexes) {
+				t.Fatalf("%s: expected %d indexes but got %d", test.name, len(test.indexes), len(indexes))
+			}
+
+			for j, idx := range indexes {
+				if idx.Name() != test.indexes[j] {
+					t.Fatalf("%s: expected index '%s' but got '%s'", test.name, test.indexes[j], idx.Name())
+				}
+
+				keys, err := idx.tree.cells(nil)
+				if err != nil {
+					t.Fatalf("%s: %s", test.name, err)
+				}
+
+				if uint32(len(keys)) != test.numRows {
+					t.Fatalf("%s: expected index '%s' to hold %d keys but it holds %d", test.name, idx.Name(), test.numRows, len(keys))
+				}
+
+				for _, key := range keys {
+					value, id, err := idx.decodeKey(key[:idx.tree.key.Size()])
+					if err != nil {
+						t.Fatalf("%s: %s", test.name, err)
+					}
+
+					if r, _ := tbl.Lookup(id); r == nil || columnValue(r, idx.Column()) != value {
+						t.Fatalf("%s: index '%s' holds '%s' for row %d", test.name, idx.Name(), value, id)
+					}
+				}
+			}
+
+			if _, ok := tbl.Stats("username"); ok != test.stats {
+				t.Fatalf("%s: expected statistics to be kept %v", test.name, test.stats)
+			}
+
+			if copyOnWrite := tbl.pager.pageMap != nil; copyOnWrite != test.copyOnWrite {
+				t.Fatalf("%s: expected the file to stay copy-on-write %v", test.name, test.copyOnWrite)
+			}
+
+			// Commits go on in the current version
+			if i == 1 {
+				row, _ := NewRow(test.numRows+1, "new", "new@example.com")
+				if err := tbl.Insert(row); err != nil {
+					t.Fatalf("%s: %s", test.name, err)
+				}
+			}
+
+			if err := tbl.Close(); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+	}
+}
+
+func TestUpgradeTree(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := extractFixture(t, "v6-tree.db")
+
+	tree, err := OpenTree(filename, TreeOptions{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tree.Close()
+
+	if tree.MaxKeySize() != 16 || tree.MaxValueSize() != 32 {
+		t.Fatalf("expected the limits of the old tree but got %d and %d", tree.MaxKeySize(), tree.MaxValueSize())
+	}
+
+	for i := 0; i < 100; i++ {
+		value, ok, err := tree.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if !ok || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("expected key %d to be upgraded but got '%s'", i, value)
+		}
+	}
+}
+
+func TestUpgradeReadOnly(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := extractFixture(t, "v6.db")
+
+	if _, err := OpenDatabaseWithOptions(filename, Options{ReadOnly: true}); err == nil {
+		t.Fatalf("expected a file of an older version not to be upgraded read only")
+	}
+
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl.Close()
+
+	tbl, err = OpenDatabaseWithOptions(filename, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl.Close()
+}
@@ -0,0 +1,536 @@
+package persist
+
+// Nodes are never merged or freed, after deletes the file holds empty and
+// half full leaves. Vacuum rebuilds every tree into densely packed pages
+// numbered from the start of the file and commits them in place of the
+// old ones. IncrementalVacuum keeps the shape of the trees: it merges the
+// leaves of a parent whose cells fit in fewer, unlinks the leaves this
+// empties, moves the pages at the end of the file into the pages no tree
+// reaches any more and drops the rest. Either way the file is cut
+// to its pages once the commit is written to it. Snapshots taken before
+// read the old pages, the pager keeps them until they are released
+
+// Vacuum rebuilds the table, its indexes and its statistics into densely
+// packed pages and shrinks the file to them. It is one commit of its own
+// and cannot be part of a transaction
+func (t *Table) Vacuum() error {
+	return t.vacuum(func(w *Table) error {
+		return w.rebuild()
+	})
+}
+
+// IncrementalVacuum merges sparse leaves, frees the empty ones and moves
+// pages from the end of the file into the free ones, then shrinks the
+// file. It is cheaper than Vacuum, but only leaves of the same parent
+// are merged and internal nodes are left as they are
+func (t *Table) IncrementalVacuum() error {
+	return t.vacuum(func(w *Table) error {
+		return w.compact()
+	})
+}
+
+func (t *Table) vacuum(fn func(w *Table) error) error {
+	if t.tx != nil || t.writing {
+		return ErrTxActive
+	}
+
+	if err := t.apply(nil, fn); err != nil {
+		return err
+	}
+
+	t.writer.Lock()
+	defer t.writer.Unlock()
+
+	return t.pager.shrink()
+}
+
+// trees returns the trees stored in the file with the table first, the
+// indexes are copies with the trees of the copies so they can be moved
+// without changing the catalog snapshots read
+func (t *Table) trees() ([]*Index, *btree, []*btree) {
+	indexes := make([]*Index, len(t.indexes))
+	trees := []*btree{t.tree}
+
+	for i, idx := range t.indexes {
+		indexes[i] = &Index{
+			name:   idx.name,
+			column: idx.column,
+			unique: idx.unique,
+			tree:   newIndexTree(t.pager, idx.column, idx.tree.rootPageNum),
+		}
+
+		trees = append(trees, indexes[i].tree)
+	}
+
+	var stats *btree
+	if root := getStatsRoot(t.pager); root != 0 {
+		stats = newStatsTree(t.pager, root)
+		trees = append(trees, stats)
+	}
+
+	return indexes, stats, trees
+}
+
+// rebuild replaces every page with the trees packed from page 0 on,
+// the table keeps its root at page 0
+func (t *Table) rebuild() error {
+	indexes, stats, trees := t.trees()
+
+	var packed [][]byte
+	for _, tree := range trees {
+		cells, err := tree.cells(nil)
+		if err != nil {
+			return err
+		}
+
+		root := uint32(len(packed))
+		packed = append(packed, make([]byte, t.pager.pageSize))
+		packed = tree.pack(packed, root, cells)
+
+		// The table is packed first, its root stays at page 0
+		if tree != t.tree {
+			tree.rootPageNum = root
+		}
+	}
+
+	for pageNum, data := range packed {
+		page, err := t.pager.getPageForWrite(uint32(pageNum))
+		if err != nil {
+			return err
+		}
+
+		copy(page, data)
+	}
+
+	if err := t.pager.truncate(uint32(len(packed))); err != nil {
+		return err
+	}
+
+	t.replaceRoots(indexes, stats)
+	return nil
+}
+
+// replaceRoots records the roots of the trees of the indexes and the
+// statistics in the header, the indexes replace the catalog
+func (t *Table) replaceRoots(indexes []*Index, stats *btree) {
+	t.indexes = indexes
+	writeCatalog(t.pager, t.indexes)
+
+	if stats != nil {
+		setStatsRoot(t.pager, stats.rootPageNum)
+	}
+}
+
+// cells returns a copy of every cell of the tree in order as of
+// the snapshot, a nil snapshot reads the tree as the writer sees it
+func (t *btree) cells(s *snapshot) ([][]byte, error) {
+	c, err := t.start(s, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.Close()
+
+	var cells [][]byte
+	for !c.endOfTable {
+		key, err := c.Key()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := c.Value()
+		if err != nil {
+			return nil, err
+		}
+
+		cells = append(cells, t.newLeafCell(key, value))
+
+		if err := c.Advance(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cells, nil
+}
+
+// packedNode is a node of the level being packed with the
+// largest key under it, the separator in its parent
+type packedNode struct {
+	pageNum uint32
+	maxKey  []byte
+}
+
+// pack fills leaves with the cells in order, then the levels of internal
+// nodes above them until one node is left, which is written to the root.
+// The pages are appended to the packed pages, which are returned
+func (t *btree) pack(packed [][]byte, root uint32, cells [][]byte) [][]byte {
+	allocate := func(single bool) uint32 {
+		if single {
+			return root
+		}
+
+		packed = append(packed, make([]byte, t.pager.pageSize))
+		return uint32(len(packed) - 1)
+	}
+
+	maxCells := int(t.leafNodeMaxCells())
+	numLeaves := (len(cells) + maxCells - 1) / maxCells
+	if numLeaves == 0 {
+		numLeaves = 1
+	}
+
+	var level []packedNode
+	for i := 0; i < numLeaves; i++ {
+		pageNum := allocate(numLeaves == 1)
+		page := packed[pageNum]
+		initializeLeafNode(page)
+
+		end := (i + 1) * maxCells
+		if end > len(cells) {
+			end = len(cells)
+		}
+
+		leafCells := cells[i*maxCells : end]
+		for j, cell := range leafCells {
+			copy(t.getLeafNodeCell(page, uint32(j)), cell)
+		}
+
+		setLeafNodeNumCells(page, uint32(len(leafCells)))
+
+		if i > 0 {
+			setLeafNodeNextLeaf(packed[level[i-1].pageNum], pageNum)
+		}
+
+		var maxKey []byte
+		if len(leafCells) > 0 {
+			maxKey = leafCells[len(leafCells)-1][:t.key.Size()]
+		}
+
+		level = append(level, packedNode{pageNum: pageNum, maxKey: maxKey})
+	}
+
+	// The children are spread evenly so no node is left with a single one
+	fanout := int(t.internalNodeMaxCells()) + 1
+	for len(level) > 1 {
+		numNodes := (len(level) + fanout - 1) / fanout
+
+		parents := make([]packedNode, 0, numNodes)
+		for i := 0; i < numNodes; i++ {
+			children := level[i*len(level)/numNodes : (i+1)*len(level)/numNodes]
+
+			pageNum := allocate(numNodes == 1)
+			page := packed[pageNum]
+			initializeInternalNode(page)
+
+			last := len(children) - 1
+			setInternalNodeNumKeys(page, uint32(last))
+			for j, child := range children[:last] {
+				t.setInternalNodeChild(page, uint32(j), child.pageNum)
+				t.setInternalNodeKey(page, uint32(j), child.maxKey)
+			}
+
+			setInternalNodeRightChild(page, children[last].pageNum)
+			for _, child := range children {
+				setNodeParent(packed[child.pageNum], pageNum)
+			}
+
+			parents = append(parents, packedNode{pageNum: pageNum, maxKey: children[last].maxKey})
+		}
+
+		level = parents
+	}
+
+	setNodeRoot(packed[root], true)
+	return packed
+}
+
+// compact merges the leaves and unlinks the empty ones of every tree,
+// then moves the last page into the lowest page no tree reaches until
+// the last page is reached, and drops the pages after it
+func (t *Table) compact() error {
+	indexes, stats, trees := t.trees()
+
+	for _, tree := range trees {
+		if err := tree.mergeLeaves(); err != nil {
+			return err
+		}
+
+		if err := tree.unlinkEmptyLeaves(); err != nil {
+			return err
+		}
+	}
+
+	owners := map[uint32]*btree{}
+	prevLeaf := map[uint32]uint32{}
+	for _, tree := range trees {
+		if err := tree.collectPages(owners, prevLeaf); err != nil {
+			return err
+		}
+	}
+
+	var free []uint32
+	for pageNum := uint32(0); pageNum < t.pager.numPages; pageNum++ {
+		if owners[pageNum] == nil {
+			free = append(free, pageNum)
+		}
+	}
+
+	numPages := t.pager.numPages
+	for len(free) > 0 {
+		last := numPages - 1
+		numPages--
+
+		if free[len(free)-1] == last {
+			free = free[:len(free)-1]
+			continue
+		}
+
+		to := free[0]
+		free = free[1:]
+
+		if err := owners[last].movePage(last, to, prevLeaf); err != nil {
+			return err
+		}
+
+		owners[to] = owners[last]
+		delete(owners, last)
+	}
+
+	if err := t.pager.truncate(numPages); err != nil {
+		return err
+	}
+
+	t.replaceRoots(indexes, stats)
+	return nil
+}
+
+// mergeLeaves moves the cells of every leaf into the next leaf when it
+// has the same parent and room for them, the leaf is left empty. The
+// next leaf keeps its key in the parent, which stays the largest key
+func (t *btree) mergeLeaves() error {
+	pageNum, _, err := t.descend(nil, nil)
+	if err != nil {
+		return err
+	}
+
+	cellSize := t.leafNodeCellSize()
+	maxCells := t.leafNodeMaxCells()
+
+	for {
+		page, err := t.pager.GetPage(pageNum)
+		if err != nil {
+			return err
+		}
+
+		next := getLeafNodeNextLeaf(page)
+		if next == 0 {
+			return nil
+		}
+
+		nextPage, err := t.pager.GetPage(next)
+		if err != nil {
+			return err
+		}
+
+		numCells, nextCells := getLeafNodeNumCells(page), getLeafNodeNumCells(nextPage)
+		if numCells > 0 && numCells+nextCells <= maxCells && getNodeParent(page) == getNodeParent(nextPage) {
+			if page, err = t.pager.getPageForWrite(pageNum); err != nil {
+				return err
+			}
+
+			if nextPage, err = t.pager.getPageForWrite(next); err != nil {
+				return err
+			}
+
+			cells := nextPage[leafNodeHeaderSize:]
+			copy(cells[numCells*cellSize:], cells[:nextCells*cellSize])
+			copy(cells, page[leafNodeHeaderSize:leafNodeHeaderSize+numCells*cellSize])
+
+			setLeafNodeNumCells(nextPage, numCells+nextCells)
+			setLeafNodeNumCells(page, 0)
+		}
+
+		pageNum = next
+	}
+}
+
+// unlinkEmptyLeaves removes the empty leaves other than the root from
+// their parents and the chain of leaves. A parent keeps at least one
+// child, an empty leaf which is the only child of its parent stays
+func (t *btree) unlinkEmptyLeaves() error {
+	pageNum, _, err := t.descend(nil, nil)
+	if err != nil {
+		return err
+	}
+
+	var prev uint32
+	hasPrev := false
+
+	for {
+		page, err := t.pager.GetPage(pageNum)
+		if err != nil {
+			return err
+		}
+
+		next := getLeafNodeNextLeaf(page)
+
+		unlinked := false
+		if getLeafNodeNumCells(page) == 0 && !isNodeRoot(page) {
+			if unlinked, err = t.removeChild(getNodeParent(page), pageNum); err != nil {
+				return err
+			}
+		}
+
+		if unlinked && hasPrev {
+			prevPage, err := t.pager.getPageForWrite(prev)
+			if err != nil {
+				return err
+			}
+
+			setLeafNodeNextLeaf(prevPage, next)
+		}
+
+		if !unlinked {
+			prev, hasPrev = pageNum, true
+		}
+
+		if next == 0 {
+			return nil
+		}
+
+		pageNum = next
+	}
+}
+
+// removeChild removes the child from the internal node unless it is the
+// only one. The neighbour after the child takes over its keys, or the one
+// before it when it is the right child
+func (t *btree) removeChild(pageNum, child uint32) (bool, error) {
+	page, err := t.pager.GetPage(pageNum)
+	if err != nil {
+		return false, err
+	}
+
+	numKeys := getInternalNodeNumKeys(page)
+	if numKeys == 0 {
+		return false, nil
+	}
+
+	index, err := t.internalNodeChildIndex(page, child)
+	if err != nil {
+		return false, err
+	}
+
+	page, err = t.pager.getPageForWrite(pageNum)
+	if err != nil {
+		return false, err
+	}
+
+	if index == numKeys {
+		left, err := t.getInternalNodeChild(page, numKeys-1)
+		if err != nil {
+			return false, err
+		}
+
+		setInternalNodeRightChild(page, left)
+	} else {
+		for i := index; i+1 < numKeys; i++ {
+			copy(t.getInternalNodeCell(page, i), t.getInternalNodeCell(page, i+1))
+		}
+	}
+
+	setInternalNodeNumKeys(page, numKeys-1)
+	return true, nil
+}
+
+// collectPages records the tree as the owner of every page it reaches
+// and the leaf before every leaf in the chain
+func (t *btree) collectPages(owners map[uint32]*btree, prevLeaf map[uint32]uint32) error {
+	pending := []uint32{t.rootPageNum}
+	for len(pending) > 0 {
+		pageNum := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		page, err := t.pager.GetPage(pageNum)
+		if err != nil {
+			return err
+		}
+
+		owners[pageNum] = t
+
+		if getNodeType(page) == leafNode {
+			if next := getLeafNodeNextLeaf(page); next != 0 {
+				prevLeaf[next] = pageNum
+			}
+
+			continue
+		}
+
+		for i := uint32(0); i <= getInternalNodeNumKeys(page); i++ {
+			child, err := t.getInternalNodeChild(page, i)
+			if err != nil {
+				return err
+			}
+
+			pending = append(pending, child)
+		}
+	}
+
+	return nil
+}
+
+// movePage copies the node to a page no tree reaches and points its
+// parent, its children or the leaf before it at the new page. A moved
+// root changes the root of the tree
+func (t *btree) movePage(from, to uint32, prevLeaf map[uint32]uint32) error {
+	page, err := t.pager.GetPage(from)
+	if err != nil {
+		return err
+	}
+
+	moved, err := t.pager.getPageForWrite(to)
+	if err != nil {
+		return err
+	}
+
+	copy(moved, page)
+
+	if isNodeRoot(moved) {
+		t.rootPageNum = to
+	} else {
+		parent, err := t.pager.getPageForWrite(getNodeParent(moved))
+		if err != nil {
+			return err
+		}
+
+		index, err := t.internalNodeChildIndex(parent, from)
+		if err != nil {
+			return err
+		}
+
+		if err := t.setInternalNodeChild(parent, index, to); err != nil {
+			return err
+		}
+	}
+
+	if getNodeType(moved) == internalNode {
+		return t.setChildrenParent(to, moved)
+	}
+
+	if prev, ok := prevLeaf[from]; ok {
+		prevPage, err := t.pager.getPageForWrite(prev)
+		if err != nil {
+			return err
+		}
+
+		setLeafNodeNextLeaf(prevPage, to)
+		prevLeaf[to] = prev
+		delete(prevLeaf, from)
+	}
+
+	if next := getLeafNodeNextLeaf(moved); next != 0 {
+		prevLeaf[next] = to
+	}
+
+	return nil
+}
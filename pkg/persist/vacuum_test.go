@@ -0,0 +1,251 @@
+package persist
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+// checkIndexes checks every index holds one entry per row
+func checkIndexes(t *testing.T, tbl *Table, rows int) {
+	s := tbl.pager.acquireSnapshot()
+	defer s.release()
+
+	for _, idx := range tbl.Indexes() {
+		cells, err := idx.tree.cells(s)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if len(cells) != rows {
+			t.Fatalf("Expected %d entries in index '%s', got %d", rows, idx.name, len(cells))
+		}
+	}
+}
+
+func fileSize(t *testing.T, filename string) int64 {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return stat.Size()
+}
+
+func TestVacuum(t *testing.T) {
+	for _, copyOnWrite := range []bool{false, true} {
+		t.Run(fmt.Sprintf("copyOnWrite=%v", copyOnWrite), func(t *testing.T) {
+			createTestDir(t, testDirPath)
+			t.Cleanup(cleanupTestDir(t, testDirPath))
+
+			filename := path.Join(testDirPath, "test.db")
+			tbl, err := OpenDatabaseWithOptions(filename, Options{CopyOnWrite: copyOnWrite})
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			insertUsers(t, tbl, 0, 2000)
+			if err := tbl.CreateIndex("idx_username", "username", true); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			if err := tbl.Analyze(); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			stats, _ := tbl.Stats("id")
+
+			for i := 0; i < 2000; i++ {
+				if i%10 != 0 {
+					if err := tbl.Delete(uint32(i)); err != nil {
+						t.Fatalf("%s", err)
+					}
+				}
+			}
+
+			if err := tbl.pager.shrink(); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			numPages, size := tbl.pager.committedPages, fileSize(t, filename)
+
+			snapshot := tbl.Snapshot()
+			defer snapshot.Release()
+
+			if err := tbl.Vacuum(); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			if tbl.pager.committedPages >= numPages/4 {
+				t.Fatalf("Expected far fewer than %d pages after vacuum, got %d", numPages, tbl.pager.committedPages)
+			}
+
+			if n := fileSize(t, filename); n >= size {
+				t.Fatalf("Expected the file to shrink from %d bytes, got %d", size, n)
+			}
+
+			// The snapshot reads the pages as they were before
+			if ids := checkScan(t, snapshot, false); len(ids) != 200 {
+				t.Fatalf("Expected the snapshot to read 200 rows, got %d", len(ids))
+			}
+
+			if ids := checkScan(t, tbl, false); len(ids) != 200 {
+				t.Fatalf("Expected 200 rows after vacuum, got %d", len(ids))
+			}
+
+			checkIndexes(t, tbl, 200)
+			if s, ok := tbl.Stats("id"); !ok || s.RowCount != stats.RowCount {
+				t.Fatalf("Expected the statistics to be kept, got %v", s)
+			}
+
+			// The packed leaves split again
+			insertUsers(t, tbl, 2001, 2100)
+			if err := tbl.Close(); err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			tbl, err = OpenDatabase(filename)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			defer tbl.Close()
+
+			if ids := checkScan(t, tbl, false); len(ids) != 299 {
+				t.Fatalf("Expected 299 rows after reopening, got %d", len(ids))
+			}
+
+			checkIndexes(t, tbl, 299)
+			if ids := selectIds(t, tbl, Predicate{Column: "username", Op: Equal, Value: "user#2050"}); len(ids) != 1 {
+				t.Fatalf("Expected the index to find the row, got %v", ids)
+			}
+		})
+	}
+}
+
+func TestIncrementalVacuum(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 2000)
+	if err := tbl.CreateIndex("idx_email", "email", false); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Empties every leaf in the middle of the table
+	for i := 100; i < 1900; i++ {
+		if err := tbl.Delete(uint32(i)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	numPages := tbl.pager.committedPages
+	if err := tbl.IncrementalVacuum(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if tbl.pager.committedPages >= numPages/2 {
+		t.Fatalf("Expected fewer than half of %d pages after vacuum, got %d", numPages, tbl.pager.committedPages)
+	}
+
+	if n := fileSize(t, filename); n != pageOffset(tbl.pager.pageSize, tbl.pager.committedPages) {
+		t.Fatalf("Expected the file to be cut to %d pages, it is %d bytes", tbl.pager.committedPages, n)
+	}
+
+	if ids := checkScan(t, tbl, false); len(ids) != 200 {
+		t.Fatalf("Expected 200 rows after vacuum, got %d", len(ids))
+	}
+
+	checkIndexes(t, tbl, 200)
+
+	// Rows go back into the range the leaves were dropped from
+	insertUsers(t, tbl, 500, 1000)
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl, err = OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	if ids := checkScan(t, tbl, false); len(ids) != 700 || ids[100] != 500 {
+		t.Fatalf("Expected 700 rows after reopening, got %d", len(ids))
+	}
+
+	checkIndexes(t, tbl, 700)
+}
+
+func TestIncrementalVacuumMergesLeaves(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabaseWithOptions(filename, Options{PageSize: MaxPageSize})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 2000)
+	if err := tbl.CreateIndex("idx_email", "email", false); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Leaves no leaf empty, only merging them frees pages
+	for i := 0; i < 2000; i++ {
+		if i%10 != 0 {
+			if err := tbl.Delete(uint32(i)); err != nil {
+				t.Fatalf("%s", err)
+			}
+		}
+	}
+
+	if err := tbl.pager.shrink(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	size := fileSize(t, filename)
+	if err := tbl.IncrementalVacuum(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if n := fileSize(t, filename); n >= size/2 {
+		t.Fatalf("Expected the file to shrink to less than half of %d bytes, got %d", size, n)
+	}
+
+	if ids := checkScan(t, tbl, false); len(ids) != 200 {
+		t.Fatalf("Expected 200 rows after vacuum, got %d", len(ids))
+	}
+
+	checkIndexes(t, tbl, 200)
+
+	insertUsers(t, tbl, 2000, 2100)
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl, err = OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	if ids := checkScan(t, tbl, false); len(ids) != 300 {
+		t.Fatalf("Expected 300 rows after reopening, got %d", len(ids))
+	}
+
+	checkIndexes(t, tbl, 300)
+	if ids := selectIds(t, tbl, Predicate{Column: "email", Op: Equal, Value: "person#1990@example.com"}); len(ids) != 1 {
+		t.Fatalf("Expected the index to find the row, got %v", ids)
+	}
+}
@@ -0,0 +1,337 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A file written in place is only changed by checkpoints. A commit appends
+// the pages it changed and the header to the write-ahead log next to the
+// file, the log is replayed when the file is opened so a commit survives
+// the process crashing. A checkpoint writes the pages committed since the
+// last one to the file and empties the log, it runs once the log holds
+// walCheckpointPages pages and when the file is closed.
+//
+// Every commit has a log sequence number one above the one before, the
+// header records the number of the commit it is part of. A record is
+// [lsn][time][numPages][count] [header] ([pageNum][page])... [checksum],
+// records the file already holds are skipped when the log is replayed
+const (
+	walLSNSize          uint32 = 8
+	walLSNOffset        uint32 = 0
+	walTimeSize         uint32 = 8
+	walTimeOffset       uint32 = walLSNOffset + walLSNSize
+	walNumPagesSize     uint32 = 4
+	walNumPagesOffset   uint32 = walTimeOffset + walTimeSize
+	walCountSize        uint32 = 4
+	walCountOffset      uint32 = walNumPagesOffset + walNumPagesSize
+	walRecordHeaderSize uint32 = walCountOffset + walCountSize
+	walPageNumSize      uint32 = 4
+	walChecksumSize     uint32 = 4
+	walCheckpointPages  uint32 = 1024
+	walFileSuffix              = "-wal"
+	walSegmentSuffix           = ".wal"
+)
+
+// Durability is how much a crash may take of what was committed
+type Durability int
+
+const (
+	// DurabilityNormal syncs the log before a checkpoint changes the file
+	// and the file and its directory after. A crash of the process loses
+	// nothing, one of the machine may lose the commits since the last
+	// checkpoint but never leaves the file corrupt
+	DurabilityNormal Durability = iota
+
+	// DurabilityFull also syncs the log at every commit,
+	// a commit survives any crash once it returns
+	DurabilityFull
+
+	// DurabilityOff never syncs, a crash of the
+	// machine may leave the file corrupt
+	DurabilityOff
+)
+
+// writeAheadLog is the log of the commits since the last checkpoint.
+// It is only used by the writer, records are appended by the group
+// commit when there is one
+type writeAheadLog struct {
+	file     *os.File
+	group    *groupCommit
+	pageSize uint32
+
+	// archiveDir keeps a copy of the log as a segment before a
+	// checkpoint empties it when it is set, see archive
+	archiveDir string
+
+	// size is where the next record is appended,
+	// pages the number of pages logged so far
+	size  int64
+	pages uint32
+}
+
+// logRecord is a commit read from the log
+type logRecord struct {
+	lsn      uint64
+	time     time.Time
+	numPages uint32
+	header   []byte
+	pages    map[uint32][]byte
+}
+
+// openLog opens the log of the file, it is created unless the file is
+// opened read only. A read only file without a log has a nil log
+func openLog(filename string, readOnly bool, pageSize uint32) (*writeAheadLog, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	file, err := os.OpenFile(filename+walFileSuffix, flag, 0600)
+	if readOnly && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &writeAheadLog{file: file, pageSize: pageSize}, nil
+}
+
+// loggedPageSize is the page size of the header of the first record in
+// the log of the file, 0 if the log has no whole header
+func loggedPageSize(filename string) (uint32, error) {
+	file, err := os.Open(filename + walFileSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	prefix := make([]byte, headerPrefixSize)
+	if _, err := file.ReadAt(prefix, int64(walRecordHeaderSize)); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(prefix[headerMagicOffset:headerMagicOffset+headerMagicSize], headerMagic) {
+		return 0, nil
+	}
+
+	return headerPageSize(prefix), nil
+}
+
+func headerLSN(header []byte) uint64 {
+	return binary.LittleEndian.Uint64(header[headerLSNOffset : headerLSNOffset+headerLSNSize])
+}
+
+func setHeaderLSN(header []byte, lsn uint64) {
+	binary.LittleEndian.PutUint64(header[headerLSNOffset:headerLSNOffset+headerLSNSize], lsn)
+}
+
+func headerTimeline(header []byte) uint64 {
+	offset := headerTimelineOffset(uint32(len(header)))
+	return binary.LittleEndian.Uint64(header[offset : offset+headerTimelineSize])
+}
+
+func setHeaderTimeline(header []byte, timeline uint64) {
+	offset := headerTimelineOffset(uint32(len(header)))
+	binary.LittleEndian.PutUint64(header[offset:offset+headerTimelineSize], timeline)
+}
+
+// logRecordOf encodes the commit as a record of the log
+func logRecordOf(header []byte, numPages uint32, dirty map[uint32][]byte) []byte {
+	pageSize := uint32(len(header))
+	record := make([]byte, walRecordHeaderSize, int(walRecordHeaderSize+pageSize+walChecksumSize)+
+		len(dirty)*int(walPageNumSize+pageSize))
+
+	binary.LittleEndian.PutUint64(record[walLSNOffset:walLSNOffset+walLSNSize], headerLSN(header))
+	binary.LittleEndian.PutUint64(record[walTimeOffset:walTimeOffset+walTimeSize], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint32(record[walNumPagesOffset:walNumPagesOffset+walNumPagesSize], numPages)
+	binary.LittleEndian.PutUint32(record[walCountOffset:walCountOffset+walCountSize], uint32(len(dirty)))
+
+	record = append(record, header...)
+
+	pageNum := make([]byte, walPageNumSize)
+	for n, data := range dirty {
+		binary.LittleEndian.PutUint32(pageNum, n)
+		record = append(record, pageNum...)
+		record = append(record, data...)
+	}
+
+	checksum := make([]byte, walChecksumSize)
+	binary.LittleEndian.PutUint32(checksum, crc32.ChecksumIEEE(record))
+	return append(record, checksum...)
+}
+
+// append appends the records to the log, they are synced if asked to.
+// Records which fail to be written or synced are cut off again, some may
+// be in the file and a replay would commit what was reported failed
+func (l *writeAheadLog) append(records []byte, sync bool) error {
+	if _, err := l.file.WriteAt(records, l.size); err != nil {
+		l.file.Truncate(l.size)
+		return err
+	}
+
+	if sync {
+		if err := l.file.Sync(); err != nil {
+			l.file.Truncate(l.size)
+			return err
+		}
+	}
+
+	l.size += int64(len(records))
+	return nil
+}
+
+// replay calls fn with every record of the log in order. The log ends at
+// the first record which is cut short or does not match its checksum, a
+// commit which was being written when the process crashed. The rest is
+// cut off unless the log is read only, so it is never taken for records
+func (l *writeAheadLog) replay(readOnly bool, fn func(r *logRecord)) error {
+	l.size, l.pages = 0, 0
+
+	for {
+		r, size, err := readLogRecord(l.file, l.size, l.pageSize)
+		if err != nil {
+			return err
+		}
+
+		if r == nil {
+			break
+		}
+
+		fn(r)
+		l.size += size
+		l.pages += uint32(len(r.pages))
+	}
+
+	if readOnly {
+		return nil
+	}
+
+	return l.file.Truncate(l.size)
+}
+
+// readLogRecord reads the record of pages of the size at the offset and
+// returns it with its size, a nil record if there is no whole one
+func readLogRecord(file *os.File, offset int64, pageSize uint32) (*logRecord, int64, error) {
+	head := make([]byte, walRecordHeaderSize)
+	if _, err := file.ReadAt(head, offset); err == io.EOF {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	count := binary.LittleEndian.Uint32(head[walCountOffset : walCountOffset+walCountSize])
+	if count > tableMaxPages {
+		return nil, 0, nil
+	}
+
+	size := int64(walRecordHeaderSize+pageSize+walChecksumSize) + int64(count)*int64(walPageNumSize+pageSize)
+	record := make([]byte, size)
+	if _, err := file.ReadAt(record, offset); err == io.EOF {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	body := record[:size-int64(walChecksumSize)]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(record[size-int64(walChecksumSize):]) {
+		return nil, 0, nil
+	}
+
+	r := &logRecord{
+		lsn:      binary.LittleEndian.Uint64(head[walLSNOffset : walLSNOffset+walLSNSize]),
+		time:     time.Unix(0, int64(binary.LittleEndian.Uint64(head[walTimeOffset:walTimeOffset+walTimeSize]))),
+		numPages: binary.LittleEndian.Uint32(head[walNumPagesOffset : walNumPagesOffset+walNumPagesSize]),
+		header:   body[walRecordHeaderSize : walRecordHeaderSize+pageSize],
+		pages:    make(map[uint32][]byte, count),
+	}
+
+	entries := body[walRecordHeaderSize+pageSize:]
+	for i := uint32(0); i < count; i++ {
+		entry := entries[i*(walPageNumSize+pageSize) : (i+1)*(walPageNumSize+pageSize)]
+		r.pages[binary.LittleEndian.Uint32(entry[:walPageNumSize])] = entry[walPageNumSize:]
+	}
+
+	return r, size, nil
+}
+
+// archive copies the log to a segment in the archive directory named
+// after the timeline and the sequence number of its first record, see
+// segmentName. A segment archived again after a crash has the records
+// of the first copy and replaces it
+func (l *writeAheadLog) archive(sync bool) error {
+	if l.archiveDir == "" || l.size == 0 {
+		return nil
+	}
+
+	first := make([]byte, walRecordHeaderSize+l.pageSize)
+	if _, err := l.file.ReadAt(first, 0); err != nil {
+		return err
+	}
+
+	lsn := binary.LittleEndian.Uint64(first[walLSNOffset : walLSNOffset+walLSNSize])
+	name := filepath.Join(l.archiveDir, segmentName(headerTimeline(first[walRecordHeaderSize:]), lsn))
+	temp, err := os.CreateTemp(l.archiveDir, filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(temp, io.NewSectionReader(l.file, 0, l.size)); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if sync {
+		if err := temp.Sync(); err != nil {
+			temp.Close()
+			os.Remove(temp.Name())
+			return err
+		}
+	}
+
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := os.Rename(temp.Name(), name); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if sync {
+		return syncDir(l.archiveDir)
+	}
+
+	return nil
+}
+
+// reset empties the log once a checkpoint wrote its pages to the file
+func (l *writeAheadLog) reset() error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+
+	l.size, l.pages = 0, 0
+	return nil
+}
+
+func (l *writeAheadLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,125 @@
+package persist
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLogReplayedAfterCrash(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabaseWithOptions(filename, Options{Durability: DurabilityFull})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 300)
+	if err := tbl.CreateIndex("idx_username", "username", true); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	lsn := headerLSN(tbl.pager.committedHeader)
+	crash(tbl)
+
+	// The commits are only in the log, the file was never written
+	if stat, err := os.Stat(filename); err != nil || stat.Size() != 0 {
+		t.Fatalf("Expected the file to be empty before the log is replayed: %v %v", stat, err)
+	}
+
+	tbl, err = OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if ids := checkScan(t, tbl, false); len(ids) != 300 {
+		t.Fatalf("Expected 300 rows after replaying the log, got %d", len(ids))
+	}
+
+	if len(tbl.Indexes()) != 1 {
+		t.Fatalf("Expected the index to be replayed")
+	}
+
+	if n := headerLSN(tbl.pager.committedHeader); n != lsn {
+		t.Fatalf("Expected the file to be at commit %d, got %d", lsn, n)
+	}
+
+	// Opening checkpoints the commits replayed
+	if tbl.pager.log.size != 0 {
+		t.Fatalf("Expected the log to be empty after the checkpoint")
+	}
+
+	insertUsers(t, tbl, 300, 310)
+	if err := tbl.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl, err = OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	if ids := checkScan(t, tbl, false); len(ids) != 310 {
+		t.Fatalf("Expected 310 rows after reopening, got %d", len(ids))
+	}
+}
+
+func TestTornLogRecordIgnored(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	filename := path.Join(testDirPath, "test.db")
+	tbl, err := OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	insertUsers(t, tbl, 0, 10)
+	size := tbl.pager.log.size
+
+	insertUsers(t, tbl, 10, 11)
+	crash(tbl)
+
+	// The last commit was being written when the machine crashed
+	if err := os.Truncate(filename+walFileSuffix, size+int64(tbl.pager.pageSize)); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tbl, err = OpenDatabase(filename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	if ids := checkScan(t, tbl, false); len(ids) != 10 {
+		t.Fatalf("Expected the 10 rows before the torn commit, got %d", len(ids))
+	}
+}
+
+func TestLogCheckpointed(t *testing.T) {
+	createTestDir(t, testDirPath)
+	t.Cleanup(cleanupTestDir(t, testDirPath))
+
+	tbl, err := OpenDatabaseWithOptions(path.Join(testDirPath, "test.db"), Options{Durability: DurabilityOff})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer tbl.Close()
+
+	// Every insert logs at least a leaf
+	insertUsers(t, tbl, 0, int(walCheckpointPages)+10)
+
+	if tbl.pager.log.pages >= walCheckpointPages {
+		t.Fatalf("Expected the log to be checkpointed, it holds %d pages", tbl.pager.log.pages)
+	}
+
+	if tbl.pager.fileLength == 0 {
+		t.Fatalf("Expected the checkpoint to write the file")
+	}
+}
@@ -0,0 +1,176 @@
+package query
+
+import "github.com/rob2244/SimpleDB/pkg/persist"
+
+// TableName is the name of the only table, the users table
+const TableName = "users"
+
+// Columns are the columns of the users table in order
+var Columns = []string{"id", "username", "email"}
+
+type Statement interface {
+	statement()
+}
+
+// Value is a Literal, a Placeholder which is replaced by a
+// parameter on execution or a ColumnRef to compare two columns
+type Value interface {
+	value()
+}
+
+// Literal holds an int64 or a string
+type Literal struct {
+	Value interface{}
+}
+
+// Placeholder refers to a parameter by its position, starting at 1.
+// Named placeholders are numbered in the order their names first
+// appear, so they can also be bound by position
+type Placeholder struct {
+	Ordinal int
+	Name    string
+}
+
+// ColumnRef names a column, Table is the name or alias of the table
+// in the from clause and may be empty when the column is not ambiguous
+type ColumnRef struct {
+	Table  string
+	Column string
+}
+
+// Expression is a ColumnRef or an Aggregate, the values
+// a select returns and orders its rows by
+type Expression interface {
+	expression()
+}
+
+// Aggregate applies Func, one of count, sum, min or max, to the column
+// over the rows of each group. Star is set for count(*) which has no column
+type Aggregate struct {
+	Func   string
+	Column ColumnRef
+	Star   bool
+}
+
+// OrderBy sorts the rows by the expression, ascending unless Desc is set
+type OrderBy struct {
+	Expression Expression
+	Desc       bool
+}
+
+type Condition struct {
+	Table  string
+	Column string
+	Op     persist.Operator
+	Value  Value
+}
+
+// TableRef is a table in the from clause, Alias is empty
+// when the table is referred to by its name
+type TableRef struct {
+	Name  string
+	Alias string
+}
+
+type JoinKind int
+
+const (
+	InnerJoin JoinKind = iota
+	LeftJoin
+	CrossJoin
+)
+
+// Join joins the table to the tables before it, cross joins have no On
+type Join struct {
+	Kind  JoinKind
+	Table TableRef
+	On    []Condition
+}
+
+type Assignment struct {
+	Column string
+	Value  Value
+}
+
+type SelectStatement struct {
+	// Columns are the expressions to return, nil for 'select *'
+	Columns []Expression
+	From    TableRef
+	Joins   []Join
+	Where   []Condition
+	GroupBy []ColumnRef
+	OrderBy []OrderBy
+
+	// Limit is nil when all rows are returned
+	Limit Value
+}
+
+type InsertStatement struct {
+	Columns []string
+	Values  []Value
+}
+
+type UpdateStatement struct {
+	Set   []Assignment
+	Where []Condition
+}
+
+type DeleteStatement struct {
+	Where []Condition
+}
+
+type CreateIndexStatement struct {
+	Name   string
+	Column string
+	Unique bool
+}
+
+// AnalyzeStatement collects the statistics the planner uses
+type AnalyzeStatement struct{}
+
+// VacuumStatement shrinks the database file, an incremental
+// vacuum frees empty leaves rather than rebuilding every tree
+type VacuumStatement struct {
+	Incremental bool
+}
+
+// ExplainStatement shows the plan of the statement, with
+// analyze the statement is executed to measure the plan
+type ExplainStatement struct {
+	Analyze   bool
+	Statement Statement
+}
+
+// SavepointStatement marks the state of the transaction to roll back to
+type SavepointStatement struct {
+	Name string
+}
+
+// ReleaseStatement forgets the savepoint and the ones after it
+type ReleaseStatement struct {
+	Name string
+}
+
+// RollbackToStatement drops the changes made since the savepoint
+type RollbackToStatement struct {
+	Name string
+}
+
+func (Literal) value()     {}
+func (Placeholder) value() {}
+func (ColumnRef) value()   {}
+
+func (ColumnRef) expression() {}
+func (Aggregate) expression() {}
+
+func (*SelectStatement) statement()      {}
+func (*InsertStatement) statement()      {}
+func (*UpdateStatement) statement()      {}
+func (*DeleteStatement) statement()      {}
+func (*CreateIndexStatement) statement() {}
+func (*AnalyzeStatement) statement()     {}
+func (*VacuumStatement) statement()      {}
+func (*ExplainStatement) statement()     {}
+func (*SavepointStatement) statement()   {}
+func (*ReleaseStatement) statement()     {}
+func (*RollbackToStatement) statement()  {}
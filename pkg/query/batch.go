@@ -0,0 +1,374 @@
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+// vector is a batch of rows of a single table, sel holds the positions
+// of the rows which passed the filters so far
+type vector struct {
+	batch *persist.Batch
+	sel   []int
+}
+
+// planBatchScan plans reading the table at position i of the scope in
+// batches with the given access method, the filter of the access method
+// is applied to the vectors
+func planBatchScan(t *persist.Table, s *scope, i int, access *persist.Plan) *operator {
+	scan := &operator{
+		name:    "Batch " + access.Describe(s.name(i)),
+		batches: &batchScanIterator{table: t, access: access},
+	}
+
+	if len(access.Filter) == 0 {
+		return scan
+	}
+
+	var filter []string
+	for _, p := range access.Filter {
+		filter = append(filter, s.qualify(i, p.String()))
+	}
+
+	return &operator{
+		name:     fmt.Sprintf("Batch Filter (%s)", strings.Join(filter, " and ")),
+		children: []*operator{scan},
+		batches:  &batchFilterIterator{child: scan, predicates: access.Filter},
+	}
+}
+
+type batchScanIterator struct {
+	table  *persist.Table
+	access *persist.Plan
+	cursor *persist.BatchCursor
+	vector vector
+}
+
+func (it *batchScanIterator) Open() error {
+	c, err := it.table.OpenBatches(it.access)
+	if err != nil {
+		return err
+	}
+
+	it.cursor = c
+	return nil
+}
+
+func (it *batchScanIterator) NextBatch() (*vector, bool, error) {
+	b, err := it.cursor.Next()
+	if err != nil || b == nil {
+		return nil, false, err
+	}
+
+	it.vector.batch = b
+	it.vector.sel = it.vector.sel[:0]
+	for i := 0; i < b.Len; i++ {
+		it.vector.sel = append(it.vector.sel, i)
+	}
+
+	return &it.vector, true, nil
+}
+
+func (it *batchScanIterator) Close() error {
+	if it.cursor != nil {
+		it.cursor.Close()
+	}
+
+	it.cursor = nil
+	return nil
+}
+
+// batchFilterIterator narrows the selection of each vector to the
+// rows matching the predicates, vectors left empty are skipped
+type batchFilterIterator struct {
+	child      *operator
+	predicates []persist.Predicate
+}
+
+func (it *batchFilterIterator) Open() error {
+	return it.child.Open()
+}
+
+func (it *batchFilterIterator) NextBatch() (*vector, bool, error) {
+	for {
+		v, ok, err := it.child.NextBatch()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+
+		for _, p := range it.predicates {
+			v.sel = v.batch.Filter(p, v.sel)
+		}
+
+		if len(v.sel) > 0 {
+			return v, true, nil
+		}
+	}
+}
+
+func (it *batchFilterIterator) Close() error {
+	return it.child.Close()
+}
+
+// unbatch returns the selected rows of the vectors of child one at a
+// time as the table at position i of rows of the given width
+func unbatch(child *operator, width, i int) *operator {
+	return &operator{
+		name:     "Batch To Rows",
+		children: []*operator{child},
+		iter:     &unbatchIterator{child: child, width: width, position: i},
+	}
+}
+
+type unbatchIterator struct {
+	child    *operator
+	width    int
+	position int
+	current  *vector
+	next     int
+}
+
+func (it *unbatchIterator) Open() error {
+	it.current = nil
+	return it.child.Open()
+}
+
+func (it *unbatchIterator) Next() (row, bool, error) {
+	for it.current == nil || it.next == len(it.current.sel) {
+		v, ok, err := it.child.NextBatch()
+		if err != nil || !ok {
+			return row{}, false, err
+		}
+
+		it.current, it.next = v, 0
+	}
+
+	tables := make([]*persist.Row, it.width)
+	tables[it.position] = it.current.batch.Row(it.current.sel[it.next])
+	it.next++
+
+	return row{tables: tables}, true, nil
+}
+
+func (it *unbatchIterator) Close() error {
+	it.current = nil
+	return it.child.Close()
+}
+
+// batchAggregate computes the same values as aggregate from the vectors
+// of child, groups are the columns the rows are grouped by
+func batchAggregate(child *operator, groups []string, groupTexts []evaluator, funcs []aggregateFunc) *operator {
+	return &operator{
+		name:     "Batch " + aggregateName(groupTexts, funcs),
+		children: []*operator{child},
+		iter:     &batchAggregateIterator{child: child, groups: groups, funcs: funcs},
+	}
+}
+
+// batchAccumulator holds the state of an aggregate for one group, min
+// and max keep the id or a copy of the text of the current value
+type batchAccumulator struct {
+	count int64
+	sum   int64
+	id    uint32
+	text  []byte
+}
+
+type batchGroup struct {
+	values       []interface{}
+	accumulators []batchAccumulator
+}
+
+type batchAggregateIterator struct {
+	child  *operator
+	groups []string
+	funcs  []aggregateFunc
+	rows   []row
+}
+
+func (it *batchAggregateIterator) Open() error {
+	var order []*batchGroup
+	index := map[string]int{}
+
+	if len(it.groups) == 0 {
+		order = append(order, &batchGroup{accumulators: make([]batchAccumulator, len(it.funcs))})
+	}
+
+	groupOf := make([]int, 0, persist.BatchSize)
+	texts := make([][][]byte, len(it.groups))
+	var key []byte
+
+	err := it.child.Open()
+	for err == nil {
+		var v *vector
+		var ok bool
+
+		v, ok, err = it.child.NextBatch()
+		if err != nil || !ok {
+			break
+		}
+
+		b := v.batch
+
+		// Find the group of every selected row first, the aggregates
+		// are then computed a column at a time
+		groupOf = groupOf[:0]
+		for k, column := range it.groups {
+			if column != "id" {
+				texts[k] = b.Text(column)
+			}
+		}
+
+		for _, i := range v.sel {
+			if len(it.groups) == 0 {
+				groupOf = append(groupOf, 0)
+				continue
+			}
+
+			key = key[:0]
+			for k, column := range it.groups {
+				if column == "id" {
+					key = appendUint32(key, b.Ids[i])
+					continue
+				}
+
+				key = appendUint32(key, uint32(len(texts[k][i])))
+				key = append(key, texts[k][i]...)
+			}
+
+			g, ok := index[string(key)]
+			if !ok {
+				g = len(order)
+				index[string(key)] = g
+				order = append(order, it.newGroup(b, i))
+			}
+
+			groupOf = append(groupOf, g)
+		}
+
+		for f, fn := range it.funcs {
+			aggregateVector(fn, f, b, v.sel, groupOf, order)
+		}
+	}
+
+	if closeErr := it.child.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	it.rows = make([]row, len(order))
+	for i, g := range order {
+		values := g.values
+		for j, f := range it.funcs {
+			values = append(values, batchResult(f, &g.accumulators[j]))
+		}
+
+		it.rows[i] = row{values: values}
+	}
+
+	return nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (it *batchAggregateIterator) newGroup(b *persist.Batch, i int) *batchGroup {
+	g := &batchGroup{
+		values:       make([]interface{}, len(it.groups)),
+		accumulators: make([]batchAccumulator, len(it.funcs)),
+	}
+
+	for k, column := range it.groups {
+		if column == "id" {
+			g.values[k] = int64(b.Ids[i])
+		} else {
+			g.values[k] = string(b.Text(column)[i])
+		}
+	}
+
+	return g
+}
+
+// aggregateVector adds the selected rows of the batch to the
+// accumulators at position f of their groups
+func aggregateVector(fn aggregateFunc, f int, b *persist.Batch, sel, groupOf []int, groups []*batchGroup) {
+	if fn.fn == "count" {
+		for k := range sel {
+			groups[groupOf[k]].accumulators[f].count++
+		}
+
+		return
+	}
+
+	if fn.columnName == "id" {
+		ids := b.Ids
+		for k, i := range sel {
+			acc := &groups[groupOf[k]].accumulators[f]
+			id := ids[i]
+
+			switch {
+			case fn.fn == "sum":
+				acc.sum += int64(id)
+			case acc.count == 0, fn.fn == "min" && id < acc.id, fn.fn == "max" && id > acc.id:
+				acc.id = id
+			}
+
+			acc.count++
+		}
+
+		return
+	}
+
+	values := b.Text(fn.columnName)
+	for k, i := range sel {
+		acc := &groups[groupOf[k]].accumulators[f]
+		value := values[i]
+
+		if acc.count == 0 ||
+			(fn.fn == "min" && bytes.Compare(value, acc.text) < 0) ||
+			(fn.fn == "max" && bytes.Compare(value, acc.text) > 0) {
+			acc.text = append(acc.text[:0], value...)
+		}
+
+		acc.count++
+	}
+}
+
+// batchResult is nil for sum, min and max of a group without values
+func batchResult(f aggregateFunc, acc *batchAccumulator) interface{} {
+	switch {
+	case f.fn == "count":
+		return acc.count
+	case acc.count == 0:
+		return nil
+	case f.fn == "sum":
+		return acc.sum
+	case f.columnName == "id":
+		return int64(acc.id)
+	default:
+		return string(acc.text)
+	}
+}
+
+func (it *batchAggregateIterator) Next() (row, bool, error) {
+	if len(it.rows) == 0 {
+		return row{}, false, nil
+	}
+
+	r := it.rows[0]
+	it.rows = it.rows[1:]
+
+	return r, true, nil
+}
+
+func (it *batchAggregateIterator) Close() error {
+	it.rows = nil
+	return nil
+}
@@ -0,0 +1,101 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// batchQueries are answered the same way in batches and a row at a time
+var batchQueries = []string{
+	"select count(*), min(email), max(id), sum(id) from users",
+	"select count(*) from users where username = 'user#1' and id >= 100 and id < 2500",
+	"select username, count(email), min(id), max(email) from users where email > '2' group by username order by username",
+	"select id, username from users where email < '13' and id > 10 order by id desc limit 20",
+	"select email, username from users where id > 2990",
+	"select count(*) from users where username = email",
+	"select max(email) from users where username = 'nobody'",
+}
+
+func TestBatchExecution(t *testing.T) {
+	tbl := openTestTable(t)
+	insertJoinUsers(t, tbl, 3000)
+
+	for _, sql := range batchQueries {
+		batched, err := execute(tbl, sql)
+		if err != nil {
+			t.Fatalf("Unable to execute '%s': '%s'", sql, err)
+		}
+
+		rows, err := executeWithOptions(tbl, Options{RowAtATime: true}, sql)
+		if err != nil {
+			t.Fatalf("Unable to execute '%s': '%s'", sql, err)
+		}
+
+		if fmt.Sprint(batched) != fmt.Sprint(rows) {
+			t.Fatalf("Batched result of '%s' differs:\n%v\n%v", sql, batched, rows)
+		}
+	}
+
+	result, err := execute(tbl, "explain select username, count(*) from users where id < 100 and email > '5' group by username")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := "Project (username, count(*))\n" +
+		"  Batch Aggregate by username (count(*))\n" +
+		"    Batch Filter (email > 5)\n" +
+		"      Batch Range Scan on users (id < 100)"
+	if explained := planText(result); explained != expected {
+		t.Fatalf("Unexpected plan:\n%s", explained)
+	}
+
+	result, err = execute(tbl, "explain select * from users a join users b on a.id = b.id")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if strings.Contains(planText(result), "Batch") {
+		t.Fatalf("Expected joins to read rows:\n%s", planText(result))
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	tbl := openTestTable(b)
+	insertJoinUsers(b, tbl, 20000)
+
+	benchmarks := []struct {
+		name string
+		sql  string
+	}{
+		{"Count", "select count(*) from users"},
+		{"Filter", "select count(*), max(email) from users where username = 'user#1' and email > '5'"},
+		{"GroupBy", "select username, count(*), min(email), sum(id) from users group by username"},
+		{"Rows", "select id, email from users where email > '19'"},
+	}
+
+	for _, bm := range benchmarks {
+		p, err := Prepare(bm.sql)
+		if err != nil {
+			b.Fatalf("%s", err)
+		}
+
+		for _, batched := range []bool{false, true} {
+			mode := "RowAtATime"
+			if batched {
+				mode = "Batched"
+			}
+
+			b.Run(bm.name+"/"+mode, func(b *testing.B) {
+				options := Options{RowAtATime: !batched}
+				b.ReportAllocs()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := p.ExecuteWithOptions(tbl, options); err != nil {
+						b.Fatalf("%s", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package query
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache holds the most recently used prepared statements keyed by
+// their SQL text, the least recently used one is evicted when full
+type Cache struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func NewCache(capacity int) *Cache {
+	return &Cache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// Prepare returns the cached statement for the SQL text,
+// preparing and caching it if it is not cached yet
+func (c *Cache) Prepare(sql string) (*Prepared, error) {
+	c.lock.Lock()
+	if e, ok := c.entries[sql]; ok {
+		c.order.MoveToFront(e)
+		c.lock.Unlock()
+		return e.Value.(*Prepared), nil
+	}
+	c.lock.Unlock()
+
+	p, err := Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[sql]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*Prepared), nil
+	}
+
+	if c.capacity <= 0 {
+		return p, nil
+	}
+
+	c.entries[sql] = c.order.PushFront(p)
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*Prepared).sql)
+	}
+
+	return p, nil
+}
+
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
@@ -0,0 +1,769 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+var ErrNoTransaction = errors.New("savepoints can only be used inside a transaction")
+
+// Result is the outcome of executing a statement. Rows hold the values
+// of the selected columns, ids are int64 and the text columns are strings.
+// Columns of a table a left join found no row for are nil
+type Result struct {
+	Columns      []string
+	Rows         [][]interface{}
+	RowsAffected int64
+}
+
+// Options change how statements are executed, the zero value
+// executes them the default way
+type Options struct {
+	// RowAtATime turns off batch execution. By default scans of a single
+	// table over a range of ids read it in batches of persist.BatchSize
+	// rows, filters and aggregates then run over column vectors instead
+	// of one row at a time
+	RowAtATime bool
+
+	// JoinMemoryBudget is the memory in bytes a hash join may use for
+	// the rows its hash table is built from, DefaultJoinMemoryBudget
+	// when 0. Rows beyond it are partitioned and spilled to a file
+	JoinMemoryBudget int
+}
+
+func (o Options) joinMemoryBudget() int {
+	if o.JoinMemoryBudget <= 0 {
+		return DefaultJoinMemoryBudget
+	}
+
+	return o.JoinMemoryBudget
+}
+
+// Execute runs the statement against the table with the default options
+func Execute(t *persist.Table, stmt Statement, args []interface{}) (*Result, error) {
+	return ExecuteWithOptions(t, stmt, args, Options{})
+}
+
+// ExecuteWithOptions runs the statement against the table. The args are
+// the values of the statement's parameters, each an int64, string or
+// []byte. A query reads one snapshot of the table from start to end
+func ExecuteWithOptions(t *persist.Table, stmt Statement, args []interface{}, options Options) (*Result, error) {
+	tmpl, err := compile(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return executeCompiled(t, stmt, tmpl, args, options)
+}
+
+// executeCompiled runs the statement with its template
+func executeCompiled(t *persist.Table, stmt Statement, tmpl template, args []interface{}, options Options) (*Result, error) {
+	switch stmt.(type) {
+	case *SavepointStatement, *ReleaseStatement, *RollbackToStatement:
+		return executeSavepoint(t, stmt)
+	case *VacuumStatement:
+		return executeVacuum(t, stmt.(*VacuumStatement))
+	}
+
+	if readOnly(stmt) {
+		t = t.Snapshot()
+		defer t.Release()
+
+		return executeStatement(t, stmt, tmpl, args, options)
+	}
+
+	// The changes of a statement are committed together
+	var result *Result
+	err := t.Change(func(w *persist.Table) error {
+		var err error
+		result, err = executeStatement(w, stmt, tmpl, args, options)
+		return err
+	})
+
+	return result, err
+}
+
+// readOnly reports whether the statement only reads the table
+func readOnly(stmt Statement) bool {
+	switch s := stmt.(type) {
+	case *SelectStatement:
+		return true
+	case *ExplainStatement:
+		return !s.Analyze || readOnly(s.Statement)
+	default:
+		return false
+	}
+}
+
+// executeSavepoint runs a savepoint statement
+// on the transaction the handle belongs to
+func executeSavepoint(t *persist.Table, stmt Statement) (*Result, error) {
+	tx := t.Tx()
+	if tx == nil {
+		return nil, ErrNoTransaction
+	}
+
+	var err error
+	switch s := stmt.(type) {
+	case *SavepointStatement:
+		err = tx.Savepoint(s.Name)
+	case *ReleaseStatement:
+		err = tx.Release(s.Name)
+	case *RollbackToStatement:
+		err = tx.RollbackTo(s.Name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{}, nil
+}
+
+// executeVacuum shrinks the database file, a vacuum is a
+// commit of its own and cannot be part of a transaction
+func executeVacuum(t *persist.Table, s *VacuumStatement) (*Result, error) {
+	vacuum := t.Vacuum
+	if s.Incremental {
+		vacuum = t.IncrementalVacuum
+	}
+
+	if err := vacuum(); err != nil {
+		return nil, err
+	}
+
+	return &Result{}, nil
+}
+
+func executeStatement(t *persist.Table, stmt Statement, tmpl template, args []interface{}, options Options) (*Result, error) {
+	if s, ok := stmt.(*ExplainStatement); ok {
+		return executeExplain(t, s, tmpl, args, options)
+	}
+
+	p, err := tmpl(t, args, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.run(false); err != nil {
+		return nil, err
+	}
+
+	return p.result, nil
+}
+
+// executeExplain returns the plan of the statement, a row per operator.
+// With analyze the statement is executed, changes it makes are kept
+func executeExplain(t *persist.Table, s *ExplainStatement, tmpl template, args []interface{}, options Options) (*Result, error) {
+	p, err := tmpl(t, args, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Analyze {
+		if err := p.run(true); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &Result{Columns: []string{"plan"}}
+	for _, line := range p.root.explain(nil, 0, s.Analyze) {
+		result.Rows = append(result.Rows, []interface{}{line})
+	}
+
+	return result, nil
+}
+
+// joinTemplate is a join of a select with its conditions resolved
+type joinTemplate struct {
+	kind      JoinKind
+	inner, on []condition
+}
+
+// compileSelect resolves the tables, conditions and expressions of the
+// select. How each table is read is chosen once the values are bound
+func compileSelect(stmt *SelectStatement) (template, error) {
+	s := &scope{tables: []TableRef{stmt.From}}
+	for _, j := range stmt.Joins {
+		s.tables = append(s.tables, j.Table)
+	}
+
+	for i := range s.tables {
+		for j := 0; j < i; j++ {
+			if s.name(i) == s.name(j) {
+				return nil, fmt.Errorf("table '%s' appears more than once, give it an alias", s.name(i))
+			}
+		}
+	}
+
+	where, err := s.resolveConditions(stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+
+	first, where := splitConditions(where, 0)
+
+	joins := make([]joinTemplate, len(stmt.Joins))
+	for j, join := range stmt.Joins {
+		i := j + 1
+
+		on, err := s.resolveConditions(join.On)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range on {
+			if c.lastTable() > i {
+				return nil, fmt.Errorf("join condition '%s' refers to a table joined later", c.text)
+			}
+		}
+
+		// Conditions in the where clause on the table of an inner join
+		// can be applied while reading it, for a left join they have to
+		// wait until the join decided whether the table has a row
+		inner, on := splitConditions(on, i)
+		if join.Kind != LeftJoin {
+			var pushed []condition
+			pushed, where = splitConditions(where, i)
+			inner = append(inner, pushed...)
+		}
+
+		joins[j] = joinTemplate{kind: join.Kind, inner: inner, on: on}
+	}
+
+	aggregated := len(stmt.GroupBy) > 0 || hasAggregate(stmt)
+
+	var groups []evaluator
+	var funcs []aggregateFunc
+	var bind func(e Expression) (evaluator, error)
+	if aggregated {
+		groups, funcs, bind, err = bindAggregates(s, stmt)
+	} else {
+		bind = func(e Expression) (evaluator, error) {
+			return s.column(e.(ColumnRef))
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []sortKey
+	for _, o := range stmt.OrderBy {
+		e, err := bind(o.Expression)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, sortKey{e, o.Desc})
+	}
+
+	var columns []evaluator
+	if stmt.Columns == nil {
+		for i := range s.tables {
+			for _, c := range Columns {
+				e, err := s.column(ColumnRef{Table: s.name(i), Column: c})
+				if err != nil {
+					return nil, err
+				}
+
+				columns = append(columns, e)
+			}
+		}
+	}
+
+	for _, c := range stmt.Columns {
+		e, err := bind(c)
+		if err != nil {
+			return nil, err
+		}
+
+		columns = append(columns, e)
+	}
+
+	return func(t *persist.Table, args []interface{}, options Options) (*plannedStatement, error) {
+		constant, err := bindConditions(first, args)
+		if err != nil {
+			return nil, err
+		}
+
+		root, err := planScan(t, s, 0, constant, !options.RowAtATime && len(joins) == 0)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, join := range joins {
+			inner, err := bindConditions(join.inner, args)
+			if err != nil {
+				return nil, err
+			}
+
+			on, err := bindConditions(join.on, args)
+			if err != nil {
+				return nil, err
+			}
+
+			root, err = planJoin(t, s, root, j+1, join.kind, inner, on, options)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		where, err := bindConditions(where, args)
+		if err != nil {
+			return nil, err
+		}
+
+		// Batches are aggregated as they are, everything else needs rows
+		if root.batches != nil && (len(where) > 0 || !aggregated) {
+			root = unbatch(root, len(s.tables), 0)
+		}
+
+		root = filter(root, where)
+
+		if aggregated {
+			root = planAggregate(stmt, root, groups, funcs)
+		}
+
+		if len(keys) > 0 {
+			root = sortRows(root, keys)
+		}
+
+		if stmt.Limit != nil {
+			n, err := bindLimit(stmt.Limit, args)
+			if err != nil {
+				return nil, err
+			}
+
+			root = limit(root, n)
+		}
+
+		p := &plannedStatement{result: &Result{}, returnsRows: true}
+		for _, c := range columns {
+			p.result.Columns = append(p.result.Columns, c.text)
+		}
+
+		p.root = project(root, columns)
+		return p, nil
+	}, nil
+}
+
+func hasAggregate(stmt *SelectStatement) bool {
+	for _, c := range stmt.Columns {
+		if _, ok := c.(Aggregate); ok {
+			return true
+		}
+	}
+
+	for _, o := range stmt.OrderBy {
+		if _, ok := o.Expression.(Aggregate); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bindAggregates resolves the group by columns and the aggregates used
+// by the select list and the order by clause. It returns how expressions
+// are bound to the values of the groups, columns have to be grouped by
+// to be used
+func bindAggregates(s *scope, stmt *SelectStatement) ([]evaluator, []aggregateFunc, func(e Expression) (evaluator, error), error) {
+	if stmt.Columns == nil {
+		return nil, nil, nil, fmt.Errorf("select * cannot be used with group by or aggregates")
+	}
+
+	groups := make([]evaluator, len(stmt.GroupBy))
+	for i, ref := range stmt.GroupBy {
+		g, err := s.column(ref)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		groups[i] = g
+	}
+
+	var funcs []aggregateFunc
+
+	bindAggregate := func(a Aggregate) (aggregateFunc, error) {
+		if a.Star {
+			return aggregateFunc{text: "count(*)", fn: a.Func}, nil
+		}
+
+		column, err := s.column(a.Column)
+		if err != nil {
+			return aggregateFunc{}, err
+		}
+
+		if a.Func == "sum" && a.Column.Column != "id" {
+			return aggregateFunc{}, fmt.Errorf("cannot sum the text column '%s'", a.Column.Column)
+		}
+
+		return aggregateFunc{
+			text:       fmt.Sprintf("%s(%s)", a.Func, column.text),
+			fn:         a.Func,
+			column:     &column,
+			columnName: a.Column.Column,
+		}, nil
+	}
+
+	bind := func(e Expression) (evaluator, error) {
+		if a, ok := e.(Aggregate); ok {
+			f, err := bindAggregate(a)
+			if err != nil {
+				return evaluator{}, err
+			}
+
+			for i := range funcs {
+				if funcs[i].text == f.text {
+					return value(f.text, len(groups)+i), nil
+				}
+			}
+
+			funcs = append(funcs, f)
+			return value(f.text, len(groups)+len(funcs)-1), nil
+		}
+
+		column, err := s.column(e.(ColumnRef))
+		if err != nil {
+			return evaluator{}, err
+		}
+
+		for i, g := range groups {
+			if g.text == column.text {
+				return value(column.text, i), nil
+			}
+		}
+
+		return evaluator{}, fmt.Errorf("column '%s' must be grouped by or used in an aggregate", column.text)
+	}
+
+	// Bind the aggregates up front so the operator knows all of them,
+	// the expressions are bound again to the same values afterwards
+	for _, c := range stmt.Columns {
+		if _, err := bind(c); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	for _, o := range stmt.OrderBy {
+		if _, err := bind(o.Expression); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return groups, funcs, bind, nil
+}
+
+// planAggregate groups the rows of child by the group by columns and
+// computes the aggregates, batches are aggregated without rows
+func planAggregate(stmt *SelectStatement, child *operator, groups []evaluator, funcs []aggregateFunc) *operator {
+	if child.batches != nil {
+		columns := make([]string, len(stmt.GroupBy))
+		for i, ref := range stmt.GroupBy {
+			columns[i] = ref.Column
+		}
+
+		return batchAggregate(child, columns, groups, funcs)
+	}
+
+	return aggregate(child, groups, funcs)
+}
+
+// bindLimit resolves the limit to a number which is not negative
+func bindLimit(v Value, args []interface{}) (int64, error) {
+	var value interface{}
+
+	switch v := v.(type) {
+	case Literal:
+		value = v.Value
+	case Placeholder:
+		if v.Ordinal > len(args) {
+			return 0, fmt.Errorf("missing value for parameter %d", v.Ordinal)
+		}
+
+		value = args[v.Ordinal-1]
+	}
+
+	n, ok := value.(int64)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("limit expects a number that is not negative but got '%v'", value)
+	}
+
+	return n, nil
+}
+
+func planInsert(t *persist.Table, s *InsertStatement, args []interface{}) (*plannedStatement, error) {
+	values := map[string]interface{}{"username": "", "email": ""}
+
+	for i, c := range s.Columns {
+		v, err := bindColumn(c, s.Values[i], args)
+		if err != nil {
+			return nil, err
+		}
+
+		values[c] = v
+	}
+
+	r, err := persist.NewRow(values["id"].(uint32), values["username"].(string), values["email"].(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return &plannedStatement{
+		result: &Result{},
+		root: &operator{
+			name: "Insert into users",
+			iter: &changeIterator{
+				given: []*persist.Row{r},
+				change: func(r *persist.Row) (*persist.Row, error) {
+					return r, t.Insert(r)
+				},
+			},
+		},
+	}, nil
+}
+
+// compileTableScan resolves the where clause of an update or delete,
+// the template returned plans reading the rows of the users table
+// matching it
+func compileTableScan(where []Condition) (func(t *persist.Table, args []interface{}) (*operator, error), error) {
+	s := &scope{tables: []TableRef{{Name: TableName}}}
+
+	conditions, err := s.resolveConditions(where)
+	if err != nil {
+		return nil, err
+	}
+
+	constant, rest := splitConditions(conditions, 0)
+
+	return func(t *persist.Table, args []interface{}) (*operator, error) {
+		constant, err := bindConditions(constant, args)
+		if err != nil {
+			return nil, err
+		}
+
+		rest, err := bindConditions(rest, args)
+		if err != nil {
+			return nil, err
+		}
+
+		scan, err := planScan(t, s, 0, constant, false)
+		if err != nil {
+			return nil, err
+		}
+
+		return filter(scan, rest), nil
+	}, nil
+}
+
+func compileUpdate(s *UpdateStatement) (template, error) {
+	scan, err := compileTableScan(s.Where)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(t *persist.Table, args []interface{}, options Options) (*plannedStatement, error) {
+		return planUpdate(t, s, scan, args)
+	}, nil
+}
+
+func planUpdate(t *persist.Table, s *UpdateStatement, scan func(t *persist.Table, args []interface{}) (*operator, error), args []interface{}) (*plannedStatement, error) {
+	set := map[string]string{}
+	assignments := make([]string, len(s.Set))
+
+	for i, a := range s.Set {
+		v, err := bindColumn(a.Column, a.Value, args)
+		if err != nil {
+			return nil, err
+		}
+
+		set[a.Column] = v.(string)
+		assignments[i] = fmt.Sprintf("%s = %s", a.Column, v)
+	}
+
+	child, err := scan(t, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &plannedStatement{
+		result: &Result{},
+		root: &operator{
+			name:     fmt.Sprintf("Update users (%s)", strings.Join(assignments, ", ")),
+			children: []*operator{child},
+			iter: &changeIterator{
+				child: child,
+				change: func(r *persist.Row) (*persist.Row, error) {
+					username, email := r.Username(), r.Email()
+					if v, ok := set["username"]; ok {
+						username = v
+					}
+
+					if v, ok := set["email"]; ok {
+						email = v
+					}
+
+					updated, err := persist.NewRow(r.Id(), username, email)
+					if err != nil {
+						return nil, err
+					}
+
+					return updated, t.Update(updated)
+				},
+			},
+		},
+	}, nil
+}
+
+func compileDelete(s *DeleteStatement) (template, error) {
+	scan, err := compileTableScan(s.Where)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(t *persist.Table, args []interface{}, options Options) (*plannedStatement, error) {
+		return planDelete(t, scan, args)
+	}, nil
+}
+
+func planDelete(t *persist.Table, scan func(t *persist.Table, args []interface{}) (*operator, error), args []interface{}) (*plannedStatement, error) {
+	child, err := scan(t, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &plannedStatement{
+		result: &Result{},
+		root: &operator{
+			name:     "Delete from users",
+			children: []*operator{child},
+			iter: &changeIterator{
+				child: child,
+				change: func(r *persist.Row) (*persist.Row, error) {
+					return r, t.Delete(r.Id())
+				},
+			},
+		},
+	}, nil
+}
+
+func planCreateIndex(t *persist.Table, s *CreateIndexStatement) *plannedStatement {
+	return &plannedStatement{
+		result: &Result{},
+		root: &operator{
+			name: fmt.Sprintf("Create Index %s on users (%s)", s.Name, s.Column),
+			iter: &commandIterator{run: func() error {
+				return t.CreateIndex(s.Name, s.Column, s.Unique)
+			}},
+		},
+	}
+}
+
+func planAnalyze(t *persist.Table) *plannedStatement {
+	return &plannedStatement{
+		result: &Result{},
+		root: &operator{
+			name: "Analyze users",
+			iter: &commandIterator{run: t.Analyze},
+		},
+	}
+}
+
+// bindColumn resolves the value and converts it to the type of the
+// column, uint32 for the id column and string for the text columns
+func bindColumn(column string, v Value, args []interface{}) (interface{}, error) {
+	value, err := bindValue(v, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if column == "id" {
+		return toId(value)
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	default:
+		return nil, fmt.Errorf("column '%s' expects a string but got %T", column, value)
+	}
+}
+
+// bindValue resolves a literal or the argument of a parameter
+func bindValue(v Value, args []interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case Literal:
+		return v.Value, nil
+	case Placeholder:
+		if v.Ordinal > len(args) {
+			return nil, fmt.Errorf("missing value for parameter %d", v.Ordinal)
+		}
+
+		return args[v.Ordinal-1], nil
+	}
+
+	return nil, fmt.Errorf("unsupported value %T", v)
+}
+
+// bindIdCondition binds the value the id column is compared with. An
+// integer no id can be is not an error, the comparison is rewritten to
+// one on id 0 which none or every id matches like the original would
+func bindIdCondition(op persist.Operator, v Value, args []interface{}) (persist.Operator, uint32, error) {
+	value, err := bindValue(v, args)
+	if err != nil {
+		return op, 0, err
+	}
+
+	if n, ok := value.(int64); ok && (n < 0 || n > math.MaxUint32) {
+		below := n < 0
+		if op == persist.Equal || below == (op == persist.Less || op == persist.LessOrEqual) {
+			return persist.Less, 0, nil
+		}
+
+		return persist.GreaterOrEqual, 0, nil
+	}
+
+	id, err := toId(value)
+	return op, id, err
+}
+
+func toId(value interface{}) (uint32, error) {
+	switch v := value.(type) {
+	case int64:
+		if v < 0 || v > math.MaxUint32 {
+			return 0, fmt.Errorf("invalid user id: '%d'", v)
+		}
+
+		return uint32(v), nil
+
+	case string:
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid user id: '%s'", v)
+		}
+
+		return uint32(n), nil
+
+	default:
+		return 0, fmt.Errorf("column 'id' expects an integer but got %T", value)
+	}
+}
+
+func columnValue(r *persist.Row, column string) interface{} {
+	switch column {
+	case "id":
+		return int64(r.Id())
+	case "username":
+		return r.Username()
+	default:
+		return r.Email()
+	}
+}
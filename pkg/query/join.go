@@ -0,0 +1,618 @@
+package query
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+// DefaultJoinMemoryBudget is the memory in bytes a hash join may use for
+// the rows its hash table is built from unless the options set another,
+// rows beyond it are partitioned and spilled to temporary pages
+const DefaultJoinMemoryBudget = 4 << 20
+
+const (
+	hashJoinPartitions = 16
+
+	// hashJoinMaxLevel is how many times a spilled partition is split
+	// again when it does not fit either. A partition still too large
+	// then, its rows sharing a few keys, is joined in memory as it is
+	hashJoinMaxLevel = 3
+
+	// hashJoinRowOverhead estimates the memory used by the hash
+	// table for a row on top of the row itself
+	hashJoinRowOverhead = 64
+)
+
+// planJoin joins the table at position i of the scope to the rows of
+// outer. inner holds the conditions comparing the table's columns with
+// constants, on the other conditions of the join.
+//
+// An equality on the primary key of the table is joined by looking up
+// each id, any other equality between the table and an earlier one with
+// a hash join, and everything else with a nested loop
+func planJoin(t *persist.Table, s *scope, outer *operator, i int, kind JoinKind, inner, on []condition, options Options) (*operator, error) {
+	for _, c := range on {
+		if c.op != persist.Equal || !c.isColumn {
+			continue
+		}
+
+		if c.table == i && c.column == "id" && c.otherTable < i {
+			return indexNestedLoopJoin(t, s, outer, i, kind, c.otherTable, c.otherColumn, inner, on), nil
+		}
+
+		if c.otherTable == i && c.otherColumn == "id" && c.table < i {
+			return indexNestedLoopJoin(t, s, outer, i, kind, c.table, c.column, inner, on), nil
+		}
+	}
+
+	scan, err := planScan(t, s, i, inner, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []hashKey
+	for _, c := range on {
+		if c.op != persist.Equal || !c.isColumn {
+			continue
+		}
+
+		if c.table == i && c.otherTable < i {
+			keys = append(keys, hashKey{outerTable: c.otherTable, outerColumn: c.otherColumn, innerColumn: c.column})
+		} else if c.otherTable == i && c.table < i {
+			keys = append(keys, hashKey{outerTable: c.table, outerColumn: c.column, innerColumn: c.otherColumn})
+		}
+	}
+
+	if len(keys) > 0 {
+		return hashJoin(outer, scan, len(s.tables), i, kind, keys, on, options.joinMemoryBudget()), nil
+	}
+
+	return nestedLoopJoin(outer, scan, i, kind, on), nil
+}
+
+func joinName(algorithm string, kind JoinKind, on []condition) string {
+	name := algorithm + " Join"
+
+	switch kind {
+	case LeftJoin:
+		name = algorithm + " Left Join"
+	case CrossJoin:
+		name = algorithm + " Cross Join"
+	}
+
+	if len(on) > 0 {
+		name += fmt.Sprintf(" (%s)", describeConditions(on))
+	}
+
+	return name
+}
+
+// combine returns the outer row with the inner table's row added
+func combine(outer row, inner *persist.Row, i int) row {
+	tables := append([]*persist.Row{}, outer.tables...)
+	tables[i] = inner
+
+	return row{tables: tables}
+}
+
+// nestedLoopJoin runs inner once for every row of outer
+func nestedLoopJoin(outer, inner *operator, i int, kind JoinKind, on []condition) *operator {
+	return &operator{
+		name:     joinName("Nested Loop", kind, on),
+		children: []*operator{outer, inner},
+		iter:     &nestedLoopIterator{outer: outer, inner: inner, position: i, kind: kind, on: on},
+	}
+}
+
+// nestedLoopIterator opens inner again for each row of outer, bind
+// is called with the outer row before inner is opened
+type nestedLoopIterator struct {
+	outer, inner *operator
+	position     int
+	kind         JoinKind
+	on           []condition
+	bind         func(o row)
+
+	current    row
+	hasCurrent bool
+	matched    bool
+}
+
+func (it *nestedLoopIterator) Open() error {
+	it.hasCurrent = false
+	return it.outer.Open()
+}
+
+func (it *nestedLoopIterator) Next() (row, bool, error) {
+	for {
+		if !it.hasCurrent {
+			o, ok, err := it.outer.Next()
+			if err != nil || !ok {
+				return row{}, false, err
+			}
+
+			it.current, it.hasCurrent, it.matched = o, true, false
+			if it.bind != nil {
+				it.bind(o)
+			}
+
+			if err := it.inner.Open(); err != nil {
+				return row{}, false, err
+			}
+		}
+
+		in, ok, err := it.inner.Next()
+		if err != nil {
+			return row{}, false, err
+		}
+
+		if ok {
+			r := combine(it.current, in.tables[it.position], it.position)
+			if matchesAll(r, it.on) {
+				it.matched = true
+				return r, true, nil
+			}
+
+			continue
+		}
+
+		if err := it.inner.Close(); err != nil {
+			return row{}, false, err
+		}
+
+		it.hasCurrent = false
+		if it.kind == LeftJoin && !it.matched {
+			return it.current, true, nil
+		}
+	}
+}
+
+func (it *nestedLoopIterator) Close() error {
+	it.hasCurrent = false
+
+	err := it.inner.Close()
+	if outerErr := it.outer.Close(); err == nil {
+		err = outerErr
+	}
+
+	return err
+}
+
+// indexNestedLoopJoin looks up the inner row of every outer row by
+// the id found in the key column of the outer row
+func indexNestedLoopJoin(t *persist.Table, s *scope, outer *operator, i int, kind JoinKind,
+	keyTable int, keyColumn string, inner, on []condition) *operator {
+
+	lookup := &lookupIterator{table: t, width: len(s.tables), position: i}
+	lookupOp := &operator{
+		name: fmt.Sprintf("Primary Key Lookup on %s (id = %s)", s.name(i), s.qualify(keyTable, keyColumn)),
+		iter: lookup,
+	}
+
+	innerOp := filter(lookupOp, inner)
+
+	return &operator{
+		name:     joinName("Index Nested Loop", kind, on),
+		children: []*operator{outer, innerOp},
+		iter: &nestedLoopIterator{
+			outer:    outer,
+			inner:    innerOp,
+			position: i,
+			kind:     kind,
+			on:       on,
+			bind: func(o row) {
+				lookup.found = false
+				if o.tables[keyTable] == nil {
+					return
+				}
+
+				id, err := strconv.ParseUint(textValue(o.tables[keyTable], keyColumn), 10, 32)
+				lookup.id, lookup.found = uint32(id), err == nil
+			},
+		},
+	}
+}
+
+// lookupIterator returns the row with the id it was bound to, if any
+type lookupIterator struct {
+	table    *persist.Table
+	width    int
+	position int
+	id       uint32
+	found    bool
+	done     bool
+}
+
+func (it *lookupIterator) Open() error {
+	it.done = !it.found
+	return nil
+}
+
+func (it *lookupIterator) Next() (row, bool, error) {
+	if it.done {
+		return row{}, false, nil
+	}
+
+	it.done = true
+
+	r, err := it.table.Lookup(it.id)
+	if err != nil || r == nil {
+		return row{}, false, err
+	}
+
+	tables := make([]*persist.Row, it.width)
+	tables[it.position] = r
+
+	return row{tables: tables}, true, nil
+}
+
+func (it *lookupIterator) Close() error {
+	return nil
+}
+
+// hashKey is an equality between a column of an earlier table
+// and a column of the table being joined
+type hashKey struct {
+	outerTable  int
+	outerColumn string
+	innerColumn string
+}
+
+// hashJoin builds a hash table of the inner rows and probes it with
+// every outer row. When the inner rows do not fit in the memory budget
+// both sides are partitioned by key and spilled, then each partition
+// is joined on its own. A partition which does not fit either is split
+// again the same way, up to hashJoinMaxLevel times
+func hashJoin(outer, inner *operator, numTables, i int, kind JoinKind, keys []hashKey, on []condition, budget int) *operator {
+	op := &operator{
+		name:     joinName("Hash", kind, on),
+		children: []*operator{outer, inner},
+	}
+
+	op.iter = &hashJoinIterator{
+		op:        op,
+		outer:     outer,
+		inner:     inner,
+		numTables: numTables,
+		position:  i,
+		kind:      kind,
+		keys:      keys,
+		on:        on,
+		budget:    budget,
+	}
+
+	return op
+}
+
+type hashJoinIterator struct {
+	op           *operator
+	outer, inner *operator
+	numTables    int
+	position     int
+	kind         JoinKind
+	keys         []hashKey
+	on           []condition
+	budget       int
+
+	table map[string][]*persist.Row
+
+	// Once spilled the outer rows are read back from the probe partitions.
+	// pending holds the partitions left to join, split counts the ones
+	// which were split again
+	spill   *spillFile
+	pending []joinPartition
+	split   int
+	reader  *spillReader
+
+	current    row
+	hasCurrent bool
+	matches    []*persist.Row
+	matched    bool
+}
+
+// joinPartition is the inner rows and the outer rows of the keys of
+// a partition, a partition too large is split with the level's hash
+type joinPartition struct {
+	build, probe *spillPartition
+	level        int
+}
+
+func (it *hashJoinIterator) innerKey(r *persist.Row) string {
+	values := make([]string, len(it.keys))
+	for k, key := range it.keys {
+		values[k] = textValue(r, key.innerColumn)
+	}
+
+	return encodeHashKey(values)
+}
+
+// outerKey is false when a column is missing after a left join
+func (it *hashJoinIterator) outerKey(r row) (string, bool) {
+	values := make([]string, len(it.keys))
+	for k, key := range it.keys {
+		if r.tables[key.outerTable] == nil {
+			return "", false
+		}
+
+		values[k] = textValue(r.tables[key.outerTable], key.outerColumn)
+	}
+
+	return encodeHashKey(values), true
+}
+
+func (it *hashJoinIterator) Open() error {
+	it.closeSpill()
+	it.pending, it.split, it.reader = nil, 0, nil
+	it.hasCurrent = false
+
+	build := it.newBuild(0)
+	err := it.inner.drain(func(in row) error {
+		return build.add(in.tables[it.position])
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if build.partitions == nil {
+		it.table = build.table
+		return it.outer.Open()
+	}
+
+	// Rows without a key cannot match, any partition will do
+	probes := it.spill.partitions(hashJoinPartitions, it.numTables)
+	err = it.outer.drain(func(o row) error {
+		key, _ := it.outerKey(o)
+		return probes[partitionOf(key, 0)].write(o)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	it.queue(build.partitions, probes, 1)
+	it.describe()
+	return nil
+}
+
+// newBuild collects inner rows into a hash table, which spills to
+// partitions split with the level's hash when it exceeds the budget
+func (it *hashJoinIterator) newBuild(level int) *hashBuild {
+	return &hashBuild{
+		table:  map[string][]*persist.Row{},
+		key:    it.innerKey,
+		budget: it.budget,
+		level:  level,
+		spill: func() (*spillFile, error) {
+			if it.spill == nil {
+				spill, err := newSpillFile()
+				if err != nil {
+					return nil, err
+				}
+
+				it.spill = spill
+			}
+
+			return it.spill, nil
+		},
+	}
+}
+
+// queue adds the pairs of partitions to the ones to join, in order
+func (it *hashJoinIterator) queue(builds, probes []*spillPartition, level int) {
+	for p := len(builds) - 1; p >= 0; p-- {
+		it.pending = append(it.pending, joinPartition{build: builds[p], probe: probes[p], level: level})
+	}
+}
+
+func (it *hashJoinIterator) describe() {
+	it.op.detail = fmt.Sprintf("partitions=%d spilled=%dB", hashJoinPartitions, it.spill.size)
+	if it.split > 0 {
+		it.op.detail += fmt.Sprintf(" split=%d", it.split)
+	}
+}
+
+// nextOuter returns the next outer row, from the outer operator or
+// once spilled from the probe partitions. Moving on to a partition
+// loads its inner rows into the hash table
+func (it *hashJoinIterator) nextOuter() (row, bool, error) {
+	if it.spill == nil {
+		return it.outer.Next()
+	}
+
+	for {
+		if it.reader != nil {
+			o, ok, err := it.reader.next()
+			if err != nil || ok {
+				return o, ok, err
+			}
+
+			it.reader = nil
+		}
+
+		if len(it.pending) == 0 {
+			return row{}, false, nil
+		}
+
+		p := it.pending[len(it.pending)-1]
+		it.pending = it.pending[:len(it.pending)-1]
+
+		if err := it.load(p); err != nil {
+			return row{}, false, err
+		}
+	}
+}
+
+// load builds the hash table of the partition's inner rows and reads
+// its outer rows next. A partition whose inner rows exceed the budget
+// is split in two sets of partitions instead, which are joined next
+func (it *hashJoinIterator) load(p joinPartition) error {
+	built, err := p.build.reader()
+	if err != nil {
+		return err
+	}
+
+	build := it.newBuild(p.level)
+	for {
+		r, ok, err := built.next()
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			break
+		}
+
+		if err := build.add(r.tables[0]); err != nil {
+			return err
+		}
+	}
+
+	if build.partitions == nil {
+		it.table = build.table
+		it.reader, err = p.probe.reader()
+		return err
+	}
+
+	probed, err := p.probe.reader()
+	if err != nil {
+		return err
+	}
+
+	probes := it.spill.partitions(hashJoinPartitions, it.numTables)
+	for {
+		o, ok, err := probed.next()
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			break
+		}
+
+		key, _ := it.outerKey(o)
+		if err := probes[partitionOf(key, p.level)].write(o); err != nil {
+			return err
+		}
+	}
+
+	it.split++
+	it.queue(build.partitions, probes, p.level+1)
+	it.describe()
+
+	return nil
+}
+
+func (it *hashJoinIterator) Next() (row, bool, error) {
+	for {
+		if it.hasCurrent {
+			for len(it.matches) > 0 {
+				in := it.matches[0]
+				it.matches = it.matches[1:]
+
+				r := combine(it.current, in, it.position)
+				if matchesAll(r, it.on) {
+					it.matched = true
+					return r, true, nil
+				}
+			}
+
+			it.hasCurrent = false
+			if it.kind == LeftJoin && !it.matched {
+				return it.current, true, nil
+			}
+		}
+
+		o, ok, err := it.nextOuter()
+		if err != nil || !ok {
+			return row{}, false, err
+		}
+
+		it.current, it.hasCurrent, it.matched, it.matches = o, true, false, nil
+		if key, ok := it.outerKey(o); ok {
+			it.matches = it.table[key]
+		}
+	}
+}
+
+func (it *hashJoinIterator) Close() error {
+	it.closeSpill()
+	it.table, it.pending, it.reader = nil, nil, nil
+	return it.outer.Close()
+}
+
+func (it *hashJoinIterator) closeSpill() {
+	if it.spill != nil {
+		it.spill.close()
+		it.spill = nil
+	}
+}
+
+// hashBuild collects the inner rows of a hash join, in memory until
+// they exceed the budget and in spilled partitions after that. Only a
+// build at hashJoinMaxLevel keeps every row in memory
+type hashBuild struct {
+	table      map[string][]*persist.Row
+	key        func(r *persist.Row) string
+	budget     int
+	level      int
+	memory     int
+	spill      func() (*spillFile, error)
+	partitions []*spillPartition
+}
+
+func (b *hashBuild) add(r *persist.Row) error {
+	if b.partitions != nil {
+		return b.partitions[partitionOf(b.key(r), b.level)].write(row{tables: []*persist.Row{r}})
+	}
+
+	key := b.key(r)
+	b.table[key] = append(b.table[key], r)
+	b.memory += int(persist.RowSize) + hashJoinRowOverhead
+
+	if b.memory <= b.budget || b.level == hashJoinMaxLevel {
+		return nil
+	}
+
+	spill, err := b.spill()
+	if err != nil {
+		return err
+	}
+
+	b.partitions = spill.partitions(hashJoinPartitions, 1)
+	for key, rows := range b.table {
+		for _, r := range rows {
+			if err := b.partitions[partitionOf(key, b.level)].write(row{tables: []*persist.Row{r}}); err != nil {
+				return err
+			}
+		}
+	}
+
+	b.table = nil
+	return nil
+}
+
+// encodeHashKey prefixes every value with its length so
+// different values can never encode to the same key
+func encodeHashKey(values []string) string {
+	var b strings.Builder
+	for _, v := range values {
+		fmt.Fprintf(&b, "%d:%s", len(v), v)
+	}
+
+	return b.String()
+}
+
+// partitionOf hashes the key to a partition, each level of
+// partitions is split with a hash of its own
+func partitionOf(key string, level int) int {
+	h := fnv.New32a()
+	h.Write([]byte{byte(level)})
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % hashJoinPartitions)
+}
@@ -0,0 +1,168 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+func insertJoinUsers(t testing.TB, tbl *persist.Table, n int) {
+	insert, err := Prepare("insert into users values (?, ?, ?)")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Users share a username with every third user, the email
+	// holds the id of the next user
+	for i := 0; i < n; i++ {
+		if _, err := insert.Execute(tbl, i, fmt.Sprintf("user#%d", i%3), fmt.Sprint(i+1)); err != nil {
+			t.Fatalf("Unable to insert row: '%s'", err)
+		}
+	}
+}
+
+// sortedRows formats the rows of the result in sorted order
+func sortedRows(r *Result) string {
+	rows := make([]string, len(r.Rows))
+	for i, row := range r.Rows {
+		rows[i] = fmt.Sprint(row)
+	}
+
+	sort.Strings(rows)
+	return strings.Join(rows, " ")
+}
+
+func TestJoins(t *testing.T) {
+	tbl := openTestTable(t)
+	insertJoinUsers(t, tbl, 6)
+
+	tests := []struct {
+		sql  string
+		plan string
+		rows string
+	}{
+		{
+			"select a.id, b.id from users a join users b on a.username = b.username and a.id < b.id",
+			"Hash Join (a.username = b.username and a.id < b.id)",
+			"[0 3] [1 4] [2 5]",
+		},
+		{
+			"select a.id, b.id from users a join users b on b.id = a.email where a.username = 'user#1'",
+			"Index Nested Loop Join (b.id = a.email)",
+			"[1 2] [4 5]",
+		},
+		{
+			"select a.id, b.id from users a left join users b on a.email = b.id and b.username = 'user#0'",
+			"Index Nested Loop Left Join (a.email = b.id)",
+			"[0 <nil>] [1 <nil>] [2 3] [3 <nil>] [4 <nil>] [5 <nil>]",
+		},
+		{
+			"select a.id, b.id from users a left join users b on a.username = b.username and b.id > 3 where a.id < 3",
+			"Hash Left Join (a.username = b.username)",
+			"[0 <nil>] [1 4] [2 5]",
+		},
+		{
+			"select a.id, b.id from users a join users b on a.id > b.id where b.id >= 4",
+			"Nested Loop Join (a.id > b.id)",
+			"[5 4]",
+		},
+		{
+			"select a.id, b.id, c.id from users a cross join users b, users c where a.id = 0 and b.id = 1",
+			"Nested Loop Cross Join",
+			"[0 1 0] [0 1 1] [0 1 2] [0 1 3] [0 1 4] [0 1 5]",
+		},
+	}
+
+	for _, test := range tests {
+		result, err := execute(tbl, test.sql)
+		if err != nil {
+			t.Fatalf("Unable to execute '%s': '%s'", test.sql, err)
+		}
+
+		if rows := sortedRows(result); rows != test.rows {
+			t.Fatalf("Unexpected rows for '%s': %s", test.sql, rows)
+		}
+
+		explained, err := execute(tbl, "explain "+test.sql)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if !strings.Contains(planText(explained), test.plan) {
+			t.Fatalf("Expected '%s' in the plan of '%s':\n%s", test.plan, test.sql, planText(explained))
+		}
+	}
+
+	if _, err := execute(tbl, "select id from users a join users b on a.id = b.id"); err == nil {
+		t.Fatalf("Expected an ambiguous column to be rejected")
+	}
+
+	if _, err := execute(tbl, "select * from users join users on users.id = users.id"); err == nil {
+		t.Fatalf("Expected a table without an alias to be rejected the second time")
+	}
+}
+
+func TestHashJoinSpills(t *testing.T) {
+	tbl := openTestTable(t)
+	insertJoinUsers(t, tbl, 300)
+
+	sql := "select a.id, b.id from users a left join users b on a.username = b.username and b.id < 30"
+
+	inMemory, err := execute(tbl, sql)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	options := Options{JoinMemoryBudget: 1000}
+	spilled, err := executeWithOptions(tbl, options, sql)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(spilled.Rows) != 300*10 || sortedRows(spilled) != sortedRows(inMemory) {
+		t.Fatalf("Spilled join returned %d rows, expected %d", len(spilled.Rows), len(inMemory.Rows))
+	}
+
+	explained, err := executeWithOptions(tbl, options, "explain analyze "+sql)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !strings.Contains(planText(explained), "partitions=16") {
+		t.Fatalf("Expected the join to spill:\n%s", planText(explained))
+	}
+}
+
+func TestHashJoinSplitsPartitions(t *testing.T) {
+	tbl := openTestTable(t)
+	insertJoinUsers(t, tbl, 1000)
+
+	sql := "select a.id, b.id from users a join users b on a.email = b.email"
+
+	inMemory, err := execute(tbl, sql)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	options := Options{JoinMemoryBudget: 4000}
+	spilled, err := executeWithOptions(tbl, options, sql)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(spilled.Rows) != 1000 || sortedRows(spilled) != sortedRows(inMemory) {
+		t.Fatalf("Spilled join returned %d rows, expected %d", len(spilled.Rows), len(inMemory.Rows))
+	}
+
+	explained, err := executeWithOptions(tbl, options, "explain analyze "+sql)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !strings.Contains(planText(explained), "split=") {
+		t.Fatalf("Expected partitions over the budget to be split:\n%s", planText(explained))
+	}
+}
@@ -0,0 +1,171 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenSymbol
+	tokenPlaceholder
+)
+
+type token struct {
+	typ   tokenType
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokenEOF:
+		return "end of statement"
+	case tokenString:
+		return fmt.Sprintf("'%s'", t.value)
+	default:
+		return t.value
+	}
+}
+
+// is reports whether the token is the given keyword or symbol,
+// keywords are not case sensitive
+func (t token) is(s string) bool {
+	if t.typ == tokenIdent {
+		return strings.EqualFold(t.value, s)
+	}
+
+	return t.typ == tokenSymbol && t.value == s
+}
+
+var symbols = []string{"<=", ">=", "(", ")", ",", ".", "*", "=", "<", ">", ";"}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+
+	i := 0
+	for i < len(input) {
+		c := input[i]
+
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+
+		case isIdentStart(c):
+			start := i
+			for i < len(input) && isIdentPart(input[i]) {
+				i++
+			}
+
+			tokens = append(tokens, token{typ: tokenIdent, value: input[start:i], pos: start})
+
+		case isDigit(c) || (c == '-' && i+1 < len(input) && isDigit(input[i+1])):
+			start := i
+			i++
+			for i < len(input) && isDigit(input[i]) {
+				i++
+			}
+
+			tokens = append(tokens, token{typ: tokenNumber, value: input[start:i], pos: start})
+
+		case c == '\'':
+			s, end, err := lexString(input, i)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{typ: tokenString, value: s, pos: i})
+			i = end
+
+		case c == '?':
+			tokens = append(tokens, token{typ: tokenPlaceholder, value: "?", pos: i})
+			i++
+
+		case c == '$':
+			start := i
+			i++
+			for i < len(input) && isDigit(input[i]) {
+				i++
+			}
+
+			if i == start+1 {
+				return nil, fmt.Errorf("expected a parameter number after '$' at position %d", start)
+			}
+
+			tokens = append(tokens, token{typ: tokenPlaceholder, value: input[start:i], pos: start})
+
+		case c == ':' || c == '@':
+			start := i
+			i++
+			for i < len(input) && isIdentPart(input[i]) {
+				i++
+			}
+
+			if i == start+1 || !isIdentStart(input[start+1]) {
+				return nil, fmt.Errorf("expected a parameter name after '%c' at position %d", c, start)
+			}
+
+			tokens = append(tokens, token{typ: tokenPlaceholder, value: input[start:i], pos: start})
+
+		default:
+			symbol := ""
+			for _, s := range symbols {
+				if strings.HasPrefix(input[i:], s) {
+					symbol = s
+					break
+				}
+			}
+
+			if symbol == "" {
+				return nil, fmt.Errorf("unexpected character '%c' at position %d", c, i)
+			}
+
+			tokens = append(tokens, token{typ: tokenSymbol, value: symbol, pos: i})
+			i += len(symbol)
+		}
+	}
+
+	return append(tokens, token{typ: tokenEOF, pos: len(input)}), nil
+}
+
+// lexString reads a quoted string starting at the opening quote,
+// a quote inside the string is written as two quotes
+func lexString(input string, start int) (string, int, error) {
+	var b strings.Builder
+
+	i := start + 1
+	for i < len(input) {
+		if input[i] == '\'' {
+			if i+1 < len(input) && input[i+1] == '\'' {
+				b.WriteByte('\'')
+				i += 2
+				continue
+			}
+
+			return b.String(), i + 1, nil
+		}
+
+		b.WriteByte(input[i])
+		i++
+	}
+
+	return "", 0, fmt.Errorf("unterminated string starting at position %d", start)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
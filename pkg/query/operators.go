@@ -0,0 +1,476 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+// evaluator computes the value of an expression for a row, text
+// is how the expression is shown in results and plans
+type evaluator struct {
+	text string
+	eval func(r row) interface{}
+}
+
+// column evaluates to the value of a column of a table of the scope,
+// nil when a left join found no row for the table
+func (s *scope) column(ref ColumnRef) (evaluator, error) {
+	i, err := s.resolve(ref.Table, ref.Column)
+	if err != nil {
+		return evaluator{}, err
+	}
+
+	return evaluator{
+		text: s.qualify(i, ref.Column),
+		eval: func(r row) interface{} {
+			if r.tables[i] == nil {
+				return nil
+			}
+
+			return columnValue(r.tables[i], ref.Column)
+		},
+	}, nil
+}
+
+// value evaluates to the value at position i computed by an aggregate
+func value(text string, i int) evaluator {
+	return evaluator{text: text, eval: func(r row) interface{} {
+		return r.values[i]
+	}}
+}
+
+func describeEvaluators(evaluators []evaluator) string {
+	strs := make([]string, len(evaluators))
+	for i, e := range evaluators {
+		strs[i] = e.text
+	}
+
+	return strings.Join(strs, ", ")
+}
+
+// compareValues orders nil before any value, ids as
+// numbers and the text columns as strings
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	if x, ok := a.(int64); ok {
+		y := b.(int64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(a.(string), b.(string))
+}
+
+// project computes the values of the columns for every row of child
+func project(child *operator, columns []evaluator) *operator {
+	return &operator{
+		name:     fmt.Sprintf("Project (%s)", describeEvaluators(columns)),
+		children: []*operator{child},
+		iter:     &projectIterator{child: child, columns: columns},
+	}
+}
+
+type projectIterator struct {
+	child   *operator
+	columns []evaluator
+}
+
+func (it *projectIterator) Open() error {
+	return it.child.Open()
+}
+
+func (it *projectIterator) Next() (row, bool, error) {
+	r, ok, err := it.child.Next()
+	if err != nil || !ok {
+		return row{}, false, err
+	}
+
+	values := make([]interface{}, len(it.columns))
+	for i, c := range it.columns {
+		values[i] = c.eval(r)
+	}
+
+	return row{tables: r.tables, values: values}, true, nil
+}
+
+func (it *projectIterator) Close() error {
+	return it.child.Close()
+}
+
+// sortKey orders rows by the value of an expression
+type sortKey struct {
+	evaluator
+	desc bool
+}
+
+// sortRows reads all rows of child into memory and sorts them by the keys,
+// rows with equal keys keep the order child produced them in
+func sortRows(child *operator, keys []sortKey) *operator {
+	strs := make([]string, len(keys))
+	for i, k := range keys {
+		strs[i] = k.text
+		if k.desc {
+			strs[i] += " desc"
+		}
+	}
+
+	return &operator{
+		name:     fmt.Sprintf("Sort (%s)", strings.Join(strs, ", ")),
+		children: []*operator{child},
+		iter:     &sortIterator{child: child, keys: keys},
+	}
+}
+
+type sortIterator struct {
+	child *operator
+	keys  []sortKey
+	rows  []row
+}
+
+func (it *sortIterator) Open() error {
+	type sorted struct {
+		r      row
+		values []interface{}
+	}
+
+	var rows []sorted
+
+	err := it.child.drain(func(r row) error {
+		values := make([]interface{}, len(it.keys))
+		for i, k := range it.keys {
+			values[i] = k.eval(r)
+		}
+
+		rows = append(rows, sorted{r, values})
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(rows, func(a, b int) bool {
+		for i, k := range it.keys {
+			cmp := compareValues(rows[a].values[i], rows[b].values[i])
+			if k.desc {
+				cmp = -cmp
+			}
+
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+
+		return false
+	})
+
+	it.rows = make([]row, len(rows))
+	for i, s := range rows {
+		it.rows[i] = s.r
+	}
+
+	return nil
+}
+
+func (it *sortIterator) Next() (row, bool, error) {
+	if len(it.rows) == 0 {
+		return row{}, false, nil
+	}
+
+	r := it.rows[0]
+	it.rows = it.rows[1:]
+
+	return r, true, nil
+}
+
+func (it *sortIterator) Close() error {
+	it.rows = nil
+	return nil
+}
+
+// limit passes on the first n rows of child, it stops
+// reading child once it has them
+func limit(child *operator, n int64) *operator {
+	return &operator{
+		name:     fmt.Sprintf("Limit (%d)", n),
+		children: []*operator{child},
+		iter:     &limitIterator{child: child, limit: n},
+	}
+}
+
+type limitIterator struct {
+	child *operator
+	limit int64
+	count int64
+}
+
+func (it *limitIterator) Open() error {
+	it.count = 0
+	return it.child.Open()
+}
+
+func (it *limitIterator) Next() (row, bool, error) {
+	if it.count == it.limit {
+		return row{}, false, nil
+	}
+
+	r, ok, err := it.child.Next()
+	if ok {
+		it.count++
+	}
+
+	return r, ok, err
+}
+
+func (it *limitIterator) Close() error {
+	return it.child.Close()
+}
+
+// aggregateFunc is an aggregate bound to the scope, column is nil
+// for count(*). columnName is the name of the column in its table
+type aggregateFunc struct {
+	text       string
+	fn         string
+	column     *evaluator
+	columnName string
+}
+
+// accumulator holds the state of an aggregate for one group
+type accumulator struct {
+	count int64
+	sum   int64
+	value interface{}
+}
+
+func (f aggregateFunc) add(acc *accumulator, r row) {
+	if f.column == nil {
+		acc.count++
+		return
+	}
+
+	v := f.column.eval(r)
+	if v == nil {
+		return
+	}
+
+	acc.count++
+
+	switch f.fn {
+	case "sum":
+		acc.sum += v.(int64)
+	case "min":
+		if acc.count == 1 || compareValues(v, acc.value) < 0 {
+			acc.value = v
+		}
+	case "max":
+		if acc.count == 1 || compareValues(v, acc.value) > 0 {
+			acc.value = v
+		}
+	}
+}
+
+// result is nil for sum, min and max of a group without values
+func (f aggregateFunc) result(acc *accumulator) interface{} {
+	switch f.fn {
+	case "count":
+		return acc.count
+	case "sum":
+		if acc.count == 0 {
+			return nil
+		}
+
+		return acc.sum
+	default:
+		return acc.value
+	}
+}
+
+// aggregate groups the rows of child by the values of the groups and
+// computes the aggregates for each group. The values of a row it returns
+// are the values of the groups followed by the aggregates. Without
+// groups all rows form a single group, even when there are none
+func aggregate(child *operator, groups []evaluator, funcs []aggregateFunc) *operator {
+	return &operator{
+		name:     aggregateName(groups, funcs),
+		children: []*operator{child},
+		iter:     &aggregateIterator{child: child, groups: groups, funcs: funcs},
+	}
+}
+
+func aggregateName(groups []evaluator, funcs []aggregateFunc) string {
+	texts := make([]string, len(funcs))
+	for i, f := range funcs {
+		texts[i] = f.text
+	}
+
+	if len(groups) == 0 {
+		return fmt.Sprintf("Aggregate (%s)", strings.Join(texts, ", "))
+	}
+
+	return fmt.Sprintf("Aggregate by %s (%s)", describeEvaluators(groups), strings.Join(texts, ", "))
+}
+
+type aggregateIterator struct {
+	child  *operator
+	groups []evaluator
+	funcs  []aggregateFunc
+	rows   []row
+}
+
+func (it *aggregateIterator) Open() error {
+	type group struct {
+		values       []interface{}
+		accumulators []accumulator
+	}
+
+	var order []*group
+	groups := map[string]*group{}
+
+	err := it.child.drain(func(r row) error {
+		values := make([]interface{}, len(it.groups))
+		key := make([]string, len(it.groups))
+		for i, g := range it.groups {
+			values[i] = g.eval(r)
+
+			// A missing value is kept apart from every text value
+			key[i] = "-"
+			if values[i] != nil {
+				key[i] = fmt.Sprintf("+%v", values[i])
+			}
+		}
+
+		g, ok := groups[encodeHashKey(key)]
+		if !ok {
+			g = &group{values: values, accumulators: make([]accumulator, len(it.funcs))}
+			groups[encodeHashKey(key)] = g
+			order = append(order, g)
+		}
+
+		for i, f := range it.funcs {
+			f.add(&g.accumulators[i], r)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(order) == 0 && len(it.groups) == 0 {
+		order = append(order, &group{accumulators: make([]accumulator, len(it.funcs))})
+	}
+
+	it.rows = make([]row, len(order))
+	for i, g := range order {
+		values := g.values
+		for j, f := range it.funcs {
+			values = append(values, f.result(&g.accumulators[j]))
+		}
+
+		it.rows[i] = row{values: values}
+	}
+
+	return nil
+}
+
+func (it *aggregateIterator) Next() (row, bool, error) {
+	if len(it.rows) == 0 {
+		return row{}, false, nil
+	}
+
+	r := it.rows[0]
+	it.rows = it.rows[1:]
+
+	return r, true, nil
+}
+
+func (it *aggregateIterator) Close() error {
+	it.rows = nil
+	return nil
+}
+
+// changeIterator applies a change to rows of the users table, each
+// row it returns is a changed row. The rows of child are all read
+// before any is changed so a change never moves a row ahead of the
+// scan. Without a child the change is applied to the given rows
+type changeIterator struct {
+	child  *operator
+	given  []*persist.Row
+	change func(r *persist.Row) (*persist.Row, error)
+	rows   []*persist.Row
+}
+
+func (it *changeIterator) Open() error {
+	if it.child == nil {
+		it.rows = it.given
+		return nil
+	}
+
+	it.rows = nil
+	return it.child.drain(func(r row) error {
+		it.rows = append(it.rows, r.tables[0])
+		return nil
+	})
+}
+
+func (it *changeIterator) Next() (row, bool, error) {
+	if len(it.rows) == 0 {
+		return row{}, false, nil
+	}
+
+	r, err := it.change(it.rows[0])
+	it.rows = it.rows[1:]
+	if err != nil {
+		return row{}, false, err
+	}
+
+	return row{tables: []*persist.Row{r}}, true, nil
+}
+
+func (it *changeIterator) Close() error {
+	it.rows = nil
+	return nil
+}
+
+// commandIterator runs a command on the first call to Next,
+// it returns no rows
+type commandIterator struct {
+	run  func() error
+	done bool
+}
+
+func (it *commandIterator) Open() error {
+	it.done = false
+	return nil
+}
+
+func (it *commandIterator) Next() (row, bool, error) {
+	if it.done {
+		return row{}, false, nil
+	}
+
+	it.done = true
+	return row{}, false, it.run()
+}
+
+func (it *commandIterator) Close() error {
+	return nil
+}
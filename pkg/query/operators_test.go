@@ -0,0 +1,115 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSortLimitAndAggregate(t *testing.T) {
+	for _, batched := range []bool{true, false} {
+		t.Run(fmt.Sprintf("batched=%v", batched), func(t *testing.T) {
+			testSortLimitAndAggregate(t, Options{RowAtATime: !batched})
+		})
+	}
+}
+
+func testSortLimitAndAggregate(t *testing.T, options Options) {
+	tbl := openTestTable(t)
+
+	result, err := executeWithOptions(tbl, options, "select count(*), count(email), sum(id), min(username) from users")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if fmt.Sprint(result.Rows) != "[[0 0 <nil> <nil>]]" {
+		t.Fatalf("Unexpected aggregates of an empty table: %v", result.Rows)
+	}
+
+	insertJoinUsers(t, tbl, 10)
+
+	tests := []struct {
+		sql     string
+		columns string
+		rows    string
+	}{
+		{
+			"select id from users order by username desc, id limit 4",
+			"[id]",
+			"[[2] [5] [8] [1]]",
+		},
+		{
+			"select username, count(*), sum(id), max(email) from users group by username order by count(*) desc, username",
+			"[username count(*) sum(id) max(email)]",
+			"[[user#0 4 18 7] [user#1 3 12 8] [user#2 3 15 9]]",
+		},
+		{
+			"select a.username, count(b.id) from users a left join users b on a.email = b.id and b.id < 3 group by a.username",
+			"[a.username count(b.id)]",
+			"[[user#0 1] [user#1 1] [user#2 0]]",
+		},
+		{
+			"select max(id) from users where id < 5",
+			"[max(id)]",
+			"[[4]]",
+		},
+		{
+			"select id from users limit 0",
+			"[id]",
+			"[]",
+		},
+	}
+
+	for _, test := range tests {
+		result, err := executeWithOptions(tbl, options, test.sql)
+		if err != nil {
+			t.Fatalf("Unable to execute '%s': '%s'", test.sql, err)
+		}
+
+		if fmt.Sprint(result.Columns) != test.columns || fmt.Sprint(result.Rows) != test.rows {
+			t.Fatalf("Unexpected result for '%s': %v %v", test.sql, result.Columns, result.Rows)
+		}
+	}
+
+	for _, sql := range []string{
+		"select id, count(*) from users",
+		"select * from users group by username",
+		"select sum(email) from users",
+		"select username from users group by username order by id",
+	} {
+		if _, err := executeWithOptions(tbl, options, sql); err == nil {
+			t.Fatalf("Expected '%s' to fail", sql)
+		}
+	}
+}
+
+func TestLimitStopsReading(t *testing.T) {
+	tbl := openTestTable(t)
+	insertJoinUsers(t, tbl, 100)
+
+	result, err := executeWithOptions(tbl, Options{RowAtATime: true}, "explain analyze select id from users limit 3")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	lines := strings.Split(planText(result), "\n")
+	if len(lines) != 3 ||
+		!strings.HasPrefix(lines[0], "Project (id) (rows=3 ") ||
+		!strings.HasPrefix(lines[1], "  Limit (3) (rows=3 ") ||
+		!strings.HasPrefix(lines[2], "    Full Scan on users (rows=3 ") {
+		t.Fatalf("Unexpected analyzed plan:\n%s", planText(result))
+	}
+
+	result, err = executeWithOptions(tbl, Options{RowAtATime: true}, "explain select username, count(*) from users group by username order by count(*) desc")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := "Project (username, count(*))\n" +
+		"  Sort (count(*) desc)\n" +
+		"    Aggregate by username (count(*))\n" +
+		"      Full Scan on users"
+	if explained := planText(result); explained != expected {
+		t.Fatalf("Unexpected plan:\n%s", explained)
+	}
+}
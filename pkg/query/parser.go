@@ -0,0 +1,765 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+type parser struct {
+	tokens []token
+	pos    int
+
+	// Placeholders in a statement are all '?', all '$n' or all named,
+	// params holds the name of each parameter, empty when unnamed
+	style  placeholderStyle
+	params []string
+}
+
+type placeholderStyle int
+
+const (
+	styleNone placeholderStyle = iota
+	stylePositional
+	styleNumbered
+	styleNamed
+)
+
+// Parse parses a single statement, it returns the statement
+// and the number of parameters the statement expects
+func Parse(sql string) (Statement, int, error) {
+	stmt, params, err := parse(sql)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return stmt, len(params), nil
+}
+
+func parse(sql string) (Statement, []string, error) {
+	tokens, err := lex(sql)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.accept(";")
+	if p.peek().typ != tokenEOF {
+		return nil, nil, p.unexpected()
+	}
+
+	return stmt, p.params, nil
+}
+
+func (p *parser) parseStatement() (Statement, error) {
+	switch {
+	case p.accept("select"):
+		return p.parseSelect()
+	case p.accept("insert"):
+		return p.parseInsert()
+	case p.accept("update"):
+		return p.parseUpdate()
+	case p.accept("delete"):
+		return p.parseDelete()
+	case p.accept("create"):
+		return p.parseCreateIndex()
+	case p.accept("analyze"):
+		p.accept(TableName)
+		return &AnalyzeStatement{}, nil
+	case p.accept("vacuum"):
+		return &VacuumStatement{Incremental: p.accept("incremental")}, nil
+	case p.accept("explain"):
+		return p.parseExplain()
+	case p.accept("savepoint"):
+		name, err := p.parseIdent()
+		return &SavepointStatement{Name: name}, err
+	case p.accept("release"):
+		p.accept("savepoint")
+		name, err := p.parseIdent()
+		return &ReleaseStatement{Name: name}, err
+	case p.accept("rollback"):
+		return p.parseRollbackTo()
+	default:
+		return nil, p.unexpected()
+	}
+}
+
+// explain [analyze] statement
+func (p *parser) parseExplain() (Statement, error) {
+	stmt := &ExplainStatement{Analyze: p.accept("analyze")}
+
+	if p.peek().is("explain") {
+		return nil, p.unexpected()
+	}
+
+	s, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt.Statement = s
+	return stmt, nil
+}
+
+// rollback to [savepoint] name, a plain rollback ends
+// the transaction and is left to the driver
+func (p *parser) parseRollbackTo() (Statement, error) {
+	if err := p.expect("to"); err != nil {
+		return nil, err
+	}
+
+	p.accept("savepoint")
+
+	name, err := p.parseIdent()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RollbackToStatement{Name: name}, nil
+}
+
+// select (* | expression [, expression]...) from users [alias] [join...]
+// [where ...] [group by column [, column]...]
+// [order by expression [asc | desc] [, ...]] [limit n]
+func (p *parser) parseSelect() (Statement, error) {
+	stmt := &SelectStatement{}
+
+	if !p.accept("*") {
+		for {
+			e, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+
+			stmt.Columns = append(stmt.Columns, e)
+
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+
+	if err := p.expect("from"); err != nil {
+		return nil, err
+	}
+
+	from, err := p.parseTableRef()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt.From = from
+
+	for {
+		join, ok, err := p.parseJoin()
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			break
+		}
+
+		stmt.Joins = append(stmt.Joins, join)
+	}
+
+	where, err := p.parseWhere()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt.Where = where
+
+	if p.accept("group") {
+		if err := p.expect("by"); err != nil {
+			return nil, err
+		}
+
+		for {
+			column, err := p.parseColumnRef()
+			if err != nil {
+				return nil, err
+			}
+
+			stmt.GroupBy = append(stmt.GroupBy, column)
+
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+
+	if p.accept("order") {
+		if err := p.expect("by"); err != nil {
+			return nil, err
+		}
+
+		for {
+			e, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+
+			order := OrderBy{Expression: e}
+			if p.accept("desc") {
+				order.Desc = true
+			} else {
+				p.accept("asc")
+			}
+
+			stmt.OrderBy = append(stmt.OrderBy, order)
+
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+
+	if p.accept("limit") {
+		limit, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		if l, ok := limit.(Literal); ok {
+			if n, ok := l.Value.(int64); !ok || n < 0 {
+				return nil, fmt.Errorf("limit expects a number that is not negative")
+			}
+		}
+
+		stmt.Limit = limit
+	}
+
+	return stmt, nil
+}
+
+// aggregates are the functions an Aggregate can apply
+var aggregates = map[string]bool{"count": true, "sum": true, "min": true, "max": true}
+
+// [table.]column | count(*) | function([table.]column)
+func (p *parser) parseExpression() (Expression, error) {
+	t := p.peek()
+	if t.typ != tokenIdent || !aggregates[strings.ToLower(t.value)] || !p.tokens[p.pos+1].is("(") {
+		return p.parseColumnRef()
+	}
+
+	p.next()
+	p.next()
+
+	agg := Aggregate{Func: strings.ToLower(t.value)}
+
+	if agg.Func == "count" && p.accept("*") {
+		agg.Star = true
+	} else {
+		column, err := p.parseColumnRef()
+		if err != nil {
+			return nil, err
+		}
+
+		agg.Column = column
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return agg, nil
+}
+
+// [inner] join table [alias] on ... | left [outer] join table [alias] on ...
+// | cross join table [alias] | , table [alias]
+func (p *parser) parseJoin() (Join, bool, error) {
+	var join Join
+
+	switch {
+	case p.accept(","):
+		join.Kind = CrossJoin
+	case p.accept("cross"):
+		join.Kind = CrossJoin
+		if err := p.expect("join"); err != nil {
+			return join, false, err
+		}
+	case p.accept("left"):
+		join.Kind = LeftJoin
+		p.accept("outer")
+		if err := p.expect("join"); err != nil {
+			return join, false, err
+		}
+	case p.accept("inner"):
+		if err := p.expect("join"); err != nil {
+			return join, false, err
+		}
+	case p.accept("join"):
+	default:
+		return join, false, nil
+	}
+
+	table, err := p.parseTableRef()
+	if err != nil {
+		return join, false, err
+	}
+
+	join.Table = table
+
+	if join.Kind == CrossJoin {
+		return join, true, nil
+	}
+
+	if err := p.expect("on"); err != nil {
+		return join, false, err
+	}
+
+	on, err := p.parseConditions()
+	if err != nil {
+		return join, false, err
+	}
+
+	join.On = on
+	return join, true, nil
+}
+
+// keywords cannot be used as aliases so they are not mistaken for one
+var keywords = map[string]bool{
+	"where": true, "join": true, "inner": true, "left": true, "outer": true,
+	"cross": true, "on": true, "and": true, "as": true, "group": true,
+	"order": true, "limit": true,
+}
+
+// users [[as] alias]
+func (p *parser) parseTableRef() (TableRef, error) {
+	if err := p.expectTable(); err != nil {
+		return TableRef{}, err
+	}
+
+	ref := TableRef{Name: TableName}
+
+	t := p.peek()
+	if p.accept("as") || (t.typ == tokenIdent && !keywords[strings.ToLower(t.value)]) {
+		alias, err := p.parseIdent()
+		if err != nil {
+			return TableRef{}, err
+		}
+
+		ref.Alias = alias
+	}
+
+	return ref, nil
+}
+
+// insert into users [(column [, column]...)] values (value [, value]...)
+func (p *parser) parseInsert() (Statement, error) {
+	if err := p.expect("into"); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectTable(); err != nil {
+		return nil, err
+	}
+
+	stmt := &InsertStatement{Columns: Columns}
+
+	if p.accept("(") {
+		columns, err := p.parseColumnList()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+
+		stmt.Columns = columns
+	}
+
+	if !containsColumn(stmt.Columns, "id") {
+		return nil, fmt.Errorf("insert requires a value for the id column")
+	}
+
+	if err := p.expect("values"); err != nil {
+		return nil, err
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		stmt.Values = append(stmt.Values, v)
+
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if len(stmt.Values) != len(stmt.Columns) {
+		return nil, fmt.Errorf("insert has %d columns but %d values", len(stmt.Columns), len(stmt.Values))
+	}
+
+	return stmt, nil
+}
+
+// update users set column = value [, column = value]... [where ...]
+func (p *parser) parseUpdate() (Statement, error) {
+	if err := p.expectTable(); err != nil {
+		return nil, err
+	}
+
+	if err := p.expect("set"); err != nil {
+		return nil, err
+	}
+
+	stmt := &UpdateStatement{}
+
+	for {
+		column, err := p.parseColumn()
+		if err != nil {
+			return nil, err
+		}
+
+		if column == "id" {
+			return nil, fmt.Errorf("the id column cannot be updated")
+		}
+
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		stmt.Set = append(stmt.Set, Assignment{Column: column, Value: v})
+
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	where, err := p.parseWhere()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt.Where = where
+	return stmt, nil
+}
+
+// delete from users [where ...]
+func (p *parser) parseDelete() (Statement, error) {
+	if err := p.expect("from"); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectTable(); err != nil {
+		return nil, err
+	}
+
+	where, err := p.parseWhere()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeleteStatement{Where: where}, nil
+}
+
+// create [unique] index name on users (column)
+func (p *parser) parseCreateIndex() (Statement, error) {
+	stmt := &CreateIndexStatement{Unique: p.accept("unique")}
+
+	if err := p.expect("index"); err != nil {
+		return nil, err
+	}
+
+	name, err := p.parseIdent()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt.Name = name
+
+	if err := p.expect("on"); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectTable(); err != nil {
+		return nil, err
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	column, err := p.parseColumn()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt.Column = column
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return stmt, nil
+}
+
+// [where condition [and condition]...]
+func (p *parser) parseWhere() ([]Condition, error) {
+	if !p.accept("where") {
+		return nil, nil
+	}
+
+	return p.parseConditions()
+}
+
+// column op (value | column) [and column op (value | column)]...
+func (p *parser) parseConditions() ([]Condition, error) {
+	var conditions []Condition
+
+	for {
+		column, err := p.parseColumnRef()
+		if err != nil {
+			return nil, err
+		}
+
+		t := p.peek()
+		if t.typ != tokenSymbol {
+			return nil, p.unexpected()
+		}
+
+		op, err := persist.ParseOperator(t.value)
+		if err != nil {
+			return nil, p.unexpected()
+		}
+
+		p.next()
+
+		var v Value
+		if p.peek().typ == tokenIdent {
+			v, err = p.parseColumnRef()
+		} else {
+			v, err = p.parseValue()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		conditions = append(conditions, Condition{Table: column.Table, Column: column.Column, Op: op, Value: v})
+
+		if !p.accept("and") {
+			return conditions, nil
+		}
+	}
+}
+
+// [table.]column
+func (p *parser) parseColumnRef() (ColumnRef, error) {
+	name, err := p.parseIdent()
+	if err != nil {
+		return ColumnRef{}, err
+	}
+
+	if !p.accept(".") {
+		if !containsColumn(Columns, name) {
+			return ColumnRef{}, fmt.Errorf("unknown column '%s'", name)
+		}
+
+		return ColumnRef{Column: name}, nil
+	}
+
+	column, err := p.parseColumn()
+	if err != nil {
+		return ColumnRef{}, err
+	}
+
+	return ColumnRef{Table: name, Column: column}, nil
+}
+
+func (p *parser) parseColumnList() ([]string, error) {
+	var columns []string
+
+	for {
+		column, err := p.parseColumn()
+		if err != nil {
+			return nil, err
+		}
+
+		columns = append(columns, column)
+
+		if !p.accept(",") {
+			return columns, nil
+		}
+	}
+}
+
+func (p *parser) parseColumn() (string, error) {
+	name, err := p.parseIdent()
+	if err != nil {
+		return "", err
+	}
+
+	if !containsColumn(Columns, name) {
+		return "", fmt.Errorf("unknown column '%s'", name)
+	}
+
+	return name, nil
+}
+
+func containsColumn(columns []string, name string) bool {
+	for _, c := range columns {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *parser) parseIdent() (string, error) {
+	t := p.peek()
+	if t.typ != tokenIdent {
+		return "", p.unexpected()
+	}
+
+	p.next()
+	return strings.ToLower(t.value), nil
+}
+
+func (p *parser) parseValue() (Value, error) {
+	t := p.peek()
+
+	switch t.typ {
+	case tokenNumber:
+		p.next()
+
+		n, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", t.value)
+		}
+
+		return Literal{Value: n}, nil
+
+	case tokenString:
+		p.next()
+		return Literal{Value: t.value}, nil
+
+	case tokenPlaceholder:
+		p.next()
+		return p.placeholder(t)
+
+	default:
+		return nil, p.unexpected()
+	}
+}
+
+func (p *parser) placeholder(t token) (Value, error) {
+	style := styleNamed
+	switch t.value[0] {
+	case '?':
+		style = stylePositional
+	case '$':
+		style = styleNumbered
+	}
+
+	if p.style != styleNone && p.style != style {
+		return nil, fmt.Errorf("cannot mix '?', '$n' and named parameters")
+	}
+
+	p.style = style
+
+	switch style {
+	case stylePositional:
+		p.params = append(p.params, "")
+		return Placeholder{Ordinal: len(p.params)}, nil
+
+	case styleNumbered:
+		n, err := strconv.Atoi(t.value[1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid parameter '%s'", t.value)
+		}
+
+		for len(p.params) < n {
+			p.params = append(p.params, "")
+		}
+
+		return Placeholder{Ordinal: n}, nil
+
+	default:
+		name := t.value[1:]
+		for i, param := range p.params {
+			if param == name {
+				return Placeholder{Ordinal: i + 1, Name: name}, nil
+			}
+		}
+
+		p.params = append(p.params, name)
+		return Placeholder{Ordinal: len(p.params), Name: name}, nil
+	}
+}
+
+func (p *parser) expectTable() error {
+	name, err := p.parseIdent()
+	if err != nil {
+		return err
+	}
+
+	if name != TableName {
+		return fmt.Errorf("unknown table '%s'", name)
+	}
+
+	return nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+// accept consumes the next token if it is the given keyword or symbol
+func (p *parser) accept(s string) bool {
+	if p.peek().is(s) {
+		p.next()
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.accept(s) {
+		return fmt.Errorf("expected '%s' but found %s at position %d", s, p.peek(), p.peek().pos)
+	}
+
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	return fmt.Errorf("unexpected %s at position %d", p.peek(), p.peek().pos)
+}
@@ -0,0 +1,179 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		sql       string
+		stmt      Statement
+		numParams int
+	}{
+		{
+			"select * from users",
+			&SelectStatement{From: TableRef{Name: "users"}},
+			0,
+		},
+		{
+			"SELECT id, email FROM users WHERE email >= ? AND id < ?;",
+			&SelectStatement{
+				Columns: []Expression{ColumnRef{Column: "id"}, ColumnRef{Column: "email"}},
+				From:    TableRef{Name: "users"},
+				Where: []Condition{
+					{Column: "email", Op: persist.GreaterOrEqual, Value: Placeholder{Ordinal: 1}},
+					{Column: "id", Op: persist.Less, Value: Placeholder{Ordinal: 2}},
+				},
+			},
+			2,
+		},
+		{
+			"insert into users (id, username) values ($2, 'it''s')",
+			&InsertStatement{
+				Columns: []string{"id", "username"},
+				Values:  []Value{Placeholder{Ordinal: 2}, Literal{Value: "it's"}},
+			},
+			2,
+		},
+		{
+			"update users set email = 'a@b.c' where id = 1",
+			&UpdateStatement{
+				Set:   []Assignment{{Column: "email", Value: Literal{Value: "a@b.c"}}},
+				Where: []Condition{{Column: "id", Op: persist.Equal, Value: Literal{Value: int64(1)}}},
+			},
+			0,
+		},
+		{
+			"delete from users",
+			&DeleteStatement{},
+			0,
+		},
+		{
+			"select a.id, b.email from users a left join users as b on a.username = b.username and b.id > 3 cross join users c",
+			&SelectStatement{
+				Columns: []Expression{ColumnRef{Table: "a", Column: "id"}, ColumnRef{Table: "b", Column: "email"}},
+				From:    TableRef{Name: "users", Alias: "a"},
+				Joins: []Join{
+					{
+						Kind:  LeftJoin,
+						Table: TableRef{Name: "users", Alias: "b"},
+						On: []Condition{
+							{Table: "a", Column: "username", Op: persist.Equal, Value: ColumnRef{Table: "b", Column: "username"}},
+							{Table: "b", Column: "id", Op: persist.Greater, Value: Literal{Value: int64(3)}},
+						},
+					},
+					{Kind: CrossJoin, Table: TableRef{Name: "users", Alias: "c"}},
+				},
+			},
+			0,
+		},
+		{
+			"select username, count(*), max(id) from users group by username order by count(*) desc, username limit ?",
+			&SelectStatement{
+				Columns: []Expression{
+					ColumnRef{Column: "username"},
+					Aggregate{Func: "count", Star: true},
+					Aggregate{Func: "max", Column: ColumnRef{Column: "id"}},
+				},
+				From:    TableRef{Name: "users"},
+				GroupBy: []ColumnRef{{Column: "username"}},
+				OrderBy: []OrderBy{
+					{Expression: Aggregate{Func: "count", Star: true}, Desc: true},
+					{Expression: ColumnRef{Column: "username"}},
+				},
+				Limit: Placeholder{Ordinal: 1},
+			},
+			1,
+		},
+		{
+			"analyze users",
+			&AnalyzeStatement{},
+			0,
+		},
+		{
+			"vacuum",
+			&VacuumStatement{},
+			0,
+		},
+		{
+			"vacuum incremental",
+			&VacuumStatement{Incremental: true},
+			0,
+		},
+		{
+			"create unique index idx_email on users (email)",
+			&CreateIndexStatement{Name: "idx_email", Column: "email", Unique: true},
+			0,
+		},
+		{
+			"savepoint batch1",
+			&SavepointStatement{Name: "batch1"},
+			0,
+		},
+		{
+			"release savepoint batch1",
+			&ReleaseStatement{Name: "batch1"},
+			0,
+		},
+		{
+			"rollback to batch1",
+			&RollbackToStatement{Name: "batch1"},
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		stmt, numParams, err := Parse(test.sql)
+		if err != nil {
+			t.Fatalf("Unable to parse '%s': '%s'", test.sql, err)
+		}
+
+		if !reflect.DeepEqual(stmt, test.stmt) || numParams != test.numParams {
+			t.Fatalf("Unexpected parse of '%s': %#v with %d parameters", test.sql, stmt, numParams)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"select * from accounts",
+		"select name from users",
+		"select * from users where id = ? and email = $1",
+		"update users set id = 2",
+		"select * from users a join users b",
+		"select * from users a join accounts b on a.id = b.id",
+		"insert into users values (1, 'a')",
+		"delete from users where id",
+		"select * from users a b",
+		"select count(id, email) from users",
+		"select * from users limit -1",
+		"select * from users order id",
+		"select * from users where email = 'unterminated",
+	}
+
+	for _, sql := range tests {
+		if _, _, err := Parse(sql); err == nil {
+			t.Fatalf("Expected '%s' to fail to parse", sql)
+		}
+	}
+}
+
+func TestParseNamedParameters(t *testing.T) {
+	stmt, numParams, err := Parse("select * from users where email >= :from and email < @to and username = :from")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	where := stmt.(*SelectStatement).Where
+	if numParams != 2 || where[0].Value != (Placeholder{Ordinal: 1, Name: "from"}) ||
+		where[1].Value != (Placeholder{Ordinal: 2, Name: "to"}) || where[2].Value != where[0].Value {
+		t.Fatalf("Unexpected parameters: %d %#v", numParams, where)
+	}
+
+	if _, _, err := Parse("select * from users where id = :id and email = ?"); err == nil {
+		t.Fatalf("Expected mixing named and positional parameters to fail")
+	}
+}
@@ -0,0 +1,621 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+// row holds a row of every table in the from clause by position, a
+// table's row is nil until it is joined or when a left join found none.
+// values hold what an aggregate or a projection computed from the tables
+type row struct {
+	tables []*persist.Row
+	values []interface{}
+}
+
+// iterator produces the rows of an operator one at a time. Open prepares
+// it, Next returns false once there are no more rows and Close releases
+// what it holds. Close may be called before all rows are read, and an
+// iterator can be opened again after it is closed to start over
+type iterator interface {
+	Open() error
+	Next() (row, bool, error)
+	Close() error
+}
+
+// batchIterator produces the rows of an operator a vector at a time
+type batchIterator interface {
+	Open() error
+	NextBatch() (*vector, bool, error)
+	Close() error
+}
+
+// operator is a node of the plan tree a statement is executed by. It
+// runs its iterator, which pulls the rows of the operator's children
+// through their operators. Operators running in batches have a batch
+// iterator instead
+type operator struct {
+	name     string
+	children []*operator
+	iter     iterator
+	batches  batchIterator
+	x        *execution
+	open     bool
+
+	// rows counts the rows produced, self the time spent in this operator
+	// alone which is only measured by analyze. detail is filled in while
+	// running and shown by analyze
+	rows   int64
+	self   time.Duration
+	detail string
+}
+
+// execution tracks which operator is running so the time between
+// two switches is charged to the operator that was running
+type execution struct {
+	analyze bool
+	current *operator
+	last    time.Time
+}
+
+func (x *execution) switchTo(op *operator) *operator {
+	prev := x.current
+
+	if x.analyze {
+		now := time.Now()
+		if prev != nil {
+			prev.self += now.Sub(x.last)
+		}
+
+		x.last = now
+	}
+
+	x.current = op
+	return prev
+}
+
+// attach runs the operators from op down as part of the execution
+func (op *operator) attach(x *execution) {
+	op.x = x
+	for _, c := range op.children {
+		c.attach(x)
+	}
+}
+
+func (op *operator) Open() error {
+	caller := op.x.switchTo(op)
+	defer op.x.switchTo(caller)
+
+	op.open = true
+	if op.batches != nil {
+		return op.batches.Open()
+	}
+
+	return op.iter.Open()
+}
+
+func (op *operator) Next() (row, bool, error) {
+	caller := op.x.switchTo(op)
+	defer op.x.switchTo(caller)
+
+	r, ok, err := op.iter.Next()
+	if ok {
+		op.rows++
+	}
+
+	return r, ok, err
+}
+
+func (op *operator) NextBatch() (*vector, bool, error) {
+	caller := op.x.switchTo(op)
+	defer op.x.switchTo(caller)
+
+	v, ok, err := op.batches.NextBatch()
+	if ok {
+		op.rows += int64(len(v.sel))
+	}
+
+	return v, ok, err
+}
+
+// Close closes the iterator if it is open, so an operator
+// can always be closed after an error
+func (op *operator) Close() error {
+	if !op.open {
+		return nil
+	}
+
+	caller := op.x.switchTo(op)
+	defer op.x.switchTo(caller)
+
+	op.open = false
+	if op.batches != nil {
+		return op.batches.Close()
+	}
+
+	return op.iter.Close()
+}
+
+// drain opens the operator, reads all of its rows and closes it again
+func (op *operator) drain(fn func(r row) error) error {
+	err := op.Open()
+
+	for err == nil {
+		var r row
+		var ok bool
+
+		r, ok, err = op.Next()
+		if err != nil || !ok {
+			break
+		}
+
+		err = fn(r)
+	}
+
+	if closeErr := op.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// elapsed is the time spent in the operator and the operators below it
+func (op *operator) elapsed() time.Duration {
+	d := op.self
+	for _, c := range op.children {
+		d += c.elapsed()
+	}
+
+	return d
+}
+
+// explain appends a line per operator from op down, children are indented
+// below their parent. With analyze the rows produced and the time spent
+// are added to each line
+func (op *operator) explain(lines []string, depth int, analyze bool) []string {
+	line := strings.Repeat("  ", depth) + op.name
+
+	if analyze {
+		line += fmt.Sprintf(" (rows=%d time=%s", op.rows, op.elapsed())
+		if op.detail != "" {
+			line += " " + op.detail
+		}
+
+		line += ")"
+	}
+
+	lines = append(lines, line)
+	for _, c := range op.children {
+		lines = c.explain(lines, depth+1, analyze)
+	}
+
+	return lines
+}
+
+// plannedStatement is the operator tree of a statement and its result.
+// The values of the rows of a select are the result's rows, for other
+// statements each row is a row the statement changed
+type plannedStatement struct {
+	root        *operator
+	result      *Result
+	returnsRows bool
+}
+
+func (p *plannedStatement) run(analyze bool) error {
+	p.root.attach(&execution{analyze: analyze})
+
+	return p.root.drain(func(r row) error {
+		if p.returnsRows {
+			p.result.Rows = append(p.result.Rows, r.values)
+		} else {
+			p.result.RowsAffected++
+		}
+
+		return nil
+	})
+}
+
+// template is a statement planned as far as it can be without the table
+// and the values of its parameters. Calling it binds them and chooses how
+// to read the table. A template is never changed so it can be shared
+type template func(t *persist.Table, args []interface{}, options Options) (*plannedStatement, error)
+
+// compile resolves the tables, columns and expressions of the statement
+// into its template. The template of an explain is the one of the
+// statement it explains, statements which are not planned have none
+func compile(stmt Statement) (template, error) {
+	switch s := stmt.(type) {
+	case *SelectStatement:
+		return compileSelect(s)
+	case *ExplainStatement:
+		tmpl, err := compile(s.Statement)
+		if err == nil && tmpl == nil {
+			err = fmt.Errorf("unsupported statement %T", s.Statement)
+		}
+
+		return tmpl, err
+	case *InsertStatement:
+		return func(t *persist.Table, args []interface{}, options Options) (*plannedStatement, error) {
+			return planInsert(t, s, args)
+		}, nil
+	case *UpdateStatement:
+		return compileUpdate(s)
+	case *DeleteStatement:
+		return compileDelete(s)
+	case *CreateIndexStatement:
+		return func(t *persist.Table, args []interface{}, options Options) (*plannedStatement, error) {
+			return planCreateIndex(t, s), nil
+		}, nil
+	case *AnalyzeStatement:
+		return func(t *persist.Table, args []interface{}, options Options) (*plannedStatement, error) {
+			return planAnalyze(t), nil
+		}, nil
+	case *SavepointStatement, *ReleaseStatement, *RollbackToStatement, *VacuumStatement:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported statement %T", stmt)
+	}
+}
+
+// scope holds the tables of the from clause by position
+type scope struct {
+	tables []TableRef
+}
+
+func (s *scope) name(i int) string {
+	if s.tables[i].Alias != "" {
+		return s.tables[i].Alias
+	}
+
+	return s.tables[i].Name
+}
+
+// resolve finds the position of the table the column belongs to, an
+// unqualified column is only allowed when there is a single table
+func (s *scope) resolve(table, column string) (int, error) {
+	if table == "" {
+		if len(s.tables) > 1 {
+			return 0, fmt.Errorf("column '%s' is ambiguous", column)
+		}
+
+		return 0, nil
+	}
+
+	for i := range s.tables {
+		if s.name(i) == table {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown table '%s'", table)
+}
+
+// qualify names the column as it is shown in results and plans
+func (s *scope) qualify(i int, column string) string {
+	if len(s.tables) == 1 {
+		return column
+	}
+
+	return s.name(i) + "." + column
+}
+
+// condition is a Condition resolved to the tables of a scope. It compares
+// a column either with a constant or with the column of another table.
+// A constant is the literal or parameter arg until it is bound to value
+type condition struct {
+	table  int
+	column string
+	op     persist.Operator
+
+	// isColumn is set when the column is compared with another column
+	arg         Value
+	value       string
+	isColumn    bool
+	otherTable  int
+	otherColumn string
+
+	// name is the column as it is shown, text the whole condition
+	// which shows a parameter by its position until it is bound
+	name string
+	text string
+}
+
+// resolveConditions resolves the columns of the conditions, the
+// constants they compare with are left to bindConditions
+func (s *scope) resolveConditions(conditions []Condition) ([]condition, error) {
+	resolved := make([]condition, 0, len(conditions))
+
+	for _, c := range conditions {
+		table, err := s.resolve(c.Table, c.Column)
+		if err != nil {
+			return nil, err
+		}
+
+		r := condition{table: table, column: c.Column, op: c.Op, name: s.qualify(table, c.Column)}
+
+		if ref, ok := c.Value.(ColumnRef); ok {
+			other, err := s.resolve(ref.Table, ref.Column)
+			if err != nil {
+				return nil, err
+			}
+
+			r.isColumn, r.otherTable, r.otherColumn = true, other, ref.Column
+			r.text = fmt.Sprintf("%s %s %s", r.name, c.Op, s.qualify(other, ref.Column))
+		} else {
+			r.arg = c.Value
+			r.text = fmt.Sprintf("%s %s %s", r.name, c.Op, describeValue(c.Value))
+		}
+
+		resolved = append(resolved, r)
+	}
+
+	return resolved, nil
+}
+
+func describeValue(v Value) string {
+	if p, ok := v.(Placeholder); ok {
+		return fmt.Sprintf("$%d", p.Ordinal)
+	}
+
+	return fmt.Sprint(v.(Literal).Value)
+}
+
+// bindConditions returns copies of the conditions with the constants
+// they compare with bound to the args
+func bindConditions(conditions []condition, args []interface{}) ([]condition, error) {
+	bound := make([]condition, len(conditions))
+
+	for i, c := range conditions {
+		if c.isColumn {
+			bound[i] = c
+			continue
+		}
+
+		if c.column == "id" {
+			op, id, err := bindIdCondition(c.op, c.arg, args)
+			if err != nil {
+				return nil, err
+			}
+
+			c.op, c.value = op, fmt.Sprint(id)
+		} else {
+			v, err := bindColumn(c.column, c.arg, args)
+			if err != nil {
+				return nil, err
+			}
+
+			c.value = fmt.Sprint(v)
+		}
+
+		c.text = fmt.Sprintf("%s %s %s", c.name, c.op, c.value)
+		bound[i] = c
+	}
+
+	return bound, nil
+}
+
+func (c condition) predicate() persist.Predicate {
+	return persist.Predicate{Column: c.column, Op: c.op, Value: c.value}
+}
+
+// tables reports the highest position of the tables the condition uses
+func (c condition) lastTable() int {
+	if c.isColumn && c.otherTable > c.table {
+		return c.otherTable
+	}
+
+	return c.table
+}
+
+// matches evaluates the condition, it is false when one of
+// the rows it uses is missing after a left join
+func (c condition) matches(r row) bool {
+	if r.tables[c.table] == nil {
+		return false
+	}
+
+	if !c.isColumn {
+		return c.predicate().Matches(r.tables[c.table])
+	}
+
+	if r.tables[c.otherTable] == nil {
+		return false
+	}
+
+	cmp := compareColumns(r.tables[c.table], c.column, r.tables[c.otherTable], c.otherColumn)
+
+	switch c.op {
+	case persist.Equal:
+		return cmp == 0
+	case persist.Less:
+		return cmp < 0
+	case persist.LessOrEqual:
+		return cmp <= 0
+	case persist.Greater:
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func matchesAll(r row, conditions []condition) bool {
+	for _, c := range conditions {
+		if !c.matches(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func describeConditions(conditions []condition) string {
+	strs := make([]string, len(conditions))
+	for i, c := range conditions {
+		strs[i] = c.text
+	}
+
+	return strings.Join(strs, " and ")
+}
+
+// compareColumns compares ids as numbers and everything else as text
+func compareColumns(a *persist.Row, aColumn string, b *persist.Row, bColumn string) int {
+	if aColumn == "id" && bColumn == "id" {
+		switch {
+		case a.Id() < b.Id():
+			return -1
+		case a.Id() > b.Id():
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(textValue(a, aColumn), textValue(b, bColumn))
+}
+
+// textValue returns the value of the column as text, ids in decimal
+func textValue(r *persist.Row, column string) string {
+	return fmt.Sprint(columnValue(r, column))
+}
+
+// planScan plans reading the table at position i of the scope. It is
+// read by the access method chosen for the conditions on constants,
+// a filter on the conditions the access method cannot apply is added.
+// When batched is set access methods reading a range of ids read the
+// table in batches
+func planScan(t *persist.Table, s *scope, i int, conditions []condition, batched bool) (*operator, error) {
+	var predicates []persist.Predicate
+	for _, c := range conditions {
+		predicates = append(predicates, c.predicate())
+	}
+
+	access, err := t.Plan(predicates)
+	if err != nil {
+		return nil, err
+	}
+
+	if batched && access.Sequential() {
+		return planBatchScan(t, s, i, access), nil
+	}
+
+	scan := &operator{
+		name: access.Describe(s.name(i)),
+		iter: &scanIterator{table: t, access: access, width: len(s.tables), position: i},
+	}
+
+	if len(access.Filter) == 0 {
+		return scan, nil
+	}
+
+	var filter []string
+	for _, p := range access.Filter {
+		filter = append(filter, s.qualify(i, p.String()))
+	}
+
+	return &operator{
+		name:     fmt.Sprintf("Filter (%s)", strings.Join(filter, " and ")),
+		children: []*operator{scan},
+		iter: &filterIterator{child: scan, matches: func(r row) bool {
+			return access.Matches(r.tables[i])
+		}},
+	}, nil
+}
+
+// scanIterator reads the rows of a table with a cursor over
+// the plan's access method
+type scanIterator struct {
+	table    *persist.Table
+	access   *persist.Plan
+	width    int
+	position int
+	cursor   *persist.RowCursor
+}
+
+func (it *scanIterator) Open() error {
+	c, err := it.table.OpenPlan(it.access)
+	if err != nil {
+		return err
+	}
+
+	it.cursor = c
+	return nil
+}
+
+func (it *scanIterator) Next() (row, bool, error) {
+	r, err := it.cursor.Next()
+	if err != nil || r == nil {
+		return row{}, false, err
+	}
+
+	tables := make([]*persist.Row, it.width)
+	tables[it.position] = r
+
+	return row{tables: tables}, true, nil
+}
+
+func (it *scanIterator) Close() error {
+	if it.cursor != nil {
+		it.cursor.Close()
+	}
+
+	it.cursor = nil
+	return nil
+}
+
+// filter passes on the rows of child matching all of the conditions
+func filter(child *operator, conditions []condition) *operator {
+	if len(conditions) == 0 {
+		return child
+	}
+
+	return &operator{
+		name:     fmt.Sprintf("Filter (%s)", describeConditions(conditions)),
+		children: []*operator{child},
+		iter: &filterIterator{child: child, matches: func(r row) bool {
+			return matchesAll(r, conditions)
+		}},
+	}
+}
+
+type filterIterator struct {
+	child   *operator
+	matches func(r row) bool
+}
+
+func (it *filterIterator) Open() error {
+	return it.child.Open()
+}
+
+func (it *filterIterator) Next() (row, bool, error) {
+	for {
+		r, ok, err := it.child.Next()
+		if err != nil || !ok {
+			return row{}, false, err
+		}
+
+		if it.matches(r) {
+			return r, true, nil
+		}
+	}
+}
+
+func (it *filterIterator) Close() error {
+	return it.child.Close()
+}
+
+// splitConditions separates the conditions comparing a column of the
+// table at position i with a constant from the rest
+func splitConditions(conditions []condition, i int) (constant, rest []condition) {
+	for _, c := range conditions {
+		if !c.isColumn && c.table == i {
+			constant = append(constant, c)
+		} else {
+			rest = append(rest, c)
+		}
+	}
+
+	return constant, rest
+}
@@ -0,0 +1,117 @@
+package query
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+func TestExplain(t *testing.T) {
+	tbl := openTestTable(t)
+
+	for _, sql := range []string{
+		"insert into users values (1, 'a', 'a@example.com')",
+		"insert into users values (2, 'b', 'b@example.com')",
+		"insert into users values (3, 'c', 'c@example.com')",
+		"create index idx_username on users (username)",
+	} {
+		if _, err := execute(tbl, sql); err != nil {
+			t.Fatalf("Unable to execute '%s': '%s'", sql, err)
+		}
+	}
+
+	result, err := execute(tbl, "explain select id from users where username >= 'b' and email = 'c@example.com'")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := "Project (id)\n" +
+		"  Filter (email = c@example.com)\n" +
+		"    Index Scan on users using idx_username (username >= b)"
+	if explained := planText(result); explained != expected {
+		t.Fatalf("Unexpected plan:\n%s", explained)
+	}
+
+	result, err = execute(tbl, "explain analyze delete from users where id > 1 and username >= 'c'")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	lines := strings.Split(planText(result), "\n")
+	if len(lines) != 3 ||
+		!strings.HasPrefix(lines[0], "Delete from users (rows=1 ") ||
+		!strings.HasPrefix(lines[1], "  Filter (username >= c) (rows=1 ") ||
+		!strings.HasPrefix(lines[2], "    Range Scan on users (id > 1) (rows=2 ") {
+		t.Fatalf("Unexpected analyzed plan:\n%s", planText(result))
+	}
+
+	result, err = execute(tbl, "select id from users")
+	if err != nil || len(result.Rows) != 2 {
+		t.Fatalf("Expected explain analyze to delete a row: %v %v", result, err)
+	}
+}
+
+func TestIdsOutOfRange(t *testing.T) {
+	tbl := openTestTable(t)
+	insertJoinUsers(t, tbl, 10)
+
+	tests := []struct {
+		sql  string
+		rows int
+	}{
+		{"select id from users where id = -1", 0},
+		{"select id from users where id = 4294967296", 0},
+		{"select id from users where id < -1", 0},
+		{"select id from users where id >= -1", 10},
+		{"select id from users where id > 4294967296", 0},
+		{"select id from users where id <= 4294967296", 10},
+		{"select id from users where id < 0", 0},
+	}
+
+	for _, test := range tests {
+		result, err := execute(tbl, test.sql)
+		if err != nil {
+			t.Fatalf("Unable to execute '%s': '%s'", test.sql, err)
+		}
+
+		if len(result.Rows) != test.rows {
+			t.Fatalf("Expected '%s' to return %d rows, got %d", test.sql, test.rows, len(result.Rows))
+		}
+	}
+
+	p, err := Prepare("delete from users where id = ?")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if result, err := p.Execute(tbl, int64(-5)); err != nil || result.RowsAffected != 0 {
+		t.Fatalf("Expected a parameter out of range to delete nothing: %v %v", result, err)
+	}
+
+	if _, err := execute(tbl, "insert into users values (-1, 'a', 'a@example.com')"); err == nil {
+		t.Fatalf("Expected an id out of range to be rejected on insert")
+	}
+}
+
+func execute(tbl *persist.Table, sql string) (*Result, error) {
+	return executeWithOptions(tbl, Options{}, sql)
+}
+
+func executeWithOptions(tbl *persist.Table, options Options, sql string) (*Result, error) {
+	p, err := Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.ExecuteWithOptions(tbl, options)
+}
+
+func planText(r *Result) string {
+	lines := make([]string, len(r.Rows))
+	for i, row := range r.Rows {
+		lines[i] = row[0].(string)
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,147 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+// Prepared is a statement that is parsed and planned once and can be
+// executed many times with different parameters. Only how the tables
+// are read is chosen again, with the values bound. It is never modified
+// after it is prepared so it can be shared
+type Prepared struct {
+	sql      string
+	stmt     Statement
+	template template
+
+	// params holds the name of each parameter, empty when unnamed
+	params []string
+}
+
+// NamedArg binds a value to the parameter with the given name,
+// the name is written without its leading ':' or '@'
+type NamedArg struct {
+	Name  string
+	Value interface{}
+}
+
+func Named(name string, value interface{}) NamedArg {
+	return NamedArg{Name: name, Value: value}
+}
+
+func Prepare(sql string) (*Prepared, error) {
+	stmt, params, err := parse(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := compile(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Prepared{sql: sql, stmt: stmt, template: tmpl, params: params}, nil
+}
+
+func (p *Prepared) SQL() string {
+	return p.sql
+}
+
+func (p *Prepared) Statement() Statement {
+	return p.stmt
+}
+
+func (p *Prepared) NumParams() int {
+	return len(p.params)
+}
+
+// Execute binds the args and runs the statement with the default
+// options. Plain values are bound by position and NamedArgs by name,
+// every parameter must be bound
+func (p *Prepared) Execute(t *persist.Table, args ...interface{}) (*Result, error) {
+	return p.ExecuteWithOptions(t, Options{}, args...)
+}
+
+// ExecuteWithOptions binds the args and runs the statement with the options
+func (p *Prepared) ExecuteWithOptions(t *persist.Table, options Options, args ...interface{}) (*Result, error) {
+	values, err := p.bind(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return executeCompiled(t, p.stmt, p.template, values, options)
+}
+
+func (p *Prepared) bind(args []interface{}) ([]interface{}, error) {
+	values := make([]interface{}, len(p.params))
+	bound := make([]bool, len(p.params))
+
+	position := 0
+	for _, a := range args {
+		ordinal := 0
+
+		if named, ok := a.(NamedArg); ok {
+			ordinal = p.ordinal(named.Name)
+			if ordinal == 0 {
+				return nil, fmt.Errorf("unknown parameter '%s'", named.Name)
+			}
+
+			a = named.Value
+		} else {
+			position++
+			ordinal = position
+		}
+
+		if ordinal > len(p.params) {
+			return nil, fmt.Errorf("statement expects %d parameters but got more", len(p.params))
+		}
+
+		if bound[ordinal-1] {
+			return nil, fmt.Errorf("parameter %d is bound more than once", ordinal)
+		}
+
+		v, err := normalizeArg(a)
+		if err != nil {
+			return nil, err
+		}
+
+		values[ordinal-1] = v
+		bound[ordinal-1] = true
+	}
+
+	for i, ok := range bound {
+		if !ok {
+			return nil, fmt.Errorf("missing value for parameter %d", i+1)
+		}
+	}
+
+	return values, nil
+}
+
+func (p *Prepared) ordinal(name string) int {
+	for i, param := range p.params {
+		if param != "" && param == name {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// normalizeArg converts the Go integer types to int64,
+// the only integer type statements are executed with
+func normalizeArg(a interface{}) (interface{}, error) {
+	switch v := a.(type) {
+	case int64, string, []byte:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	default:
+		return nil, fmt.Errorf("unsupported parameter type %T", a)
+	}
+}
@@ -0,0 +1,120 @@
+package query
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+func openTestTable(t testing.TB) *persist.Table {
+	tbl, err := persist.OpenDatabase(path.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	t.Cleanup(func() { tbl.Close() })
+	return tbl
+}
+
+func TestPreparedExecute(t *testing.T) {
+	tbl := openTestTable(t)
+
+	insert, err := Prepare("insert into users values (:id, :name, :email)")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := insert.Execute(tbl, i, Named("email", fmt.Sprintf("person#%d@example.com", i)), Named("name", "x' or '1'='1"))
+		if err != nil {
+			t.Fatalf("Unable to insert row: '%s'", err)
+		}
+	}
+
+	sel, err := Prepare("select id, username from users where id >= ? and id < ?")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	result, err := sel.Execute(tbl, 3, int64(5))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if fmt.Sprint(result.Rows) != "[[3 x' or '1'='1] [4 x' or '1'='1]]" {
+		t.Fatalf("Unexpected rows: %v", result.Rows)
+	}
+
+	if _, err := sel.Execute(tbl, 3); err == nil {
+		t.Fatalf("Expected a missing parameter to fail")
+	}
+
+	if _, err := insert.Execute(tbl, 11, Named("nope", ""), Named("email", "")); err == nil {
+		t.Fatalf("Expected an unknown parameter name to fail")
+	}
+}
+
+func TestPreparedPlansOnce(t *testing.T) {
+	tbl := openTestTable(t)
+	insertJoinUsers(t, tbl, 100)
+
+	if _, err := Prepare("select nope from users"); err == nil {
+		t.Fatalf("Expected an unknown column to fail when preparing")
+	}
+
+	explain, err := Prepare("explain select id from users where username = ?")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	result, err := explain.Execute(tbl, "user#1")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if plan := planText(result); strings.Contains(plan, "idx_username") || !strings.Contains(plan, "username = user#1") {
+		t.Fatalf("Expected a scan binding the parameter:\n%s", plan)
+	}
+
+	// How the table is read is chosen again on every execution
+	if _, err := execute(tbl, "create index idx_username on users (username)"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	result, err = explain.Execute(tbl, "user#2")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if plan := planText(result); !strings.Contains(plan, "using idx_username (username = user#2)") {
+		t.Fatalf("Expected the new index to be used:\n%s", plan)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCache(2)
+
+	first, _ := c.Prepare("select * from users where id = 1")
+	c.Prepare("select * from users where id = 2")
+
+	if again, _ := c.Prepare("select * from users where id = 1"); again != first {
+		t.Fatalf("Expected the cached statement to be reused")
+	}
+
+	c.Prepare("select * from users where id = 3")
+
+	if c.Len() != 2 {
+		t.Fatalf("Expected 2 cached statements, got %d", c.Len())
+	}
+
+	if again, _ := c.Prepare("select * from users where id = 1"); again != first {
+		t.Fatalf("Recently used statement was evicted")
+	}
+
+	if _, err := c.Prepare("select * from"); err == nil {
+		t.Fatalf("Expected an invalid statement to fail")
+	}
+}
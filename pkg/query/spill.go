@@ -0,0 +1,180 @@
+package query
+
+import (
+	"encoding/binary"
+	"os"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+)
+
+// spillPageSize is the size of the temporary pages rows are spilled to,
+// a page starts with the number of records it holds
+const (
+	spillPageSize       = 4096
+	spillNumRecordsSize = 4
+)
+
+// spillFile is a temporary file of pages holding rows which do not fit
+// in memory. It is removed when closed
+type spillFile struct {
+	file *os.File
+	size int64
+}
+
+func newSpillFile() (*spillFile, error) {
+	file, err := os.CreateTemp("", "simpledb-spill-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &spillFile{file: file}, nil
+}
+
+func (f *spillFile) close() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+}
+
+// allocate reserves a page at the end of the file
+func (f *spillFile) allocate(pageSize int) int64 {
+	offset := f.size
+	f.size += int64(pageSize)
+
+	return offset
+}
+
+// partition creates a sequence of records in the file, each holding
+// a row of the given number of tables
+func (f *spillFile) partition(width int) *spillPartition {
+	recordSize := width * (1 + int(persist.RowSize))
+
+	pageSize := spillPageSize
+	if spillNumRecordsSize+recordSize > pageSize {
+		pageSize = spillNumRecordsSize + recordSize
+	}
+
+	return &spillPartition{
+		file:       f,
+		width:      width,
+		recordSize: recordSize,
+		pageSize:   pageSize,
+		page:       make([]byte, pageSize),
+	}
+}
+
+// partitions creates n partitions of rows of the given number of tables
+func (f *spillFile) partitions(n, width int) []*spillPartition {
+	partitions := make([]*spillPartition, n)
+	for p := range partitions {
+		partitions[p] = f.partition(width)
+	}
+
+	return partitions
+}
+
+// spillPartition fills one page at a time, the page is written
+// to the file when full and the partition remembers its offset
+type spillPartition struct {
+	file       *spillFile
+	width      int
+	recordSize int
+	pageSize   int
+	pages      []int64
+	page       []byte
+	numRecords int
+}
+
+func (p *spillPartition) write(r row) error {
+	if spillNumRecordsSize+(p.numRecords+1)*p.recordSize > p.pageSize {
+		if err := p.flush(); err != nil {
+			return err
+		}
+	}
+
+	record := p.page[spillNumRecordsSize+p.numRecords*p.recordSize:]
+	for i, tableRow := range r.tables {
+		slot := record[i*(1+int(persist.RowSize)) : (i+1)*(1+int(persist.RowSize))]
+		if tableRow == nil {
+			slot[0] = 0
+			continue
+		}
+
+		serialized, err := tableRow.Serialize()
+		if err != nil {
+			return err
+		}
+
+		slot[0] = 1
+		copy(slot[1:], serialized)
+	}
+
+	p.numRecords++
+	return nil
+}
+
+func (p *spillPartition) flush() error {
+	if p.numRecords == 0 {
+		return nil
+	}
+
+	binary.LittleEndian.PutUint32(p.page[:spillNumRecordsSize], uint32(p.numRecords))
+
+	offset := p.file.allocate(p.pageSize)
+	if _, err := p.file.file.WriteAt(p.page, offset); err != nil {
+		return err
+	}
+
+	p.pages = append(p.pages, offset)
+	p.numRecords = 0
+
+	return nil
+}
+
+// reader reads the records back in the order they were written
+func (p *spillPartition) reader() (*spillReader, error) {
+	if err := p.flush(); err != nil {
+		return nil, err
+	}
+
+	return &spillReader{partition: p, page: make([]byte, p.pageSize)}, nil
+}
+
+// spillReader holds one page of a partition in memory at a time
+type spillReader struct {
+	partition  *spillPartition
+	page       []byte
+	pageIndex  int
+	record     int
+	numRecords int
+}
+
+func (r *spillReader) next() (row, bool, error) {
+	p := r.partition
+
+	for r.record == r.numRecords {
+		if r.pageIndex == len(p.pages) {
+			return row{}, false, nil
+		}
+
+		if _, err := p.file.file.ReadAt(r.page, p.pages[r.pageIndex]); err != nil {
+			return row{}, false, err
+		}
+
+		r.pageIndex++
+		r.record = 0
+		r.numRecords = int(binary.LittleEndian.Uint32(r.page[:spillNumRecordsSize]))
+	}
+
+	record := r.page[spillNumRecordsSize+r.record*p.recordSize:]
+	r.record++
+
+	tables := make([]*persist.Row, p.width)
+	for i := range tables {
+		slot := record[i*(1+int(persist.RowSize)) : (i+1)*(1+int(persist.RowSize))]
+		if slot[0] == 1 {
+			tables[i] = persist.DeserializeRow(slot[1:])
+		}
+	}
+
+	return row{tables: tables}, true, nil
+}
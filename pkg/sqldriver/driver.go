@@ -0,0 +1,282 @@
+// Package sqldriver registers SimpleDB with database/sql under the
+// name "simpledb", the data source name is the path of the database file
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/rob2244/SimpleDB/pkg/persist"
+	"github.com/rob2244/SimpleDB/pkg/query"
+)
+
+func init() {
+	sql.Register("simpledb", &Driver{})
+}
+
+// Driver opens connections to database files. Connections to the same
+// file share one open table, it is closed when the last one is closed
+type Driver struct{}
+
+// database is an open table shared by the connections to its file.
+// Transactions on different connections run concurrently, they only wait
+// for the rows locked by each other. Queries outside a transaction read a
+// snapshot of the table and never wait
+type database struct {
+	path  string
+	table *persist.Table
+	cache *query.Cache
+	refs  int
+}
+
+// statementCacheSize is the number of prepared statements
+// kept for each database file
+const statementCacheSize = 128
+
+var (
+	registryLock sync.Mutex
+	registry     = map[string]*database{}
+)
+
+// Open returns a connection to the file named. The name is made absolute
+// and cleaned first so a relative and an absolute path of a file share
+// its table, the file is locked while it is open
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	db, ok := registry[path]
+	if !ok {
+		table, err := persist.OpenDatabase(path)
+		if err != nil {
+			return nil, err
+		}
+
+		db = &database{path: path, table: table, cache: query.NewCache(statementCacheSize)}
+		registry[path] = db
+	}
+
+	db.refs++
+	return &conn{db: db}, nil
+}
+
+func (db *database) release() error {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	db.refs--
+	if db.refs > 0 {
+		return nil
+	}
+
+	delete(registry, db.path)
+	return db.table.Close()
+}
+
+type conn struct {
+	db     *database
+	tx     *tx
+	closed bool
+}
+
+func (c *conn) Prepare(sql string) (driver.Stmt, error) {
+	p, err := c.db.cache.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stmt{conn: c, prepared: p}, nil
+}
+
+func (c *conn) Close() error {
+	if c.closed {
+		return nil
+	}
+
+	if c.tx != nil {
+		c.tx.Rollback()
+	}
+
+	c.closed = true
+	return c.db.release()
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, persist.ErrTxActive
+	}
+
+	if opts.ReadOnly {
+		return nil, errors.New("read only transactions are not supported")
+	}
+
+	ptx, err := c.db.table.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	c.tx = &tx{conn: c, tx: ptx}
+	return c.tx, nil
+}
+
+// CheckNamedValue accepts the types the query package can bind,
+// everything else is converted by database/sql first
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	switch nv.Value.(type) {
+	case int64, string, []byte:
+		return nil
+	default:
+		return driver.ErrSkip
+	}
+}
+
+// exec runs the statement, outside of a transaction the changes of
+// the statement are committed together or undone entirely if it fails
+func (c *conn) exec(p *query.Prepared, args []driver.NamedValue) (*query.Result, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+		if a.Name != "" {
+			values[i] = query.Named(a.Name, a.Value)
+		}
+	}
+
+	if c.tx != nil {
+		return p.Execute(c.tx.tx.Table(), values...)
+	}
+
+	return p.Execute(c.db.table, values...)
+}
+
+type stmt struct {
+	conn     *conn
+	prepared *query.Prepared
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return s.prepared.NumParams()
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	r, err := s.conn.exec(s.prepared, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return result{rowsAffected: r.RowsAffected}, nil
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	r, err := s.conn.exec(s.prepared, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rows{columns: r.Columns, values: r.Rows}, nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+
+	return named
+}
+
+type result struct {
+	rowsAffected int64
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId is not supported, ids are chosen by the caller")
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+// rows holds the whole result of a query, it is read before
+// the statement returns so no snapshot is held while the
+// caller iterates
+type rows struct {
+	columns []string
+	values  [][]interface{}
+	pos     int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	r.pos = len(r.values)
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.values) {
+		return io.EOF
+	}
+
+	for i, v := range r.values[r.pos] {
+		dest[i] = v
+	}
+
+	r.pos++
+	return nil
+}
+
+// tx is a transaction of the connection. Its changes are logged when
+// it commits and survive a crash as a commit of the table does, see
+// persist.Tx, they are not kept until the database is closed
+type tx struct {
+	conn *conn
+	tx   *persist.Tx
+}
+
+func (t *tx) Commit() error {
+	defer t.end()
+	return t.tx.Commit()
+}
+
+func (t *tx) Rollback() error {
+	defer t.end()
+	return t.tx.Rollback()
+}
+
+func (t *tx) end() {
+	if t.conn.tx == t {
+		t.conn.tx = nil
+	}
+}
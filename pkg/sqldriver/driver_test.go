@@ -0,0 +1,234 @@
+package sqldriver
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T) (*sql.DB, string) {
+	dbPath := path.Join(t.TempDir(), "test.db")
+
+	db, err := sql.Open("simpledb", dbPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return db, dbPath
+}
+
+func TestDriverRoundTrip(t *testing.T) {
+	db, dbPath := openTestDB(t)
+
+	for i := 0; i < 20; i++ {
+		_, err := db.Exec("insert into users values (?, ?, ?)", i, "user", "person@example.com")
+		if err != nil {
+			t.Fatalf("Unable to insert row: '%s'", err)
+		}
+	}
+
+	res, err := db.Exec("update users set username = $1 where id >= $2", "renamed", 15)
+	if err != nil {
+		t.Fatalf("Unable to update rows: '%s'", err)
+	}
+
+	if n, _ := res.RowsAffected(); n != 5 {
+		t.Fatalf("Expected 5 rows updated, got %d", n)
+	}
+
+	if _, err := db.Exec("delete from users where id < 10"); err != nil {
+		t.Fatalf("Unable to delete rows: '%s'", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	db, err = sql.Open("simpledb", dbPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("select id from users where username = 'renamed'").Scan(new(int)); err != nil {
+		t.Fatalf("Unable to query row: '%s'", err)
+	}
+
+	rows, err := db.Query("select id, username from users")
+	if err != nil {
+		t.Fatalf("Unable to query rows: '%s'", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		count++
+	}
+
+	if count != 10 {
+		t.Fatalf("Expected 10 rows, got %d", count)
+	}
+}
+
+func TestDriverPathsOfSameFile(t *testing.T) {
+	db, dbPath := openTestDB(t)
+	defer db.Close()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	relative, err := filepath.Rel(wd, dbPath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	other, err := sql.Open("simpledb", "./"+relative)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer other.Close()
+
+	if _, err := db.Exec("insert into users values (1, 'user', 'person@example.com')"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var count int
+	if err := other.QueryRow("select count(*) from users").Scan(&count); err != nil {
+		t.Fatalf("Expected a relative path to share the open database: '%s'", err)
+	}
+
+	if count != 1 {
+		t.Fatalf("Expected 1 row, got %d", count)
+	}
+}
+
+func TestDriverTxRollback(t *testing.T) {
+	db, _ := openTestDB(t)
+	defer db.Close()
+
+	if _, err := db.Exec("insert into users values (1, 'a', 'a@example.com')"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := tx.Exec("insert into users values (2, 'b', 'b@example.com')"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := tx.Exec("delete from users where id = 1"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var ids []int64
+	rows, err := db.Query("select id from users")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("Expected only row 1 after rollback, got %v", ids)
+	}
+}
+
+func TestDriverSavepoints(t *testing.T) {
+	db, _ := openTestDB(t)
+	defer db.Close()
+
+	if _, err := db.Exec("savepoint outside"); err == nil {
+		t.Fatalf("Expected a savepoint outside a transaction to be rejected")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, sql := range []string{
+		"insert into users values (1, 'a', 'a@example.com')",
+		"savepoint batch",
+		"insert into users values (2, 'b', 'b@example.com')",
+		"rollback to savepoint batch",
+		"insert into users values (3, 'c', 'c@example.com')",
+		"release batch",
+	} {
+		if _, err := tx.Exec(sql); err != nil {
+			t.Fatalf("Unable to execute '%s': %s", sql, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var count int64
+	if err := db.QueryRow("select count(*) from users where id = 2").Scan(&count); err != nil || count != 0 {
+		t.Fatalf("Expected the row inserted after the savepoint to be rolled back: %d %v", count, err)
+	}
+
+	if err := db.QueryRow("select count(*) from users").Scan(&count); err != nil || count != 2 {
+		t.Fatalf("Expected 2 rows, got %d %v", count, err)
+	}
+}
+
+func TestDriverFailedStatementIsUndone(t *testing.T) {
+	db, _ := openTestDB(t)
+	defer db.Close()
+
+	if _, err := db.Exec("create unique index idx_email on users (email)"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := db.Exec("insert into users values (1, 'a', 'same@example.com')"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := db.Exec("insert into users values (1, 'b', 'other@example.com')"); err == nil {
+		t.Fatalf("Expected duplicate id to be rejected")
+	}
+
+	var username string
+	if err := db.QueryRow("select username from users where id = 1").Scan(&username); err != nil || username != "a" {
+		t.Fatalf("Unexpected row after failed insert: '%s' %v", username, err)
+	}
+}
+
+func TestDriverNamedArgs(t *testing.T) {
+	db, _ := openTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("insert into users values (:id, :name, :email)",
+		sql.Named("email", "a@example.com"), sql.Named("id", 1), sql.Named("name", "a"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var email string
+	if err := db.QueryRow("select email from users where id = :id", sql.Named("id", 1)).Scan(&email); err != nil || email != "a@example.com" {
+		t.Fatalf("Unexpected email '%s' %v", email, err)
+	}
+}